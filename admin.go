@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// approvalTTL is how long first four-eyes approval waits for the second one
+const approvalTTL = 15 * time.Minute
+
+type role int
+
+// Roles are ordered, every role includes
+// permissions of previous ones
+const (
+	roleRead role = iota
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"read":     roleRead,
+	"operator": roleOperator,
+	"admin":    roleAdmin,
+}
+
+type principal struct {
+	name string
+	role role
+}
+
+// approval is first approval of four-eyes action, subject
+// fingerprints files it was given for
+type approval struct {
+	name    string
+	subject string
+	at      time.Time
+}
+
+// admin resolves API identities and keeps
+// pending four-eyes approvals
+type admin struct {
+	mu        sync.Mutex
+	keys      map[string]principal
+	jwtSecret []byte
+	fourEyes  bool
+	approvals map[string]approval
+	audit     *auditLog
+}
+
+// newAdmin parses identities given as "name:key[:role],..."
+// role defaults to admin
+func newAdmin(opts options) (*admin, error) {
+	a := &admin{
+		keys:      make(map[string]principal),
+		jwtSecret: []byte(opts.jwtSecret),
+		fourEyes:  opts.fourEyes,
+		approvals: make(map[string]approval),
+		audit:     newAuditLog(opts.auditLog),
+	}
+
+	for _, pair := range strings.Split(opts.adminKeys, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Wrong admin key format: %s", pair)
+		}
+
+		p := principal{
+			name: parts[0],
+			role: roleAdmin,
+		}
+
+		if len(parts) == 3 {
+			r, ok := roleNames[parts[2]]
+			if !ok {
+				return nil, fmt.Errorf("Unknown role %s for %s", parts[2], parts[0])
+			}
+			p.role = r
+		}
+
+		a.keys[parts[1]] = p
+	}
+
+	// Approvals are told apart by identity name, so
+	// two keys of the same identity count as one
+	names := map[string]bool{}
+	for _, p := range a.keys {
+		names[p.name] = true
+	}
+	if a.fourEyes && len(names) < 2 && len(a.jwtSecret) == 0 {
+		return nil, fmt.Errorf("Four-eyes approval requires at least two admin identities")
+	}
+
+	return a, nil
+}
+
+func (a *admin) enabled() bool {
+	return len(a.keys) > 0 || len(a.jwtSecret) > 0
+}
+
+// principal resolves caller by X-Api-Key header or by
+// JWT passed in Authorization: Bearer header
+func (a *admin) principal(r *http.Request) (principal, bool) {
+	// Without credentials anyone reaching listen address may
+	// only read, actions changing files or configuration are refused
+	if !a.enabled() {
+		return principal{name: "anonymous", role: roleRead}, true
+	}
+
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		p, ok := a.keys[key]
+		return p, ok
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(a.jwtSecret) > 0 && strings.HasPrefix(auth, "Bearer ") {
+		claims, err := parseJWT(strings.TrimPrefix(auth, "Bearer "), a.jwtSecret)
+		if err != nil {
+			return principal{}, false
+		}
+
+		r, ok := roleNames[claims.Role]
+		if !ok {
+			return principal{}, false
+		}
+
+		return principal{name: claims.Subject, role: r}, true
+	}
+
+	return principal{}, false
+}
+
+// require checks that caller has at least given role
+func (a *admin) require(w http.ResponseWriter, r *http.Request, min role) (principal, bool) {
+	p, ok := a.principal(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return p, false
+	}
+
+	if p.role < min {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return p, false
+	}
+
+	return p, true
+}
+
+// fingerprint describes state of files action is approved for,
+// so approval doesn't apply to files changed or arrived since
+func fingerprint(items []string) string {
+	sort.Strings(items)
+
+	h := sha256.New()
+	for _, item := range items {
+		h.Write([]byte(item + "\x00"))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// authorize checks caller permissions and, in four-eyes mode, collects
+// approvals. It returns identities which approved the action once it
+// may be executed, otherwise it writes response itself. Second approval
+// is rejected when subject changed since the first one, pending
+// approvals expire after approvalTTL.
+func (a *admin) authorize(w http.ResponseWriter, r *http.Request, min role, action, file, subject string) ([]string, bool) {
+	p, ok := a.require(w, r, min)
+	if !ok {
+		return nil, false
+	}
+
+	if !a.fourEyes {
+		return []string{p.name}, true
+	}
+
+	key := action + ":" + file
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for k, pending := range a.approvals {
+		if now.Sub(pending.at) > approvalTTL {
+			delete(a.approvals, k)
+			action, file, _ := strings.Cut(k, ":")
+			a.audit.record(action, file, []string{pending.name}, "approval expired")
+		}
+	}
+
+	first, pending := a.approvals[key]
+	if pending && first.subject != subject {
+		delete(a.approvals, key)
+		a.audit.record(action, file, []string{first.name, p.name}, "files changed since first approval")
+
+		http.Error(w, "Files changed since first approval, action must be approved again", http.StatusConflict)
+		return nil, false
+	}
+
+	if !pending {
+		a.approvals[key] = approval{name: p.name, subject: subject, at: now}
+		a.audit.record(action, file, []string{p.name}, "pending approval")
+
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, map[string]interface{}{
+			"status":      "pending",
+			"approved_by": []string{p.name},
+		})
+		return nil, false
+	}
+
+	if first.name == p.name {
+		http.Error(w, "Action already approved by this identity", http.StatusConflict)
+		return nil, false
+	}
+
+	delete(a.approvals, key)
+	return []string{first.name, p.name}, true
+}
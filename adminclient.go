@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// adminClient calls admin API of running hooker for commands
+type adminClient struct {
+	url    string
+	apiKey string
+	client http.Client
+}
+
+// newAdminClient falls back to HOOKER_API_KEY, so key
+// doesn't have to be passed on command line
+func newAdminClient(url, apiKey string) *adminClient {
+	if apiKey == "" {
+		apiKey = os.Getenv("HOOKER_API_KEY")
+	}
+
+	return &adminClient{
+		url:    strings.TrimRight(url, "/"),
+		apiKey: apiKey,
+		client: http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// get requests path, response of any status
+// but 200 is returned as *httpStatusError
+func (a *adminClient) get(path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, a.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if a.apiKey != "" {
+		req.Header.Set("X-Api-Key", a.apiKey)
+	}
+
+	response, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(response.Body, responseLimit))
+		return nil, &httpStatusError{Code: response.StatusCode, Body: strings.TrimSpace(truncate(body))}
+	}
+
+	return response, nil
+}
+
+// getJSON requests path and decodes its JSON response into v
+func (a *adminClient) getJSON(path string, v interface{}) error {
+	response, err := a.get(path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	return json.NewDecoder(response.Body).Decode(v)
+}
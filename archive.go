@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os/exec"
+	"path"
+	"time"
+)
+
+// Formats delivered files are archived in
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+	archiveZstd  = "zstd"
+	archiveMove  = "move"
+	archiveNone  = "none"
+)
+
+// archiveSuffixes are appended to name of archived file
+var archiveSuffixes = map[string]string{
+	archiveZip:   ".zip",
+	archiveTarGz: ".tar.gz",
+	archiveZstd:  ".zst",
+	archiveMove:  "",
+}
+
+// validateArchiveFormat checks -archive-format, zstd requires zstd to be installed
+func validateArchiveFormat(format string) error {
+	switch format {
+	case archiveZip, archiveTarGz, archiveMove, archiveNone:
+		return nil
+	case archiveZstd:
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return errors.New("zstd archive format requires zstd command")
+		}
+		return nil
+	}
+
+	return errors.New("Unknown archive format, expected zip, tar.gz, zstd, move or none: " + format)
+}
+
+// archiveName is path file is archived to relative to -out,
+// archives are kept in YYYY/MM/DD directory of day they were sent
+func (o options) archiveName(name string) string {
+	name = path.Join(time.Now().Format("2006/01/02"), name+archiveSuffixes[o.archiveFormat])
+	if o.zipEncrypt == "" {
+		return name
+	}
+
+	kind, _, _ := parseEncrypt(o.zipEncrypt)
+	return name + encryptSuffixes[kind]
+}
+
+// archive builds archive in workspace and moves it to output once complete,
+// so output never holds partially written archives. Moved file which
+// is not encrypted is renamed there as it is
+func (p *parser) archive(filePath, output string, pl *payload) error {
+	ws := p.controller.workspace
+	if p.options.archiveFormat == archiveMove && p.options.zipEncrypt == "" {
+		return ws.commit(filePath, output)
+	}
+
+	archived, err := ws.create("archive")
+	if err != nil {
+		return err
+	}
+	defer ws.discard(archived.Name())
+
+	// Archive is encrypted as it is written, so
+	// plain copy of file never reaches disk
+	enc, err := p.options.newEncryptor(archived)
+	if err != nil {
+		archived.Close()
+		return err
+	}
+
+	err = p.writeArchive(enc, path.Base(filePath), pl)
+	if closeErr := enc.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := archived.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return ws.commit(archived.Name(), output)
+}
+
+// writeArchive writes file named name in archive format into w
+func (p *parser) writeArchive(w io.Writer, name string, pl *payload) error {
+	src, err := pl.open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	switch p.options.archiveFormat {
+	case archiveTarGz:
+		gz := newGzipWriter(w, gzip.DefaultCompression)
+		defer gz.Close()
+		tw := tar.NewWriter(gz)
+
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    pl.size,
+			ModTime: p.file.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := copyPooled(tw, src); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+
+		return gz.Close()
+	case archiveZstd:
+		zw, err := newCmdWriter(w, "zstd", "-q", "-c")
+		if err != nil {
+			return err
+		}
+		if _, err := copyPooled(zw, src); err != nil {
+			zw.Close()
+			return err
+		}
+
+		return zw.Close()
+	case archiveMove:
+		_, err := io.Copy(w, src)
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := copyPooled(f, src); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
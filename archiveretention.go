@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getsentry/raven-go"
+)
+
+// archiveDay matches YYYY/MM/DD directory of archives relative to -out,
+// anything else there, e.g. quarantine, is never pruned
+var archiveDay = regexp.MustCompile(`^[0-9]{4}(/[0-9]{2}(/[0-9]{2})?)?$`)
+
+// archivedFile is archive found in dated directory
+type archivedFile struct {
+	path string
+	day  time.Time
+	size int64
+	// mtime orders archives of the same day
+	mtime time.Time
+}
+
+// listArchives walks dated directories of out, oldest archives first
+func listArchives(out string) ([]archivedFile, error) {
+	files := []archivedFile{}
+	err := filepath.Walk(out, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(out, p)
+		rel = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			if rel != "." && !archiveDay.MatchString(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		dir := path.Dir(rel)
+		if strings.Count(dir, "/") != 2 || !archiveDay.MatchString(dir) {
+			return nil
+		}
+		day, err := time.ParseInLocation("2006/01/02", dir, time.Local)
+		if err != nil {
+			return nil
+		}
+
+		files = append(files, archivedFile{path: p, day: day, size: fi.Size(), mtime: fi.ModTime()})
+		return nil
+	})
+
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].day.Equal(files[j].day) {
+			return files[i].day.Before(files[j].day)
+		}
+		return files[i].mtime.Before(files[j].mtime)
+	})
+
+	return files, err
+}
+
+// pruneArchives deletes archives of days older than -archive-retention-days,
+// then the oldest ones until the rest fits -archive-retention-size
+func (c *controller) pruneArchives() {
+	o := c.opts()
+	files, err := listArchives(o.out)
+	if err != nil {
+		raven.CaptureError(err, map[string]string{
+			"retention": "archive",
+		})
+
+		log.Printf("[RETENTION] Error listing archives: %s\n", err)
+		return
+	}
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	cutoff := today.AddDate(0, 0, -o.archiveRetentionDays)
+	maxSize := int64(o.archiveRetentionSize) * 1024 * 1024
+
+	dirs := map[string]bool{}
+	for _, f := range files {
+		reason := ""
+		switch {
+		case o.archiveRetentionDays > 0 && f.day.Before(cutoff):
+			reason = "age"
+		case maxSize > 0 && total > maxSize:
+			reason = "size"
+		default:
+			continue
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("[RETENTION] Error deleting archive %s: %s\n", f.path, err)
+			continue
+		}
+
+		total -= f.size
+		dirs[filepath.Dir(f.path)] = true
+		c.prom.inc(c.prom.archivesPruned, reason)
+		c.prom.add(c.prom.archiveReclaimed, float64(f.size), reason)
+		log.Printf("[RETENTION] Deleted archive %s (%s)\n", f.path, reason)
+	}
+
+	// Emptied day, month and year directories go as well
+	for dir := range dirs {
+		for i := 0; i < 3 && os.Remove(dir) == nil; i++ {
+			dir = filepath.Dir(dir)
+		}
+	}
+
+	c.mu.Lock()
+	c.archiveSize = total
+	c.mu.Unlock()
+}
+
+func (c *controller) watchArchives(interval time.Duration) {
+	for {
+		c.pruneArchives()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	File       string    `json:"file"`
+	Identities []string  `json:"identities"`
+	Result     string    `json:"result"`
+}
+
+// auditLog appends administrative actions as JSON lines
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{
+		path: path,
+	}
+}
+
+func (a *auditLog) record(action, file string, identities []string, result string) {
+	log.Printf("[AUDIT] %s %s by %s: %s\n", action, file, strings.Join(identities, ", "), result)
+
+	if a.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(auditEntry{
+		Time:       time.Now(),
+		Action:     action,
+		File:       file,
+		Identities: identities,
+		Result:     result,
+	})
+	if err != nil {
+		log.Printf("[AUDIT] Marshalling error: %s\n", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("[AUDIT] Opening audit log error: %s\n", err)
+		return
+	}
+	defer f.Close()
+
+	f.Write(append(data, '\n'))
+}
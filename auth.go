@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Schemes token is sent to API with
+const (
+	authToken  = "token"
+	authBearer = "bearer"
+	authBasic  = "basic"
+)
+
+// validateAuth checks auth scheme, basic one
+// takes token as <user>:<password>
+func validateAuth(name, auth string) error {
+	switch auth {
+	case "", authToken, authBearer, authBasic:
+		return nil
+	}
+
+	return fmt.Errorf("Auth of %s must be token, bearer or basic: %s", name, auth)
+}
+
+// readSecret returns secret given as it is, by environment variable
+// or by file, so it doesn't have to be passed on command line
+func readSecret(value, env, file string) (string, error) {
+	switch {
+	case env != "":
+		v := os.Getenv(env)
+		if v == "" {
+			return "", fmt.Errorf("Environment variable %s is not set", env)
+		}
+		return v, nil
+	case file != "":
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return value, nil
+}
+
+// secretSource tells where secret comes from
+// without revealing it, for configuration printout
+func secretSource(value, env, file string) string {
+	switch {
+	case env != "":
+		return "environment variable " + env
+	case file != "":
+		return "file " + file
+	case value != "":
+		return "set"
+	}
+
+	return "not set"
+}
+
+// validateSecret checks that secret is given one way only and can be read
+func validateSecret(name, value, env, file string) error {
+	given := 0
+	for _, s := range []string{value, env, file} {
+		if s != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return errors.New("Token of " + name + " is given more than one way")
+	}
+
+	if _, err := readSecret(value, env, file); err != nil {
+		return fmt.Errorf("Token of %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// setAPIHeaders sets extra headers of route or destination and its
+// token, in the scheme it is configured with or OAuth2 access token
+func (o options) setAPIHeaders(req *http.Request) error {
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+
+	if o.oauth != nil {
+		// Pins are of API, not of token endpoint
+		plain := o
+		plain.pins = nil
+		token, err := tokenProvider.token(req.Context(), o.oauth, plain.transport(), o.seconds(o.timeout))
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+
+	switch o.auth {
+	case authBearer:
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	case authBasic:
+		user, password, _ := strings.Cut(o.token, ":")
+		req.SetBasicAuth(user, password)
+	default:
+		req.Header.Set("X-Access-Token", o.token)
+	}
+
+	return nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	metrics "github.com/cryptopay-dev/go-metrics"
+	"github.com/getsentry/raven-go"
+)
+
+// Policies applied to batches still incomplete at deadline
+const (
+	batchPolicyPartial    = "partial"
+	batchPolicyQuarantine = "quarantine"
+)
+
+type manifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifest lists files which should be delivered together
+type manifest struct {
+	BatchID string         `json:"batch_id"`
+	Files   []manifestFile `json:"files"`
+}
+
+// readManifest reads manifest given by its path relative to watched directory
+func readManifest(dir, name string) (*manifest, error) {
+	buf, err := ioutil.ReadFile(path.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, err
+	}
+
+	if len(m.Files) == 0 {
+		return nil, errors.New("Manifest lists no files")
+	}
+
+	for _, f := range m.Files {
+		if f.Name == "" || strings.ContainsAny(f.Name, `/\`) {
+			return nil, fmt.Errorf("Wrong file name in manifest: %q", f.Name)
+		}
+	}
+
+	// Batch without ID is identified by its manifest, so the ID is the
+	// same on every attempt and after restart and API can deduplicate it
+	if m.BatchID == "" {
+		sum := sha256.Sum256(buf)
+		m.BatchID = processingID("", name, hex.EncodeToString(sum[:]))
+	}
+
+	return m, nil
+}
+
+// batch delivers all files listed in manifest
+// once every one of them is present and verified
+type batch struct {
+	file       os.FileInfo
+	manifest   *manifest
+	ch         chan struct{}
+	options    options
+	prefix     string
+	controller *controller
+	// ctx is cancelled when waits of batch have to be interrupted
+	ctx context.Context
+}
+
+func newBatch(file os.FileInfo, m *manifest, ch chan struct{}, opts options, c *controller) *batch {
+	return &batch{
+		file:       file,
+		manifest:   m,
+		ch:         ch,
+		options:    opts,
+		prefix:     file.Name(),
+		controller: c,
+		ctx:        context.Background(),
+	}
+}
+
+// filePath resolves name relative to manifest directory
+func (b *batch) filePath(name string) string {
+	return path.Join(b.options.dir, sameDir(b.file.Name(), name))
+}
+
+// batchDelivered tells whether journal has every file of batch present
+// in watched directory delivered, read-only source keeps them in place
+func (c *controller) batchDelivered(file os.FileInfo, m *manifest, opts options) bool {
+	present := 0
+	for _, f := range m.Files {
+		name := sameDir(file.Name(), f.Name)
+		fi, err := os.Stat(path.Join(opts.dir, name))
+		if err != nil {
+			continue
+		}
+		if !c.journal.delivered(name, fi.Size(), fi.ModTime()) {
+			return false
+		}
+		present++
+	}
+
+	return present > 0
+}
+
+// missing returns files which are not present yet or
+// which size is still different from expected one
+func (b *batch) missing() []string {
+	missing := []string{}
+	for _, f := range b.manifest.Files {
+		fi, err := os.Stat(b.filePath(f.Name))
+		if err != nil || (f.Size > 0 && fi.Size() != f.Size) {
+			missing = append(missing, f.Name)
+		}
+	}
+
+	return missing
+}
+
+func (b *batch) process() {
+	defer func() {
+		b.ch <- struct{}{}
+	}()
+	manifestPath := path.Join(b.options.dir, b.file.Name())
+	log.Printf("[BATCH: %s] Found manifest of batch %s with %d files\n", b.prefix, b.manifest.BatchID, len(b.manifest.Files))
+
+	// Waiting for all parts to arrive in any order
+	// until optional deadline counted from manifest drop
+	deadline := b.file.ModTime().Add(time.Second * time.Duration(b.options.batchDeadline))
+	missing := b.missing()
+	for len(missing) > 0 {
+		if b.options.batchDeadline > 0 && time.Now().After(deadline) {
+			break
+		}
+
+		if b.options.verbose {
+			log.Printf("[BATCH: %s] Waiting for files: %s\n", b.prefix, strings.Join(missing, ", "))
+		}
+
+		if err := sleep(b.ctx, b.controller, time.Second*time.Duration(b.options.checkInterval), true); err != nil {
+			present := []string{manifestPath}
+			for _, f := range b.manifest.Files {
+				if !contains(missing, f.Name) {
+					present = append(present, b.filePath(f.Name))
+				}
+			}
+			b.leave(err, present...)
+			return
+		}
+		missing = b.missing()
+	}
+
+	paths := []string{}
+	files := []manifestFile{}
+	for _, f := range b.manifest.Files {
+		if !contains(missing, f.Name) {
+			files = append(files, f)
+			paths = append(paths, b.filePath(f.Name))
+		}
+	}
+
+	if len(missing) > 0 {
+		log.Printf("[BATCH: %s] Deadline passed, missing files: %s\n", b.prefix, strings.Join(missing, ", "))
+
+		raven.CaptureMessage("Batch is incomplete at deadline", map[string]string{
+			"batch":   b.manifest.BatchID,
+			"file":    b.prefix,
+			"missing": strings.Join(missing, ", "),
+			"policy":  b.options.batchPolicy,
+		})
+
+		sendMetrics("batches", metrics.M{
+			"incomplete": true,
+		}, nil)
+
+		if b.options.batchPolicy != batchPolicyPartial || len(files) == 0 {
+			err := newStageError(stageValidate, b.prefix, 0, errValidation,
+				fmt.Errorf("Batch %s is incomplete, missing: %s", b.manifest.BatchID, strings.Join(missing, ", ")))
+			newParser(b.file, nil, b.options, b.controller).quarantine(manifestPath, err, paths...)
+			return
+		}
+	}
+
+	// Reading and verifying every file before sending anything
+	parsers := make([]*parser, len(files))
+	payloads := make([]*payload, len(files))
+	for i, f := range files {
+		filePath := b.filePath(f.Name)
+
+		fi, err := os.Stat(filePath)
+		if err != nil {
+			err = newStageError(stageRead, b.prefix, 0, errIO, err)
+			newParser(b.file, nil, b.options, b.controller).fail(manifestPath, err, paths...)
+			return
+		}
+
+		p := newParser(relFileInfo{FileInfo: fi, name: sameDir(b.file.Name(), f.Name)}, nil, b.options, b.controller)
+		p.prefix = b.prefix + "/" + f.Name
+		p.ctx = b.ctx
+		p.headers["X-Batch-Id"] = b.manifest.BatchID
+		p.headers["X-Batch-Size"] = strconv.Itoa(len(b.manifest.Files))
+		p.headers["X-Batch-Index"] = strconv.Itoa(i + 1)
+		if len(missing) > 0 {
+			p.headers["X-Batch-Incomplete"] = "true"
+			p.headers["X-Batch-Missing"] = strings.Join(missing, ",")
+		}
+
+		if err := p.validate(filePath); err != nil {
+			if reason := interruption(err); reason != nil {
+				b.leave(reason, append(paths, manifestPath)...)
+				return
+			}
+			newParser(b.file, nil, b.options, b.controller).fail(manifestPath, err, paths...)
+			return
+		}
+
+		pl, err := newPayload(filePath)
+		if err != nil {
+			err = newStageError(stageRead, p.prefix, 0, errIO, err)
+			newParser(b.file, nil, b.options, b.controller).fail(manifestPath, err, paths...)
+			return
+		}
+
+		hash := pl.sha256
+		if f.SHA256 != "" && !strings.EqualFold(f.SHA256, hash) {
+			err := newStageError(stageChecksum, p.prefix, 0, errValidation,
+				fmt.Errorf("Checksum mismatch: expected %s, got %s", f.SHA256, hash))
+			newParser(b.file, nil, b.options, b.controller).quarantine(manifestPath, err, paths...)
+			return
+		}
+
+		// Journal survives restarts, files of batch delivered
+		// before one are only archived or deleted
+		if p.options.journal != "" && p.deliveredEverywhere(hash) {
+			log.Printf("[FILE: %s] File content was already delivered according to journal, not sending it again\n", p.prefix)
+			p.sent = true
+		}
+
+		parsers[i] = p
+		payloads[i] = pl
+	}
+
+	log.Printf("[BATCH: %s] %d of %d files are present and verified\n", b.prefix, len(files), len(b.manifest.Files))
+
+	// Waiting for operator approval of whole batch
+	if b.options.hold {
+		log.Printf("[BATCH: %s] Batch is validated and held until release\n", b.prefix)
+		hashes := []string{}
+		for _, pl := range payloads {
+			hashes = append(hashes, pl.sha256)
+		}
+		send, err := b.controller.waitHold(b.ctx, b.file.Name(), fingerprint(hashes), b.options.priority)
+		if reason := interruption(err); reason != nil {
+			b.leave(reason, append(paths, manifestPath)...)
+			return
+		}
+		if !send {
+			for _, filePath := range append(paths, manifestPath) {
+				if err := os.Remove(filePath); err != nil {
+					raven.CaptureErrorAndWait(err, map[string]string{
+						"file": filePath,
+					})
+
+					log.Printf("[BATCH: %s] Error deleting file: %s\n", b.prefix, err)
+				}
+			}
+
+			log.Printf("[BATCH: %s] Held batch deleted by operator\n", b.prefix)
+			return
+		}
+		log.Printf("[BATCH: %s] Batch released by operator\n", b.prefix)
+	}
+
+	// Failed file is set aside together
+	// with manifest and files not sent yet
+	for i, p := range parsers {
+		if err := p.deliver(paths[i], payloads[i]); err != nil {
+			if reason := interruption(err); reason != nil {
+				b.leave(reason, append(paths[i:], manifestPath)...)
+				return
+			}
+			p.fail(paths[i], err)
+			newParser(b.file, nil, b.options, b.controller).setAside(manifestPath, err, paths[i+1:]...)
+			return
+		}
+	}
+
+	if b.options.clear || b.options.zip {
+		if err := os.Remove(manifestPath); err != nil {
+			log.Printf("[BATCH: %s] Error deleting manifest: %s\n", b.prefix, err)
+		}
+	}
+
+	log.Printf("[BATCH: %s] Batch %s delivered\n", b.prefix, b.manifest.BatchID)
+}
+
+// leave handles batch whose processing was interrupted, its files
+// stay in place unless operator deleted it
+func (b *batch) leave(reason error, paths ...string) {
+	if reason != errDeleted {
+		log.Printf("[BATCH: %s] Interrupted, %s, batch is left in place\n", b.prefix, reason)
+		return
+	}
+
+	for _, filePath := range paths {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("[BATCH: %s] Error deleting file %s: %s\n", b.prefix, filePath, err)
+		}
+	}
+
+	log.Printf("[BATCH: %s] Batch deleted by operator\n", b.prefix)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyDeliveredBatchIsNotRespawned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"batch.manifest.json": `{"batch_id":"b1","files":[{"name":"a.xml"},{"name":"b.xml"}]}`,
+		"a.xml":               "<a/>",
+		"b.xml":               "<b/>",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j, err := openJournal(path.Join(dir, "journal.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Batch members were delivered by previous scan
+	for _, name := range []string{"a.xml", "b.xml"} {
+		fi, err := os.Stat(path.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = j.record(journalEntry{Name: name, State: stateDelivered, Size: fi.Size(), Mtime: fi.ModTime(), SentAt: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := options{
+		dir:            dir,
+		patterns:       ".xml",
+		separator:      ",",
+		manifestSuffix: ".manifest.json",
+		readOnly:       true,
+		journal:        j.path,
+	}
+	s, err := openSkipList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newController(opts, nil, j, nil, s)
+
+	for i := 0; i < 2; i++ {
+		scan(c, opts)
+
+		c.mu.Lock()
+		spawned := len(c.files)
+		c.mu.Unlock()
+		if spawned != 0 {
+			t.Fatalf("scan %d spawned %d files of delivered batch", i+1, spawned)
+		}
+	}
+
+	if n := len(j.all()); n != 2 {
+		t.Fatalf("journal has %d entries after scans, want 2", n)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cryptopay-dev/go-metrics"
+)
+
+// Variants of route with canary files are compared by
+const (
+	variantStable = "stable"
+	variantCanary = "canary"
+	variantMirror = "mirror"
+)
+
+// canary sends share of route files to new destination instead of
+// route URL, or with mirror a copy of them whose result is ignored
+type canary struct {
+	Percent  float64  `json:"percent" desc:"Share of files in percent picked for canary" minimum:"0" maximum:"100" required:"true"`
+	Mirror   bool     `json:"mirror" desc:"Send copy of picked files to canary besides route URL, canary result is ignored"`
+	URL      string   `json:"url" desc:"Canary API URL" pattern:"^(https?|s3|sftp)://" required:"true"`
+	Token    string   `json:"token" desc:"Canary API token, defaults to route one"`
+	TokenEnv string   `json:"token_env" desc:"Environment variable holding canary API token"`
+	Pins     []string `json:"pins" desc:"Certificate pins of canary as sha256/<base64>"`
+}
+
+func (c *canary) validate(name string) error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("Route %s canary percent must be within 0..100: %g", name, c.Percent)
+	}
+	if c.URL == "" {
+		return errors.New("Route canary without URL: " + name)
+	}
+	if err := validateURL(c.URL); err != nil {
+		return err
+	}
+	if c.Token != "" && c.TokenEnv != "" {
+		return errors.New("Route canary has both token and token_env: " + name)
+	}
+	if c.TokenEnv != "" && os.Getenv(c.TokenEnv) == "" {
+		return fmt.Errorf("Environment variable %s with canary token of route %s is not set", c.TokenEnv, name)
+	}
+
+	return validatePins(c.URL, c.Pins)
+}
+
+// picks tells whether file goes to canary, the same
+// file is always picked so retries keep their variant
+func (c *canary) picks(rel string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(rel))
+	return float64(h.Sum32()%10000) < c.Percent*100
+}
+
+// target is options of sending to canary
+func (c *canary) target(o options) options {
+	o.url = c.URL
+	if c.Token != "" {
+		o.token = c.Token
+	}
+	if c.TokenEnv != "" {
+		o.token = os.Getenv(c.TokenEnv)
+	}
+	// Pins and pre-signing belong to route URL
+	o.pins, _ = parsePins(c.Pins)
+	o.presignURL = ""
+
+	return o
+}
+
+// withCanary picks variant of file with given relative path
+func (o options) withCanary(rel string) options {
+	c := o.canary
+	if c == nil {
+		return o
+	}
+
+	o.variant = variantStable
+	if !c.picks(rel) || c.Mirror {
+		return o
+	}
+
+	o = c.target(o)
+	o.variant = variantCanary
+
+	return o
+}
+
+// mirrorsToCanary tells whether copy of file is sent to canary
+func (o options) mirrorsToCanary(rel string) bool {
+	return o.canary != nil && o.canary.Mirror && o.canary.picks(rel)
+}
+
+// observeCanary counts upload result of route variant
+func (p *parser) observeCanary(variant string, delivered bool, elapsed time.Duration) {
+	if variant == "" {
+		return
+	}
+
+	result := "delivered"
+	if !delivered {
+		result = "failed"
+	}
+
+	sendMetrics("canary", metrics.M{
+		"delivered": delivered,
+		"duration":  elapsed.Seconds(),
+	}, metrics.T{
+		"route":   p.options.route,
+		"variant": variant,
+	})
+	prom := p.controller.prom
+	prom.inc(prom.canaryFiles, p.options.route, variant, result)
+	prom.add(prom.canarySeconds, elapsed.Seconds(), p.options.route, variant)
+}
+
+// sendCanaryCopy makes single upload attempt to canary, its
+// result is only logged and counted and never fails the file
+func (p *parser) sendCanaryCopy(pl *payload) {
+	t := p.options.canary.target(p.options)
+	t.destination = variantCanary
+	cp := p.to(t)
+
+	started := time.Now()
+	_, err := cp.post(pl, p.file.Name())
+	if err != nil {
+		log.Printf("[FILE: %s] Canary copy failed: %s\n", cp.prefix, err)
+	} else if p.options.verbose {
+		log.Printf("[FILE: %s] Canary copy delivered\n", cp.prefix)
+	}
+
+	p.observeCanary(variantMirror, err == nil, time.Since(started))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fullRescan is how often whole directory is listed even
+// when change journal tells which files are new
+const fullRescan = time.Hour
+
+// changeSet collects files change journal reported in watched directory,
+// they are looked at on every scan until they are gone, so huge
+// directories are not listed as a whole on every scan
+type changeSet struct {
+	mu       sync.Mutex
+	names    map[string]bool
+	active   bool
+	full     bool
+	lastFull time.Time
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{
+		names:  make(map[string]bool),
+		active: true,
+		full:   true,
+	}
+}
+
+// add records file journal reported as created or changed
+func (s *changeSet) add(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.names[name] = true
+}
+
+func (s *changeSet) forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.names, name)
+}
+
+// rescan asks for full listing, e.g. when journal lost changes
+func (s *changeSet) rescan() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.full = true
+}
+
+// stop switches scans back to full listings once journal is unavailable
+func (s *changeSet) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active = false
+}
+
+// take returns files to look at, false means whole directory has to be listed
+func (s *changeSet) take() ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.active || s.full || time.Since(s.lastFull) > fullRescan {
+		return nil, false
+	}
+
+	names := make([]string, 0, len(s.names))
+	for name := range s.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, true
+}
+
+// listed records that whole directory was listed
+func (s *changeSet) listed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.full, s.lastFull = false, time.Now()
+}
+
+// listChanged lists files change journal reported, whole directory is
+// listed when there is no journal, it lost changes or full rescan is due
+func (c *controller) listChanged(opts options) ([]os.FileInfo, error) {
+	if c.changes == nil {
+		return listFiles(opts)
+	}
+
+	names, ok := c.changes.take()
+	if !ok {
+		files, err := listFiles(opts)
+		if err == nil {
+			c.changes.listed()
+		}
+		return files, err
+	}
+
+	files := []os.FileInfo{}
+	for _, name := range names {
+		fi, err := os.Stat(filepath.Join(opts.dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+			c.changes.forget(name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, relFileInfo{FileInfo: fi, name: name})
+	}
+
+	return files, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Companion checksum files suffixes which are
+// recognized next to data files
+var checksumSuffixes = map[string]func() hash.Hash{
+	".sha256": sha256.New,
+	".md5":    md5.New,
+}
+
+// companionChecksum returns path of checksum file
+// which accompanies given data file
+func companionChecksum(filePath string) (string, bool) {
+	for _, suffix := range []string{".sha256", ".md5"} {
+		if _, err := os.Stat(filePath + suffix); err == nil {
+			return filePath + suffix, true
+		}
+	}
+
+	return "", false
+}
+
+// isChecksumFile reports whether name is a companion checksum file
+func isChecksumFile(name string) bool {
+	for suffix := range checksumSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyChecksum compares file content with hash from companion file,
+// which holds either bare hex digest or "<digest>  <filename>" line,
+// in FIPS mode MD5 is not accepted
+func verifyChecksum(checksumPath, filePath string, fips bool) error {
+	if fips && strings.HasSuffix(checksumPath, ".md5") {
+		return fmt.Errorf("MD5 checksum %s is not allowed in FIPS mode", checksumPath)
+	}
+
+	content, err := ioutil.ReadFile(checksumPath)
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return fmt.Errorf("Checksum file %s is empty", checksumPath)
+	}
+	expected := strings.ToLower(fields[0])
+
+	for suffix, fn := range checksumSuffixes {
+		if !strings.HasSuffix(checksumPath, suffix) {
+			continue
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+
+		h := fn()
+		_, err = copyPooled(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		actual := hex.EncodeToString(h.Sum(nil))
+
+		if actual != expected {
+			return fmt.Errorf("Checksum mismatch: expected %s, got %s", expected, actual)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("Unknown checksum file type: %s", checksumPath)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// completions remembers when files were closed after writing or
+// moved into watched directory, which means upload is finished
+// without waiting for file size to stay the same
+type completions struct {
+	mu     sync.Mutex
+	closed map[string]time.Time
+}
+
+func newCompletions() *completions {
+	return &completions{
+		closed: make(map[string]time.Time),
+	}
+}
+
+// mark records that writer has closed file
+func (c *completions) mark(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.closed[name] = now
+
+	// Files not matching patterns are never asked about
+	for n, t := range c.closed {
+		if now.Sub(t) > time.Hour {
+			delete(c.closed, n)
+		}
+	}
+}
+
+// finished reports whether file was closed after
+// its last modification, nil receiver knows nothing
+func (c *completions) finished(name string, mtime time.Time) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t, ok := c.closed[name]
+	return ok && !t.Before(mtime)
+}
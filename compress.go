@@ -0,0 +1,170 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// Codecs request body may be compressed with
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+	compressNone = "none"
+)
+
+// compressLevels are ranges of levels codecs accept, 0 is codec default
+var compressLevels = map[string][2]int{
+	compressGzip: {gzip.BestSpeed, gzip.BestCompression},
+	compressZstd: {1, 19},
+	compressNone: {0, 0},
+}
+
+// validateCompress checks codec and level, zstd requires zstd to be installed
+func validateCompress(codec string, level int) error {
+	levels, ok := compressLevels[codec]
+	if !ok {
+		return errors.New("Unknown compression: " + codec)
+	}
+	if level != 0 && (level < levels[0] || level > levels[1]) {
+		return fmt.Errorf("Compression level of %s must be within %d..%d: %d", codec, levels[0], levels[1], level)
+	}
+	if codec == compressZstd {
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return errors.New("zstd compression requires zstd command")
+		}
+	}
+
+	return nil
+}
+
+// validateCodec checks compression of route or destination,
+// level alone is ambiguous as it depends on codec
+func validateCodec(name, codec string, level int) error {
+	if codec == "" {
+		if level != 0 {
+			return errors.New("Compression level without compression: " + name)
+		}
+		return nil
+	}
+
+	return validateCompress(codec, level)
+}
+
+// contentEncoding is Content-Encoding of request body, empty for raw one
+func (o options) contentEncoding() string {
+	if o.compress == compressNone {
+		return ""
+	}
+
+	return o.compress
+}
+
+// gzipPools keep gzip writers by level for reuse, every one holds
+// compression state of several hundred KB which new writer allocates
+var gzipPools sync.Map
+
+// gzipWriter is gzip writer of pool, it is returned there once closed
+type gzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+// newGzipWriter takes gzip writer of valid level from pool
+func newGzipWriter(w io.Writer, level int) *gzipWriter {
+	v, ok := gzipPools.Load(level)
+	if !ok {
+		v, _ = gzipPools.LoadOrStore(level, &sync.Pool{
+			New: func() interface{} {
+				gz, _ := gzip.NewWriterLevel(nil, level)
+				return gz
+			},
+		})
+	}
+
+	pool := v.(*sync.Pool)
+	gz := pool.Get().(*gzip.Writer)
+	gz.Reset(w)
+
+	return &gzipWriter{Writer: gz, pool: pool}
+}
+
+func (g *gzipWriter) Close() error {
+	if g.Writer == nil {
+		return nil
+	}
+
+	err := g.Writer.Close()
+	g.pool.Put(g.Writer)
+	g.Writer = nil
+
+	return err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// cmdWriter pipes data through command, e.g. zstd,
+// close waits for all its output to be written
+type cmdWriter struct {
+	stdin io.WriteCloser
+	cmd   *exec.Cmd
+}
+
+func newCmdWriter(w io.Writer, name string, args ...string) (*cmdWriter, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &cmdWriter{stdin: stdin, cmd: cmd}, nil
+}
+
+func (c *cmdWriter) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *cmdWriter) Close() error {
+	if err := c.stdin.Close(); err != nil {
+		c.cmd.Wait()
+		return err
+	}
+
+	return c.cmd.Wait()
+}
+
+// newEncoder compresses everything written to it into w with codec of options
+func (o options) newEncoder(w io.Writer) (io.WriteCloser, error) {
+	switch o.compress {
+	case compressNone:
+		return nopWriteCloser{w}, nil
+	case compressZstd:
+		args := []string{"-q", "-c"}
+		if o.compressLevel != 0 {
+			args = append(args, "-"+strconv.Itoa(o.compressLevel))
+		}
+
+		return newCmdWriter(w, "zstd", args...)
+	}
+
+	level := o.compressLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	return newGzipWriter(w, level), nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// route maps subdirectory of watched directory
+// to its own patterns and API destination
+type route struct {
+	Name       string            `json:"name" desc:"Route name, defaults to dir"`
+	Dir        string            `json:"dir" desc:"Subdirectory of watched directory"`
+	Patterns   []string          `json:"patterns" desc:"File patterns of route"`
+	Exclude    []string          `json:"exclude" desc:"Patterns of files route never processes, replace top-level ones"`
+	Match      []string          `json:"match" desc:"Patterns of files route picks within its dir, routes sharing dir are told apart by them"`
+	URL        string            `json:"url" desc:"API URL of route" pattern:"^$|^(https?|s3|sftp)://"`
+	Token      string            `json:"token" desc:"API token of route"`
+	TokenEnv   string            `json:"token_env" desc:"Environment variable holding API token of route, instead of token"`
+	TokenFile  string            `json:"token_file" desc:"File holding API token of route, instead of token"`
+	Auth       string            `json:"auth" desc:"How token is sent: token (X-Access-Token), bearer or basic (token is user:password), overrides -auth" enum:"|token|bearer|basic"`
+	OAuth2     *oauth2           `json:"oauth2" desc:"OAuth2 client credentials access tokens of route API are acquired with, instead of token"`
+	Archive    string            `json:"archive" desc:"What to do with delivered files, overrides -zip and -clear" enum:"|archive|delete|retain"`
+	Pins       []string          `json:"pins" desc:"Certificate pins as sha256/<base64>"`
+	SLO        *slo              `json:"slo" desc:"Service level objective of route"`
+	Schemas    map[string]string `json:"schemas" desc:"XSD schemas of route by file suffix, replace top-level ones"`
+	Transforms map[string]string `json:"transforms" desc:"Transforms of route by file suffix, replace top-level ones"`
+	Sheets     []string          `json:"xlsx_sheets" desc:"Sheets every spreadsheet of route has to contain, replace top-level ones"`
+	Validate   string            `json:"validate_command" desc:"Command validating files of route, replaces top-level one"`
+	Canary     *canary           `json:"canary" desc:"Share of files sent to new destination for comparison"`
+	Compress   string            `json:"compress" desc:"Compression of request body, overrides -compress" enum:"|gzip|zstd|none"`
+	Level      int               `json:"compress_level" desc:"Compression level, overrides -compress-level" minimum:"0"`
+	Priority   int               `json:"priority" desc:"Delivery priority, files of higher one get workers first and it is sent as X-Priority"`
+	Timeout    int               `json:"timeout" desc:"API timeout in seconds, overrides -timeout" minimum:"0"`
+	Headers    map[string]string `json:"headers" desc:"Extra headers of every API request of route"`
+	Hold       bool              `json:"hold" desc:"Hold validated files of route until released via API, -hold holds every route"`
+
+	Destinations []destination `json:"destinations" desc:"Additional destinations, replace top-level ones"`
+}
+
+// config is a JSON configuration file complementing flags,
+// every value set in it overrides corresponding flag
+type config struct {
+	Patterns      []string          `json:"patterns" desc:"File patterns, override -patterns"`
+	Exclude       []string          `json:"exclude" desc:"Patterns of files never processed, override -exclude"`
+	URL           string            `json:"url" desc:"API URL, overrides -url" pattern:"^$|^(https?|s3|sftp)://"`
+	Token         string            `json:"token" desc:"API token, overrides -token"`
+	Interval      int               `json:"interval" desc:"Seconds between directory scans, overrides -interval" minimum:"0"`
+	CheckInterval int               `json:"check_interval" desc:"Seconds between XML checks, overrides -check" minimum:"0"`
+	Timeout       int               `json:"timeout" desc:"API timeout in seconds, overrides -timeout" minimum:"0"`
+	Routes        []route           `json:"routes" desc:"Subdirectories with their own patterns and destinations"`
+	Pins          []string          `json:"pins" desc:"Certificate pins as sha256/<base64>"`
+	Schemas       map[string]string `json:"schemas" desc:"XSD schemas by file suffix, override -xsd"`
+	Transforms    map[string]string `json:"transforms" desc:"Transforms by file suffix, e.g. xslt:fix.xsl+minify, override -transform"`
+	Sheets        []string          `json:"xlsx_sheets" desc:"Sheets every spreadsheet has to contain, override -xlsx-sheets"`
+	Validate      string            `json:"validate_command" desc:"Command validating files, overrides -validate-command"`
+
+	Destinations []destination `json:"destinations" desc:"Additional destinations every file is delivered to"`
+}
+
+func loadConfig(filePath string) (*config, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(buf)
+}
+
+func parseConfig(buf []byte) (*config, error) {
+	// Unknown keys are typos, they would silently leave defaults in place
+	cfg := &config{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.Routes {
+		r := &cfg.Routes[i]
+		r.Dir = strings.Trim(path.Clean("/"+r.Dir), "/")
+
+		if strings.HasPrefix(r.Dir, "..") {
+			return nil, fmt.Errorf("Route directory %s is outside of watched directory", r.Dir)
+		}
+
+		if r.Name == "" {
+			r.Name = r.Dir
+		}
+		if r.Name == "" {
+			r.Name = "root"
+		}
+	}
+
+	return cfg, nil
+}
+
+// routeFor picks route with the longest directory containing file with
+// given relative path. Of routes sharing directory the first one whose
+// match patterns file matches wins over one without them
+func (o options) routeFor(rel string) (route, bool) {
+	dir := path.Dir(rel)
+	if dir == "." {
+		dir = ""
+	}
+
+	best, found := route{}, false
+	for _, r := range o.routes {
+		if r.Dir != "" && dir != r.Dir && !strings.HasPrefix(dir, r.Dir+"/") {
+			continue
+		}
+		if len(r.Match) > 0 && !r.matches(rel) {
+			continue
+		}
+
+		if !found || len(r.Dir) > len(best.Dir) ||
+			(len(r.Dir) == len(best.Dir) && len(r.Match) > 0 && len(best.Match) == 0) {
+			best, found = r, true
+		}
+	}
+
+	return best, found
+}
+
+// matches tells whether file matches one of match patterns of route
+func (r route) matches(rel string) bool {
+	for _, p := range r.Match {
+		if matchPattern(p, rel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forFile returns options with route settings
+// applied for file with given relative path
+func (o options) forFile(rel string) options {
+	r, ok := o.routeFor(rel)
+	if !ok {
+		return o
+	}
+
+	return o.withRoute(r).withCanary(rel)
+}
+
+// withRoute returns options with settings of route applied
+func (o options) withRoute(r route) options {
+	o.route = r.Name
+	if len(r.Patterns) > 0 {
+		o.patterns = strings.Join(r.Patterns, o.separator)
+	}
+	if len(r.Exclude) > 0 {
+		o.exclude = strings.Join(r.Exclude, o.separator)
+	}
+	// Credentials and pins of top-level API are not
+	// sent to or enforced against other hosts
+	if r.URL != "" {
+		o.url = r.URL
+		o.token, o.oauth, o.pins = "", nil, nil
+	}
+	if r.Token != "" || r.TokenEnv != "" || r.TokenFile != "" {
+		o.token, _ = readSecret(r.Token, r.TokenEnv, r.TokenFile)
+		o.oauth = nil
+	}
+	if r.Auth != "" {
+		o.auth, o.oauth = r.Auth, nil
+	}
+	if r.OAuth2 != nil {
+		o.oauth = r.OAuth2
+	}
+	if r.Timeout > 0 {
+		o.timeout = r.Timeout
+	}
+	o.headers = r.Headers
+	// Read-only source is never modified whatever route says
+	if !o.readOnly {
+		switch r.Archive {
+		case actionArchive:
+			o.zip, o.clear = true, true
+		case actionDelete:
+			o.zip, o.clear = false, true
+		case actionRetain:
+			o.zip, o.clear = false, false
+		}
+	}
+	if len(r.Destinations) > 0 {
+		o.destinations = r.Destinations
+	}
+	if len(r.Pins) > 0 {
+		o.pins, _ = parsePins(r.Pins)
+	}
+	if len(r.Schemas) > 0 {
+		o.schemas = r.Schemas
+	}
+	if len(r.Transforms) > 0 {
+		o.transforms = r.Transforms
+	}
+	if len(r.Sheets) > 0 {
+		o.sheets = r.Sheets
+	}
+	if r.Validate != "" {
+		o.validateCommand = r.Validate
+	}
+	if r.Compress != "" {
+		o.compress, o.compressLevel = r.Compress, r.Level
+	}
+	o.canary = r.Canary
+	o.priority = r.Priority
+	if r.Hold {
+		o.hold = true
+	}
+
+	return o
+}
+
+// applyConfig loads configuration file and applies it on top of base options
+func applyConfig(base options) (options, error) {
+	cfg, err := loadConfig(base.config)
+	if err != nil {
+		return base, err
+	}
+
+	return base.withConfig(cfg)
+}
+
+// withConfig validates configuration and applies it on top of options
+func (o options) withConfig(cfg *config) (options, error) {
+	if err := cfg.validate(); err != nil {
+		return o, err
+	}
+	if o.proxy != "" {
+		for _, u := range cfg.urls() {
+			if strings.HasPrefix(u, "sftp://") {
+				return o, errSFTPProxy
+			}
+		}
+	}
+
+	opts := o
+	if len(cfg.Patterns) > 0 {
+		opts.patterns = strings.Join(cfg.Patterns, opts.separator)
+	}
+	if len(cfg.Exclude) > 0 {
+		opts.exclude = strings.Join(cfg.Exclude, opts.separator)
+	}
+	if cfg.URL != "" {
+		opts.url = cfg.URL
+	}
+	if cfg.Token != "" {
+		opts.token = cfg.Token
+	}
+	if cfg.Interval > 0 {
+		opts.interval = cfg.Interval
+	}
+	if cfg.CheckInterval > 0 {
+		opts.checkInterval = cfg.CheckInterval
+	}
+	if cfg.Timeout > 0 {
+		opts.timeout = cfg.Timeout
+	}
+	opts.routes = cfg.Routes
+	opts.destinations = cfg.Destinations
+	if len(cfg.Pins) > 0 {
+		opts.pins, _ = parsePins(cfg.Pins)
+	}
+	if len(cfg.Schemas) > 0 {
+		opts.schemas = cfg.Schemas
+	}
+	if len(cfg.Transforms) > 0 {
+		opts.transforms = cfg.Transforms
+	}
+	if len(cfg.Sheets) > 0 {
+		opts.sheets = cfg.Sheets
+	}
+	if cfg.Validate != "" {
+		opts.validateCommand = cfg.Validate
+	}
+
+	return opts, nil
+}
+
+func (c *config) validate() error {
+	dirs, names := map[string]bool{}, map[string]bool{}
+	for _, r := range c.Routes {
+		// Routes sharing directory are told apart by match patterns
+		if dirs[r.Dir] && len(r.Match) == 0 {
+			return errors.New("Duplicate route for directory: " + r.Dir)
+		}
+		if names[r.Name] {
+			return errors.New("Duplicate route name: " + r.Name)
+		}
+		dirs[r.Dir] = dirs[r.Dir] || len(r.Match) == 0
+		names[r.Name] = true
+
+		if err := validateURL(r.URL); err != nil {
+			return err
+		}
+		if err := validatePatterns(r.Patterns); err != nil {
+			return err
+		}
+		if err := validatePatterns(r.Exclude); err != nil {
+			return err
+		}
+		if err := validatePatterns(r.Match); err != nil {
+			return err
+		}
+		if err := validateHeaders("route "+r.Name, r.Headers); err != nil {
+			return err
+		}
+		if err := validateToken(r); err != nil {
+			return err
+		}
+		if err := validateArchive(r); err != nil {
+			return err
+		}
+		if err := validatePins(r.URL, r.Pins); err != nil {
+			return err
+		}
+		if err := validateDestinations(r.Destinations); err != nil {
+			return err
+		}
+		if r.OAuth2 != nil {
+			if err := r.OAuth2.validate("route " + r.Name); err != nil {
+				return err
+			}
+		}
+		if r.SLO != nil {
+			if err := r.SLO.validate(r.Name); err != nil {
+				return err
+			}
+		}
+		if r.Canary != nil {
+			if err := r.Canary.validate(r.Name); err != nil {
+				return err
+			}
+		}
+		if err := validateSchemas(r.Schemas); err != nil {
+			return err
+		}
+		if err := validateTransforms(r.Transforms); err != nil {
+			return err
+		}
+		if err := validateCommand(r.Validate); err != nil {
+			return err
+		}
+		if err := validateCodec(r.Name, r.Compress, r.Level); err != nil {
+			return err
+		}
+	}
+
+	if err := validateURL(c.URL); err != nil {
+		return err
+	}
+	if err := validatePatterns(c.Patterns); err != nil {
+		return err
+	}
+	if err := validatePatterns(c.Exclude); err != nil {
+		return err
+	}
+	if err := validatePins(c.URL, c.Pins); err != nil {
+		return err
+	}
+	if err := validateSchemas(c.Schemas); err != nil {
+		return err
+	}
+	if err := validateTransforms(c.Transforms); err != nil {
+		return err
+	}
+	if err := validateCommand(c.Validate); err != nil {
+		return err
+	}
+
+	return validateDestinations(c.Destinations)
+}
+
+// validateToken checks that route token comes from a single source
+// and that the way it is sent is known
+func validateToken(r route) error {
+	if err := validateSecret("route "+r.Name, r.Token, r.TokenEnv, r.TokenFile); err != nil {
+		return err
+	}
+
+	return validateAuth("route "+r.Name, r.Auth)
+}
+
+// reservedHeaders are set by hooker itself on every request
+var reservedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Content-Encoding":  true,
+	"Transfer-Encoding": true,
+	"X-Access-Token":    true,
+	"X-File-Name":       true,
+	"X-Content-Sha256":  true,
+	"X-Idempotency-Key": true,
+}
+
+// validateHeaders checks extra headers of route or destination
+func validateHeaders(name string, headers map[string]string) error {
+	for k, v := range headers {
+		if k == "" || strings.ContainsAny(k, " :\r\n\t") || strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("Wrong header of %s: %q", name, k)
+		}
+		if reservedHeaders[http.CanonicalHeaderKey(k)] {
+			return fmt.Errorf("Header %s of %s is set by hooker", k, name)
+		}
+	}
+
+	return nil
+}
+
+// validateArchive checks what route does with delivered files
+func validateArchive(r route) error {
+	switch r.Archive {
+	case "", actionArchive, actionDelete, actionRetain:
+		return nil
+	}
+
+	return fmt.Errorf("Route %s archive must be archive, delete or retain: %s", r.Name, r.Archive)
+}
+
+// urls returns every destination URL of configuration
+func (c *config) urls() []string {
+	urls := []string{c.URL}
+	for _, d := range c.Destinations {
+		urls = append(urls, d.URL)
+	}
+	for _, r := range c.Routes {
+		urls = append(urls, r.URL)
+		for _, d := range r.Destinations {
+			urls = append(urls, d.URL)
+		}
+		if r.Canary != nil {
+			urls = append(urls, r.Canary.URL)
+		}
+	}
+
+	return urls
+}
+
+// validateURL checks destination URLs which are parsed before upload
+func validateURL(u string) error {
+	if u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") &&
+		!strings.HasPrefix(u, "s3://") && !strings.HasPrefix(u, "sftp://") {
+		return errors.New("URL must be http://, https://, s3:// or sftp://: " + u)
+	}
+	if strings.HasPrefix(u, "s3://") {
+		if _, err := parseS3URL(u); err != nil {
+			return err
+		}
+	}
+	if strings.HasPrefix(u, "sftp://") {
+		if _, err := parseSFTPURL(u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// configChange is a single value differing between configurations
+type configChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// effectiveConfig is configuration options are running with,
+// flags and configuration file merged together
+func (o options) effectiveConfig() config {
+	return config{
+		Patterns:      splitPatterns(o.patterns, o.separator),
+		Exclude:       splitPatterns(o.exclude, o.separator),
+		URL:           o.url,
+		Token:         o.token,
+		Interval:      o.interval,
+		CheckInterval: o.checkInterval,
+		Timeout:       o.timeout,
+		Routes:        o.routes,
+		Pins:          o.pins,
+		Schemas:       o.schemas,
+		Transforms:    o.transforms,
+		Sheets:        o.sheets,
+		Validate:      o.validateCommand,
+		Destinations:  o.destinations,
+	}
+}
+
+// flattenConfig turns configuration into path to value map, list items
+// having name are keyed by it so reordering routes is not a change
+// and tokens are replaced by marker telling whether they are set
+func flattenConfig(prefix string, v interface{}, out map[string]interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if k == "token" || strings.HasSuffix(prefix, ".headers") {
+				if s, _ := item.(string); s != "" {
+					item = redactedToken(s)
+				}
+			}
+			flattenConfig(prefix+"."+k, item, out)
+		}
+	case []interface{}:
+		named := true
+		for _, item := range v {
+			m, ok := item.(map[string]interface{})
+			if !ok || m["name"] == nil || m["name"] == "" {
+				named = false
+				break
+			}
+		}
+		if !named {
+			out[prefix] = v
+			return
+		}
+		for _, item := range v {
+			flattenConfig(fmt.Sprintf("%s[%s]", prefix, item.(map[string]interface{})["name"]), item, out)
+		}
+	default:
+		out[prefix] = v
+	}
+}
+
+// redactedToken shows only that token is set and whether it
+// changed, short prefix of its hash tells different tokens apart
+func redactedToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "<redacted " + hex.EncodeToString(sum[:4]) + ">"
+}
+
+// diffConfig lists values changed between configurations
+func diffConfig(running, candidate config) ([]configChange, error) {
+	flat := [2]map[string]interface{}{{}, {}}
+	for i, cfg := range []config{running, candidate} {
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		flattenConfig("", v, flat[i])
+	}
+
+	paths := map[string]bool{}
+	for _, m := range flat {
+		for p := range m {
+			paths[p] = true
+		}
+	}
+
+	changes := []configChange{}
+	for p := range paths {
+		old, _ := json.Marshal(flat[0][p])
+		changed, _ := json.Marshal(flat[1][p])
+		if string(old) != string(changed) {
+			changes = append(changes, configChange{Path: strings.TrimPrefix(p, "."), Old: flat[0][p], New: flat[1][p]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+
+	return changes, nil
+}
+
+// handleConfigValidate serves POST /config/validate, candidate configuration
+// is validated and compared with running one without being applied
+func (c *controller) handleConfigValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := c.admin.require(w, r, roleAdmin); !ok {
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	invalid := func(err error) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]interface{}{
+			"valid": false,
+			"error": err.Error(),
+		})
+	}
+
+	cfg, err := parseConfig(data)
+	if err != nil {
+		invalid(err)
+		return
+	}
+
+	candidate, err := c.base.withConfig(cfg)
+	if err != nil {
+		invalid(err)
+		return
+	}
+
+	changes, err := diffConfig(c.opts().effectiveConfig(), candidate.effectiveConfig())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"valid":   true,
+		"changes": changes,
+	})
+}
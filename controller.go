@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,24 +16,94 @@ import (
 )
 
 type controller struct {
-	mu      sync.Mutex
-	files   map[string]chan struct{}
-	dirlist []os.FileInfo
-	options options
+	mu        sync.Mutex
+	files     map[string]chan struct{}
+	held      map[string]heldFile
+	queued    map[string]bool
+	retries   map[string]retryState
+	progress  map[string]*fileProgress
+	cancels   map[string]context.CancelCauseFunc
+	workers   int
+	busy      int
+	waiters   []*waiter
+	dirlist   []os.FileInfo
+	optsMu    sync.RWMutex
+	options   options
+	base      options
+	admin     *admin
+	source    *health
+	journal   *journal
+	clock     *clock
+	memory    *memoryGuard
+	workspace *workspace
+	stopping  bool
+	pausedAt  time.Time
+	// paused is closed when processing is paused
+	paused chan struct{}
+	// archiveSize is size of dated archives as of last retention run
+	archiveSize int64
+	closed      *completions
+	// changes is set when change journal tells what is new in directory
+	changes  *changeSet
+	stats    *statCache
+	skips    *skipList
+	proofKey signer
+	sessions *uploadSessions
+	prom     *promMetrics
+	slo      *sloTracker
+	shadow   *shadowLog
+	limits   *bodyLimits
 }
 
-func newController(opts options) *controller {
-	return &controller{
-		files:   make(map[string]chan struct{}),
-		options: opts,
+func newController(opts options, a *admin, j *journal, ws *workspace, s *skipList) *controller {
+	c := &controller{
+		files:     make(map[string]chan struct{}),
+		held:      make(map[string]heldFile),
+		queued:    make(map[string]bool),
+		retries:   make(map[string]retryState),
+		progress:  make(map[string]*fileProgress),
+		cancels:   make(map[string]context.CancelCauseFunc),
+		paused:    make(chan struct{}),
+		options:   opts,
+		admin:     a,
+		source:    newHealth(),
+		journal:   j,
+		workspace: ws,
+		stats:     newStatCache(),
+		skips:     s,
+		sessions:  newUploadSessions(),
+		prom:      newPromMetrics(),
+		slo:       newSLOTracker(),
+		shadow:    newShadowLog(opts.shadowLog),
+		limits:    newBodyLimits(),
+		workers:   opts.workers,
 	}
+
+	return c
+}
+
+// opts returns current options, which may
+// change when configuration is reloaded
+func (c *controller) opts() options {
+	c.optsMu.RLock()
+	defer c.optsMu.RUnlock()
+
+	return c.options
+}
+
+func (c *controller) setOptions(opts options) {
+	c.optsMu.Lock()
+	defer c.optsMu.Unlock()
+
+	c.options = opts
 }
 
 func (c *controller) watch() {
 	for {
 		c.mu.Lock()
-		metrics.Send("files", metrics.M{
+		sendMetrics("files", metrics.M{
 			"in_work": len(c.files),
+			"queued":  len(c.queued),
 		}, nil)
 		c.mu.Unlock()
 
@@ -37,30 +111,118 @@ func (c *controller) watch() {
 	}
 }
 
-func (c *controller) filesInWork() []string {
+func (c *controller) filesInDir() []string {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	files := []string{}
-	for file := range c.files {
+	for _, file := range c.dirlist {
+		files = append(files, file.Name())
+	}
+
+	return files
+}
+
+func (c *controller) filesHeld() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files := []string{}
+	for file := range c.held {
 		files = append(files, file)
 	}
 
 	return files
 }
 
-func (c *controller) filesInDir() []string {
+// heldFile is file staged until operator decides on it
+type heldFile struct {
+	decision chan bool
+	sha256   string
+}
+
+// hold registers file as staged and returns channel
+// which receives operator decision: true to send, false to delete
+func (c *controller) hold(name, sha256 string) chan bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan bool, 1)
+	c.held[name] = heldFile{decision: ch, sha256: sha256}
+
+	return ch
+}
+
+func (c *controller) decide(name string, send bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.held[name]
+	if !ok {
+		return false
+	}
+
+	f.decision <- send
+	delete(c.held, name)
+
+	return true
+}
+
+// unhold forgets held file which left without decision
+func (c *controller) unhold(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.held, name)
+}
+
+func (c *controller) release(name string) bool {
+	return c.decide(name, true)
+}
+
+func (c *controller) drop(name string) bool {
+	return c.decide(name, false)
+}
+
+func (c *controller) releaseAll() []string {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	files := []string{}
-	for _, file := range c.dirlist {
-		files = append(files, file.Name())
+	for name, f := range c.held {
+		f.decision <- true
+		delete(c.held, name)
+		files = append(files, name)
 	}
 
 	return files
 }
 
+// heldFingerprint is four-eyes approval subject of file, "*" stands for
+// every held one. Held files are identified by content, others by
+// size and modification time
+func (c *controller) heldFingerprint(name string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	items := []string{}
+	for n, f := range c.held {
+		if name == "*" || n == name {
+			items = append(items, n+"\x00"+f.sha256)
+		}
+	}
+
+	if name != "*" && len(items) == 0 {
+		for _, fi := range c.dirlist {
+			if fi.Name() == name {
+				items = append(items, fmt.Sprintf("%s\x00%d\x00%d", name, fi.Size(), fi.ModTime().UnixNano()))
+			}
+		}
+	}
+
+	return fingerprint(items)
+}
+
 func (c *controller) setDirectoryListing(list []os.FileInfo) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -70,10 +232,28 @@ func (c *controller) setDirectoryListing(list []os.FileInfo) {
 
 func (c *controller) serve() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		data, err := json.Marshal(map[string]interface{}{
-			"dir_files":     c.filesInDir(),
-			"working_files": c.filesInWork(),
-		})
+		if _, ok := c.admin.require(w, r, roleRead); !ok {
+			return
+		}
+
+		status := map[string]interface{}{
+			"dir_files":      c.filesInDir(),
+			"working_files":  c.filesInWork(),
+			"held_files":     c.filesHeld(),
+			"queued_files":   c.filesQueued(),
+			"queue_depth":    len(c.filesQueued()),
+			"retrying_files": c.filesRetrying(),
+			"source":         c.source.status(),
+			"control":        c.pauseStatus(),
+		}
+		if c.clock != nil {
+			status["clock"] = c.clock.status()
+		}
+		if c.memory != nil {
+			status["memory"] = c.memory.status()
+		}
+
+		data, err := json.Marshal(status)
 
 		if err != nil {
 			http.Error(w, "JSON marshalling error", http.StatusInternalServerError)
@@ -83,26 +263,253 @@ func (c *controller) serve() {
 		w.Write(data)
 	})
 
-	http.ListenAndServe(c.options.listen, nil)
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if c.source.degraded() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"source": c.source.status(),
+		})
+	})
+
+	http.HandleFunc("/quarantine", c.handleQuarantine)
+	http.HandleFunc("/deadletter", c.handleDeadLetter)
+	http.HandleFunc("/deadletter/", c.handleDeadLetter)
+	http.HandleFunc("/metrics", c.handleMetrics)
+	http.HandleFunc("/metrics/catalog", c.handleMetricsCatalog)
+	http.HandleFunc("/slo", c.handleSLO)
+	http.HandleFunc("/shadow", c.handleShadow)
+	http.HandleFunc("/history", c.handleHistory)
+	http.HandleFunc("/files", c.handleFiles)
+	http.HandleFunc("/state", c.handleState)
+	http.HandleFunc("/support-bundle", c.handleSupportBundle)
+	http.HandleFunc("/reload", c.handleReload)
+	http.HandleFunc("/config/validate", c.handleConfigValidate)
+	http.HandleFunc("/pause", c.handlePause)
+	http.HandleFunc("/resume", c.handlePause)
+	http.HandleFunc("/pipeline", c.handlePipeline)
+	http.HandleFunc("/skipped", c.handleSkipped)
+	http.HandleFunc("/debug/patterns", c.handlePatterns)
+	http.HandleFunc("/version", c.handleVersion)
+	http.HandleFunc("/proofs/", c.handleProof)
+
+	// POST /files/release releases every held file,
+	// POST /files/{name}/release releases a single one,
+	// POST /files/retry moves quarantined files back,
+	// DELETE /files/{name} deletes a held file or one waiting
+	// to be uploaded or retried without sending
+	http.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/files/")
+
+		switch {
+		case r.Method == http.MethodPost && name == "retry":
+			p, ok := c.admin.require(w, r, roleOperator)
+			if !ok {
+				return
+			}
+
+			if c.opts().readOnly {
+				http.Error(w, "Source is read-only", http.StatusConflict)
+				return
+			}
+
+			f, err := parseFilter(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			retried, conflicts, err := c.retryQuarantined(f)
+			c.admin.audit.record("retry", r.URL.RawQuery, []string{p.name},
+				fmt.Sprintf("retried %d files, %d already exist in watched directory", len(retried), len(conflicts)))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			writeJSON(w, map[string]interface{}{
+				"retried":   retried,
+				"conflicts": conflicts,
+			})
+
+		case r.Method == http.MethodPost && name == "release":
+			identities, ok := c.admin.authorize(w, r, roleOperator, "release", "*", c.heldFingerprint("*"))
+			if !ok {
+				return
+			}
+
+			released := c.releaseAll()
+			c.admin.audit.record("release", "*", identities, fmt.Sprintf("released %d files", len(released)))
+			writeJSON(w, map[string]interface{}{
+				"released": released,
+			})
+
+		case r.Method == http.MethodPost && strings.HasSuffix(name, "/release"):
+			name = strings.TrimSuffix(name, "/release")
+			identities, ok := c.admin.authorize(w, r, roleOperator, "release", name, c.heldFingerprint(name))
+			if !ok {
+				return
+			}
+
+			if !c.release(name) {
+				c.admin.audit.record("release", name, identities, "not held")
+				http.Error(w, "File is not held", http.StatusNotFound)
+				return
+			}
+
+			c.admin.audit.record("release", name, identities, "released")
+			writeJSON(w, map[string]interface{}{
+				"released": []string{name},
+			})
+
+		case r.Method == http.MethodDelete && name != "":
+			if c.opts().readOnly {
+				http.Error(w, "Source is read-only", http.StatusConflict)
+				return
+			}
+
+			identities, ok := c.admin.authorize(w, r, roleAdmin, "delete", name, c.heldFingerprint(name))
+			if !ok {
+				return
+			}
+
+			if !c.drop(name) {
+				found, interrupted := c.interrupt(name, errDeleted)
+				if !found {
+					c.admin.audit.record("delete", name, identities, "not in work")
+					http.Error(w, "File is not held or in work", http.StatusNotFound)
+					return
+				}
+				if !interrupted {
+					c.admin.audit.record("delete", name, identities, "being uploaded")
+					http.Error(w, "File is being uploaded", http.StatusConflict)
+					return
+				}
+			}
+
+			c.admin.audit.record("delete", name, identities, "deleted")
+			writeJSON(w, map[string]interface{}{
+				"deleted": []string{name},
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	var handler http.Handler = http.DefaultServeMux
+	if c.opts().csrf {
+		handler = csrf(handler)
+	}
+	if c.opts().corsOrigins != "" {
+		handler = cors(c.opts().corsOrigins, handler)
+	}
+	proxies, _ := parseProxies(c.opts().trustedProxies, c.opts().separator)
+	if c.opts().rateLimit > 0 {
+		handler = newRateLimiter(c.opts().rateLimit, c.opts().rateBurst, proxies).wrap(handler)
+	}
+	handler = accessLog(c.admin, proxies, handler)
+
+	http.ListenAndServe(c.opts().listen, handler)
+}
+
+func (c *controller) spawn(file os.FileInfo, opts options) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.files[file.Name()]; ok || c.stopping || !c.pausedAt.IsZero() || c.resendPending(file.Name()) {
+		return
+	}
+
+	if !c.memory.admit() {
+		if c.opts().verbose {
+			log.Printf("Memory limit is close, postponing file %s\n", file.Name())
+		}
+
+		return
+	}
+
+	if (c.opts().readOnly && c.journal.delivered(file.Name(), file.Size(), file.ModTime())) ||
+		c.journal.retained(file.Name(), file.Size(), file.ModTime()) {
+		if c.opts().verbose {
+			log.Printf("File %s was already delivered, skipping\n", file.Name())
+		}
+
+		return
+	}
+
+	ch := make(chan struct{})
+	c.files[file.Name()] = ch
+	c.track(file.Name())
+	c.prom.inc(c.prom.discovered, "")
+	parser := newParser(file, ch, opts, c)
+	ctx, cancel := c.watchContext(file.Name())
+	parser.ctx = ctx
+	go c.work(ctx, file.Name(), opts.priority, ch, parser.parse)
+
+	go func(ch chan struct{}, name string, cc *controller) {
+		<-ch
+		c.mu.Lock()
+		delete(cc.files, name)
+		delete(cc.progress, name)
+		delete(cc.cancels, name)
+		c.mu.Unlock()
+		cancel(nil)
+	}(ch, file.Name(), c)
 }
 
-func (c *controller) spawn(file os.FileInfo) {
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "JSON marshalling error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(data)
+}
+
+func (c *controller) spawnBatch(file os.FileInfo, m *manifest, opts options) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if _, ok := c.files[file.Name()]; ok {
+	if _, ok := c.files[file.Name()]; ok || c.stopping || !c.pausedAt.IsZero() {
+		return
+	}
+	for _, f := range m.Files {
+		if c.resendPending(sameDir(file.Name(), f.Name)) {
+			return
+		}
+	}
+
+	if !c.memory.admit() {
+		return
+	}
+
+	if opts.readOnly && c.batchDelivered(file, m, opts) {
+		if opts.verbose {
+			log.Printf("Batch %s was already delivered, skipping\n", file.Name())
+		}
+
 		return
 	}
 
 	ch := make(chan struct{})
 	c.files[file.Name()] = ch
-	parser := newParser(file, ch, c.options)
-	go parser.parse()
+	c.track(file.Name())
+	c.prom.inc(c.prom.discovered, "")
+	b := newBatch(file, m, ch, opts, c)
+	ctx, cancel := c.watchContext(file.Name())
+	b.ctx = ctx
+	go c.work(ctx, file.Name(), opts.priority, ch, b.process)
 
 	go func(ch chan struct{}, name string, cc *controller) {
 		<-ch
 		c.mu.Lock()
 		delete(cc.files, name)
+		delete(cc.progress, name)
+		delete(cc.cancels, name)
 		c.mu.Unlock()
+		cancel(nil)
 	}(ch, file.Name(), c)
 }
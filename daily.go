@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/getsentry/raven-go"
+)
+
+type deliveredFile struct {
+	Name  string `json:"name"`
+	Route string `json:"route,omitempty"`
+	// Destination is set for files sent to several destinations
+	Destination string    `json:"destination,omitempty"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	SentAt      time.Time `json:"sent_at"`
+}
+
+// dailyManifest lists every file delivered during a day with Merkle
+// root over their hashes, signature covers JSON encoding of manifest
+// with empty signature field
+type dailyManifest struct {
+	Date       string          `json:"date"`
+	Count      int             `json:"count"`
+	Files      []deliveredFile `json:"files"`
+	MerkleRoot string          `json:"merkle_root"`
+	Hooker     string          `json:"hooker_version"`
+	Algorithm  string          `json:"algorithm,omitempty"`
+	PublicKey  string          `json:"public_key,omitempty"`
+	Signature  string          `json:"signature,omitempty"`
+}
+
+// buildDailyManifest collects files delivered or retained
+// by API during UTC day from journal entries
+func buildDailyManifest(entries []journalEntry, day time.Time) *dailyManifest {
+	from := day.UTC().Truncate(24 * time.Hour)
+	to := from.Add(24 * time.Hour)
+
+	m := &dailyManifest{
+		Date:   from.Format("2006-01-02"),
+		Files:  []deliveredFile{},
+		Hooker: version,
+	}
+
+	for _, e := range entries {
+		if e.State != stateDelivered && e.State != stateRetained {
+			continue
+		}
+		if e.SentAt.Before(from) || !e.SentAt.Before(to) {
+			continue
+		}
+
+		m.Files = append(m.Files, deliveredFile{
+			Name:        e.Name,
+			Route:       e.Route,
+			Destination: e.Destination,
+			Size:        e.Size,
+			SHA256:      e.SHA256,
+			SentAt:      e.SentAt.UTC(),
+		})
+	}
+
+	sort.SliceStable(m.Files, func(i, j int) bool {
+		return m.Files[i].SentAt.Before(m.Files[j].SentAt)
+	})
+
+	hashes := []string{}
+	for _, f := range m.Files {
+		hashes = append(hashes, f.SHA256)
+	}
+	m.Count = len(m.Files)
+	m.MerkleRoot = merkleRoot(hashes)
+
+	return m
+}
+
+// merkleRoot builds Merkle tree over file hashes in given order, leaf
+// is SHA-256(0x00 || hash), node is SHA-256(0x01 || left || right)
+// and last node of odd level is promoted as is
+func merkleRoot(hashes []string) string {
+	level := [][]byte{}
+	for _, h := range hashes {
+		raw, _ := hex.DecodeString(h)
+		sum := sha256.Sum256(append([]byte{0}, raw...))
+		level = append(level, sum[:])
+	}
+
+	if len(level) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+
+	for len(level) > 1 {
+		next := [][]byte{}
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+
+			node := append([]byte{1}, level[i]...)
+			sum := sha256.Sum256(append(node, level[i+1]...))
+			next = append(next, sum[:])
+		}
+		level = next
+	}
+
+	return hex.EncodeToString(level[0])
+}
+
+func (m *dailyManifest) encode(key signer) ([]byte, error) {
+	if key != nil {
+		m.Algorithm = key.algorithm()
+		m.PublicKey = key.publicKey()
+		m.Signature = ""
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+
+		signature, err := key.sign(data)
+		if err != nil {
+			return nil, err
+		}
+		m.Signature = base64.StdEncoding.EncodeToString(signature)
+	}
+
+	return json.MarshalIndent(m, "", "    ")
+}
+
+// publishDailyManifest stores manifest into directory, s3://bucket/prefix
+// location or posts it to http(s) URL with access token
+func publishDailyManifest(opts options, name string, data []byte) error {
+	dest := opts.dailyManifest
+
+	switch {
+	case strings.HasPrefix(dest, "s3://"):
+		loc, err := parseS3URL(dest)
+		if err != nil {
+			return err
+		}
+
+		return newS3Client(time.Second*time.Duration(opts.timeout)).put(loc.bucket, loc.key(name), data, map[string]string{
+			"Content-Type": "application/json",
+		})
+
+	case strings.HasPrefix(dest, "http://") || strings.HasPrefix(dest, "https://"):
+		req, err := http.NewRequest(http.MethodPost, dest, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Access-Token", opts.token)
+		req.Header.Set("X-File-Name", name)
+
+		client := http.Client{Timeout: time.Second * time.Duration(opts.timeout)}
+		response, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode/100 != 2 {
+			return &httpStatusError{Code: response.StatusCode, Body: truncate(readResponse(response.Body))}
+		}
+
+		return nil
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	tmp := path.Join(dest, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path.Join(dest, name))
+}
+
+// publishDay builds, signs and publishes manifest of given day
+func (c *controller) publishDay(day time.Time) error {
+	m := buildDailyManifest(c.journal.all(), day)
+
+	data, err := m.encode(c.proofKey)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("deliveries-%s.json", m.Date)
+	if err := publishDailyManifest(c.opts(), name, data); err != nil {
+		return err
+	}
+
+	log.Printf("[MANIFEST] Published %s with %d files, merkle root %s\n", name, m.Count, m.MerkleRoot)
+	return nil
+}
+
+// watchDays publishes manifest of every finished UTC day
+func (c *controller) watchDays(check time.Duration) {
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+
+	for {
+		time.Sleep(check)
+
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		if !today.After(day) {
+			continue
+		}
+
+		if err := c.publishDay(day); err != nil {
+			raven.CaptureErrorAndWait(err, map[string]string{
+				"day": day.Format("2006-01-02"),
+			})
+
+			log.Printf("[MANIFEST] Error publishing manifest of %s: %s\n", day.Format("2006-01-02"), err)
+			continue
+		}
+
+		day = today
+	}
+}
+
+// manifestCommand implements "hooker manifest" printing manifest
+// of given day built from journal, e.g. to backfill missed days
+func manifestCommand(args []string) {
+	fs := flag.NewFlagSet("manifest", flag.ExitOnError)
+	journalPath := fs.String("journal", "", "Journal file of delivered files")
+	date := fs.String("date", time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02"), "UTC day to build manifest of")
+	keyPath := fs.String("proof-key", "", "Ed25519 private key (PKCS#8 PEM) or awskms://, gcpkms://, vault:// key to sign manifest with")
+	fs.Parse(args)
+
+	if *journalPath == "" {
+		log.Fatalln("Journal file is not set")
+	}
+
+	j, err := openJournal(*journalPath)
+	if err != nil {
+		log.Fatalf("Journal loading error: %s\n", err)
+	}
+
+	day, err := time.Parse("2006-01-02", *date)
+	if err != nil {
+		log.Fatalf("Wrong date %s, expected YYYY-MM-DD\n", *date)
+	}
+
+	var key signer
+	if *keyPath != "" {
+		if key, err = loadSigner(*keyPath, 30*time.Second); err != nil {
+			log.Fatalf("Proof key loading error: %s\n", err)
+		}
+	}
+
+	data, err := buildDailyManifest(j.all(), day).encode(key)
+	if err != nil {
+		log.Fatalf("Manifest encoding error: %s\n", err)
+	}
+
+	os.Stdout.Write(append(data, '\n'))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// grafanaTarget is PromQL query of a panel
+type grafanaTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	RefID        string `json:"refId"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Datasource  map[string]string      `json:"datasource,omitempty"`
+	GridPos     grafanaGridPos         `json:"gridPos"`
+	Targets     []grafanaTarget        `json:"targets,omitempty"`
+	FieldConfig map[string]interface{} `json:"fieldConfig,omitempty"`
+	Panels      []grafanaPanel         `json:"panels"`
+}
+
+type grafanaVariable struct {
+	Name       string            `json:"name"`
+	Label      string            `json:"label"`
+	Type       string            `json:"type"`
+	Query      string            `json:"query"`
+	Datasource map[string]string `json:"datasource,omitempty"`
+	Multi      bool              `json:"multi"`
+	IncludeAll bool              `json:"includeAll"`
+	Refresh    int               `json:"refresh,omitempty"`
+}
+
+type grafanaDashboard struct {
+	Title         string                 `json:"title"`
+	UID           string                 `json:"uid"`
+	Tags          []string               `json:"tags"`
+	Timezone      string                 `json:"timezone"`
+	SchemaVersion int                    `json:"schemaVersion"`
+	Refresh       string                 `json:"refresh"`
+	Time          map[string]string      `json:"time"`
+	Templating    map[string]interface{} `json:"templating"`
+	Panels        []grafanaPanel         `json:"panels"`
+}
+
+// dashboardBuilder lays out panels in rows of two
+type dashboardBuilder struct {
+	panels []grafanaPanel
+	id     int
+	y      int
+	x      int
+}
+
+var grafanaDatasource = map[string]string{"type": "prometheus", "uid": "${datasource}"}
+
+func (b *dashboardBuilder) row(title string) {
+	if b.x > 0 {
+		b.x, b.y = 0, b.y+8
+	}
+
+	b.id++
+	b.panels = append(b.panels, grafanaPanel{
+		ID:      b.id,
+		Type:    "row",
+		Title:   title,
+		GridPos: grafanaGridPos{H: 1, W: 24, X: 0, Y: b.y},
+		Panels:  []grafanaPanel{},
+	})
+	b.y++
+}
+
+// panel adds time series panel, queries are given as expr and legend pairs
+func (b *dashboardBuilder) panel(title, unit string, queries ...string) {
+	b.id++
+	p := grafanaPanel{
+		ID:         b.id,
+		Type:       "timeseries",
+		Title:      title,
+		Datasource: grafanaDatasource,
+		GridPos:    grafanaGridPos{H: 8, W: 12, X: b.x, Y: b.y},
+		FieldConfig: map[string]interface{}{
+			"defaults":  map[string]interface{}{"unit": unit},
+			"overrides": []interface{}{},
+		},
+		Panels: []grafanaPanel{},
+	}
+	for i := 0; i+1 < len(queries); i += 2 {
+		p.Targets = append(p.Targets, grafanaTarget{
+			Expr:         queries[i],
+			LegendFormat: queries[i+1],
+			RefID:        string(rune('A' + i/2)),
+		})
+	}
+	b.panels = append(b.panels, p)
+
+	if b.x == 0 {
+		b.x = 12
+	} else {
+		b.x, b.y = 0, b.y+8
+	}
+}
+
+// promSelector is label selector limiting query to chosen instances
+func promSelector(labels ...string) string {
+	return "{" + strings.Join(append([]string{`instance=~"$instance"`}, labels...), ",") + "}"
+}
+
+// buildDashboard makes Grafana dashboard of hooker Prometheus
+// metrics, routes with SLO get their own compliance panels
+func buildDashboard(title string, routes []route, instances []string) grafanaDashboard {
+	b := &dashboardBuilder{}
+	s := promSelector()
+
+	b.row("Files")
+	b.panel("Discovered and sent", "ops",
+		"sum(rate(hooker_files_discovered_total"+s+"[5m]))", "discovered",
+		"sum by (destination) (rate(hooker_files_sent_total"+s+"[5m]))", "sent {{destination}}")
+	b.panel("Queue", "short",
+		"sum(hooker_queue_depth"+s+")", "queued",
+		"sum(hooker_files_in_work"+s+")", "in work",
+		"sum(hooker_files_held"+s+")", "held",
+		"sum(hooker_files_retrying"+s+")", "retrying")
+	b.panel("Quarantined and dead-lettered", "short",
+		"sum(increase(hooker_files_quarantined_total"+s+"[1h]))", "quarantined",
+		"sum(increase(hooker_files_dead_lettered_total"+s+"[1h]))", "dead-lettered")
+	b.panel("Dropped metrics", "short",
+		"sum by (instance) (hooker_metrics_dropped"+s+")", "{{instance}}")
+
+	b.row("Uploads")
+	b.panel("Failures by kind", "ops",
+		"sum by (kind) (rate(hooker_send_failures_total"+s+"[5m]))", "{{kind}}")
+	b.panel("Failures by phase", "ops",
+		"sum by (phase) (rate(hooker_send_failure_phases_total"+s+"[5m]))", "{{phase}}")
+	b.panel("Retries", "ops",
+		"sum by (destination) (rate(hooker_send_retries_total"+s+"[5m]))", "{{destination}}")
+	b.panel("Upload duration", "s",
+		"histogram_quantile(0.5, sum by (le) (rate(hooker_upload_duration_seconds_bucket"+s+"[5m])))", "p50",
+		"histogram_quantile(0.95, sum by (le) (rate(hooker_upload_duration_seconds_bucket"+s+"[5m])))", "p95",
+		"histogram_quantile(0.99, sum by (le) (rate(hooker_upload_duration_seconds_bucket"+s+"[5m])))", "p99")
+	b.panel("Payload size", "bytes",
+		"histogram_quantile(0.5, sum by (le) (rate(hooker_payload_size_bytes_bucket"+s+"[5m])))", "p50",
+		"histogram_quantile(0.95, sum by (le) (rate(hooker_payload_size_bytes_bucket"+s+"[5m])))", "p95")
+	b.panel("Throughput", "Bps",
+		"sum(rate(hooker_payload_size_bytes_sum"+s+"[5m]))", "bytes")
+
+	for _, r := range routes {
+		if r.SLO == nil {
+			continue
+		}
+
+		rs := promSelector("route=" + strconv.Quote(r.Name))
+		b.row(fmt.Sprintf("SLO: %s (%g%% within %ds)", r.Name, r.SLO.Objective, r.SLO.Latency))
+		b.panel("Compliance", "percent",
+			"min(hooker_slo_compliance_percent"+rs+")", "compliance",
+			"min(hooker_slo_budget_remaining_percent"+rs+")", "budget remaining")
+		b.panel("Burn rate", "short",
+			"max by (window) (hooker_slo_burn_rate"+rs+")", "{{window}}")
+	}
+
+	for _, r := range routes {
+		if r.Canary == nil {
+			continue
+		}
+
+		rs := promSelector("route=" + strconv.Quote(r.Name))
+		b.row(fmt.Sprintf("Canary: %s (%g%% to %s)", r.Name, r.Canary.Percent, redactURL(r.Canary.URL)))
+		b.panel("Success rate", "percentunit",
+			"sum by (variant) (rate(hooker_canary_files_total"+promSelector("route="+strconv.Quote(r.Name), `result="delivered"`)+"[5m]))"+
+				" / sum by (variant) (rate(hooker_canary_files_total"+rs+"[5m]))", "{{variant}}")
+		b.panel("Average upload duration", "s",
+			"sum by (variant) (rate(hooker_canary_upload_seconds_total"+rs+"[5m]))"+
+				" / sum by (variant) (rate(hooker_canary_files_total"+rs+"[5m]))", "{{variant}}")
+	}
+
+	instance := grafanaVariable{
+		Name:       "instance",
+		Label:      "Instance",
+		Type:       "query",
+		Query:      "label_values(hooker_files_discovered_total, instance)",
+		Datasource: grafanaDatasource,
+		Multi:      true,
+		IncludeAll: true,
+		Refresh:    2,
+	}
+	if len(instances) > 0 {
+		instance.Type, instance.Query, instance.Datasource, instance.Refresh = "custom", strings.Join(instances, ","), nil, 0
+	}
+
+	return grafanaDashboard{
+		Title:         title,
+		UID:           "hooker",
+		Tags:          []string{"hooker"},
+		Timezone:      "browser",
+		SchemaVersion: 39,
+		Refresh:       "30s",
+		Time:          map[string]string{"from": "now-6h", "to": "now"},
+		Templating: map[string]interface{}{
+			"list": []grafanaVariable{
+				{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+				instance,
+			},
+		},
+		Panels: b.panels,
+	}
+}
+
+func dashboardsCommand(args []string) {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Println("Usage: hooker dashboards export [-config <file>] [-instances <host:port,...>] [-file <dashboard.json>]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("dashboards export", flag.ExitOnError)
+	configPath := fs.String("config", "", "JSON configuration file with routes")
+	instances := fs.String("instances", "", "Prometheus instance labels of hooker (separated by: ,), empty lists scraped ones")
+	title := fs.String("title", "Hooker", "Dashboard title")
+	file := fs.String("file", "-", "Dashboard file (- for stdout)")
+	fs.Parse(args[1:])
+
+	routes := []route{}
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Configuration loading error: %s\n", err)
+		}
+		if err := cfg.validate(); err != nil {
+			log.Fatalf("Configuration error: %s\n", err)
+		}
+		routes = cfg.Routes
+	}
+
+	list := []string{}
+	for _, i := range strings.Split(*instances, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			list = append(list, i)
+		}
+	}
+
+	data, err := json.MarshalIndent(buildDashboard(*title, routes, list), "", "  ")
+	if err != nil {
+		log.Fatalf("Dashboard marshalling error: %s\n", err)
+	}
+
+	if *file == "-" {
+		os.Stdout.Write(append(data, '\n'))
+		return
+	}
+
+	if err := ioutil.WriteFile(*file, data, 0644); err != nil {
+		log.Fatalf("Dashboard writing error: %s\n", err)
+	}
+
+	log.Printf("Dashboard written to %s\n", *file)
+}
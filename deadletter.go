@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metrics "github.com/cryptopay-dev/go-metrics"
+	"github.com/getsentry/raven-go"
+)
+
+// deadLetterSuffix is appended to name of
+// sidecar describing dead-lettered file
+const deadLetterSuffix = ".deadletter.json"
+
+// deadLetter is sidecar written next to file
+// which could not be delivered after all retries
+type deadLetter struct {
+	// File is name relative to watched directory
+	// file is moved back to on retry
+	File           string    `json:"file"`
+	Route          string    `json:"route,omitempty"`
+	Destination    string    `json:"destination,omitempty"`
+	Size           int64     `json:"size"`
+	Error          string    `json:"error"`
+	Kind           string    `json:"kind,omitempty"`
+	Attempts       int       `json:"attempts"`
+	FirstAttemptAt time.Time `json:"first_attempt_at"`
+	LastAttemptAt  time.Time `json:"last_attempt_at"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+}
+
+// setAside moves failed file out of watched directory, files
+// which ran out of upload attempts go to dead-letter directory
+// and everything else to quarantine
+func (p *parser) setAside(filePath string, reason error, companions ...string) {
+	var exhausted *exhaustedError
+	if errors.As(reason, &exhausted) {
+		p.deadLetter(filePath, exhausted, companions...)
+		return
+	}
+
+	p.quarantine(filePath, reason, companions...)
+}
+
+// deadLetter moves file with its companions to dead-letter
+// directory and writes sidecar with last error next to it
+func (p *parser) deadLetter(filePath string, reason *exhaustedError, companions ...string) {
+	log.Printf("[FILE: %s] Giving up after %d attempts, moving file to dead-letter directory\n", p.prefix, reason.Attempts)
+
+	raven.CaptureMessage("File dead-lettered", errorTags(reason))
+
+	sendMetrics("files", metrics.M{
+		"dead_lettered": true,
+	}, nil)
+	p.controller.prom.inc(p.controller.prom.deadLettered, "")
+	p.observeSLO(false)
+
+	if p.options.readOnly {
+		log.Printf("[FILE: %s] Read-only source, leaving file in place\n", p.prefix)
+		if fi, err := os.Stat(filePath); err == nil {
+			p.controller.skips.add(relFileInfo{FileInfo: fi, name: p.file.Name()}, p.options.route, skipDeadLettered, "")
+		}
+		return
+	}
+
+	for _, src := range append([]string{filePath}, companions...) {
+		dst := p.options.deadLetterPath(src)
+		if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+			raven.CaptureErrorAndWait(err, map[string]string{
+				"file": filePath,
+			})
+
+			log.Printf("[FILE: %s] Error creating dead-letter directory: %s\n", p.prefix, err)
+			return
+		}
+
+		if err := moveFile(src, dst); err != nil {
+			raven.CaptureErrorAndWait(err, map[string]string{
+				"file": src,
+			})
+
+			log.Printf("[FILE: %s] Error moving %s to dead-letter directory: %s\n", p.prefix, src, err)
+			continue
+		}
+
+		log.Printf("[FILE: %s] Moved %s to %s\n", p.prefix, src, dst)
+	}
+
+	sidecar := deadLetter{
+		File:           p.file.Name(),
+		Route:          p.options.route,
+		Destination:    reason.Destination,
+		Size:           p.file.Size(),
+		Error:          reason.Error(),
+		Attempts:       reason.Attempts,
+		FirstAttemptAt: reason.FirstAttempt,
+		LastAttemptAt:  reason.LastAttempt,
+		DeadLetteredAt: time.Now(),
+	}
+	var se *stageError
+	if errors.As(reason, &se) && se.Kind != nil {
+		sidecar.Kind = se.Kind.Error()
+	}
+
+	data, err := json.MarshalIndent(sidecar, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(p.options.deadLetterPath(filePath)+deadLetterSuffix, data, 0644)
+	}
+	if err != nil {
+		raven.CaptureErrorAndWait(err, map[string]string{
+			"file": filePath,
+		})
+
+		log.Printf("[FILE: %s] Error writing dead-letter sidecar: %s\n", p.prefix, err)
+	}
+}
+
+// deadLetterPath keeps path of file relative to watched directory
+// under dead-letter one, like quarantinePath does
+func (o options) deadLetterPath(src string) string {
+	return o.setAsidePath(o.deadLetter, src)
+}
+
+// deadLettered lists files in dead-letter directory
+// matching filter together with their sidecars
+func (c *controller) deadLettered(f fileFilter) ([]os.FileInfo, map[string]deadLetter, error) {
+	return readDeadLetter(c.opts().deadLetter, f)
+}
+
+// readDeadLetter walks dead-letter directory and lists files with
+// their sidecars, named by their path relative to it
+func readDeadLetter(dir string, f fileFilter) ([]os.FileInfo, map[string]deadLetter, error) {
+	matched := []os.FileInfo{}
+	sidecars := map[string]deadLetter{}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), deadLetterSuffix) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		fi = relFileInfo{FileInfo: fi, name: filepath.ToSlash(rel)}
+		if !f.match(fi) {
+			return nil
+		}
+		matched = append(matched, fi)
+
+		data, err := ioutil.ReadFile(p + deadLetterSuffix)
+		if err != nil {
+			return nil
+		}
+		var d deadLetter
+		if json.Unmarshal(data, &d) == nil {
+			sidecars[fi.Name()] = d
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return matched, sidecars, nil
+}
+
+// redrive moves dead-lettered file with its checksum file back to
+// where it was taken from in watched directory and removes its
+// sidecar, so it is processed again with all retries available
+func redrive(deadLetterDir, dir, name string) ([]string, error) {
+	if name == "" || path.IsAbs(name) || path.Clean(name) != name || name == ".." ||
+		strings.HasPrefix(name, "../") || strings.HasSuffix(name, deadLetterSuffix) {
+		return nil, errors.New("Wrong file name: " + name)
+	}
+
+	src := path.Join(deadLetterDir, name)
+	if fi, err := os.Stat(src); err != nil {
+		return nil, err
+	} else if fi.IsDir() {
+		return nil, errors.New("Wrong file name: " + name)
+	}
+
+	sidecar := path.Join(deadLetterDir, name+deadLetterSuffix)
+	target := name
+	if data, err := ioutil.ReadFile(sidecar); err == nil {
+		var d deadLetter
+		if json.Unmarshal(data, &d) == nil && d.File != "" {
+			target = d.File
+		}
+	}
+
+	dst := path.Join(dir, target)
+	if _, err := os.Stat(dst); err == nil {
+		return nil, errors.New("File already exists in watched directory: " + target)
+	}
+
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return nil, err
+	}
+
+	// Checksum file goes back first so that file
+	// is not picked up without it with -checksums
+	moved := []string{}
+	for suffix := range checksumSuffixes {
+		if _, err := os.Stat(src + suffix); err != nil {
+			continue
+		}
+		if err := moveFile(src+suffix, dst+suffix); err != nil {
+			return moved, err
+		}
+		moved = append(moved, target+suffix)
+	}
+
+	if err := moveFile(src, dst); err != nil {
+		return moved, err
+	}
+	moved = append(moved, target)
+
+	if err := os.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+		return moved, err
+	}
+	removeEmptyDirs(deadLetterDir, src)
+
+	return moved, nil
+}
+
+// retryDeadLettered re-drives dead-lettered file, with read-only
+// source file stays in place and is only dropped from skip list
+func (c *controller) retryDeadLettered(name string) ([]string, error) {
+	opts := c.opts()
+	if opts.readOnly {
+		cleared := c.skips.clear(func(e skipEntry) bool {
+			return e.Name == name && e.Reason == skipDeadLettered
+		})
+		if len(cleared) == 0 {
+			return nil, os.ErrNotExist
+		}
+
+		return cleared, nil
+	}
+
+	return redrive(opts.deadLetter, opts.dir, name)
+}
+
+// deadLetterCommand is "hooker deadletter retry" moving dead-lettered
+// files back into watched directory without admin API
+func deadLetterCommand(args []string) {
+	if len(args) == 0 || args[0] != "retry" {
+		fmt.Println("Usage: hooker deadletter retry -dir <dir> -dead-letter <dir> <file>...")
+		os.Exit(2)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Getwd() error: %s\n", err)
+	}
+
+	fs := flag.NewFlagSet("deadletter retry", flag.ExitOnError)
+	dir := fs.String("dir", cwd, "Watched directory to move files back into")
+	deadLetterDir := fs.String("dead-letter", path.Join(cwd, "dead-letter"), "Dead-letter directory")
+	fs.Parse(args[1:])
+
+	if fs.NArg() == 0 {
+		log.Fatalln("No files to retry")
+	}
+
+	failed := false
+	for _, name := range fs.Args() {
+		moved, err := redrive(*deadLetterDir, *dir, name)
+		if err != nil {
+			log.Printf("Error retrying %s: %s\n", name, err)
+			failed = true
+			continue
+		}
+
+		log.Printf("Moved %s back into %s\n", strings.Join(moved, ", "), *dir)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// deadLetterItem is dead-lettered file with details of its last failure
+type deadLetterItem struct {
+	fileItem
+	Failure *deadLetter `json:"failure,omitempty"`
+}
+
+// handleDeadLetter serves GET /deadletter listing
+// of files which failed after all retries and
+// POST /deadletter/{name}/retry re-driving one of them
+func (c *controller) handleDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if name := strings.TrimPrefix(r.URL.Path, "/deadletter/"); name != r.URL.Path {
+		if r.Method != http.MethodPost || !strings.HasSuffix(name, "/retry") {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name = strings.TrimSuffix(name, "/retry")
+
+		p, ok := c.admin.require(w, r, roleOperator)
+		if !ok {
+			return
+		}
+
+		moved, err := c.retryDeadLettered(name)
+		if os.IsNotExist(err) {
+			c.admin.audit.record("retry-deadletter", name, []string{p.name}, "not found")
+			http.Error(w, "File is not dead-lettered", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			c.admin.audit.record("retry-deadletter", name, []string{p.name}, err.Error())
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		c.admin.audit.record("retry-deadletter", name, []string{p.name}, "retried")
+		writeJSON(w, map[string]interface{}{
+			"retried": moved,
+		})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	f, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	files, sidecars, err := c.deadLettered(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := []deadLetterItem{}
+	for _, fi := range files {
+		d, ok := sidecars[fi.Name()]
+		if !q.match(fi.Name(), d.Route, "", 0, fi.ModTime()) {
+			continue
+		}
+
+		item := deadLetterItem{
+			fileItem: fileItem{
+				Name:  fi.Name(),
+				Route: d.Route,
+				State: "dead_lettered",
+				Size:  fi.Size(),
+				Mtime: fi.ModTime(),
+			},
+		}
+		if ok {
+			item.Failure = &d
+		}
+		list = append(list, item)
+	}
+
+	lo, hi := q.page(len(list))
+	writePage(w, q, len(list), list[lo:hi])
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	metrics "github.com/cryptopay-dev/go-metrics"
+)
+
+// What is done with file whose content was delivered under other name
+const (
+	dedupSkip = "skip"
+	dedupFlag = "flag"
+)
+
+// duplicateOf returns the latest entry with the same content but other
+// processing ID delivered to main destination since given time
+func (j *journal) duplicateOf(id, hash string, since time.Time) (journalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	ids := j.byHash[hash]
+	for i := len(ids) - 1; i >= 0; i-- {
+		e := j.entries[ids[i]]
+		if e.SentAt.Before(since) {
+			break
+		}
+		if e.ID != id && e.Destination == "" && (e.State == stateDelivered || e.State == stateRetained) {
+			return e, true
+		}
+	}
+
+	return journalEntry{}, false
+}
+
+// checkDuplicate looks for content delivered under other name within
+// dedup window, skipped file is archived or deleted without being sent
+// and flagged one is sent with X-Duplicate-Of header
+func (p *parser) checkDuplicate(hash string) {
+	if p.options.dedupWindow <= 0 || p.options.mirror || p.sent {
+		return
+	}
+
+	since := time.Now().Add(-time.Duration(p.options.dedupWindow) * time.Second)
+	orig, ok := p.controller.journal.duplicateOf(p.processingID(hash), hash, since)
+	if !ok {
+		return
+	}
+
+	log.Printf("[FILE: %s] Content %s was delivered as %s at %s, handling it as duplicate (%s)\n",
+		p.prefix, hash, orig.Name, orig.SentAt.Format(time.RFC3339), p.options.dedupAction)
+	sendMetrics("files", metrics.M{
+		"duplicate": true,
+	}, metrics.T{
+		"action": p.options.dedupAction,
+	})
+	p.controller.prom.inc(p.controller.prom.duplicates, p.options.dedupAction)
+
+	switch p.options.dedupAction {
+	case dedupSkip:
+		p.duplicate = true
+	case dedupFlag:
+		p.headers["X-Duplicate-Of"] = orig.Name
+		p.headers["X-Duplicate-Of-Id"] = orig.ID
+	}
+}
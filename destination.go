@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/raven-go"
+)
+
+// destination is an additional place file is delivered to
+// besides main URL, e.g. S3 archive next to HTTP API
+type destination struct {
+	Name  string `json:"name" desc:"Destination name" required:"true"`
+	URL   string `json:"url" desc:"Destination URL" pattern:"^(https?|s3|sftp)://" required:"true"`
+	Token string `json:"token" desc:"API token, defaults to main one"`
+	// Token of environment variable or file is read on every upload
+	TokenEnv  string            `json:"token_env" desc:"Environment variable holding API token, instead of token"`
+	TokenFile string            `json:"token_file" desc:"File holding API token, instead of token"`
+	Auth      string            `json:"auth" desc:"How token is sent: token (X-Access-Token), bearer or basic (token is user:password), defaults to main one" enum:"|token|bearer|basic"`
+	Headers   map[string]string `json:"headers" desc:"Extra headers of every request to destination"`
+	OAuth2    *oauth2           `json:"oauth2" desc:"OAuth2 client credentials access tokens are acquired with, instead of token"`
+	// Pins are not inherited from main URL
+	Pins     []string `json:"pins" desc:"Certificate pins as sha256/<base64>"`
+	Compress string   `json:"compress" desc:"Compression of request body, defaults to main one" enum:"|gzip|zstd|none"`
+	Level    int      `json:"compress_level" desc:"Compression level" minimum:"0"`
+}
+
+func validateDestinations(list []destination) error {
+	names := map[string]bool{}
+	for _, d := range list {
+		if d.Name == "" || strings.ContainsAny(d.Name, "/\\") {
+			return fmt.Errorf("Wrong destination name: %q", d.Name)
+		}
+		if names[d.Name] {
+			return errors.New("Duplicate destination name: " + d.Name)
+		}
+		names[d.Name] = true
+
+		if d.URL == "" {
+			return errors.New("Destination without URL: " + d.Name)
+		}
+		if err := validateURL(d.URL); err != nil {
+			return err
+		}
+		if err := validatePins(d.URL, d.Pins); err != nil {
+			return err
+		}
+		if err := validateCodec(d.Name, d.Compress, d.Level); err != nil {
+			return err
+		}
+		if err := validateSecret("destination "+d.Name, d.Token, d.TokenEnv, d.TokenFile); err != nil {
+			return err
+		}
+		if err := validateAuth("destination "+d.Name, d.Auth); err != nil {
+			return err
+		}
+		if err := validateHeaders("destination "+d.Name, d.Headers); err != nil {
+			return err
+		}
+		if d.OAuth2 != nil {
+			if err := d.OAuth2.validate("destination " + d.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// targets returns options for every destination file is sent to,
+// main URL goes first and has empty destination name
+func (o options) targets() []options {
+	list := []options{o}
+	for _, d := range o.destinations {
+		t := o
+		t.destination = d.Name
+		t.url = d.URL
+		t.pins, _ = parsePins(d.Pins)
+		t.headers = d.Headers
+		t.presignURL = ""
+		if d.Token != "" || d.TokenEnv != "" || d.TokenFile != "" {
+			t.token, _ = readSecret(d.Token, d.TokenEnv, d.TokenFile)
+			t.oauth = nil
+		}
+		if d.Auth != "" {
+			t.auth, t.oauth = d.Auth, nil
+		}
+		if d.OAuth2 != nil {
+			t.oauth = d.OAuth2
+		}
+		if d.Compress != "" {
+			t.compress, t.compressLevel = d.Compress, d.Level
+		}
+		list = append(list, t)
+	}
+
+	return list
+}
+
+// deliveredEverywhere reports whether journal has
+// content delivered to every destination of file
+func (p *parser) deliveredEverywhere(hash string) bool {
+	id := p.processingID(hash)
+	for _, t := range p.options.targets() {
+		if !p.controller.journal.deliveredTo(id, t.destination) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fanOut sends file to all destinations in parallel, each with its own
+// retries, skipping ones journal says already have this content. Extra
+// destinations are recorded in journal on their own, directive of main
+// destination is returned or nil when it was not sent
+func (p *parser) fanOut(pl *payload, primary bool) (*directive, error) {
+	hash := pl.sha256
+	targets := p.options.targets()
+	results := make([]*directive, len(targets))
+	errs := make([]error, len(targets))
+
+	var wg sync.WaitGroup
+	if primary && p.options.mirrorsToCanary(p.file.Name()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.sendCanaryCopy(pl)
+		}()
+	}
+	var shadow *shadowResult
+	if primary && p.options.shadowURL != "" && !p.options.mirror {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := p.sendShadow(pl)
+			shadow = &r
+		}()
+	}
+
+	// Variant result is of main destination, when it is sent to
+	var elapsed time.Duration
+	sentMain := false
+	for i, t := range targets {
+		if i == 0 && !primary {
+			continue
+		}
+		if p.controller.journal.deliveredTo(p.processingID(hash), t.destination) {
+			if t.destination != "" {
+				log.Printf("[FILE: %s] Already delivered to %s\n", p.prefix, t.destination)
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, t options) {
+			defer wg.Done()
+			started := time.Now()
+			results[i], errs[i] = p.sendTo(t, pl)
+			if i == 0 {
+				elapsed, sentMain = time.Since(started), true
+			}
+		}(i, t)
+	}
+	wg.Wait()
+
+	if sentMain {
+		p.observeCanary(p.options.variant, errs[0] == nil, elapsed)
+	}
+	if shadow != nil {
+		p.recordShadow(*shadow, sentMain, results[0], errs[0])
+	}
+
+	var failed error
+	for i, t := range targets {
+		if errs[i] != nil {
+			if failed == nil {
+				failed = errs[i]
+			}
+			continue
+		}
+		if i == 0 || results[i] == nil {
+			continue
+		}
+
+		p.recordTo(t, results[i], hash)
+	}
+
+	// Main destination succeeded while some other failed, it has
+	// to be recorded so that retry resends only failed ones
+	if failed != nil && results[0] != nil {
+		p.recordTo(targets[0], results[0], hash)
+	}
+
+	return results[0], failed
+}
+
+// maxResends caps resends API may ask for when retries are unlimited
+const maxResends = 10
+
+// to returns parser sending to given target with its own headers
+func (p *parser) to(t options) *parser {
+	dp := *p
+	dp.options = t
+	dp.headers = make(map[string]string, len(p.headers))
+	for k, v := range p.headers {
+		dp.headers[k] = v
+	}
+	if t.destination != "" {
+		dp.prefix = p.prefix + " -> " + t.destination
+	}
+
+	return &dp
+}
+
+// sendTo delivers file to single destination
+func (p *parser) sendTo(t options, pl *payload) (*directive, error) {
+	hash := pl.sha256
+	dp := p.to(t)
+
+	// Marking upload as started, after restart this tells that
+	// API may have received file although it was not recorded
+	if dp.controller.journal.interrupted(dp.file.Name(), dp.processingID(hash), t.destination) {
+		log.Printf("[FILE: %s] Previous upload was interrupted, sending again\n", dp.prefix)
+		dp.headers["X-Resumed"] = "true"
+	} else {
+		err := dp.controller.journal.record(journalEntry{
+			Name:        dp.file.Name(),
+			Route:       t.route,
+			Destination: t.destination,
+			State:       stateSending,
+			Size:        dp.file.Size(),
+			Mtime:       dp.file.ModTime(),
+			SHA256:      hash,
+			SentAt:      time.Now(),
+		})
+		if err != nil {
+			log.Printf("[FILE: %s] Error writing journal: %s\n", dp.prefix, err)
+		}
+	}
+
+	started := time.Now()
+	resends := dp.controller.resends(dp.file.Name(), t.destination)
+	d, err := dp.sendWithBackoff(pl, dp.file.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[FILE: %s] Successfully send data to API\n", dp.prefix)
+
+	// File is left in place and picked up again once time comes,
+	// so its worker serves other files in the meantime. Resends
+	// count as attempts, API can't keep file forever
+	if d.ResendAfter > 0 {
+		resends++
+		if t.retryPolicy().exhausted(resends) || resends > maxResends {
+			return nil, &exhaustedError{
+				Err:          fmt.Errorf("API asked to resend file %d times", resends),
+				Destination:  t.destination,
+				Attempts:     resends,
+				FirstAttempt: started,
+				LastAttempt:  time.Now(),
+			}
+		}
+
+		after := time.Second * time.Duration(d.ResendAfter)
+		dp.controller.setRetry(retryState{
+			File:        dp.file.Name(),
+			Destination: t.destination,
+			Failed:      resends,
+			LastError:   errResend.Error(),
+			NextAt:      time.Now().Add(after),
+		})
+
+		log.Printf("[FILE: %s] API asked to resend file after %s\n", dp.prefix, after)
+		return nil, errResend
+	}
+
+	if dp.controller.proofKey != nil {
+		target, err := dp.writeProof(&proof{
+			Version:       proofVersion,
+			File:          dp.file.Name(),
+			Route:         t.route,
+			Size:          pl.size,
+			SHA256:        hash,
+			Destination:   t.url,
+			RequestSHA256: d.requestHash,
+			Status:        d.status,
+			Receipt:       d.response,
+			StartedAt:     started,
+			DeliveredAt:   time.Now(),
+			Hooker:        version,
+		})
+		if err != nil {
+			err = newStageError(stageArchive, dp.prefix, 0, errIO, err)
+			raven.CaptureErrorAndWait(err, errorTags(err))
+
+			log.Printf("[FILE: %s] Error writing proof of delivery: %s\n", dp.prefix, err)
+		} else {
+			log.Printf("[FILE: %s] Proof of delivery written to %s\n", dp.prefix, target)
+		}
+	}
+
+	return d, nil
+}
+
+// recordTo writes journal entry of successful delivery to destination
+func (p *parser) recordTo(t options, d *directive, hash string) {
+	state := stateDelivered
+	if d.Action == actionRetain {
+		state = stateRetained
+	}
+
+	entry := journalEntry{
+		Name:        p.file.Name(),
+		Route:       t.route,
+		Destination: t.destination,
+		State:       state,
+		Status:      d.status,
+		Size:        p.file.Size(),
+		Mtime:       p.file.ModTime(),
+		SHA256:      hash,
+		SentAt:      time.Now(),
+		Action:      d.Action,
+		Response:    d.response,
+	}
+	p.recordDeadline(&entry)
+
+	err := p.controller.journal.record(entry)
+	if err != nil {
+		err = newStageError(stageJournal, p.prefix, 0, errIO, err)
+		raven.CaptureError(err, errorTags(err))
+
+		log.Printf("[FILE: %s] Error writing journal: %s\n", p.prefix, err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Post-processing actions API may request in its response
+const (
+	actionRetain  = "retain"
+	actionArchive = "archive"
+	actionDelete  = "delete"
+)
+
+// directive overrides default post-processing of file,
+// e.g. {"action":"retain"} or {"resend_after":3600}
+type directive struct {
+	Action      string `json:"action"`
+	ResendAfter int    `json:"resend_after"`
+
+	// HTTP status and body of response directive came with
+	status   int
+	response string
+
+	// requestHash is SHA-256 of request body as it was sent
+	requestHash string
+}
+
+// responseLimit is how much of API response is kept in journal
+const responseLimit = 4096
+
+// readResponse reads beginning of API response body,
+// e.g. of error response, the rest is not needed
+func readResponse(body io.Reader) []byte {
+	data, _ := ioutil.ReadAll(io.LimitReader(body, responseLimit))
+	return data
+}
+
+// responseTooLargeError is returned when API
+// response body exceeds -max-response-size
+type responseTooLargeError struct {
+	Limit int64
+}
+
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("API response is larger than %d bytes", e.Limit)
+}
+
+// cappedReader fails once more than limit bytes are read
+type cappedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+	err   error
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	// Reading one byte past limit tells whether body is larger
+	if left := c.limit - c.read + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	if c.read > c.limit {
+		c.err = &responseTooLargeError{Limit: c.limit}
+		return n - int(c.read-c.limit), c.err
+	}
+
+	return n, err
+}
+
+// headWriter keeps first responseLimit bytes written to it
+type headWriter struct {
+	bytes.Buffer
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if left := responseLimit - h.Len(); left > 0 {
+		if len(p) < left {
+			left = len(p)
+		}
+		h.Buffer.Write(p[:left])
+	}
+
+	return len(p), nil
+}
+
+// readDirective streams API response body through directive decoder
+// without buffering it, body larger than limit is an error
+func readDirective(response *http.Response, limit int64) (*directive, error) {
+	head := &headWriter{}
+	body := io.TeeReader(&cappedReader{r: response.Body, limit: limit}, head)
+
+	d := parseDirective(response.Header.Get("Content-Type"), body)
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		return nil, err
+	}
+
+	d.status = response.StatusCode
+	d.response = head.String()
+
+	return d, nil
+}
+
+func truncate(data []byte) string {
+	if len(data) > responseLimit {
+		data = data[:responseLimit]
+	}
+
+	return string(data)
+}
+
+// parseDirective decodes directive from API response body,
+// anything but JSON object is treated as no directive
+func parseDirective(contentType string, body io.Reader) *directive {
+	d := &directive{}
+
+	if !strings.Contains(contentType, "json") {
+		return d
+	}
+
+	if err := json.NewDecoder(body).Decode(d); err != nil {
+		return &directive{}
+	}
+
+	switch d.Action {
+	case "", actionRetain, actionArchive, actionDelete:
+	default:
+		d.Action = ""
+	}
+
+	return d
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Ciphers archives may be encrypted with
+const (
+	encryptAge    = "age"
+	encryptAESGCM = "aes-gcm"
+)
+
+// encryptSuffixes are appended to name of encrypted archive
+var encryptSuffixes = map[string]string{
+	encryptAge:    ".age",
+	encryptAESGCM: ".enc",
+}
+
+// AES-GCM archives are written as magic, 7 bytes nonce prefix and
+// segments of up to aesSegment bytes sealed one by one. Nonce of
+// segment is prefix, its big endian number and 1 for the last one,
+// so segments can't be reordered, dropped or truncated unnoticed
+const aesSegment = 64 * 1024
+
+var aesMagic = []byte("HOOKERv1")
+
+// parseEncrypt splits -zip-encrypt into cipher and its key file
+func parseEncrypt(spec string) (string, string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if _, ok := encryptSuffixes[parts[0]]; !ok || len(parts) != 2 || parts[1] == "" {
+		return "", "", errors.New("Wrong archive encryption, expected age:<recipients file> or aes-gcm:<key file>: " + spec)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// validateEncrypt checks archive encryption before it is needed,
+// age is not FIPS approved and requires age command
+func validateEncrypt(spec string, fips bool) error {
+	if spec == "" {
+		return nil
+	}
+
+	kind, file, err := parseEncrypt(spec)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case encryptAge:
+		if fips {
+			return errors.New("FIPS mode allows only aes-gcm archive encryption")
+		}
+		if _, err := exec.LookPath("age"); err != nil {
+			return errors.New("age archive encryption requires age command")
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("age recipients: %w", err)
+		}
+	case encryptAESGCM:
+		if _, err := loadAESKey(file); err != nil {
+			return fmt.Errorf("AES key %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// loadAESKey reads 256 bit key stored raw, as hex or as base64
+func loadAESKey(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+
+	text := string(bytes.TrimSpace(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+
+	return nil, errors.New("key must be 32 bytes, raw, hex or base64 encoded")
+}
+
+func newAEAD(file string) (cipher.AEAD, error) {
+	key, err := loadAESKey(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:], n)
+	if last {
+		nonce[11] = 1
+	}
+
+	return nonce
+}
+
+// aesWriter seals everything written to it segment by segment,
+// close seals the last segment which may be empty
+type aesWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	buf    []byte
+}
+
+func newAESWriter(w io.Writer, aead cipher.AEAD) (*aesWriter, error) {
+	prefix := make([]byte, 7)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(append([]byte{}, aesMagic...), prefix...)); err != nil {
+		return nil, err
+	}
+
+	return &aesWriter{w: w, aead: aead, prefix: prefix}, nil
+}
+
+func (a *aesWriter) Write(b []byte) (int, error) {
+	a.buf = append(a.buf, b...)
+
+	// Full segment is kept until more data shows it isn't the last one
+	for len(a.buf) > aesSegment {
+		if err := a.seal(a.buf[:aesSegment], false); err != nil {
+			return 0, err
+		}
+		a.buf = a.buf[aesSegment:]
+	}
+
+	return len(b), nil
+}
+
+func (a *aesWriter) seal(segment []byte, last bool) error {
+	if a.n == ^uint32(0) {
+		return errors.New("archive is too large to encrypt")
+	}
+
+	_, err := a.w.Write(a.aead.Seal(nil, segmentNonce(a.prefix, a.n, last), segment, nil))
+	a.n++
+
+	return err
+}
+
+func (a *aesWriter) Close() error {
+	return a.seal(a.buf, true)
+}
+
+// decryptAES opens archive written by aesWriter
+func decryptAES(w io.Writer, r io.Reader, aead cipher.AEAD) error {
+	header := make([]byte, len(aesMagic)+7)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header[:len(aesMagic)], aesMagic) {
+		return errors.New("not an encrypted archive")
+	}
+	prefix := header[len(aesMagic):]
+
+	br := bufio.NewReaderSize(r, aesSegment+aead.Overhead()+1)
+	segment := make([]byte, aesSegment+aead.Overhead())
+	for n := uint32(0); ; n++ {
+		size, err := io.ReadFull(br, segment)
+		last := err == io.ErrUnexpectedEOF || err == io.EOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			_, err := br.Peek(1)
+			last = err == io.EOF
+		}
+
+		plain, err := aead.Open(nil, segmentNonce(prefix, n, last), segment[:size], nil)
+		if err != nil {
+			return errors.New("archive is corrupted, truncated or key is wrong")
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// newEncryptor encrypts archive written to it into w with -zip-encrypt,
+// age does it with age command and aes-gcm with key file
+func (o options) newEncryptor(w io.Writer) (io.WriteCloser, error) {
+	if o.zipEncrypt == "" {
+		return nopWriteCloser{w}, nil
+	}
+
+	kind, file, err := parseEncrypt(o.zipEncrypt)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == encryptAge {
+		return newCmdWriter(w, "age", "-e", "-R", file)
+	}
+
+	aead, err := newAEAD(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAESWriter(w, aead)
+}
+
+// decryptCommand implements "hooker decrypt" opening aes-gcm
+// archives, age ones are opened with age command itself
+func decryptCommand(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFile := fs.String("key", "", "AES key file archive was encrypted with")
+	file := fs.String("file", "-", "Decrypted archive (- for stdout)")
+	fs.Parse(args)
+
+	if *keyFile == "" || fs.NArg() != 1 {
+		fmt.Println("Usage: hooker decrypt -key <file> [-file <archive.zip>] <archive.zip.enc>")
+		os.Exit(2)
+	}
+
+	aead, err := newAEAD(*keyFile)
+	if err != nil {
+		log.Fatalf("AES key error: %s\n", err)
+	}
+
+	in, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Archive opening error: %s\n", err)
+	}
+	defer in.Close()
+
+	// Nothing is left behind unless whole archive is authenticated
+	if *file == "-" {
+		var buf bytes.Buffer
+		if err := decryptAES(&buf, in, aead); err != nil {
+			log.Fatalf("Archive decryption error: %s\n", err)
+		}
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+
+	out, err := os.Create(*file + ".part")
+	if err != nil {
+		log.Fatalf("Archive writing error: %s\n", err)
+	}
+
+	err = decryptAES(out, in, aead)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(*file+".part", *file)
+	}
+	if err != nil {
+		os.Remove(*file + ".part")
+		log.Fatalf("Archive decryption error: %s\n", err)
+	}
+
+	log.Printf("Decrypted %s to %s\n", fs.Arg(0), *file)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Processing stages errors are attributed to
+const (
+	stageStabilize = "stabilize"
+	stageValidate  = "validate"
+	stageRead      = "read"
+	stageChecksum  = "checksum"
+	stageSend      = "send"
+	stageJournal   = "journal"
+	stageArchive   = "archive"
+	stageDelete    = "delete"
+)
+
+// Kinds of failures which callers may check with errors.Is,
+// messages are short as they are used as metric tags
+var (
+	errValidation = errors.New("validation")
+	errIO         = errors.New("io")
+	errPayload    = errors.New("payload")
+	errNetwork    = errors.New("network")
+	errRejected   = errors.New("rejected")
+)
+
+// stageError describes failure of one processing stage of a file
+type stageError struct {
+	Stage   string
+	File    string
+	Attempt int
+	Kind    error
+	Err     error
+}
+
+func (e *stageError) Error() string {
+	if e.Attempt > 0 {
+		return fmt.Sprintf("%s of %s failed (attempt %d): %s", e.Stage, e.File, e.Attempt, e.Err)
+	}
+
+	return fmt.Sprintf("%s of %s failed: %s", e.Stage, e.File, e.Err)
+}
+
+func (e *stageError) Unwrap() error {
+	return e.Err
+}
+
+func (e *stageError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// httpStatusError is returned when API answers with unexpected status
+type httpStatusError struct {
+	Code int
+	Body string
+}
+
+func (e *httpStatusError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("Http status: %d, response: %s", e.Code, e.Body)
+	}
+
+	return fmt.Sprintf("Http status: %d", e.Code)
+}
+
+func newStageError(stage, file string, attempt int, kind, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &stageError{
+		Stage:   stage,
+		File:    file,
+		Attempt: attempt,
+		Kind:    kind,
+		Err:     err,
+	}
+}
+
+// sendKind classifies error returned by upload attempt
+func sendKind(err error) error {
+	var status *httpStatusError
+	if errors.As(err, &status) {
+		return errRejected
+	}
+
+	var sftpErr *sftpError
+	if errors.As(err, &sftpErr) {
+		if sftpErr.Code == 255 {
+			return errNetwork
+		}
+		return errRejected
+	}
+
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) || errorPhase(err) != "" {
+		return errNetwork
+	}
+
+	return errPayload
+}
+
+// errorTags describes error for Sentry
+func errorTags(err error) map[string]string {
+	tags := map[string]string{
+		"error": err.Error(),
+	}
+
+	var se *stageError
+	if errors.As(err, &se) {
+		tags["stage"] = se.Stage
+		tags["file"] = se.File
+		tags["kind"] = se.Kind.Error()
+		if se.Attempt > 0 {
+			tags["attempt"] = fmt.Sprintf("%d", se.Attempt)
+		}
+	}
+	if phase := errorPhase(err); phase != "" {
+		tags["phase"] = phase
+	}
+
+	return tags
+}
+
+// exhaustedError is returned when all upload attempts failed
+type exhaustedError struct {
+	Err          error
+	Destination  string
+	Attempts     int
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+}
+
+func (e *exhaustedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *exhaustedError) Unwrap() error {
+	return e.Err
+}
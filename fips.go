@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/fips140"
+	"crypto/tls"
+	"net/http"
+	"runtime"
+)
+
+// fipsStatus tells whether hooker runs FIPS compatible: -fips keeps hooker
+// itself to approved algorithms, while Go cryptographic module in FIPS
+// 140-3 mode restricts TLS and every primitive underneath
+type fipsStatus struct {
+	Mode      bool `json:"mode"`
+	Module    bool `json:"module"`
+	Compliant bool `json:"compliant"`
+}
+
+func (o options) fipsStatus() fipsStatus {
+	return fipsStatus{
+		Mode:      o.fips,
+		Module:    fips140.Enabled(),
+		Compliant: o.fips && fips140.Enabled(),
+	}
+}
+
+// fipsTLS restricts TLS to versions, cipher suites and
+// curves approved by FIPS 140-3 when -fips is set
+func (o options) fipsTLS(cfg *tls.Config) *tls.Config {
+	if !o.fips {
+		return cfg
+	}
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+
+	cfg.MinVersion = tls.VersionTLS12
+	cfg.CipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+	cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+
+	return cfg
+}
+
+// handleVersion serves GET /version
+func (c *controller) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"version": version,
+		"go":      runtime.Version(),
+		"fips":    c.opts().fipsStatus(),
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+)
+
+// health keeps state of the watched source
+// directory as seen by the scan loop
+type health struct {
+	mu       sync.Mutex
+	state    string
+	err      string
+	since    time.Time
+	failures int
+}
+
+func newHealth() *health {
+	return &health{
+		state: healthOK,
+		since: time.Now(),
+	}
+}
+
+func (h *health) fail(err error) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.state != healthDegraded {
+		h.state = healthDegraded
+		h.since = time.Now()
+	}
+	h.err = err.Error()
+	h.failures++
+
+	return h.failures
+}
+
+func (h *health) recover() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.state == healthOK {
+		return false
+	}
+
+	h.state = healthOK
+	h.err = ""
+	h.since = time.Now()
+	h.failures = 0
+
+	return true
+}
+
+func (h *health) degraded() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.state == healthDegraded
+}
+
+func (h *health) status() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return map[string]interface{}{
+		"state":    h.state,
+		"error":    h.err,
+		"since":    h.since,
+		"failures": h.failures,
+	}
+}
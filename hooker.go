@@ -1,19 +1,86 @@
 package main
 
 import (
+	"crypto/fips140"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/cryptopay-dev/go-metrics"
 	"github.com/getsentry/raven-go"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "state" {
+		stateCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "manifest" {
+		manifestCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "deadletter" {
+		deadLetterCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		configCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "dashboards" {
+		dashboardsCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "shadow" {
+		shadowCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "route" {
+		routeCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		simulateCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		decryptCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		statusCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		topCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "support-bundle" {
+		supportBundleCommand(os.Args[2:])
+		return
+	}
+
+	// Keep last lines of log for support bundles
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+
 	cwd, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("Getwd() error: %s\n", err)
@@ -23,15 +90,108 @@ func main() {
 	dir := flag.String("dir", cwd, "Directory we should look for a new files")
 	out := flag.String("out", cwd, "Directory we should place zip files into")
 	separator := flag.String("sep", ",", "Pattern separator")
-	patterns := flag.String("patterns", ".xml, .xlsx", fmt.Sprintf("Patterns we look files in directory (seperated by: %s)", *separator))
+	patterns := flag.String("patterns", ".xml, .xlsx", fmt.Sprintf("Patterns we look files in directory: suffixes, globs like report_*.xml or re:<regexp> (seperated by: %s)", *separator))
+	exclude := flag.String("exclude", "", fmt.Sprintf("Patterns of files never processed even when matching -patterns, e.g. *.partial.xml (seperated by: %s)", *separator))
 	timeout := flag.Int("timeout", 180, "Timeout waiting request from API")
+	dnsTimeout := flag.Int("dns-timeout", 0, "Timeout in seconds of resolving API host (0 is -timeout)")
+	connectTimeout := flag.Int("connect-timeout", 0, "Timeout in seconds of connecting to API (0 is -timeout)")
+	tlsTimeout := flag.Int("tls-timeout", 0, "Timeout in seconds of TLS handshake with API (0 is -timeout)")
+	responseTimeout := flag.Int("response-timeout", 0, "Timeout in seconds of waiting for API response headers once request is sent (0 is -timeout)")
+	attemptTimeout := flag.Int("attempt-timeout", 0, "Deadline in seconds of whole upload attempt (0 is unlimited)")
 	verbose := flag.Bool("v", false, "Verbose output")
 	checkInterval := flag.Int("check", 180, "Interval in seconds of file check")
+	stableWindow := flag.Int("stable-window", 15, "Time in seconds file size has to stay the same before file is validated")
+	completion := flag.String("completion", completionSize, "How to tell that file is completely written: size (stays the same for -stable-window), marker (producer drops <file><-done-suffix> next to it) or rename (producer writes it under name not matching -patterns and renames it once complete)")
+	doneSuffix := flag.String("done-suffix", ".done", "Suffix of done marker of marker -completion protocol")
+	minAge := flag.Int("min-age", 0, "Time in seconds since last modification before file is picked up (0 picks files up right away)")
+	lockProbe := flag.Bool("lock-probe", false, "Treat file which can be locked exclusively as finished without waiting whole -stable-window (flock, on Windows any writer holding file open)")
 	url := flag.String("url", "http://localhost:3000/", "URL of reports API")
 	token := flag.String("token", "", "Auth token for API")
+	tokenEnv := flag.String("token-env", "", "Environment variable holding auth token for API, instead of -token")
+	tokenFile := flag.String("token-file", "", "File holding auth token for API, instead of -token")
+	oauthTokenURL := flag.String("oauth-token-url", "", "OAuth2 token endpoint, access tokens acquired with client credentials grant are sent instead of -token")
+	oauthClientID := flag.String("oauth-client-id", "", "OAuth2 client ID")
+	oauthClientSecret := flag.String("oauth-client-secret", "", "OAuth2 client secret")
+	oauthClientSecretEnv := flag.String("oauth-client-secret-env", "", "Environment variable holding OAuth2 client secret, instead of -oauth-client-secret")
+	oauthClientSecretFile := flag.String("oauth-client-secret-file", "", "File holding OAuth2 client secret, instead of -oauth-client-secret")
+	oauthScopes := flag.String("oauth-scopes", "", "OAuth2 scopes to request (separated by: ,)")
+	auth := flag.String("auth", authToken, "How token is sent to API: token (X-Access-Token header), bearer (Authorization: Bearer) or basic (token is <user>:<password>)")
 	zipFile := flag.Bool("zip", true, "Zip file")
+	archiveFormat := flag.String("archive-format", archiveZip, "Format of archives in -out: zip, tar.gz, zstd (requires zstd command), move (into dated subdirectory as is) or none (same as -zip=false)")
+	zipEncrypt := flag.String("zip-encrypt", "", "Encrypt archives as age:<recipients file> (requires age command) or aes-gcm:<key file> (32 bytes, raw, hex or base64)")
 	clear := flag.Bool("clear", true, "Clear file after send")
 	listen := flag.String("listen", ":8080", "Server listen address")
+	hold := flag.Bool("hold", false, "Hold validated files until released via API")
+	adminKeys := flag.String("admin-keys", "", "Admin API identities as name:key[:role] (roles: read, operator, admin; separated by: ,)")
+	jwtSecret := flag.String("jwt-secret", "", "HS256 secret to verify admin API bearer tokens")
+	fourEyes := flag.Bool("four-eyes", false, "Require two distinct admin identities to release or delete files")
+	auditLog := flag.String("audit-log", "", "File to append admin actions audit log into")
+	corsOrigins := flag.String("cors-origins", "", "Origins allowed to call admin API from browser (separated by: ,)")
+	csrfProtect := flag.Bool("csrf", false, "Require CSRF token on mutating admin API requests")
+	rateLimit := flag.Float64("rate-limit", 0, "Admin API requests per second allowed from single IP (0 disables)")
+	rateBurst := flag.Int("rate-burst", 10, "Admin API requests burst allowed from single IP")
+	trustedProxies := flag.String("trusted-proxies", "", "Addresses or CIDR networks of reverse proxies admin API client address is taken from X-Forwarded-For of (separated by: ,)")
+	readOnly := flag.Bool("read-only", false, "Never modify source directory, track delivered files via journal")
+	journalPath := flag.String("journal", "", "File to keep journal of delivered files in")
+	shadowURL := flag.String("shadow-url", "", "URL every file is additionally sent to once, its result never affects the file")
+	shadowToken := flag.String("shadow-token", "", "Auth token for shadow URL (default is -token)")
+	shadowLog := flag.String("shadow-log", "", "File to append shadow upload results into")
+	shadowIgnore := flag.String("shadow-ignore", "", "Response fields not compared with shadow ones, e.g. receipt.id (separated by: ,)")
+	dedupWindow := flag.Int("dedup-window", 0, "Seconds within which file with content delivered under other name is a duplicate (0 disables)")
+	dedupAction := flag.String("dedup-action", dedupSkip, "What to do with duplicate: skip or flag (send with X-Duplicate-Of header)")
+	mirror := flag.Bool("mirror", false, "Only validate and archive files without sending them to API")
+	checksums := flag.Bool("checksums", false, "Process files only with companion .sha256/.md5 checksum file and verify it")
+	manifestSuffix := flag.String("manifest-suffix", "", "Suffix of batch manifest files, e.g. .manifest.json (empty disables batches)")
+	batchDeadline := flag.Int("batch-deadline", 0, "Time in seconds to wait for all batch files since manifest appeared (0 waits forever)")
+	batchPolicy := flag.String("batch-policy", batchPolicyQuarantine, "What to do with batch incomplete at deadline: partial or quarantine")
+	preflightURL := flag.String("preflight-url", "", "URL to check with HEAD request whether API already has file content")
+	preflightMinSize := flag.Int64("preflight-min-size", 0, "Minimal file size in bytes to do preflight check for")
+	presignURL := flag.String("presign-url", "", "URL to request pre-signed upload URL from, body is then uploaded directly to object storage")
+	maxResponseSize := flag.Int64("max-response-size", 1024*1024, "Maximal size in bytes of API response body")
+	maxBodySize := flag.Int64("max-body-size", 0, "Maximal size in bytes of request body API accepts, larger files are quarantined without sending (0 is unlimited)")
+	discoverBodySize := flag.Bool("discover-body-size", false, "Ask API for maximal request body size with OPTIONS request, -max-body-size is used when it doesn't tell")
+	presignMinSize := flag.Int64("presign-min-size", 0, "Minimal file size in bytes to upload via pre-signed URL")
+	transforms := flag.String("transform", ".xml=minify", "Transforms of file content before upload as <suffix>=<step>[+<step>], step is minify, none, xslt:<file.xsl> or template:<file>, files matching none are sent as they are (separated by: ,)")
+	xsd := flag.String("xsd", "", "XSD schemas to validate files against as <suffix>=<file.xsd> (separated by: ,)")
+	xlsxSheets := flag.String("xlsx-sheets", "", "Sheets every spreadsheet has to contain (separated by: ,)")
+	validateCmd := flag.String("validate-command", "", "Command validating files, gets file path as last argument and on stdin (exit code 0 accepts, 75 checks later)")
+	ntpServer := flag.String("ntp-server", "", "NTP server to check clock skew against (empty disables)")
+	maxClockSkew := flag.Int("max-clock-skew", 5, "Clock skew in seconds to alert on")
+	maxRSS := flag.Int("max-rss", 0, "Memory limit in MB, new files are not admitted when RSS gets close to it (0 disables)")
+	watchMode := flag.String("watch-mode", watchPoll, "How to discover new files: poll, notify (inotify or ReadDirectoryChangesW) or usn (NTFS change journal on Windows), polling is fallback of the latter two")
+	recursive := flag.Bool("recursive", false, "Look for a new files in subdirectories too")
+	configPath := flag.String("config", "", "JSON configuration file, reloaded on SIGHUP")
+	retentionDays := flag.Int("retention-days", 0, "Days to keep journal and audit records for (0 keeps forever)")
+	retentionSize := flag.Int("retention-size", 0, "Maximal size in MB of journal and audit files (0 is unlimited)")
+	archiveRetentionDays := flag.Int("archive-retention-days", 0, "Days to keep dated archives in -out for (0 keeps forever)")
+	archiveRetentionSize := flag.Int("archive-retention-size", 0, "Maximal size in MB of dated archives in -out, the oldest are deleted (0 is unlimited)")
+	retentionExport := flag.String("retention-export", "", "Directory or s3://bucket/prefix to export pruned records into")
+	quarantine := flag.String("quarantine", "", "Directory to move rejected files into (default \"<out>/quarantine\")")
+	deadLetter := flag.String("dead-letter", "", "Directory to move files failed after all retries into (default \"<out>/dead-letter\")")
+	sftpKey := flag.String("sftp-key", "", "Private key file to authenticate to sftp:// url with")
+	sftpKnownHosts := flag.String("sftp-known-hosts", "", "Known hosts file to verify sftp:// url host key with (default is ssh one)")
+	s3SSE := flag.String("s3-sse", "", "Server-side encryption of objects uploaded to s3:// url: AES256 or aws:kms")
+	s3KMSKeyID := flag.String("s3-sse-kms-key", "", "KMS key id for aws:kms server-side encryption")
+	retryAttempts := flag.Int("retry-attempts", 6, "Upload attempts per file before it fails (0 retries forever)")
+	retryDelay := flag.Int("retry-delay", 120, "Delay in seconds after first failed upload, doubled after every next one")
+	retryMaxDelay := flag.Int("retry-max-delay", 3600, "Maximal delay in seconds between upload attempts (0 is unlimited)")
+	retryJitter := flag.Float64("retry-jitter", 0, "Random fraction (0-1) taken off every retry delay")
+	fips := flag.Bool("fips", fips140.Enabled(), "Use only FIPS 140-3 approved algorithms, requires Go cryptographic module in FIPS mode")
+	pins := flag.String("pin-sha256", "", "Base64 SHA-256 hashes of API certificate public keys one of which must be in its chain (separated by -sep)")
+	proxy := flag.String("proxy", "", "SOCKS5 proxy for uploads as socks5://[user[:password]@]host:port, password may be set with PROXY_PASSWORD")
+	compress := flag.String("compress", compressGzip, "Compression of request body: gzip, zstd (requires zstd command) or none")
+	compressLevel := flag.Int("compress-level", 0, "Compression level, 1-9 for gzip and 1-19 for zstd (0 is codec default)")
+	chunkSize := flag.Int("chunk-size", 0, "Size in MB of chunks files larger than it are sent to API in with resumable tus upload (0 disables)")
+	s3PartSize := flag.Int("s3-part-size", 16, "Size in MB of parts files larger than it are uploaded to s3:// url in")
+	s3Concurrency := flag.Int("s3-concurrency", 4, "Number of parts of multipart S3 upload sent in parallel")
+	skipListPath := flag.String("skip-list", "", "File to keep list of files which are skipped until they change in")
+	proofKey := flag.String("proof-key", "", "Ed25519 private key (PKCS#8 PEM) or awskms://, gcpkms://, vault:// key to sign proofs of delivery with, enables proofs")
+	dailyManifest := flag.String("daily-manifest", "", "Directory, s3://bucket/prefix or http(s) URL to publish daily manifest of deliveries to")
+	workers := flag.Int("workers", 0, "Maximal number of files processed at once, others are queued (0 is unlimited)")
+	grace := flag.Int("grace", 30, "Seconds to wait for files in work on SIGTERM/SIGINT")
+	spillThreshold := flag.Int("spill-threshold", 32, "Size in MB of intermediate transform output kept in memory, larger one is spilled to workspace file")
+	snapshot := flag.String("snapshot", "", "Process a snapshot of stable file taken into workspace: link (hardlink unless writer holds file, copy otherwise) or copy")
+	workspaceDir := flag.String("workspace", "", "Directory for intermediate files, leftovers of previous run are removed on startup (default \"<out>/.workspace\")")
 
 	flag.Parse()
 
@@ -40,19 +200,323 @@ func main() {
 
 	// Setting options
 	opts := options{
-		interval:      *interval,
-		dir:           *dir,
-		out:           *out,
-		patterns:      *patterns,
-		timeout:       *timeout,
-		verbose:       *verbose,
-		checkInterval: *checkInterval,
-		url:           *url,
-		token:         *token,
-		zip:           *zipFile,
-		clear:         *clear,
-		separator:     *separator,
-		listen:        *listen,
+		interval:             *interval,
+		dir:                  *dir,
+		out:                  *out,
+		patterns:             *patterns,
+		exclude:              *exclude,
+		timeout:              *timeout,
+		dnsTimeout:           *dnsTimeout,
+		connectTimeout:       *connectTimeout,
+		tlsTimeout:           *tlsTimeout,
+		responseTimeout:      *responseTimeout,
+		attemptTimeout:       *attemptTimeout,
+		verbose:              *verbose,
+		checkInterval:        *checkInterval,
+		stableWindow:         *stableWindow,
+		lockProbe:            *lockProbe,
+		completion:           *completion,
+		doneSuffix:           *doneSuffix,
+		minAge:               *minAge,
+		url:                  *url,
+		token:                *token,
+		auth:                 *auth,
+		zip:                  *zipFile,
+		zipEncrypt:           *zipEncrypt,
+		archiveFormat:        *archiveFormat,
+		clear:                *clear,
+		separator:            *separator,
+		listen:               *listen,
+		hold:                 *hold,
+		adminKeys:            *adminKeys,
+		jwtSecret:            *jwtSecret,
+		fourEyes:             *fourEyes,
+		auditLog:             *auditLog,
+		corsOrigins:          *corsOrigins,
+		csrf:                 *csrfProtect,
+		rateLimit:            *rateLimit,
+		rateBurst:            *rateBurst,
+		trustedProxies:       *trustedProxies,
+		readOnly:             *readOnly,
+		journal:              *journalPath,
+		dedupWindow:          *dedupWindow,
+		dedupAction:          *dedupAction,
+		shadowURL:            *shadowURL,
+		shadowToken:          *shadowToken,
+		shadowLog:            *shadowLog,
+		mirror:               *mirror,
+		checksums:            *checksums,
+		quarantine:           *quarantine,
+		deadLetter:           *deadLetter,
+		workspace:            *workspaceDir,
+		snapshot:             *snapshot,
+		spillThreshold:       *spillThreshold,
+		grace:                *grace,
+		workers:              *workers,
+		proofKey:             *proofKey,
+		dailyManifest:        *dailyManifest,
+		skipList:             *skipListPath,
+		s3SSE:                *s3SSE,
+		sftpKey:              *sftpKey,
+		sftpKnownHosts:       *sftpKnownHosts,
+		s3KMSKeyID:           *s3KMSKeyID,
+		s3PartSize:           *s3PartSize,
+		s3Concurrency:        *s3Concurrency,
+		chunkSize:            *chunkSize,
+		compress:             *compress,
+		compressLevel:        *compressLevel,
+		proxy:                *proxy,
+		retryAttempts:        *retryAttempts,
+		retryDelay:           *retryDelay,
+		retryMaxDelay:        *retryMaxDelay,
+		retryJitter:          *retryJitter,
+		fips:                 *fips,
+		manifestSuffix:       *manifestSuffix,
+		batchDeadline:        *batchDeadline,
+		batchPolicy:          *batchPolicy,
+		preflightURL:         *preflightURL,
+		preflightMinSize:     *preflightMinSize,
+		presignURL:           *presignURL,
+		presignMinSize:       *presignMinSize,
+		maxResponseSize:      *maxResponseSize,
+		maxBodySize:          *maxBodySize,
+		discoverBodySize:     *discoverBodySize,
+		ntpServer:            *ntpServer,
+		maxClockSkew:         *maxClockSkew,
+		maxRSS:               *maxRSS,
+		watchMode:            *watchMode,
+		recursive:            *recursive,
+		config:               *configPath,
+		retentionDays:        *retentionDays,
+		retentionSize:        *retentionSize,
+		retentionExport:      *retentionExport,
+		archiveRetentionDays: *archiveRetentionDays,
+		archiveRetentionSize: *archiveRetentionSize,
+	}
+
+	if opts.watchMode != watchPoll && opts.watchMode != watchNotify && opts.watchMode != watchUSN {
+		log.Fatalf("Unknown watch mode: %s\n", opts.watchMode)
+	}
+
+	if opts.stableWindow < 1 {
+		log.Fatalln("Stable window must be at least 1 second")
+	}
+
+	if opts.minAge < 0 {
+		log.Fatalln("Minimal file age can not be negative")
+	}
+
+	if err := validateCompletion(opts.completion, opts.doneSuffix); err != nil {
+		log.Fatalln(err)
+	}
+
+	if opts.batchPolicy != batchPolicyPartial && opts.batchPolicy != batchPolicyQuarantine {
+		log.Fatalf("Unknown batch policy: %s\n", opts.batchPolicy)
+	}
+
+	if err := validateURL(opts.shadowURL); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := validatePatterns(splitPatterns(opts.patterns, opts.separator)); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validatePatterns(splitPatterns(opts.exclude, opts.separator)); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := validateSecret("API", *token, *tokenEnv, *tokenFile); err != nil {
+		log.Fatalln(err)
+	}
+	opts.token, _ = readSecret(*token, *tokenEnv, *tokenFile)
+
+	if err := validateAuth("API", opts.auth); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *oauthTokenURL != "" {
+		opts.oauth = &oauth2{
+			TokenURL:         *oauthTokenURL,
+			ClientID:         *oauthClientID,
+			ClientSecret:     *oauthClientSecret,
+			ClientSecretEnv:  *oauthClientSecretEnv,
+			ClientSecretFile: *oauthClientSecretFile,
+		}
+		for _, s := range strings.Split(*oauthScopes, opts.separator) {
+			if s = strings.TrimSpace(s); s != "" {
+				opts.oauth.Scopes = append(opts.oauth.Scopes, s)
+			}
+		}
+		if err := opts.oauth.validate("API"); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if opts.dedupAction != dedupSkip && opts.dedupAction != dedupFlag {
+		log.Fatalf("Unknown dedup action: %s\n", opts.dedupAction)
+	}
+
+	if strings.HasPrefix(opts.url, "s3://") {
+		if _, err := parseS3URL(opts.url); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if strings.HasPrefix(opts.url, "sftp://") {
+		if _, err := parseSFTPURL(opts.url); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if opts.s3SSE != "" && opts.s3SSE != sseS3 && opts.s3SSE != sseKMS {
+		log.Fatalf("Unknown server-side encryption: %s\n", opts.s3SSE)
+	}
+
+	if opts.s3PartSize < 5 {
+		log.Fatalln("S3 part size can not be less than 5 MB")
+	}
+
+	if opts.s3Concurrency < 1 {
+		log.Fatalln("S3 concurrency must be at least 1")
+	}
+
+	if opts.maxResponseSize < responseLimit {
+		log.Fatalf("Maximal response size can not be less than %d bytes\n", responseLimit)
+	}
+
+	if opts.maxBodySize < 0 {
+		log.Fatalln("Maximal body size can not be negative")
+	}
+
+	if _, err := parseProxies(opts.trustedProxies, opts.separator); err != nil {
+		log.Fatalln(err)
+	}
+
+	if err := validateCompress(opts.compress, opts.compressLevel); err != nil {
+		log.Fatalln(err)
+	}
+
+	if opts.chunkSize < 0 {
+		log.Fatalln("Chunk size can not be negative")
+	}
+
+	if opts.retryAttempts < 0 || opts.retryDelay < 0 || opts.retryMaxDelay < 0 {
+		log.Fatalln("Retry attempts and delays can not be negative")
+	}
+
+	if opts.retryJitter < 0 || opts.retryJitter > 1 {
+		log.Fatalln("Retry jitter must be between 0 and 1")
+	}
+
+	if opts.fips && !fips140.Enabled() {
+		log.Fatalln("FIPS mode requires Go cryptographic module in FIPS 140-3 mode, run with GODEBUG=fips140=on or build with GOFIPS140")
+	}
+
+	if err := validateArchiveFormat(opts.archiveFormat); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Files are still zipped when archiving is
+	// requested by route or API response
+	if opts.archiveFormat == archiveNone {
+		opts.zip, opts.archiveFormat = false, archiveZip
+	}
+
+	if err := validateEncrypt(opts.zipEncrypt, opts.fips); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *pins != "" {
+		if err := validatePins(opts.url, strings.Split(*pins, opts.separator)); err != nil {
+			log.Fatalln(err)
+		}
+		opts.pins, _ = parsePins(strings.Split(*pins, opts.separator))
+	}
+
+	if opts.transforms, err = parseTransforms(*transforms, opts.separator); err != nil {
+		log.Fatalln(err)
+	}
+	if opts.schemas, err = parseSchemas(*xsd, opts.separator); err != nil {
+		log.Fatalln(err)
+	}
+	if err := validateSchemas(opts.schemas); err != nil {
+		log.Fatalln(err)
+	}
+	opts.validateCommand = *validateCmd
+	for _, f := range strings.Split(*shadowIgnore, opts.separator) {
+		if f = strings.TrimSpace(f); f != "" {
+			opts.shadowIgnore = append(opts.shadowIgnore, f)
+		}
+	}
+	if err := validateCommand(opts.validateCommand); err != nil {
+		log.Fatalln(err)
+	}
+	for _, s := range strings.Split(*xlsxSheets, opts.separator) {
+		if s = strings.TrimSpace(s); s != "" {
+			opts.sheets = append(opts.sheets, s)
+		}
+	}
+
+	if opts.presignURL != "" {
+		if err := validatePresign(opts.presignURL, opts.url); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if opts.proxy != "" {
+		if err := validateProxy(opts.proxy); err != nil {
+			log.Fatalln(err)
+		}
+		if strings.HasPrefix(opts.url, "sftp://") || strings.HasPrefix(opts.shadowURL, "sftp://") {
+			log.Fatalln(errSFTPProxy)
+		}
+	}
+
+	if opts.snapshot != "" && opts.snapshot != snapshotLink && opts.snapshot != snapshotCopy {
+		log.Fatalf("Unknown snapshot mode: %s\n", opts.snapshot)
+	}
+
+	if opts.spillThreshold < 0 {
+		log.Fatalln("Spill threshold can not be negative")
+	}
+
+	if opts.quarantine == "" {
+		opts.quarantine = path.Join(opts.out, "quarantine")
+	}
+
+	if opts.deadLetter == "" {
+		opts.deadLetter = path.Join(opts.out, "dead-letter")
+	}
+
+	if opts.workspace == "" {
+		opts.workspace = path.Join(opts.out, ".workspace")
+	}
+
+	// Output may be inside of watched directory, by default both are
+	// working directory, files written there are never picked up
+	opts.producedPatterns = producedPatterns(opts)
+
+	if opts.readOnly {
+		if opts.journal == "" {
+			log.Fatalln("Read-only mode requires -journal to be set")
+		}
+
+		opts.zip = false
+		opts.clear = false
+	}
+
+	if opts.mirror && !opts.zip {
+		log.Fatalln("Mirror mode requires archiving to be enabled (-zip) and writable source")
+	}
+
+	// Configuration file is applied on top of flags,
+	// which are kept to be used again on reload
+	base := opts
+	if opts.config != "" {
+		opts, err = applyConfig(base)
+		if err != nil {
+			log.Fatalf("Config loading error: %s\n", err)
+		}
 	}
 
 	sentry := os.Getenv("SENTRY_DSN")
@@ -67,90 +531,210 @@ func main() {
 		fmt.Println("** WARNING: You currently have disabled Sentry **")
 	}
 
-	if opts.token == "" {
+	if opts.token == "" && opts.oauth == nil && !opts.mirror {
 		fmt.Println("** WARNING: You providen empty token! **")
 	}
 
+	if opts.adminKeys == "" && opts.jwtSecret == "" {
+		fmt.Println("** WARNING: Admin API is read-only without -admin-keys or -jwt-secret **")
+	}
+
 	// Enable metrics
-	if err := metrics.Setup(os.Getenv("METRICS_URL"), os.Getenv("METRICS_APPLICATION"), os.Getenv("METRICS_HOSTNAME")); err == nil {
-		go metrics.Watch(time.Second * 10)
+	metricsBuffer := defaultMetricsBuffer
+	if size := os.Getenv("METRICS_BUFFER"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			log.Fatalf("Wrong METRICS_BUFFER: %s\n", size)
+		}
+		metricsBuffer = n
+	}
+	if err := setupMetrics(os.Getenv("METRICS_URL"), os.Getenv("METRICS_APPLICATION"), os.Getenv("METRICS_HOSTNAME"), metricsBuffer); err == nil {
+		go watchMetrics(time.Second * 10)
 	} else {
 		log.Fatalf("Metrcis setup error: %s\n", err.Error())
 	}
 
 	fmt.Println("====================================================================")
 	fmt.Println("Configuration:")
-	fmt.Printf("  Interval:\t%d seconds\n", opts.interval)
-	fmt.Printf("  Timeout:\t%d seconds\n", opts.timeout)
+	fmt.Printf("  Interval:\t%d seconds (watch mode: %s)\n", opts.interval, opts.watchMode)
+	fmt.Printf("  Timeout:\t%d seconds (dns: %s, connect: %s, tls: %s, response: %s, attempt: %d seconds)\n", opts.timeout,
+		opts.seconds(opts.dnsTimeout), opts.seconds(opts.connectTimeout), opts.seconds(opts.tlsTimeout), opts.seconds(opts.responseTimeout), opts.attemptTimeout)
+	fmt.Printf("  Retries:\t%d attempts (0 is unlimited), delay %d-%d seconds, jitter %.2f\n", opts.retryAttempts, opts.retryDelay, opts.retryMaxDelay, opts.retryJitter)
 	fmt.Printf("  XML Check:\t%d seconds\n", opts.checkInterval)
-	fmt.Printf("  Directory:\t%s\n", opts.dir)
+	fmt.Printf("  Stable:\t%d seconds (lock probe: %t)\n", opts.stableWindow, opts.lockProbe)
+	fmt.Printf("  Completion:\t%s\n", opts.completion)
+	fmt.Printf("  Min age:\t%d seconds\n", opts.minAge)
+	fmt.Printf("  Directory:\t%s (recursive: %t)\n", opts.dir, opts.recursive)
 	fmt.Printf("  Zip dir:\t%s\n", opts.out)
 	fmt.Printf("  Patterns:\t%s (separator: %s)\n", opts.patterns, opts.separator)
-	fmt.Printf("  URL:\t\t%s, Token:%s\n", opts.url, opts.token)
+	if opts.exclude != "" {
+		fmt.Printf("  Exclude:\t%s\n", opts.exclude)
+	}
+	fmt.Printf("  URL:\t\t%s, Token: %s\n", opts.url, secretSource(opts.token, *tokenEnv, *tokenFile))
+	if opts.oauth != nil {
+		fmt.Printf("  Auth:\t\tOAuth2 %s (client: %s)\n", opts.oauth.TokenURL, opts.oauth.ClientID)
+	} else if opts.auth != authToken {
+		fmt.Printf("  Auth:\t\t%s\n", opts.auth)
+	}
+	for _, r := range opts.routes {
+		if len(r.Match) > 0 {
+			fmt.Printf("  Route:\t/%s [%s] -> %s (patterns: %s, hold: %t)\n", r.Dir, strings.Join(r.Match, opts.separator), r.URL, strings.Join(r.Patterns, opts.separator), r.Hold)
+			continue
+		}
+		fmt.Printf("  Route:\t/%s -> %s (patterns: %s, hold: %t)\n", r.Dir, r.URL, strings.Join(r.Patterns, opts.separator), r.Hold)
+	}
+	if strings.HasPrefix(opts.url, "s3://") {
+		fmt.Printf("  S3:\t\tsse: %s, part size: %d MB, concurrency: %d\n", opts.s3SSE, opts.s3PartSize, opts.s3Concurrency)
+	}
+	if opts.fips {
+		fmt.Printf("  FIPS:\t\tmode: %t, module: %t\n", opts.fips, fips140.Enabled())
+	}
+	if len(opts.pins) > 0 {
+		fmt.Printf("  Pins:\t\t%s\n", strings.Join(opts.pins, opts.separator))
+	}
+	if opts.presignURL != "" {
+		fmt.Printf("  Presign:\t%s (min size: %d bytes)\n", opts.presignURL, opts.presignMinSize)
+	}
+	if opts.proxy != "" {
+		fmt.Printf("  Proxy:\t%s\n", opts.proxyURL().Redacted())
+	}
+	fmt.Printf("  Compress:\t%s (level: %d)\n", opts.compress, opts.compressLevel)
+	if opts.chunkSize > 0 {
+		fmt.Printf("  Chunks:\t%d MB (tus)\n", opts.chunkSize)
+	}
+	if strings.HasPrefix(opts.url, "sftp://") {
+		fmt.Printf("  SFTP:\t\tkey: %s, known hosts: %s\n", opts.sftpKey, opts.sftpKnownHosts)
+	}
 	fmt.Printf("  Clear:\t%t\n", opts.clear)
-	fmt.Printf("  Zip:\t\t%t\n", opts.zip)
+	fmt.Printf("  Zip:\t\t%t (format: %s, encrypt: %s)\n", opts.zip, opts.archiveFormat, opts.zipEncrypt)
 	fmt.Printf("  Verbose:\t%t\n", opts.verbose)
 	fmt.Printf("  Listen:\t%s\n", opts.listen)
+	if opts.trustedProxies != "" {
+		fmt.Printf("  Proxies:\t%s\n", opts.trustedProxies)
+	}
+	fmt.Printf("  Grace:\t%d seconds\n", opts.grace)
+	fmt.Printf("  Workers:\t%d\n", opts.workers)
+	fmt.Printf("  Preflight:\t%s (min size: %d bytes)\n", opts.preflightURL, opts.preflightMinSize)
+	fmt.Printf("  Max response:\t%d bytes\n", opts.maxResponseSize)
+	fmt.Printf("  Max body:\t%d bytes (discover: %t)\n", opts.maxBodySize, opts.discoverBodySize)
+	fmt.Printf("  Transform:\t%s\n", *transforms)
+	fmt.Printf("  XSD:\t\t%s\n", *xsd)
+	fmt.Printf("  XLSX sheets:\t%s\n", *xlsxSheets)
+	fmt.Printf("  Validator:\t%s\n", opts.validateCommand)
+	fmt.Printf("  NTP:\t\t%s (max skew: %d seconds)\n", opts.ntpServer, opts.maxClockSkew)
+	fmt.Printf("  Max RSS:\t%d MB\n", opts.maxRSS)
+	fmt.Printf("  Hold:\t\t%t\n", opts.hold)
+	fmt.Printf("  Four-eyes:\t%t\n", opts.fourEyes)
+	fmt.Printf("  Read-only:\t%t\n", opts.readOnly)
+	fmt.Printf("  Journal:\t%s\n", opts.journal)
+	fmt.Printf("  Shadow:\t%s (log: %s, ignore: %s)\n", redactURL(opts.shadowURL), opts.shadowLog, *shadowIgnore)
+	fmt.Printf("  Dedup:\t%d seconds (action: %s)\n", opts.dedupWindow, opts.dedupAction)
+	fmt.Printf("  Proof key:\t%s\n", opts.proofKey)
+	fmt.Printf("  Daily:\t%s\n", opts.dailyManifest)
+	fmt.Printf("  Skip list:\t%s\n", opts.skipList)
+	fmt.Printf("  Retention:\t%d days, %d MB (export: %s)\n", opts.retentionDays, opts.retentionSize, opts.retentionExport)
+	fmt.Printf("  Archives:\t%d days, %d MB\n", opts.archiveRetentionDays, opts.archiveRetentionSize)
+	fmt.Printf("  Mirror:\t%t\n", opts.mirror)
+	fmt.Printf("  Checksums:\t%t\n", opts.checksums)
+	fmt.Printf("  Quarantine:\t%s\n", opts.quarantine)
+	fmt.Printf("  Dead letter:\t%s\n", opts.deadLetter)
+	fmt.Printf("  Workspace:\t%s (snapshot: %s, spill threshold: %d MB)\n", opts.workspace, opts.snapshot, opts.spillThreshold)
+	fmt.Printf("  Manifests:\t%s (deadline: %d seconds, policy: %s)\n", opts.manifestSuffix, opts.batchDeadline, opts.batchPolicy)
 	fmt.Println("====================================================================")
 
-	c := newController(opts)
+	a, err := newAdmin(opts)
+	if err != nil {
+		log.Fatalf("Admin API setup error: %s\n", err)
+	}
+
+	j, err := openJournal(opts.journal)
+	if err != nil {
+		log.Fatalf("Journal loading error: %s\n", err)
+	}
+
+	s, err := openSkipList(opts.skipList)
+	if err != nil {
+		log.Fatalf("Skip list loading error: %s\n", err)
+	}
+
+	ws, err := openWorkspace(opts.workspace)
+	if err != nil {
+		log.Fatalf("Workspace setup error: %s\n", err)
+	}
+
+	c := newController(opts, a, j, ws, s)
+	tokenProvider.observe(c.prom)
+	c.base = base
+	if opts.proofKey != "" {
+		if c.proofKey, err = loadSigner(opts.proofKey, time.Second*time.Duration(opts.timeout)); err != nil {
+			log.Fatalf("Proof key loading error: %s\n", err)
+		}
+	}
+
+	if opts.ntpServer != "" {
+		c.clock = newClock(opts.ntpServer, time.Second*time.Duration(opts.maxClockSkew))
+		c.clock.check()
+		go c.clock.watch(time.Hour)
+	}
+
+	go c.watchSLO(time.Minute)
+
+	if opts.maxRSS > 0 {
+		c.memory = newMemoryGuard(uint64(opts.maxRSS) * 1024 * 1024)
+		go c.memory.watch(time.Second * 5)
+	}
+
+	if opts.dailyManifest != "" {
+		go c.watchDays(time.Minute)
+	}
+
+	if opts.retentionDays > 0 || opts.retentionSize > 0 {
+		go newRetention(opts, j, a.audit).watch(time.Hour)
+	}
+
+	if opts.archiveRetentionDays > 0 || opts.archiveRetentionSize > 0 {
+		go c.watchArchives(time.Hour)
+	}
+
 	go c.watch()
 	go c.serve()
+	go c.reloadOnSignal()
+	go c.stopOnSignal(time.Second * time.Duration(opts.grace))
 
-	for {
-		if opts.verbose {
-			log.Println("Scanning directory for a new files")
+	// Directory events trigger scan immediately,
+	// interval scans are kept as a fallback
+	events := make(chan struct{}, 1)
+	if opts.watchMode == watchNotify {
+		closed := newCompletions()
+		if err := watchDir(opts.dir, opts.recursive, events, closed); err != nil {
+			log.Printf("Notify watch mode is unavailable, falling back to polling: %s\n", err)
+		} else {
+			c.closed = closed
 		}
-
-		files, err := ioutil.ReadDir(opts.dir)
-		if err != nil {
-			raven.CaptureErrorAndWait(err, map[string]string{
-				"directory": opts.dir,
-			})
-
-			log.Fatalf("Directory traverse error: %s\n", err)
-		}
-		c.setDirectoryListing(files)
-
-		if len(files) > 0 {
-			for _, file := range files {
-				// Skip if this is directory
-				if file.IsDir() {
-					if opts.verbose {
-						log.Printf("Path %s is directory skipping\n", file.Name())
-					}
-
-					continue
-				}
-
-				// Skip if file has wrong suffix
-				goodFile := false
-				for _, suffix := range strings.Split(opts.patterns, opts.separator) {
-					if strings.HasSuffix(file.Name(), strings.TrimSpace(suffix)) {
-						goodFile = true
-						break
-					}
-				}
-
-				if !goodFile {
-					if opts.verbose {
-						metrics.SendAndWait("files", metrics.M{
-							"skipped": true,
-						}, nil)
-						log.Printf("File %s is not accepted by system\n", file.Name())
-					}
-					continue
-				}
-
-				c.spawn(file)
-			}
+	}
+	if opts.watchMode == watchUSN {
+		closed, changes := newCompletions(), newChangeSet()
+		if err := watchJournal(opts, events, changes, closed); err != nil {
+			log.Printf("USN watch mode is unavailable, falling back to polling: %s\n", err)
+		} else {
+			c.closed, c.changes = closed, changes
 		}
+	}
+
+	for {
+		opts := c.opts()
+		delay := scan(c, opts)
 
 		if opts.verbose {
-			log.Printf("Sleeping for a %d sec\n", opts.interval)
+			log.Printf("Sleeping for a %s\n", delay)
 		}
 
-		time.Sleep(time.Second * time.Duration(opts.interval))
+		select {
+		case <-events:
+			if opts.verbose {
+				log.Println("Directory changed")
+			}
+		case <-time.After(delay):
+		}
 	}
-
 }
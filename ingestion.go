@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Completion protocols telling that producer has finished writing file
+const (
+	completionSize   = "size"
+	completionMarker = "marker"
+	completionRename = "rename"
+)
+
+// validateCompletion checks -completion and -done-suffix
+func validateCompletion(completion, doneSuffix string) error {
+	switch completion {
+	case completionSize, completionRename:
+		return nil
+	case completionMarker:
+		if doneSuffix == "" {
+			return errors.New("Done marker suffix can not be empty")
+		}
+		return nil
+	}
+
+	return errors.New("Unknown completion protocol, expected size, marker or rename: " + completion)
+}
+
+// doneMarker returns path of marker producer drops next to complete file
+// with marker protocol, empty one is returned for other protocols
+func (o options) doneMarker(filePath string) string {
+	if o.completion != completionMarker {
+		return ""
+	}
+
+	return filePath + o.doneSuffix
+}
+
+// complete tells whether file may be picked up under completion protocol,
+// with marker protocol it is once its marker exists
+func (o options) complete(filePath string) bool {
+	marker := o.doneMarker(filePath)
+	if marker == "" {
+		return true
+	}
+
+	_, err := os.Stat(marker)
+	return err == nil
+}
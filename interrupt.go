@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+// Reasons waits of file in work are interrupted for
+var (
+	errShutdown = errors.New("hooker is shutting down")
+	errPaused   = errors.New("processing is paused")
+	errDeleted  = errors.New("file is deleted by operator")
+	errResend   = errors.New("API asked to resend file later")
+)
+
+// interruption returns reason err was caused by, nil when
+// it is a regular error which has to fail the file
+func interruption(err error) error {
+	for _, reason := range []error{errShutdown, errPaused, errDeleted, errResend} {
+		if errors.Is(err, reason) {
+			return reason
+		}
+	}
+
+	return nil
+}
+
+// interruptible tells whether file in given stage may be interrupted,
+// waits before upload and between its attempts are, upload itself is not
+func interruptible(stage string) bool {
+	switch stage {
+	case progressWaiting, progressStabilizing, progressValidating, progressRetrying:
+		return true
+	}
+
+	return false
+}
+
+// watchContext returns context of file in work, cancelled
+// with interruption reason on shutdown or when file is deleted
+func (c *controller) watchContext(name string) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	c.cancels[name] = cancel
+
+	return ctx, cancel
+}
+
+// interrupt cancels waits of file in work, found is false when file
+// is not in work and interrupted is false while it is being uploaded
+func (c *controller) interrupt(name string, reason error) (found, interrupted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cancel, ok := c.cancels[name]
+	fp, tracked := c.progress[name]
+	if !ok || !tracked {
+		return false, false
+	}
+	if !interruptible(fp.Stage) {
+		return true, false
+	}
+
+	cancel(reason)
+	return true, true
+}
+
+// interruptAll cancels waits of every file in work
+func (c *controller) interruptAll(reason error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cancel := range c.cancels {
+		cancel(reason)
+	}
+}
+
+// pausing returns channel closed once processing is paused
+func (c *controller) pausing() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.paused
+}
+
+// sleep waits for d unless file is interrupted first. Pausable waits,
+// ones before upload starts, are also interrupted by pause, retry
+// backoffs go on as files in work finish their retries when paused
+func sleep(ctx context.Context, c *controller, d time.Duration, pausable bool) error {
+	var paused <-chan struct{}
+	if pausable {
+		paused = c.pausing()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-paused:
+		return errPaused
+	case <-t.C:
+		return nil
+	}
+}
+
+// sleep waits for d unless parser is interrupted first
+func (p *parser) sleep(d time.Duration, pausable bool) error {
+	return sleep(p.ctx, p.controller, d, pausable)
+}
+
+// leave handles file whose processing was interrupted, it stays in
+// place to be picked up again unless operator deleted it
+func (p *parser) leave(reason error, paths ...string) {
+	if reason != errDeleted {
+		log.Printf("[FILE: %s] Interrupted, %s, file is left in place\n", p.prefix, reason)
+		return
+	}
+
+	for _, filePath := range paths {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("[FILE: %s] Error deleting file %s: %s\n", p.prefix, filePath, err)
+		}
+	}
+
+	log.Printf("[FILE: %s] File deleted by operator\n", p.prefix)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// States of journal entries
+const (
+	stateDelivered = "delivered"
+	stateRetained  = "retained"
+	stateMirrored  = "mirrored"
+	stateSkipped   = "skipped"
+	stateFailed    = "failed"
+	stateSending   = "sending"
+	stateDuplicate = "duplicate"
+)
+
+// done tells whether entry state means file was processed,
+// sending entries only mark upload which has been started
+func done(state string) bool {
+	return state != stateFailed && state != stateSending
+}
+
+type journalEntry struct {
+	// ID is processing ID of route, name and content, entries
+	// written before it was introduced get it once loaded
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name"`
+	Route string `json:"route,omitempty"`
+	// Destination is empty for main URL
+	Destination string    `json:"destination,omitempty"`
+	State       string    `json:"state,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Size        int64     `json:"size"`
+	Mtime       time.Time `json:"mtime"`
+	SHA256      string    `json:"sha256"`
+	SentAt      time.Time `json:"sent_at"`
+	Action      string    `json:"action,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Response    string    `json:"response,omitempty"`
+	// Deadline is set for routes with SLO
+	Deadline    *time.Time `json:"deadline,omitempty"`
+	DeadlineMet *bool      `json:"deadline_met,omitempty"`
+}
+
+// journal is an append-only log of delivered files, stored as
+// JSON lines and fully loaded in memory with name, route,
+// content and processing ID indexes
+type journal struct {
+	mu      sync.Mutex
+	path    string
+	entries []journalEntry
+	byName  map[string][]int
+	byRoute map[string][]int
+	byHash  map[string][]int
+	byID    map[string][]int
+}
+
+// openJournal loads journal from path, empty
+// path gives in-memory journal
+func openJournal(path string) (*journal, error) {
+	j := &journal{
+		path:    path,
+		byName:  make(map[string][]int),
+		byRoute: make(map[string][]int),
+		byHash:  make(map[string][]int),
+		byID:    make(map[string][]int),
+	}
+
+	if path == "" {
+		return j, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+
+		j.index(e)
+	}
+
+	return j, scanner.Err()
+}
+
+// withID fills processing ID of entry which has content hash
+func withID(e journalEntry) journalEntry {
+	if e.ID == "" && e.SHA256 != "" {
+		e.ID = processingID(e.Route, e.Name, e.SHA256)
+	}
+
+	return e
+}
+
+func (j *journal) index(e journalEntry) {
+	e = withID(e)
+	i := len(j.entries)
+	j.entries = append(j.entries, e)
+	j.byName[e.Name] = append(j.byName[e.Name], i)
+	j.byRoute[e.Route] = append(j.byRoute[e.Route], i)
+	if e.SHA256 != "" {
+		j.byHash[e.SHA256] = append(j.byHash[e.SHA256], i)
+	}
+	if e.ID != "" {
+		j.byID[e.ID] = append(j.byID[e.ID], i)
+	}
+}
+
+func (j *journal) record(e journalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e = withID(e)
+	j.index(e)
+
+	if j.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// compact applies retention to journal file
+// and rebuilds in-memory indexes from what is left
+func (j *journal) compact(r *retention) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	pruned, err := r.compact("journal", j.path, "sent_at")
+	if err != nil || pruned == 0 {
+		return pruned, err
+	}
+
+	j.entries = nil
+	j.byName = make(map[string][]int)
+	j.byRoute = make(map[string][]int)
+	j.byHash = make(map[string][]int)
+	j.byID = make(map[string][]int)
+
+	lines, _, err := readRecords(j.path, "sent_at")
+	if err != nil {
+		return pruned, err
+	}
+
+	for _, line := range lines {
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return pruned, err
+		}
+
+		j.index(e)
+	}
+
+	return pruned, nil
+}
+
+// find returns entries of file with given name
+func (j *journal) find(name string) []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := []journalEntry{}
+	for _, i := range j.byName[name] {
+		entries = append(entries, j.entries[i])
+	}
+
+	return entries
+}
+
+// delivered reports whether file with same name, size and modification
+// time was already sent to every destination it was started for, failure
+// recorded later means it has to be sent again
+func (j *journal) delivered(name string, size int64, mtime time.Time) bool {
+	sent := map[string]bool{}
+	for _, e := range j.find(name) {
+		if e.Size != size || !e.Mtime.Equal(mtime) {
+			continue
+		}
+
+		if e.State == stateFailed {
+			sent = map[string]bool{}
+			continue
+		}
+		sent[e.Destination] = done(e.State)
+	}
+
+	for _, ok := range sent {
+		if !ok {
+			return false
+		}
+	}
+
+	return len(sent) > 0
+}
+
+// retained reports whether file with same name, size and
+// modification time was sent and API asked to keep it in place
+func (j *journal) retained(name string, size int64, mtime time.Time) bool {
+	for _, e := range j.find(name) {
+		if e.Size == size && e.Mtime.Equal(mtime) && e.Action == actionRetain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findID returns entries with given processing ID
+func (j *journal) findID(id string) []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := []journalEntry{}
+	for _, i := range j.byID[id] {
+		entries = append(entries, j.entries[i])
+	}
+
+	return entries
+}
+
+// deliveredTo reports whether content with given processing
+// ID was already sent to destination with given name
+func (j *journal) deliveredTo(id, destination string) bool {
+	for _, e := range j.findID(id) {
+		if done(e.State) && e.Destination == destination {
+			return true
+		}
+	}
+
+	return false
+}
+
+// interrupted tells whether upload with given processing ID was
+// started but neither finished nor failed, e.g. because of a crash
+func (j *journal) interrupted(name, id, destination string) bool {
+	sending := false
+	for _, e := range j.find(name) {
+		if (e.ID == id && e.Destination == destination) || e.State == stateFailed {
+			sending = e.State == stateSending
+		}
+	}
+
+	return sending
+}
+
+// search returns entries matching query newest first, using
+// route index when query is limited to a single route
+func (j *journal) search(q query) ([]journalEntry, int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var candidates []int
+	if q.route != "" {
+		candidates = j.byRoute[q.route]
+	} else if q.exactName {
+		candidates = j.byName[q.name]
+	} else {
+		candidates = make([]int, len(j.entries))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	}
+
+	matched := []journalEntry{}
+	for k := len(candidates) - 1; k >= 0; k-- {
+		e := j.entries[candidates[k]]
+		if q.match(e.Name, e.Route, e.State, e.Status, e.SentAt) {
+			matched = append(matched, e)
+		}
+	}
+
+	total := len(matched)
+	lo, hi := q.page(total)
+
+	return matched[lo:hi], total
+}
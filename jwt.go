@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// jwtMaxLifetime caps how far in the future admin token may expire,
+// so a leaked token can't be used for good
+const jwtMaxLifetime = 24 * time.Hour
+
+type jwtClaims struct {
+	Subject string `json:"sub"`
+	Role    string `json:"role"`
+	Expires int64  `json:"exp"`
+}
+
+// parseJWT verifies HS256 signed token and returns its claims
+func parseJWT(token string, secret []byte) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	h := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, err
+	}
+
+	if h.Alg != "HS256" {
+		return nil, errors.New("Unsupported token algorithm: " + h.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("Invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &jwtClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if claims.Expires == 0 {
+		return nil, errors.New("Token has no expiration")
+	}
+	if now.Unix() > claims.Expires {
+		return nil, errors.New("Token expired")
+	}
+	if time.Unix(claims.Expires, 0).Sub(now) > jwtMaxLifetime {
+		return nil, errors.New("Token expires later than in 24 hours")
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("Token subject is empty")
+	}
+
+	return claims, nil
+}
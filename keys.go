@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	algEd25519 = "ed25519"
+	algECDSA   = "ecdsa-p256-sha256"
+)
+
+// signer signs proofs and manifests with key kept either on disk or in
+// key management service, ed25519 signs data itself while ecdsa-p256-sha256
+// produces ASN.1 signature of its SHA-256 digest
+type signer interface {
+	algorithm() string
+	// publicKey is base64 of raw Ed25519 key or of DER encoded SPKI
+	publicKey() string
+	sign(data []byte) ([]byte, error)
+}
+
+// loadSigner picks key provider by reference: awskms://<key id or arn>,
+// gcpkms://projects/.../cryptoKeyVersions/N, vault://<mount>/<key>
+// or path to PKCS#8 PEM Ed25519 private key
+func loadSigner(ref string, timeout time.Duration) (signer, error) {
+	switch {
+	case strings.HasPrefix(ref, "awskms://"):
+		return newAWSKMSSigner(strings.TrimPrefix(ref, "awskms://"), timeout)
+	case strings.HasPrefix(ref, "gcpkms://"):
+		return newGCPKMSSigner(strings.TrimPrefix(ref, "gcpkms://"), timeout)
+	case strings.HasPrefix(ref, "vault://"):
+		return newVaultSigner(strings.TrimPrefix(ref, "vault://"), timeout)
+	}
+
+	key, err := loadProofKey(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return fileSigner(key), nil
+}
+
+// fileSigner is Ed25519 key read from disk
+type fileSigner ed25519.PrivateKey
+
+func (k fileSigner) algorithm() string {
+	return algEd25519
+}
+
+func (k fileSigner) publicKey() string {
+	return base64.StdEncoding.EncodeToString(ed25519.PrivateKey(k).Public().(ed25519.PublicKey))
+}
+
+func (k fileSigner) sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(ed25519.PrivateKey(k), data), nil
+}
+
+// signed returns what is passed to key provider for
+// given algorithm, either data itself or its digest
+func signed(alg string, data []byte) []byte {
+	if alg == algEd25519 {
+		return data
+	}
+
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// encodePublicKey converts DER or PEM encoded SPKI public key
+// returned by key provider into algorithm and published form
+func encodePublicKey(der []byte) (string, string, error) {
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return algEd25519, base64.StdEncoding.EncodeToString(k), nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return "", "", errors.New("Only P-256 ECDSA keys are supported")
+		}
+		return algECDSA, base64.StdEncoding.EncodeToString(der), nil
+	}
+
+	return "", "", errors.New("Signing key must be Ed25519 or ECDSA P-256")
+}
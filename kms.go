@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// awsKMSSigner signs with asymmetric AWS KMS key,
+// only digest of data is sent to KMS
+type awsKMSSigner struct {
+	client *s3Client
+	keyID  string
+	alg    string
+	public string
+}
+
+func newAWSKMSSigner(keyID string, timeout time.Duration) (*awsKMSSigner, error) {
+	if keyID == "" {
+		return nil, errors.New("AWS KMS key id is not set")
+	}
+
+	s := &awsKMSSigner{
+		client: newAWSClient("kms", "KMS_ENDPOINT", timeout),
+		keyID:  keyID,
+	}
+
+	out := struct {
+		PublicKey []byte
+	}{}
+	if err := s.call("GetPublicKey", map[string]string{"KeyId": keyID}, &out); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if s.alg, s.public, err = encodePublicKey(out.PublicKey); err != nil {
+		return nil, err
+	}
+	if s.alg != algECDSA {
+		return nil, errors.New("AWS KMS key must be ECC_NIST_P256")
+	}
+
+	return s, nil
+}
+
+func (s *awsKMSSigner) algorithm() string {
+	return s.alg
+}
+
+func (s *awsKMSSigner) publicKey() string {
+	return s.public
+}
+
+func (s *awsKMSSigner) sign(data []byte) ([]byte, error) {
+	in := map[string]interface{}{
+		"KeyId":            s.keyID,
+		"Message":          signed(s.alg, data),
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": "ECDSA_SHA_256",
+	}
+	out := struct {
+		Signature []byte
+	}{}
+	if err := s.call("Sign", in, &out); err != nil {
+		return nil, err
+	}
+
+	return out.Signature, nil
+}
+
+// call executes KMS JSON API action
+func (s *awsKMSSigner) call(action string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.client.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+
+	sum := sha256.Sum256(body)
+	s.client.sign(req, hex.EncodeToString(sum[:]), time.Now().UTC())
+
+	return doJSON(s.client.client, req, "AWS KMS "+action, out)
+}
+
+// gcpKMSSigner signs with asymmetric Cloud KMS key version,
+// access token is taken from GOOGLE_OAUTH_ACCESS_TOKEN or
+// metadata server of the instance
+type gcpKMSSigner struct {
+	client   *http.Client
+	endpoint string
+	name     string
+	alg      string
+	public   string
+}
+
+func newGCPKMSSigner(name string, timeout time.Duration) (*gcpKMSSigner, error) {
+	if !strings.Contains(name, "/cryptoKeyVersions/") {
+		return nil, errors.New("Cloud KMS key must be full key version name: " + name)
+	}
+
+	endpoint := os.Getenv("GCP_KMS_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "https://cloudkms.googleapis.com"
+	}
+
+	s := &gcpKMSSigner{
+		client:   &http.Client{Timeout: timeout},
+		endpoint: strings.TrimRight(endpoint, "/"),
+		name:     name,
+	}
+
+	out := struct {
+		PEM string `json:"pem"`
+	}{}
+	if err := s.call(http.MethodGet, "/publicKey", nil, &out); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if s.alg, s.public, err = encodePublicKey([]byte(out.PEM)); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *gcpKMSSigner) algorithm() string {
+	return s.alg
+}
+
+func (s *gcpKMSSigner) publicKey() string {
+	return s.public
+}
+
+func (s *gcpKMSSigner) sign(data []byte) ([]byte, error) {
+	in := map[string]interface{}{
+		"data": data,
+	}
+	if s.alg == algECDSA {
+		in = map[string]interface{}{
+			"digest": map[string][]byte{"sha256": signed(s.alg, data)},
+		}
+	}
+
+	out := struct {
+		Signature []byte `json:"signature"`
+	}{}
+	if err := s.call(http.MethodPost, ":asymmetricSign", in, &out); err != nil {
+		return nil, err
+	}
+
+	return out.Signature, nil
+}
+
+func (s *gcpKMSSigner) call(method, suffix string, in, out interface{}) error {
+	token, err := s.token()
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	if in != nil {
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, s.endpoint+"/v1/"+s.name+suffix, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	return doJSON(s.client, req, "Cloud KMS", out)
+}
+
+func (s *gcpKMSSigner) token() (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	out := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := doJSON(s.client, req, "GCP metadata", &out); err != nil {
+		return "", err
+	}
+
+	return out.AccessToken, nil
+}
+
+// vaultSigner signs with Vault transit key using
+// VAULT_ADDR and VAULT_TOKEN from environment
+type vaultSigner struct {
+	client  *http.Client
+	addr    string
+	token   string
+	mount   string
+	key     string
+	version int
+	alg     string
+	public  string
+}
+
+func newVaultSigner(ref string, timeout time.Duration) (*vaultSigner, error) {
+	mount, key := path.Split(strings.Trim(ref, "/"))
+	if mount == "" || key == "" {
+		return nil, errors.New("Vault key must be vault://<mount>/<key>: " + ref)
+	}
+
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, errors.New("VAULT_ADDR is not set")
+	}
+
+	s := &vaultSigner{
+		client: &http.Client{Timeout: timeout},
+		addr:   strings.TrimRight(addr, "/"),
+		token:  os.Getenv("VAULT_TOKEN"),
+		mount:  strings.Trim(mount, "/"),
+		key:    key,
+	}
+
+	out := struct {
+		Data struct {
+			Type          string `json:"type"`
+			LatestVersion int    `json:"latest_version"`
+			Keys          map[string]struct {
+				PublicKey string `json:"public_key"`
+			} `json:"keys"`
+		} `json:"data"`
+	}{}
+	if err := s.call(http.MethodGet, "keys", nil, &out); err != nil {
+		return nil, err
+	}
+
+	s.version = out.Data.LatestVersion
+	public := out.Data.Keys[strconv.Itoa(s.version)].PublicKey
+
+	switch out.Data.Type {
+	case "ed25519":
+		raw, err := base64.StdEncoding.DecodeString(public)
+		if err != nil {
+			return nil, err
+		}
+		s.alg, s.public = algEd25519, base64.StdEncoding.EncodeToString(raw)
+	case "ecdsa-p256":
+		var err error
+		if s.alg, s.public, err = encodePublicKey([]byte(public)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Vault key type %s is not supported, use ed25519 or ecdsa-p256", out.Data.Type)
+	}
+
+	return s, nil
+}
+
+func (s *vaultSigner) algorithm() string {
+	return s.alg
+}
+
+func (s *vaultSigner) publicKey() string {
+	return s.public
+}
+
+func (s *vaultSigner) sign(data []byte) ([]byte, error) {
+	in := map[string]interface{}{
+		"input":       signed(s.alg, data),
+		"key_version": s.version,
+	}
+	if s.alg == algECDSA {
+		in["prehashed"] = true
+		in["hash_algorithm"] = "sha2-256"
+	}
+
+	out := struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}{}
+	if err := s.call(http.MethodPost, "sign", in, &out); err != nil {
+		return nil, err
+	}
+
+	// Signature looks like vault:v1:<base64>
+	parts := strings.Split(out.Data.Signature, ":")
+	return base64.StdEncoding.DecodeString(parts[len(parts)-1])
+}
+
+func (s *vaultSigner) call(method, action string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, s.addr+"/v1/"+s.mount+"/"+action+"/"+s.key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	return doJSON(s.client, req, "Vault", out)
+}
+
+// doJSON executes request and decodes JSON response
+func doJSON(client *http.Client, req *http.Request, name string, out interface{}) error {
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %w", name, &httpStatusError{Code: response.StatusCode, Body: truncate(data)})
+	}
+
+	return json.Unmarshal(data, out)
+}
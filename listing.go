@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// File states reported by files listing
+const (
+	fileWaiting = "waiting"
+	fileWorking = "working"
+	fileHeld    = "held"
+	fileQueued  = "queued"
+)
+
+type fileItem struct {
+	Name  string    `json:"name"`
+	Route string    `json:"route,omitempty"`
+	State string    `json:"state"`
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+// fileItems describes every file of directory listing with its state
+func (c *controller) fileItems() []fileItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	items := []fileItem{}
+	for _, fi := range c.dirlist {
+		if fi.IsDir() {
+			continue
+		}
+
+		state := fileWaiting
+		if _, ok := c.files[fi.Name()]; ok {
+			state = fileWorking
+		}
+		if c.queued[fi.Name()] {
+			state = fileQueued
+		}
+		if _, ok := c.held[fi.Name()]; ok {
+			state = fileHeld
+		}
+
+		items = append(items, fileItem{
+			Name:  fi.Name(),
+			Route: c.opts().forFile(fi.Name()).route,
+			State: state,
+			Size:  fi.Size(),
+			Mtime: fi.ModTime(),
+		})
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+
+	return items
+}
+
+// handleFiles serves GET /files listing
+// directory files filtered by query
+func (c *controller) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	matched := []fileItem{}
+	for _, item := range c.fileItems() {
+		if q.match(item.Name, item.Route, item.State, 0, item.Mtime) {
+			matched = append(matched, item)
+		}
+	}
+
+	lo, hi := q.page(len(matched))
+	writePage(w, q, len(matched), matched[lo:hi])
+}
+
+// handleHistory serves GET /history with journal entries
+func (c *controller) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, total := c.journal.search(q)
+	writePage(w, q, total, entries)
+}
@@ -0,0 +1,32 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "syscall"
+
+// writerDone probes whether writer has finished with file by opening it
+// without sharing write access, which fails with sharing violation
+// while any other process still has file open for writing
+func writerDone(filePath string) bool {
+	name, err := syscall.UTF16PtrFromString(filePath)
+	if err != nil {
+		return false
+	}
+
+	handle, err := syscall.CreateFile(
+		name,
+		syscall.GENERIC_READ,
+		syscall.FILE_SHARE_READ,
+		nil,
+		syscall.OPEN_EXISTING,
+		syscall.FILE_ATTRIBUTE_NORMAL,
+		0,
+	)
+	if err != nil {
+		return false
+	}
+	syscall.CloseHandle(handle)
+
+	return true
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/cryptopay-dev/go-metrics"
+	"github.com/getsentry/raven-go"
+)
+
+// Fractions of limit at which shedding starts and stops
+const (
+	shedHigh = 0.9
+	shedLow  = 0.8
+)
+
+// rss returns resident set size of process in bytes, using
+// /proc when available and Go runtime stats otherwise
+func rss() uint64 {
+	f, err := os.Open("/proc/self/status")
+	if err == nil {
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "VmRSS:") {
+				continue
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				if kb, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+					return kb * 1024
+				}
+			}
+		}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return mem.Sys
+}
+
+// memoryGuard stops admitting new files
+// while process is close to memory limit
+type memoryGuard struct {
+	mu       sync.Mutex
+	limit    uint64
+	current  uint64
+	shedding bool
+}
+
+func newMemoryGuard(limit uint64) *memoryGuard {
+	return &memoryGuard{
+		limit: limit,
+	}
+}
+
+func (g *memoryGuard) check() {
+	current := rss()
+
+	g.mu.Lock()
+	g.current = current
+	wasShedding := g.shedding
+	switch {
+	case float64(current) >= float64(g.limit)*shedHigh:
+		g.shedding = true
+	case float64(current) < float64(g.limit)*shedLow:
+		g.shedding = false
+	}
+	shedding := g.shedding
+	g.mu.Unlock()
+
+	sendMetrics("memory", metrics.M{
+		"rss":      current,
+		"shedding": shedding,
+	}, nil)
+
+	if !shedding {
+		if wasShedding {
+			log.Printf("[MEMORY] RSS is %d MB, admitting new files again\n", current/1024/1024)
+		}
+		return
+	}
+
+	if !wasShedding {
+		log.Printf("[MEMORY] RSS is %d MB of %d MB limit, not admitting new files\n", current/1024/1024, g.limit/1024/1024)
+
+		raven.CaptureMessage("Memory limit is close, shedding load", map[string]string{
+			"rss":   strconv.FormatUint(current, 10),
+			"limit": strconv.FormatUint(g.limit, 10),
+		})
+	}
+
+	debug.FreeOSMemory()
+}
+
+func (g *memoryGuard) watch(interval time.Duration) {
+	for {
+		g.check()
+		time.Sleep(interval)
+	}
+}
+
+// admit reports whether new files may be started
+func (g *memoryGuard) admit() bool {
+	if g == nil {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return !g.shedding
+}
+
+func (g *memoryGuard) status() map[string]interface{} {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return map[string]interface{}{
+		"rss":      g.current,
+		"limit":    g.limit,
+		"shedding": g.shedding,
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/cryptopay-dev/go-metrics"
+	"github.com/nats-io/go-nats"
+)
+
+// metricsSink delivers metrics to METRICS_URL, go-metrics
+// connection publishes them into NATS, statsdSink sends
+// them over UDP
+type metricsSink interface {
+	SendAndWait(name string, m metrics.M, t metrics.T) error
+	Disable()
+}
+
+// metricsConn is nil while METRICS_URL is not set
+var metricsConn *metricsBuffer
+
+// defaultMetricsBuffer is how many metrics are kept
+// while METRICS_URL is unavailable
+const defaultMetricsBuffer = 1000
+
+// natsReconnectWait is delay between NATS connection attempts
+const natsReconnectWait = 2 * time.Second
+
+// errMetricsDisconnected is returned until NATS is connected
+var errMetricsDisconnected = errors.New("Metrics transport is not connected yet")
+
+// setupMetrics connects to METRICS_URL picking sink by its scheme,
+// up to size metrics are kept while it is unavailable
+func setupMetrics(url, application, hostname string, size int) error {
+	if url == "" {
+		return nil
+	}
+
+	if application == "" {
+		return errors.New("Application name not set")
+	}
+	if hostname == "" {
+		return errors.New("Hostname not set")
+	}
+
+	if strings.HasPrefix(url, "statsd://") || strings.HasPrefix(url, "dogstatsd://") {
+		s, err := newStatsD(url, application, hostname)
+		if err != nil {
+			return err
+		}
+		metricsConn = &metricsBuffer{sink: s, size: size}
+		return nil
+	}
+
+	b := &metricsBuffer{size: size}
+	options := []nats.Option{
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(natsReconnectWait),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			go b.flush()
+		}),
+		// Publishing fails while reconnecting instead of filling
+		// client buffer, so such metrics are kept and counted here
+		func(o *nats.Options) error {
+			o.ReconnectBufSize = -1
+			return nil
+		},
+	}
+
+	c, err := metrics.New(url, application, hostname, options...)
+	switch {
+	case err == nats.ErrNoServers:
+		// NATS is not up yet, connecting in background
+		go b.connect(func() (metricsSink, error) {
+			return metrics.New(url, application, hostname, options...)
+		})
+	case err != nil:
+		return err
+	default:
+		b.sink = c
+	}
+	metricsConn = b
+
+	return nil
+}
+
+// sendMetrics sends metrics in background
+func sendMetrics(name string, m metrics.M, t metrics.T) {
+	go sendMetricsAndWait(name, m, t)
+}
+
+// sendMetricsAndWait sends metrics, it does nothing without METRICS_URL
+func sendMetricsAndWait(name string, m metrics.M, t metrics.T) error {
+	if metricsConn == nil {
+		return nil
+	}
+
+	return metricsConn.SendAndWait(name, m, t)
+}
+
+// metricsDropped returns number of metrics lost because buffer was full
+func metricsDropped() uint64 {
+	if metricsConn == nil {
+		return 0
+	}
+
+	return metricsConn.lost()
+}
+
+// disableMetrics disconnects from METRICS_URL
+func disableMetrics() {
+	if metricsConn != nil {
+		metricsConn.Disable()
+	}
+}
+
+// watchMetrics reports Go runtime stats as gostats every interval
+func watchMetrics(interval time.Duration) {
+	var mem runtime.MemStats
+	for {
+		runtime.ReadMemStats(&mem)
+		sendMetricsAndWait("gostats", metrics.M{
+			"alloc":         mem.Alloc,
+			"alloc_objects": mem.HeapObjects,
+			"gorotines":     runtime.NumGoroutine(),
+			"gc":            mem.LastGC,
+			"next_gc":       mem.NextGC,
+			"pause_ns":      mem.PauseNs[(mem.NumGC+255)%256],
+			"dropped":       metricsDropped(),
+			"buffered":      metricsConn.len(),
+		}, nil)
+
+		time.Sleep(interval)
+	}
+}
+
+// metricsEntry is metric kept until sink is back
+type metricsEntry struct {
+	name string
+	m    metrics.M
+	t    metrics.T
+}
+
+// metricsBuffer delivers metrics to sink, ones it fails to deliver
+// are kept and sent first once it is back, the oldest of them are
+// dropped when there are more than size
+type metricsBuffer struct {
+	mu       sync.Mutex
+	sink     metricsSink
+	entries  []metricsEntry
+	size     int
+	dropped  uint64
+	disabled bool
+}
+
+// SendAndWait returns error of sink, metrics are kept anyway
+func (b *metricsBuffer) SendAndWait(name string, m metrics.M, t metrics.T) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.disabled {
+		return nil
+	}
+
+	e := metricsEntry{name: name, m: m, t: t}
+	if b.sink == nil {
+		b.push(e)
+		return errMetricsDisconnected
+	}
+
+	if err := b.send(); err != nil {
+		b.push(e)
+		return err
+	}
+
+	if err := b.sink.SendAndWait(name, m, t); err != nil {
+		b.push(e)
+		return err
+	}
+
+	return nil
+}
+
+// flush sends kept metrics, it is called once NATS reconnects
+func (b *metricsBuffer) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sink == nil || b.disabled {
+		return nil
+	}
+
+	return b.send()
+}
+
+// send delivers kept metrics in order until sink fails
+func (b *metricsBuffer) send() error {
+	for len(b.entries) > 0 {
+		e := b.entries[0]
+		if err := b.sink.SendAndWait(e.name, e.m, e.t); err != nil {
+			return err
+		}
+		b.entries = b.entries[1:]
+	}
+
+	return nil
+}
+
+func (b *metricsBuffer) push(e metricsEntry) {
+	b.entries = append(b.entries, e)
+	if over := len(b.entries) - b.size; over > 0 {
+		b.entries = b.entries[over:]
+		b.dropped += uint64(over)
+	}
+}
+
+// connect retries until sink is created and sends kept metrics
+func (b *metricsBuffer) connect(dial func() (metricsSink, error)) {
+	for {
+		time.Sleep(natsReconnectWait)
+
+		sink, err := dial()
+		if err != nil {
+			continue
+		}
+
+		b.mu.Lock()
+		if b.disabled {
+			b.mu.Unlock()
+			sink.Disable()
+			return
+		}
+		b.sink = sink
+		b.mu.Unlock()
+
+		b.flush()
+		return
+	}
+}
+
+func (b *metricsBuffer) len() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.entries)
+}
+
+func (b *metricsBuffer) lost() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.dropped
+}
+
+// Disable disconnects sink, metrics sent afterwards are ignored
+func (b *metricsBuffer) Disable() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.disabled = true
+	if b.sink != nil {
+		b.sink.Disable()
+	}
+}
+
+// statsdMaxPacket keeps datagrams below common MTU
+const statsdMaxPacket = 1432
+
+// statsdSink sends metrics over UDP in StatsD format, with DogStatsD
+// tags are attached to every metric, plain StatsD has no tags
+type statsdSink struct {
+	mu          sync.Mutex
+	conn        net.Conn
+	dogstatsd   bool
+	application string
+	hostname    string
+	disabled    bool
+}
+
+func newStatsD(url, application, hostname string) (*statsdSink, error) {
+	dogstatsd := strings.HasPrefix(url, "dogstatsd://")
+	addr := strings.TrimPrefix(strings.TrimPrefix(url, "dogstatsd://"), "statsd://")
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdSink{
+		conn:        conn,
+		dogstatsd:   dogstatsd,
+		application: application,
+		hostname:    hostname,
+	}, nil
+}
+
+// SendAndWait sends every metric as separate line: booleans are counters
+// incremented by one, numbers are gauges and strings are skipped
+func (s *statsdSink) SendAndWait(name string, m metrics.M, t metrics.T) error {
+	tags := metrics.T{"hostname": s.hostname}
+	for k, v := range t {
+		tags[k] = v
+	}
+
+	suffix := ""
+	if s.dogstatsd {
+		var pairs []string
+		for k, v := range tags {
+			pairs = append(pairs, k+":"+v)
+		}
+		sort.Strings(pairs)
+		suffix = "|#" + strings.Join(pairs, ",")
+	}
+
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, k := range keys {
+		var value string
+		switch v := m[k].(type) {
+		case bool:
+			if !v {
+				continue
+			}
+			value = "1|c"
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+			value = fmt.Sprintf("%v|g", v)
+		default:
+			continue
+		}
+
+		lines = append(lines, s.application+"."+name+"."+k+":"+value+suffix)
+	}
+
+	return s.write(lines)
+}
+
+// write packs lines into as few datagrams as possible
+func (s *statsdSink) write(lines []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.disabled {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > statsdMaxPacket {
+			if _, err := s.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteRune('\n')
+		}
+		buf.WriteString(line)
+	}
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+// Disable closes UDP socket, metrics sent afterwards are ignored
+func (s *statsdSink) Disable() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.disabled = true
+	s.conn.Close()
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const csrfCookie = "hooker_csrf"
+
+// cors allows browser requests from configured origins and answers
+// preflight requests. Credentials are allowed for listed origins only,
+// "*" lets any origin in without them
+func cors(origins string, next http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			allowed[origin] = true
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !allowed["*"] && !allowed[origin] {
+			if r.Method == http.MethodOptions {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if allowed[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Api-Key, X-CSRF-Token")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrf implements double submit cookie protection: safe requests
+// receive token cookie, mutating requests must echo it in X-CSRF-Token
+func csrf(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(csrfCookie)
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if err != nil || cookie.Value == "" {
+				token, err := csrfToken()
+				if err != nil {
+					http.Error(w, "CSRF token generation error", http.StatusInternalServerError)
+					return
+				}
+
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookie,
+					Value:    token,
+					Path:     "/",
+					SameSite: http.SameSiteStrictMode,
+				})
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get("X-CSRF-Token")
+		if err != nil || header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+			http.Error(w, "CSRF token mismatch", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func csrfToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// accessLog logs every admin request with
+// its status, latency and resolved principal
+func accessLog(a *admin, proxies trustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		next.ServeHTTP(sw, r)
+
+		name := "-"
+		if p, ok := a.principal(r); ok {
+			name = p.name
+		}
+
+		log.Printf("[ACCESS] ip=%s method=%s path=%q status=%d latency=%s principal=%s\n",
+			proxies.clientIP(r), r.Method, r.URL.Path, sw.status, time.Since(start), name)
+	})
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a per-IP token bucket limiter
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	proxies trustedProxies
+}
+
+func newRateLimiter(rate float64, burst int, proxies trustedProxies) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	l := &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		proxies: proxies,
+	}
+	go l.cleanup()
+
+	return l
+}
+
+func (l *rateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// cleanup forgets clients which were idle long enough to refill
+func (l *rateLimiter) cleanup() {
+	for {
+		time.Sleep(time.Minute)
+
+		l.mu.Lock()
+		for ip, b := range l.buckets {
+			if time.Since(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (l *rateLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.allow(l.proxies.clientIP(r)) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trustedProxies are reverse proxies admin API sits behind,
+// only they are believed to tell client address
+type trustedProxies []*net.IPNet
+
+// parseProxies reads IP addresses and CIDR networks
+func parseProxies(list, separator string) (trustedProxies, error) {
+	proxies := trustedProxies{}
+	for _, s := range strings.Split(list, separator) {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Wrong trusted proxy address: %s", s)
+			}
+
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong trusted proxy network: %s", s)
+		}
+		proxies = append(proxies, network)
+	}
+
+	return proxies, nil
+}
+
+func (t trustedProxies) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range t {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP is address of request peer. When peer is trusted proxy
+// X-Forwarded-For is walked from the right, the first address
+// not belonging to trusted proxies is the client
+func (t trustedProxies) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !t.trusted(host) {
+		return host
+	}
+
+	forwarded := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		host = addr
+		if !t.trusted(addr) {
+			break
+		}
+	}
+
+	return host
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	metrics "github.com/cryptopay-dev/go-metrics"
+	"github.com/getsentry/raven-go"
+)
+
+// Seconds between NTP epoch (1900) and Unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+// ntpTime converts 64-bit NTP timestamp to time
+func ntpTime(b []byte) time.Time {
+	sec := binary.BigEndian.Uint32(b[0:4])
+	frac := binary.BigEndian.Uint32(b[4:8])
+	nsec := (int64(frac) * 1e9) >> 32
+
+	return time.Unix(int64(sec)-ntpEpochOffset, nsec)
+}
+
+// ntpOffset queries SNTP server and returns
+// local clock offset relative to it
+func ntpOffset(server string, timeout time.Duration) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// LI = 0, VN = 4, Mode = 3 (client), transmit timestamp is
+	// random, server echoes it as originate one so that its reply
+	// can be told from stale or spoofed packets
+	req := make([]byte, 48)
+	req[0] = 0x23
+	if _, err := rand.Read(req[40:48]); err != nil {
+		return 0, err
+	}
+
+	t1 := time.Now()
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+
+	resp := make([]byte, 128)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	t4 := time.Now()
+
+	if err := validateNTPReply(req, resp[:n]); err != nil {
+		return 0, err
+	}
+
+	t2 := ntpTime(resp[32:40])
+	t3 := ntpTime(resp[40:48])
+
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+// validateNTPReply checks that packet is reply of synchronized server
+// to request sent, offset computed of anything else would be bogus
+func validateNTPReply(req, resp []byte) error {
+	if len(resp) < 48 {
+		return fmt.Errorf("NTP reply is too short: %d bytes", len(resp))
+	}
+
+	if mode := resp[0] & 0x07; mode != 4 {
+		return fmt.Errorf("NTP reply has mode %d instead of server", mode)
+	}
+
+	// Stratum 0 is Kiss-o'-Death, reference ID holds its code
+	switch stratum := resp[1]; {
+	case stratum == 0:
+		return fmt.Errorf("NTP server sent Kiss-o'-Death %q", bytes.TrimRight(resp[12:16], "\x00"))
+	case stratum > 15:
+		return fmt.Errorf("NTP server is unsynchronized (stratum %d)", stratum)
+	}
+
+	if resp[0]>>6 == 3 {
+		return errors.New("NTP server clock is not synchronized")
+	}
+
+	if !bytes.Equal(resp[24:32], req[40:48]) {
+		return errors.New("NTP reply doesn't match request")
+	}
+
+	if binary.BigEndian.Uint64(resp[40:48]) == 0 {
+		return errors.New("NTP reply has no transmit timestamp")
+	}
+
+	return nil
+}
+
+// clock keeps result of last time synchronization check
+type clock struct {
+	mu      sync.Mutex
+	server  string
+	maxSkew time.Duration
+	skew    time.Duration
+	checked time.Time
+	err     string
+}
+
+func newClock(server string, maxSkew time.Duration) *clock {
+	return &clock{
+		server:  server,
+		maxSkew: maxSkew,
+	}
+}
+
+func (c *clock) check() {
+	skew, err := ntpOffset(c.server, 5*time.Second)
+
+	c.mu.Lock()
+	c.checked = time.Now()
+	if err != nil {
+		c.err = err.Error()
+		c.mu.Unlock()
+
+		log.Printf("[CLOCK] Time check against %s failed: %s\n", c.server, err)
+		return
+	}
+	c.skew = skew
+	c.err = ""
+	c.mu.Unlock()
+
+	sendMetrics("clock", metrics.M{
+		"skew_ms": skew.Nanoseconds() / int64(time.Millisecond),
+	}, nil)
+
+	if math.Abs(float64(skew)) > float64(c.maxSkew) {
+		log.Printf("[CLOCK] WARNING: Clock is skewed by %s (max allowed %s)\n", skew, c.maxSkew)
+
+		raven.CaptureMessage("Clock skew exceeds threshold", map[string]string{
+			"server": c.server,
+			"skew":   skew.String(),
+		})
+	}
+}
+
+// watch checks time periodically
+func (c *clock) watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		c.check()
+	}
+}
+
+func (c *clock) status() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return map[string]interface{}{
+		"server":     c.server,
+		"skew_ms":    c.skew.Nanoseconds() / int64(time.Millisecond),
+		"ok":         c.err == "" && math.Abs(float64(c.skew)) <= float64(c.maxSkew),
+		"checked_at": c.checked,
+		"error":      c.err,
+	}
+}
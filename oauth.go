@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cryptopay-dev/go-metrics"
+	"github.com/getsentry/raven-go"
+)
+
+// Token is refreshed this long before it expires, or halfway
+// through its lifetime when it is shorter than twice that
+const oauthRefreshMargin = time.Minute
+
+// oauthResponseLimit caps token response, JWT access tokens may be several KB
+const oauthResponseLimit = 64 * 1024
+
+// oauthDefaultLifetime is assumed when token endpoint doesn't tell expires_in
+const oauthDefaultLifetime = time.Hour
+
+// oauth2 is OAuth2 client credentials grant access tokens
+// of API are acquired with, they are sent as bearer tokens
+type oauth2 struct {
+	TokenURL         string   `json:"token_url" desc:"Token endpoint" pattern:"^https?://" required:"true"`
+	ClientID         string   `json:"client_id" desc:"Client ID" required:"true"`
+	ClientSecret     string   `json:"client_secret" desc:"Client secret"`
+	ClientSecretEnv  string   `json:"client_secret_env" desc:"Environment variable holding client secret, instead of client_secret"`
+	ClientSecretFile string   `json:"client_secret_file" desc:"File holding client secret, instead of client_secret"`
+	Scopes           []string `json:"scopes" desc:"Scopes requested"`
+}
+
+func (c *oauth2) validate(name string) error {
+	if !strings.HasPrefix(c.TokenURL, "http://") && !strings.HasPrefix(c.TokenURL, "https://") {
+		return fmt.Errorf("OAuth2 token URL of %s must be http:// or https://: %s", name, c.TokenURL)
+	}
+	if c.ClientID == "" {
+		return errors.New("OAuth2 client ID of " + name + " is not set")
+	}
+
+	return validateSecret("OAuth2 client of "+name, c.ClientSecret, c.ClientSecretEnv, c.ClientSecretFile)
+}
+
+// key identifies tokens client credentials grant gives
+func (c *oauth2) key() string {
+	return c.TokenURL + "\x00" + c.ClientID + "\x00" + strings.Join(c.Scopes, " ")
+}
+
+// oauthToken is cached access token
+type oauthToken struct {
+	mu        sync.Mutex
+	access    string
+	expires   time.Time
+	refreshAt time.Time
+}
+
+// oauthTokens caches access tokens of every client shared by
+// all files, token is requested again once it is close to expiry
+type oauthTokens struct {
+	mu     sync.Mutex
+	tokens map[string]*oauthToken
+	prom   *promMetrics
+}
+
+var tokenProvider = &oauthTokens{tokens: map[string]*oauthToken{}}
+
+// observe makes token requests counted in Prometheus metrics
+func (p *oauthTokens) observe(prom *promMetrics) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prom = prom
+}
+
+func (p *oauthTokens) entry(c *oauth2) (*oauthToken, *promMetrics) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.tokens[c.key()]
+	if !ok {
+		t = &oauthToken{}
+		p.tokens[c.key()] = t
+	}
+
+	return t, p.prom
+}
+
+// token returns cached access token of client, requesting new one when
+// it is about to expire. Token which is still valid is used when
+// refresh fails, so short token endpoint outage doesn't stop uploads
+func (p *oauthTokens) token(ctx context.Context, c *oauth2, transport http.RoundTripper, timeout time.Duration) (string, error) {
+	t, prom := p.entry(c)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.access != "" && now.Before(t.refreshAt) {
+		return t.access, nil
+	}
+
+	access, lifetime, err := requestToken(ctx, c, transport, timeout)
+	if prom != nil {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		prom.inc(prom.oauthRequests, result)
+	}
+	sendMetrics("oauth", metrics.M{
+		"error": err != nil,
+	}, nil)
+
+	if err != nil {
+		raven.CaptureError(err, map[string]string{
+			"token_url": c.TokenURL,
+			"client_id": c.ClientID,
+		})
+
+		if t.access != "" && now.Before(t.expires) {
+			log.Printf("[OAUTH] Error refreshing token of %s, using current one until %s: %s\n", c.ClientID, t.expires.Format(time.RFC3339), err)
+			return t.access, nil
+		}
+		return "", err
+	}
+
+	margin := oauthRefreshMargin
+	if lifetime < 2*margin {
+		margin = lifetime / 2
+	}
+	t.access, t.expires, t.refreshAt = access, now.Add(lifetime), now.Add(lifetime-margin)
+
+	return t.access, nil
+}
+
+// invalidate drops cached token of client, e.g. one API rejected
+func (p *oauthTokens) invalidate(c *oauth2) {
+	t, _ := p.entry(c)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.access = ""
+}
+
+// tokenResponse is successful response of token endpoint
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// requestToken asks token endpoint for access token with client
+// credentials grant, client authenticates with HTTP Basic auth
+func requestToken(ctx context.Context, c *oauth2, transport http.RoundTripper, timeout time.Duration) (string, time.Duration, error) {
+	secret, err := readSecret(c.ClientSecret, c.ClientSecretEnv, c.ClientSecretFile)
+	if err != nil {
+		return "", 0, err
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(secret))
+
+	client := http.Client{Transport: transport, Timeout: timeout}
+	response, err := client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("OAuth2 token request: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("OAuth2 token request: %w", &httpStatusError{Code: response.StatusCode, Body: truncate(readResponse(response.Body))})
+	}
+
+	var token tokenResponse
+	if err := json.NewDecoder(&cappedReader{r: response.Body, limit: oauthResponseLimit}).Decode(&token); err != nil {
+		return "", 0, fmt.Errorf("OAuth2 token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return "", 0, errors.New("OAuth2 token response has no access_token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, errors.New("OAuth2 token type is not bearer: " + token.TokenType)
+	}
+
+	lifetime := time.Duration(token.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = oauthDefaultLifetime
+	}
+
+	return token.AccessToken, lifetime, nil
+}
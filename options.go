@@ -1,17 +1,112 @@
 package main
 
 type options struct {
-	interval      int
-	dir           string
-	out           string
-	patterns      string
-	timeout       int
-	verbose       bool
-	checkInterval int
-	url           string
-	token         string
-	zip           bool
-	clear         bool
-	separator     string
-	listen        string
+	interval             int
+	dir                  string
+	out                  string
+	patterns             string
+	exclude              string
+	headers              map[string]string
+	auth                 string
+	oauth                *oauth2
+	producedPatterns     []string
+	timeout              int
+	dnsTimeout           int
+	connectTimeout       int
+	tlsTimeout           int
+	responseTimeout      int
+	attemptTimeout       int
+	verbose              bool
+	checkInterval        int
+	stableWindow         int
+	lockProbe            bool
+	completion           string
+	doneSuffix           string
+	minAge               int
+	url                  string
+	sftpKey              string
+	sftpKnownHosts       string
+	s3SSE                string
+	s3KMSKeyID           string
+	s3PartSize           int
+	s3Concurrency        int
+	chunkSize            int
+	retryAttempts        int
+	retryDelay           int
+	retryMaxDelay        int
+	retryJitter          float64
+	fips                 bool
+	token                string
+	zip                  bool
+	zipEncrypt           string
+	archiveFormat        string
+	clear                bool
+	separator            string
+	grace                int
+	workers              int
+	listen               string
+	hold                 bool
+	adminKeys            string
+	jwtSecret            string
+	fourEyes             bool
+	auditLog             string
+	corsOrigins          string
+	csrf                 bool
+	rateLimit            float64
+	rateBurst            int
+	trustedProxies       string
+	readOnly             bool
+	skipList             string
+	proofKey             string
+	dailyManifest        string
+	journal              string
+	mirror               bool
+	checksums            bool
+	snapshot             string
+	spillThreshold       int
+	workspace            string
+	quarantine           string
+	deadLetter           string
+	manifestSuffix       string
+	batchDeadline        int
+	batchPolicy          string
+	preflightURL         string
+	preflightMinSize     int64
+	presignURL           string
+	presignMinSize       int64
+	maxResponseSize      int64
+	maxBodySize          int64
+	compress             string
+	compressLevel        int
+	discoverBodySize     bool
+	ntpServer            string
+	maxClockSkew         int
+	maxRSS               int
+	watchMode            string
+	recursive            bool
+	config               string
+	routes               []route
+	route                string
+	destinations         []destination
+	destination          string
+	pins                 []string
+	schemas              map[string]string
+	transforms           map[string]string
+	sheets               []string
+	validateCommand      string
+	dedupWindow          int
+	dedupAction          string
+	shadowURL            string
+	shadowToken          string
+	shadowLog            string
+	shadowIgnore         []string
+	canary               *canary
+	variant              string
+	priority             int
+	proxy                string
+	retentionDays        int
+	retentionSize        int
+	retentionExport      string
+	archiveRetentionDays int
+	archiveRetentionSize int
 }
@@ -1,40 +1,48 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	x "encoding/xml"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
-	"math"
-	"net"
 	"net/http"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	metrics "github.com/cryptopay-dev/go-metrics"
 	"github.com/getsentry/raven-go"
-	"github.com/tdewolff/minify"
-	"github.com/tdewolff/minify/xml"
 )
 
 type parser struct {
-	file    os.FileInfo
-	ch      chan struct{}
-	options options
-	prefix  string
+	file       os.FileInfo
+	ch         chan struct{}
+	options    options
+	prefix     string
+	controller *controller
+	headers    map[string]string
+	// ctx is cancelled when waits of file have to be interrupted
+	ctx context.Context
+
+	// sent is set when journal says content was already delivered
+	sent bool
+	// duplicate is set when the same content was delivered under other name
+	duplicate bool
 }
 
-func newParser(file os.FileInfo, ch chan struct{}, opts options) *parser {
+func newParser(file os.FileInfo, ch chan struct{}, opts options, c *controller) *parser {
 	return &parser{
-		ch:      ch,
-		file:    file,
-		options: opts,
-		prefix:  file.Name(),
+		ch:         ch,
+		file:       file,
+		options:    opts,
+		prefix:     file.Name(),
+		controller: c,
+		headers:    make(map[string]string),
+		ctx:        context.Background(),
 	}
 }
 
@@ -45,254 +53,751 @@ func (p *parser) parse() {
 	filePath := path.Join(p.options.dir, p.file.Name())
 	log.Printf("[FILE: %s] Found new file, start processing %s\n", p.prefix, filePath)
 
-	// Checking that file have good size
-	err := p.finishedUpload(filePath)
-	if err != nil {
-		raven.CaptureErrorAndWait(err, map[string]string{
-			"path": filePath,
-		})
+	// Checking that file have good size, companion
+	// checksum file marks upload as finished itself
+	checksumPath, withChecksum := "", false
+	if p.options.checksums {
+		checksumPath, withChecksum = companionChecksum(filePath)
+	}
+	companions := []string{}
+	if withChecksum {
+		companions = append(companions, checksumPath)
+	}
+	if marker := p.options.doneMarker(filePath); marker != "" {
+		companions = append(companions, marker)
+	}
 
-		log.Fatalf("[FILE: %s] File size checking error: %s\n", p.prefix, err)
+	// File may be interrupted while it was queued
+	if reason := interruption(context.Cause(p.ctx)); reason != nil {
+		p.leave(reason, append(companions, filePath)...)
+		return
 	}
 
-	// Sending stuff and deleting file
-	buf, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		raven.CaptureErrorAndWait(err, map[string]string{
-			"path": filePath,
-		})
+	// Snapshot is retaken until file stays unchanged while it is
+	// being taken, producer following completion protocol tells
+	// that file is complete, so its size is not watched
+	readPath := filePath
+	for {
+		var err error
+		if withChecksum || p.options.completion != completionSize {
+			err = p.validate(filePath)
+		} else {
+			err = p.finishedUpload(filePath)
+		}
+		if reason := interruption(err); reason != nil {
+			p.leave(reason, append(companions, filePath)...)
+			return
+		}
+		if err != nil {
+			p.fail(filePath, err, companions...)
+			return
+		}
 
-		log.Fatalf("[FILE: %s] Reading file error: %s\n", p.prefix, err)
+		if p.options.snapshot == "" {
+			break
+		}
+
+		readPath, err = p.snapshot(filePath)
+		if err == errChanged {
+			log.Printf("[FILE: %s] File changed while taking snapshot, waiting again\n", p.prefix)
+			continue
+		}
+		if err != nil {
+			p.fail(filePath, newStageError(stageRead, p.prefix, 0, errIO, err))
+			return
+		}
+
+		defer p.controller.workspace.discard(readPath)
+		break
 	}
 
-	err = p.sendWithBackoff(buf, p.file.Name())
+	// Sending stuff and deleting file, content is
+	// streamed from disk and never kept in memory
+	var pl *payload
+	err := p.retryTransient(5, func() error {
+		var err error
+		pl, err = newPayload(readPath)
+		return err
+	})
+	if reason := interruption(err); reason != nil {
+		p.leave(reason, append(companions, filePath)...)
+		return
+	}
 	if err != nil {
-		raven.CaptureErrorAndWait(err, map[string]string{
-			"error": err.Error(),
-			"file":  p.prefix,
-		})
+		p.fail(filePath, newStageError(stageRead, p.prefix, 0, errIO, err))
+		return
+	}
+
+	if withChecksum {
+		if err := verifyChecksum(checksumPath, readPath, p.options.fips); err != nil {
+			p.quarantine(filePath, newStageError(stageChecksum, p.prefix, 0, errValidation, err), companions...)
+			return
+		}
+
+		log.Printf("[FILE: %s] Checksum verified with %s\n", p.prefix, checksumPath)
+	}
+
+	hash := pl.sha256
+	if p.deliveredEverywhere(hash) {
+		if p.options.readOnly {
+			log.Printf("[FILE: %s] File content was already delivered, skipping\n", p.prefix)
+			return
+		}
 
-		log.Fatalf("[FILE: %s] Error sending to API: %s\n", p.prefix, err)
+		// Persistent journal survives restarts, so file left
+		// in place after delivery is only archived or deleted
+		if p.options.journal != "" {
+			log.Printf("[FILE: %s] File content was already delivered according to journal, not sending it again\n", p.prefix)
+			p.sent = true
+		}
 	}
+	p.checkDuplicate(hash)
+
+	// Waiting for operator approval
+	if p.options.hold {
+		p.stage(progressHeld, 0)
+		log.Printf("[FILE: %s] File is validated and held until release\n", p.prefix)
+		send, err := p.controller.waitHold(p.ctx, p.file.Name(), hash, p.options.priority)
+		if reason := interruption(err); reason != nil {
+			p.leave(reason, append(companions, filePath)...)
+			return
+		}
+		if !send {
+			err = os.Remove(filePath)
+			if err != nil {
+				err = newStageError(stageDelete, p.prefix, 0, errIO, err)
+				raven.CaptureErrorAndWait(err, errorTags(err))
+
+				log.Printf("[FILE: %s] Error deleting file: %s\n", p.prefix, err)
+				return
+			}
 
-	log.Printf("[FILE: %s] Successfully send data to API\n", p.prefix)
+			log.Printf("[FILE: %s] Held file deleted by operator\n", p.prefix)
+			return
+		}
+		log.Printf("[FILE: %s] File released by operator\n", p.prefix)
+	}
 
-	// Zipping file
-	if p.options.zip {
-		zipname := path.Join(p.options.out, p.file.Name()+".zip")
+	err = p.deliver(filePath, pl, companions...)
+	if reason := interruption(err); reason != nil {
+		p.leave(reason, append(companions, filePath)...)
+		return
+	}
+	if err != nil {
+		p.fail(filePath, err, companions...)
+	}
+}
 
-		err := p.zipit(p.file.Name(), zipname, buf)
+// deliver sends file to API, records it in journal,
+// archives and deletes it with its companion files
+func (p *parser) deliver(filePath string, pl *payload, companions ...string) error {
+	var err error
+	hash := pl.sha256
+	zip, clear := p.options.zip, p.options.clear
+	d := &directive{}
+	p.setFileHeaders(pl)
+
+	// Asking API whether it already has this content
+	skip := p.sent || p.duplicate
+	if !skip && p.options.preflightURL != "" && !p.options.mirror && pl.size >= p.options.preflightMinSize {
+		exists, err := p.exists(hash)
 		if err != nil {
-			raven.CaptureErrorAndWait(err, map[string]string{
-				"file":    p.file.Name(),
-				"zipname": zipname,
-			})
+			log.Printf("[FILE: %s] Preflight check error, uploading anyway: %s\n", p.prefix, err)
+		} else if exists {
+			log.Printf("[FILE: %s] API already has content %s, skipping upload\n", p.prefix, hash)
+			sendMetrics("files", metrics.M{
+				"preflight_skipped": true,
+			}, nil)
+			skip = true
+		}
+	}
 
-			log.Fatalf("[FILE: %s] Error zipping file: %s\n", p.prefix, err)
+	// Mirror mode only archives files
+	if p.options.mirror {
+		log.Printf("[FILE: %s] Mirror mode, skipping API upload\n", p.prefix)
+	} else {
+		d, err = p.fanOut(pl, !skip)
+		if err != nil {
+			return err
+		}
+		if d == nil {
+			d, skip = &directive{}, true
 		}
 
-		log.Printf("[FILE: %s] Zipped file to: %s\n", p.prefix, zipname)
+		// API may override what we do with original file
+		if d.Action != "" && !p.options.readOnly {
+			log.Printf("[FILE: %s] API requested %s action\n", p.prefix, d.Action)
+
+			switch d.Action {
+			case actionRetain:
+				zip, clear = false, false
+			case actionArchive:
+				zip = true
+			case actionDelete:
+				zip, clear = false, true
+			}
+		}
 	}
 
-	// Deleting file
-	if p.options.clear || p.options.zip {
-		err = os.Remove(filePath)
+	state := stateDelivered
+	switch {
+	case p.options.mirror:
+		state = stateMirrored
+	case p.duplicate:
+		state = stateDuplicate
+	case skip:
+		state = stateSkipped
+	case d.Action == actionRetain:
+		state = stateRetained
+	}
+
+	entry := journalEntry{
+		Name:     p.file.Name(),
+		Route:    p.options.route,
+		State:    state,
+		Status:   d.status,
+		Size:     p.file.Size(),
+		Mtime:    p.file.ModTime(),
+		SHA256:   hash,
+		SentAt:   time.Now(),
+		Action:   d.Action,
+		Response: d.response,
+	}
+	if state == stateDelivered || state == stateRetained {
+		p.recordDeadline(&entry)
+	}
+
+	err = p.controller.journal.record(entry)
+	if err != nil {
+		err = newStageError(stageJournal, p.prefix, 0, errIO, err)
+		raven.CaptureError(err, errorTags(err))
+
+		log.Printf("[FILE: %s] Error writing journal: %s\n", p.prefix, err)
+	}
+
+	if !p.options.mirror {
+		p.observeSLO(true)
+	}
+
+	// Archiving file
+	if zip {
+		p.stage(progressZipping, 0)
+		archived := path.Join(p.options.out, p.options.archiveName(p.file.Name()))
+
+		err := p.archive(filePath, archived, pl)
 		if err != nil {
-			raven.CaptureErrorAndWait(err, map[string]string{
-				"file": filePath,
-			})
+			return newStageError(stageArchive, p.prefix, 0, errIO, err)
+		}
+
+		log.Printf("[FILE: %s] Archived file to: %s\n", p.prefix, archived)
+	}
 
-			log.Fatalf("[FILE: %s] Error deleting file: %s\n", p.prefix, err)
+	// Deleting file, moved to archive already
+	// when archive format is move
+	if clear || zip {
+		err = os.Remove(filePath)
+		switch {
+		case err == nil:
+			log.Printf("[FILE: %s] Deleted file %s\n", p.prefix, filePath)
+		case !(zip && os.IsNotExist(err)):
+			return newStageError(stageDelete, p.prefix, 0, errIO, err)
 		}
 
-		log.Printf("[FILE: %s] Deleted file %s\n", p.prefix, filePath)
+		for _, companion := range companions {
+			if err := os.Remove(companion); err != nil {
+				log.Printf("[FILE: %s] Error deleting companion file %s: %s\n", p.prefix, companion, err)
+			}
+		}
 	}
+
+	return nil
 }
 
 func (p *parser) finishedUpload(filePath string) error {
 	// Waiting for a size stop changing
 	// We should wait before file size will be stable
 	// And then parse it with XML and validate
-	var t int64
+	if err := p.waitStable(filePath); err != nil {
+		return err
+	}
 
-	file, err := os.Open(filePath)
-	defer file.Close()
+	return p.validate(filePath)
+}
 
-	if err != nil {
+// stableTime is how long file size has to stay the same
+func (o options) stableTime() time.Duration {
+	return time.Duration(o.stableWindow) * time.Second
+}
+
+// writerFinished tells that writer is known to be done with file,
+// either because it closed file or, with -lock-probe, because
+// file could be locked exclusively
+func (p *parser) writerFinished(filePath string, mtime time.Time) bool {
+	if p.controller.closed.finished(p.file.Name(), mtime) {
+		return true
+	}
+
+	return p.options.lockProbe && writerDone(filePath)
+}
+
+func (p *parser) waitStable(filePath string) error {
+	p.stage(progressStabilizing, 0)
+
+	var t int64
+
+	var file *os.File
+	err := p.retryTransient(5, func() error {
+		var err error
+		file, err = os.Open(filePath)
 		return err
+	})
+	if err != nil {
+		return newStageError(stageStabilize, p.prefix, 0, errIO, err)
 	}
+	defer file.Close()
 
 	for {
-		fi, err := file.Stat()
-		if err != nil {
+		var fi os.FileInfo
+		err := p.retryTransient(5, func() error {
+			var err error
+			fi, err = file.Stat()
 			return err
+		})
+		if err != nil {
+			return newStageError(stageStabilize, p.prefix, 0, errIO, err)
 		}
 
 		if p.options.verbose {
 			log.Printf("[FILE: %s] Size is %d bytes\n", p.prefix, fi.Size())
 		}
 
+		// File unchanged since earlier scans is stable already
+		if p.controller.stats.stableFor(p.file.Name(), fi.Size(), fi.ModTime()) >= p.options.stableTime() {
+			if p.options.verbose {
+				log.Printf("[FILE: %s] File is unchanged since previous scans, validating it\n", p.prefix)
+			}
+
+			return nil
+		}
+
+		// Writer closing file is better signal than size
+		if p.controller.closed.finished(p.file.Name(), fi.ModTime()) {
+			if p.options.verbose {
+				log.Printf("[FILE: %s] File is closed after writing, validating it\n", p.prefix)
+			}
+
+			return nil
+		}
+
+		// Size is checked once more after writer is done,
+		// so small files wait a second instead of whole window
 		if t != fi.Size() {
 			t = fi.Size()
-			time.Sleep(15 * time.Second)
+			for i := time.Duration(0); i < p.options.stableTime(); i += time.Second {
+				if err := p.sleep(time.Second, true); err != nil {
+					return err
+				}
+				if p.writerFinished(filePath, fi.ModTime()) {
+					break
+				}
+			}
 			continue
 		}
 
 		if p.options.verbose {
-			log.Printf("[FILE: %s] Size is stabilized, parsing XML\n", p.prefix)
+			log.Printf("[FILE: %s] Size is stabilized, validating it\n", p.prefix)
 		}
 
-		break
+		return nil
 	}
+}
+
+// validator checks content of file whose size stopped changing
+type validator interface {
+	// validate returns *incompleteError when file may be still
+	// written and has to be checked again later
+	validate(filePath string, fi os.FileInfo) error
+	String() string
+}
+
+// incompleteError tells that file is not complete yet
+type incompleteError struct {
+	Err error
+}
+
+func (e *incompleteError) Error() string {
+	return "file is not complete: " + e.Err.Error()
+}
+
+// xmlValidator checks that file is well-formed XML, file being
+// written is not, so XML errors never make file invalid
+type xmlValidator struct{}
 
+func (xmlValidator) validate(filePath string, fi os.FileInfo) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Decoder reads file in chunks, whole document is not kept in memory
 	m := struct{}{}
+	if err := x.NewDecoder(f).Decode(&m); err != nil {
+		return &incompleteError{Err: err}
+	}
+
+	return nil
+}
+
+func (xmlValidator) String() string {
+	return "XML"
+}
+
+// validators returns checks of file with given name in order they are done
+func (o options) validators(name string) []validator {
+	list := []validator{}
+	if isSpreadsheet(name) {
+		list = append(list, xlsxValidator{sheets: o.sheets})
+	} else {
+		list = append(list, xmlValidator{})
+		if schema := o.schemaFor(name); schema != "" {
+			list = append(list, xsdValidator{schema: schema})
+		}
+	}
+	if o.rewrites(name) {
+		list = append(list, transformValidator{options: o, name: name})
+	}
+	if o.validateCommand != "" {
+		list = append(list, commandValidator{command: o.validateCommand, route: o.route})
+	}
+
+	return list
+}
+
+// check runs validators of file, the first failed one stops it
+func (p *parser) check(filePath string, fi os.FileInfo) error {
+	for _, v := range p.options.validators(p.file.Name()) {
+		err := v.validate(filePath, fi)
+		switch err.(type) {
+		case nil:
+			continue
+		case *incompleteError:
+			return err
+		case *xsdError, *xlsxError, *transformError, *commandError:
+			return newStageError(stageValidate, p.prefix, 0, errValidation, err)
+		default:
+			return newStageError(stageValidate, p.prefix, 0, errIO, fmt.Errorf("%s validation: %w", v, err))
+		}
+	}
+
+	return nil
+}
+
+func (p *parser) validate(filePath string) error {
+	p.stage(progressValidating, 0)
+
 	for {
-		buf, err := ioutil.ReadFile(filePath)
-		if err != nil {
+		var fi os.FileInfo
+		err := p.retryTransient(5, func() error {
+			var err error
+			fi, err = os.Stat(filePath)
 			return err
+		})
+		if err != nil {
+			return newStageError(stageValidate, p.prefix, 0, errIO, err)
 		}
 
-		if len(buf) < 50 {
+		if fi.Size() < 50 {
 			if p.options.verbose {
-				log.Printf("[FILE: %s] File is too small, skipping it for now, size: %d\n", p.prefix, len(buf))
+				log.Printf("[FILE: %s] File is too small, skipping it for now, size: %d\n", p.prefix, fi.Size())
 			}
 
-			time.Sleep(time.Second * time.Duration(p.options.checkInterval))
+			if err := p.sleep(time.Second*time.Duration(p.options.checkInterval), true); err != nil {
+				return err
+			}
 			continue
 		}
 
-		err = x.Unmarshal(buf, &m)
-		if err != nil {
-			if p.options.verbose {
-				log.Printf("[FILE: %s] Error parsing XML: %s\n", p.prefix, err)
-			}
+		err = p.check(filePath, fi)
+		if _, incomplete := err.(*incompleteError); !incomplete {
+			return err
+		}
+		if p.options.verbose {
+			log.Printf("[FILE: %s] %s\n", p.prefix, err)
+		}
 
-			time.Sleep(time.Second * time.Duration(p.options.checkInterval))
-		} else {
-			return nil
+		if err := p.sleep(time.Second*time.Duration(p.options.checkInterval), true); err != nil {
+			return err
 		}
 	}
 }
 
-func (p *parser) sendWithBackoff(info []byte, filename string) error {
+func (p *parser) sendWithBackoff(pl *payload, filename string) (*directive, error) {
+	policy := p.options.retryPolicy()
+	defer p.controller.clearRetry(p.file.Name(), p.options.destination)
+
 	backoff := 0
+	first := time.Now()
+	destination := p.options.destination
+	if destination == "" {
+		destination = "default"
+	}
+
+	if err := p.checkBodySize(pl); err != nil {
+		log.Printf("[FILE: %s] Not sending to API: %s\n", p.prefix, err)
+		p.controller.prom.inc(p.controller.prom.oversized, "limit")
+
+		return nil, newStageError(stageSend, p.prefix, 0, errRejected, err)
+	}
 
 	for {
+		// Deleted or shut down while waiting for next attempt
+		if err := context.Cause(p.ctx); err != nil {
+			return nil, err
+		}
+
 		log.Printf("[FILE: %s] Sending data to API %d try\n", p.prefix, backoff+1)
+		p.stage(progressSending, backoff)
 
-		err := p.post(info, filename)
+		started := time.Now()
+		d, err := p.post(pl, filename)
+		p.controller.prom.observeUpload(started)
 		if err == nil {
-			metrics.Send("files", metrics.M{
+			sendMetrics("files", metrics.M{
 				"sent": true,
 			}, nil)
+			p.controller.prom.inc(p.controller.prom.sent, destination)
+			p.controller.prom.observe(p.controller.prom.size, float64(pl.size))
 
-			return nil
+			return d, nil
 		}
 
-		metrics.Send("files", metrics.M{
+		backoff++
+		kind := sendKind(err)
+		err = newStageError(stageSend, p.prefix, backoff, kind, err)
+
+		phase := errorPhase(err)
+		if phase == "" {
+			phase = "unknown"
+		}
+		sendMetrics("files", metrics.M{
 			"failed": true,
-		}, nil)
+		}, metrics.T{
+			"kind":  kind.Error(),
+			"phase": phase,
+		})
+		p.controller.prom.inc(p.controller.prom.failures, kind.Error())
+		p.controller.prom.inc(p.controller.prom.phases, phase)
 
-		backoff++
-		mul := math.Pow(2, float64(backoff)) // 2 4 16 32 64
 		log.Printf("[FILE: %s] Error sending to API: %s\n", p.prefix, err)
 
-		raven.CaptureMessage("Error sending data to API", map[string]string{
-			"message": err.Error(),
-			"file":    p.prefix,
-		})
+		raven.CaptureMessage("Error sending data to API", errorTags(err))
 
-		if backoff > 5 {
-			break
+		// The same body would be rejected again on every retry
+		if p.tooLarge(err) {
+			p.controller.prom.inc(p.controller.prom.oversized, "status")
+			return nil, err
 		}
 
-		log.Printf("[FILE: %s] Backoff for %d mins\n", p.prefix, int64(mul))
-		time.Sleep(time.Minute * time.Duration(mul))
+		if policy.exhausted(backoff) {
+			return nil, &exhaustedError{
+				Err:          err,
+				Destination:  p.options.destination,
+				Attempts:     backoff,
+				FirstAttempt: first,
+				LastAttempt:  time.Now(),
+			}
+		}
+
+		delay := policy.delay(backoff)
+		p.controller.prom.inc(p.controller.prom.retries, destination)
+		p.controller.setRetry(retryState{
+			File:        p.file.Name(),
+			Destination: p.options.destination,
+			Failed:      backoff,
+			LastError:   err.Error(),
+			NextAt:      time.Now().Add(delay),
+		})
+
+		log.Printf("[FILE: %s] Backoff for %s\n", p.prefix, delay)
+		p.stage(progressRetrying, backoff)
+		if err := p.sleep(delay, false); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	return errors.New("Unable to send data to API")
+// uploader delivers file content to destination given by -url
+type uploader interface {
+	upload(ctx context.Context, pl *payload, filename string, headers map[string]string) (*directive, error)
 }
 
-func (p *parser) post(data []byte, filename string) error {
-	// Minification
-	m := minify.New()
-	m.AddFunc("xml", xml.Minify)
+// newUploader picks destination backend by URL scheme
+func newUploader(opts options, ws *workspace, sessions *uploadSessions) (uploader, error) {
+	if strings.HasPrefix(opts.url, "s3://") {
+		return newS3Uploader(opts)
+	}
+	if strings.HasPrefix(opts.url, "sftp://") {
+		return newSFTPUploader(opts)
+	}
+
+	return &httpUploader{options: opts, ws: ws, sessions: sessions}, nil
+}
 
-	minified, err := m.Bytes("xml", data)
+func (p *parser) post(pl *payload, filename string) (*directive, error) {
+	u, err := newUploader(p.options, p.controller.workspace, p.controller.sessions)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-	n, err := gz.Write(minified)
-	if err != nil {
-		return err
+	ctx, cancel := p.options.attempt()
+	defer cancel()
+	ctx = withSentCounter(ctx, p.controller.sentCounter(p.file.Name()))
+
+	d, err := u.upload(ctx, pl, filename, p.headers)
+	if err != nil && errorPhase(err) == "" && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = &phaseError{Phase: phaseAttempt, Err: err}
 	}
-	if n == 0 {
-		return errors.New("Written 0 bytes")
+
+	return d, err
+}
+
+// httpUploader posts transformed and compressed file to API
+type httpUploader struct {
+	options  options
+	ws       *workspace
+	sessions *uploadSessions
+}
+
+// countingWriter counts bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// body streams file through its transform and compression into request
+// body, hash of what was sent is available once request is done
+func (u *httpUploader) body(pl *payload, filename string) (io.ReadCloser, func() (string, error)) {
+	pr, pw := io.Pipe()
+	hasher := sha256.New()
+	done := make(chan error, 1)
+
+	go func() {
+		err := func() error {
+			f, err := pl.open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			enc, err := u.options.newEncoder(io.MultiWriter(pw, hasher))
+			if err != nil {
+				return err
+			}
+			transformed := &countingWriter{w: enc}
+
+			if err := u.options.transform(transformed, f, filename); err != nil {
+				enc.Close()
+				return err
+			}
+			if transformed.n == 0 {
+				enc.Close()
+				return errors.New("Written 0 bytes")
+			}
+
+			return enc.Close()
+		}()
+
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	return pr, func() (string, error) {
+		// Unblocks writer if request ended before whole body was read
+		pr.Close()
+		if err := <-done; err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("%x", hasher.Sum(nil)), nil
 	}
-	gz.Close()
+}
 
-	req, err := http.NewRequest("POST", p.options.url, &buf)
-	if req != nil {
-		defer req.Body.Close()
+func (u *httpUploader) client() *http.Client {
+	return &http.Client{
+		Transport: u.options.transport(),
 	}
+}
 
-	if err != nil {
-		return err
+func (u *httpUploader) upload(ctx context.Context, pl *payload, filename string, headers map[string]string) (*directive, error) {
+	if u.options.presignURL != "" && pl.size >= u.options.presignMinSize {
+		return u.uploadPresigned(ctx, pl, filename, headers)
 	}
 
-	req.Header.Set("X-Access-Token", p.options.token)
-	req.Header.Set("X-File-Name", filename)
-	req.Header.Set("Content-Encoding", "gzip")
+	chunkSize := int64(u.options.chunkSize) * 1024 * 1024
+	if chunkSize > 0 && pl.size > chunkSize {
+		return u.uploadChunked(ctx, pl, filename, headers, chunkSize)
+	}
+
+	body, wait := u.body(pl, filename)
 
-	tout := time.Second * time.Duration(p.options.timeout)
-	transport := http.Transport{
-		Dial: func(network, addr string) (net.Conn, error) {
-			return net.DialTimeout(network, addr, tout)
-		},
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.options.url, body)
+	if err != nil {
+		body.Close()
+		wait()
+		return nil, err
 	}
 
-	client := http.Client{
-		Transport: &transport,
+	if err := u.options.setAPIHeaders(req); err != nil {
+		body.Close()
+		wait()
+		return nil, err
+	}
+	req.Header.Set("X-File-Name", path.Base(filename))
+	if enc := u.options.contentEncoding(); enc != "" {
+		req.Header.Set("Content-Encoding", enc)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
 	}
 
-	response, err := client.Do(req)
+	response, err := u.client().Do(req)
 	if response != nil {
 		defer response.Body.Close()
 	}
 
+	requestHash, bodyErr := wait()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if response.StatusCode != http.StatusOK {
-		return fmt.Errorf("Http status: %d", response.StatusCode)
-	}
-
-	return nil
-}
-
-func (p *parser) zipit(file, output string, data []byte) error {
-	zipfile, err := os.Create(output)
-	if err != nil {
-		return err
+		err := &httpStatusError{Code: response.StatusCode, Body: truncate(readResponse(response.Body))}
+		if response.StatusCode == http.StatusUnauthorized && u.options.oauth != nil {
+			// Token may be revoked before it expires, next attempt gets new one
+			tokenProvider.invalidate(u.options.oauth)
+		}
+		if response.StatusCode == http.StatusRequestEntityTooLarge {
+			limit, _ := maxBodyHeader(response.Header)
+			return nil, &bodyTooLargeError{Limit: limit, Err: err}
+		}
+		return nil, err
 	}
-	defer zipfile.Close()
-
-	archive := zip.NewWriter(zipfile)
-	defer archive.Close()
-
-	f, err := archive.Create(file)
-	if err != nil {
-		return err
+	if bodyErr != nil {
+		return nil, bodyErr
 	}
 
-	_, err = f.Write(data)
+	d, err := readDirective(response, u.options.maxResponseSize)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	d.requestHash = requestHash
 
-	return nil
+	return d, nil
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// regexpPrefix marks pattern as regular expression
+const regexpPrefix = "re:"
+
+// compiled caches regular expressions of patterns,
+// files are matched against them on every scan
+var compiled sync.Map
+
+// splitPatterns splits pattern list dropping empty items
+func splitPatterns(list, separator string) []string {
+	patterns := []string{}
+	for _, p := range strings.Split(list, separator) {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+
+	return patterns
+}
+
+// isGlob tells whether pattern has glob metacharacters,
+// patterns without them are plain suffixes like .xml
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// validatePatterns checks that globs and regular expressions compile
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if strings.HasPrefix(p, regexpPrefix) {
+			if _, err := regexp.Compile(strings.TrimPrefix(p, regexpPrefix)); err != nil {
+				return fmt.Errorf("Invalid pattern %s: %s", p, err)
+			}
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("Invalid pattern %s: %s", p, err)
+		}
+	}
+
+	return nil
+}
+
+// matchPattern tells whether file with relative path rel matches pattern.
+// Regular expressions (re:^report_\d+\.xml$) are matched against relative
+// path, globs (report_*.xml) against base name unless they contain slash
+// and patterns without metacharacters are suffixes
+func matchPattern(pattern, rel string) bool {
+	switch {
+	case strings.HasPrefix(pattern, regexpPrefix):
+		v, ok := compiled.Load(pattern)
+		if !ok {
+			re, err := regexp.Compile(strings.TrimPrefix(pattern, regexpPrefix))
+			if err != nil {
+				return false
+			}
+			v, _ = compiled.LoadOrStore(pattern, re)
+		}
+		return v.(*regexp.Regexp).MatchString(rel)
+
+	case isGlob(pattern):
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		matched, _ := path.Match(pattern, name)
+		return matched
+	}
+
+	return strings.HasSuffix(rel, pattern)
+}
+
+// produced tells whether file with relative path rel
+// was written by hooker into watched directory
+func (o options) produced(rel string) (bool, string) {
+	for _, p := range o.producedPatterns {
+		if matchPattern(p, rel) {
+			return true, "produced by hooker, matches " + p
+		}
+	}
+
+	return false, ""
+}
+
+// accepts tells whether file with relative path rel is processed under
+// options, reason tells which pattern decided it. File has to match
+// one of patterns and none of exclude ones, files produced by hooker
+// are never accepted
+func (o options) accepts(rel string) (bool, string) {
+	if produced, reason := o.produced(rel); produced {
+		return false, reason
+	}
+
+	for _, p := range splitPatterns(o.exclude, o.separator) {
+		if matchPattern(p, rel) {
+			return false, "excluded by " + p
+		}
+	}
+
+	for _, p := range splitPatterns(o.patterns, o.separator) {
+		if matchPattern(p, rel) {
+			return true, "matches pattern " + p
+		}
+	}
+
+	return false, "matches none of patterns " + o.patterns
+}
+
+// selection describes patterns file was judged by, skip list
+// entries are ignored once it changes
+func (o options) selection() string {
+	if o.exclude == "" {
+		return o.patterns
+	}
+
+	return o.patterns + " except " + o.exclude
+}
+
+type patternItem struct {
+	Name     string `json:"name"`
+	Route    string `json:"route,omitempty"`
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason"`
+}
+
+// handlePatterns serves GET /debug/patterns telling why every
+// entry of last directory listing was accepted or skipped
+func (c *controller) handlePatterns(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	listing := c.dirlist
+	c.mu.Unlock()
+
+	opts := c.opts()
+	items := []patternItem{}
+	for _, fi := range listing {
+		o := opts.forFile(fi.Name())
+		item := patternItem{Name: fi.Name(), Route: o.route, Reason: "directory"}
+		if !fi.IsDir() {
+			item.Accepted, item.Reason = o.accepts(fi.Name())
+		}
+
+		if q.match(item.Name, item.Route, "", 0, fi.ModTime()) {
+			items = append(items, item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+
+	lo, hi := q.page(len(items))
+	writePage(w, q, len(items), items[lo:hi])
+}
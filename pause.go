@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// pause stops spawning parsers for new files and interrupts files
+// waiting to be uploaded, files already sent finish their uploads
+// and retries
+func (c *controller) pause() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.pausedAt.IsZero() {
+		return false
+	}
+	c.pausedAt = time.Now()
+	close(c.paused)
+
+	return true
+}
+
+func (c *controller) resume() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pausedAt.IsZero() {
+		return false
+	}
+	c.pausedAt = time.Time{}
+	c.paused = make(chan struct{})
+
+	return true
+}
+
+// pauseStatus is reported by / and pause endpoints
+func (c *controller) pauseStatus() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := map[string]interface{}{
+		"paused": !c.pausedAt.IsZero(),
+	}
+	if !c.pausedAt.IsZero() {
+		status["paused_at"] = c.pausedAt
+	}
+
+	return status
+}
+
+// handlePause serves POST /pause and POST /resume
+func (c *controller) handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := c.admin.require(w, r, roleOperator)
+	if !ok {
+		return
+	}
+
+	action := r.URL.Path[1:]
+	changed := false
+	if action == "pause" {
+		changed = c.pause()
+	} else {
+		changed = c.resume()
+	}
+
+	result := "unchanged"
+	if changed {
+		result = action + "d"
+		log.Printf("[CONTROL] Processing %s by %s\n", result, p.name)
+	}
+	c.admin.audit.record(action, "*", []string{p.name}, result)
+
+	writeJSON(w, c.pauseStatus())
+}
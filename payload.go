@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// payload is file content being delivered, it is streamed from
+// disk on every upload attempt instead of being kept in memory
+type payload struct {
+	path   string
+	size   int64
+	sha256 string
+}
+
+// newPayload reads file once to learn its size and hash
+func newPayload(filePath string) (*payload, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := copyPooled(h, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &payload{
+		path:   filePath,
+		size:   n,
+		sha256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func (pl *payload) open() (*os.File, error) {
+	return os.Open(pl.path)
+}
+
+// setFileHeaders describes file as it is on disk, before transform
+// and compression, so API can verify and deduplicate it. S3 stores them
+// as object metadata
+func (p *parser) setFileHeaders(pl *payload) {
+	p.headers["X-Content-SHA256"] = pl.sha256
+	p.headers["X-File-Size"] = strconv.FormatInt(pl.size, 10)
+	p.headers["X-File-Mtime"] = p.file.ModTime().UTC().Format(time.RFC3339)
+	p.headers["X-Idempotency-Key"] = p.processingID(pl.sha256)
+	if p.options.priority != 0 {
+		p.headers["X-Priority"] = strconv.Itoa(p.options.priority)
+	}
+	if deadline, ok := p.deadline(); ok {
+		p.headers["X-Deadline"] = deadline.UTC().Format(time.RFC3339)
+	}
+}
+
+// processingNamespace is UUID namespace of processing IDs
+var processingNamespace = [16]byte{0x44, 0x46, 0x4b, 0x3b, 0xb8, 0xd7, 0x4b, 0x74, 0xb1, 0x26, 0x11, 0x91, 0xe7, 0xfe, 0xee, 0xcc}
+
+// processingID is name based UUID (version 5) of route, file name and
+// content. It keys journal entries and is sent as idempotency key, so it is
+// the same on every attempt, after restart and on replay, and API can tell
+// upload it has already received from a new one when its response got lost
+func processingID(route, name, sha256 string) string {
+	h := sha1.New()
+	h.Write(processingNamespace[:])
+	h.Write([]byte(route + "\x00" + name + "\x00" + sha256))
+
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// processingID of file content delivered by parser
+func (p *parser) processingID(hash string) string {
+	return processingID(p.options.route, p.file.Name(), hash)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// parsePins splits list of base64 SHA-256 hashes of certificate
+// SubjectPublicKeyInfo, optionally prefixed with sha256/ as in HPKP
+func parsePins(list []string) ([]string, error) {
+	pins := []string{}
+	for _, pin := range list {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		if pin == "" {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("Wrong SPKI pin %s, expected base64 of SHA-256", pin)
+		}
+		pins = append(pins, pin)
+	}
+
+	return pins, nil
+}
+
+// validatePins checks pins configured for destination URL
+func validatePins(u string, pins []string) error {
+	list, err := parsePins(pins)
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 && u != "" && !strings.HasPrefix(u, "https://") {
+		return errors.New("Certificate pins require https:// URL: " + u)
+	}
+
+	return nil
+}
+
+// tlsConfig returns TLS configuration for API requests, with pins server
+// certificate chain must, besides passing regular verification, contain
+// public key matching one of them, so that proxy or CA trusted by system
+// can't intercept uploads
+func (o options) tlsConfig() *tls.Config {
+	if len(o.pins) == 0 {
+		return o.fipsTLS(nil)
+	}
+
+	pins := map[string]bool{}
+	for _, pin := range o.pins {
+		pins[pin] = true
+	}
+
+	return o.fipsTLS(&tls.Config{
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+						return nil
+					}
+				}
+			}
+
+			return errors.New("Server certificate doesn't match any of pinned keys")
+		},
+	})
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of pipeline graph nodes
+const (
+	nodeSource    = "source"
+	nodeStage     = "stage"
+	nodeTransform = "transform"
+	nodeSink      = "sink"
+)
+
+type pipelineNode struct {
+	ID     string            `json:"id"`
+	Kind   string            `json:"kind"`
+	Label  string            `json:"label"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// pipelineEdge is labeled for failure paths only
+type pipelineEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Label string `json:"label,omitempty"`
+}
+
+// pipeline is what happens to files of a single route
+type pipeline struct {
+	Route string         `json:"route"`
+	Nodes []pipelineNode `json:"nodes"`
+	Edges []pipelineEdge `json:"edges"`
+}
+
+func (p *pipeline) node(id, kind, label string, params map[string]string) string {
+	p.Nodes = append(p.Nodes, pipelineNode{ID: id, Kind: kind, Label: label, Params: params})
+	return id
+}
+
+func (p *pipeline) edge(from, to, label string) {
+	p.Edges = append(p.Edges, pipelineEdge{From: from, To: to, Label: label})
+}
+
+// chain adds stage after previous one and returns it as new tail
+func (p *pipeline) chain(tail, id, kind, label string, params map[string]string) string {
+	p.edge(tail, p.node(id, kind, label, params), "")
+	return id
+}
+
+// redactURL hides credentials of destination URL
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+
+	return parsed.Redacted()
+}
+
+// buildPipeline describes route with options already applied,
+// it follows what parser does with every file
+func buildPipeline(o options, dir string) pipeline {
+	p := pipeline{Route: o.route, Nodes: []pipelineNode{}, Edges: []pipelineEdge{}}
+	if p.Route == "" {
+		p.Route = "default"
+	}
+
+	tail := p.node("source", nodeSource, "Directory "+dir, map[string]string{
+		"patterns":  o.patterns,
+		"exclude":   o.exclude,
+		"recursive": strconv.FormatBool(o.recursive),
+		"read_only": strconv.FormatBool(o.readOnly),
+	})
+
+	failures := []string{}
+	switch o.completion {
+	case completionMarker:
+		tail = p.chain(tail, "stabilize", nodeStage, "Wait for done marker", map[string]string{
+			"suffix": o.doneSuffix,
+		})
+	case completionRename:
+		tail = p.chain(tail, "stabilize", nodeStage, "Complete once renamed into place", nil)
+	default:
+		tail = p.chain(tail, "stabilize", nodeStage, "Wait for stable size", map[string]string{
+			"stable":     o.stableTime().String(),
+			"lock_probe": strconv.FormatBool(o.lockProbe),
+		})
+	}
+	validate := map[string]string{
+		"check_interval": strconv.Itoa(o.checkInterval) + "s",
+	}
+	for suffix, schema := range o.schemas {
+		validate["xsd "+suffix] = schema
+	}
+	if len(o.sheets) > 0 {
+		validate["xlsx_sheets"] = strings.Join(o.sheets, ",")
+	}
+	if o.validateCommand != "" {
+		validate["command"] = o.validateCommand
+	}
+	tail = p.chain(tail, "validate", nodeStage, "Validate XML or XLSX", validate)
+	if o.checksums {
+		tail = p.chain(tail, "checksum", nodeStage, "Verify checksum companion", nil)
+		failures = append(failures, tail)
+	}
+	if o.snapshot != "" {
+		tail = p.chain(tail, "snapshot", nodeStage, "Snapshot", map[string]string{"mode": o.snapshot})
+	}
+	if o.hold {
+		tail = p.chain(tail, "hold", nodeStage, "Hold until released", map[string]string{
+			"four_eyes": strconv.FormatBool(o.fourEyes),
+		})
+	}
+	if o.journal != "" {
+		tail = p.chain(tail, "dedup", nodeStage, "Skip delivered content", map[string]string{"journal": o.journal})
+	}
+	if o.dedupWindow > 0 && !o.mirror {
+		tail = p.chain(tail, "duplicates", nodeStage, "Detect content delivered under other name", map[string]string{
+			"window": strconv.Itoa(o.dedupWindow) + "s",
+			"action": o.dedupAction,
+		})
+	}
+	if o.preflightURL != "" && !o.mirror {
+		tail = p.chain(tail, "preflight", nodeStage, "Preflight check", map[string]string{
+			"url":      redactURL(o.preflightURL),
+			"min_size": strconv.FormatInt(o.preflightMinSize, 10),
+		})
+	}
+
+	if o.canary != nil && !o.mirror {
+		label := "Send share to canary"
+		if o.canary.Mirror {
+			label = "Copy share to canary"
+		}
+		tail = p.chain(tail, "canary", nodeStage, label, map[string]string{
+			"percent": formatFloat(o.canary.Percent),
+			"url":     redactURL(o.canary.URL),
+		})
+	}
+
+	if !o.mirror {
+		fanOut := p.chain(tail, "fanout", nodeStage, "Send to every destination", map[string]string{
+			"retry_attempts": strconv.Itoa(o.retryAttempts),
+		})
+		done := p.node("delivered", nodeStage, "Delivered everywhere", nil)
+		if o.shadowURL != "" {
+			p.edge(fanOut, p.node("shadow", nodeSink, "Shadow "+redactURL(o.shadowURL), nil), "")
+		}
+
+		for i, t := range o.targets() {
+			name := t.destination
+			if name == "" {
+				name = "default"
+			}
+			prefix := "destination" + strconv.Itoa(i)
+
+			from := fanOut
+			switch {
+			case strings.HasPrefix(t.url, "s3://"):
+				from = p.chain(from, prefix+"_sink", nodeSink, "S3 "+name, map[string]string{
+					"url":         redactURL(t.url),
+					"part_size":   strconv.Itoa(t.s3PartSize) + "MB",
+					"concurrency": strconv.Itoa(t.s3Concurrency),
+				})
+			case strings.HasPrefix(t.url, "sftp://"):
+				from = p.chain(from, prefix+"_sink", nodeSink, "SFTP "+name, map[string]string{
+					"url": redactURL(t.url),
+				})
+			default:
+				if len(t.transforms) > 0 {
+					from = p.chain(from, prefix+"_transform", nodeTransform, "Transform", t.transforms)
+				}
+				if t.compress != compressNone {
+					from = p.chain(from, prefix+"_compress", nodeTransform, "Compress", map[string]string{
+						"codec": t.compress,
+						"level": strconv.Itoa(t.compressLevel),
+					})
+				}
+
+				mode := "post"
+				switch {
+				case t.presignURL != "":
+					mode = "presigned"
+				case t.chunkSize > 0:
+					mode = "tus"
+				}
+				from = p.chain(from, prefix+"_sink", nodeSink, "HTTP "+name, map[string]string{
+					"url":  redactURL(t.url),
+					"mode": mode,
+				})
+			}
+			p.edge(from, done, "")
+			failures = append(failures, from)
+		}
+		tail = done
+	}
+
+	if o.proofKey != "" && !o.mirror {
+		tail = p.chain(tail, "proof", nodeStage, "Write proof of delivery", nil)
+	}
+
+	switch {
+	case o.readOnly:
+		p.chain(tail, "retain", nodeSink, "Leave in place", nil)
+	case o.zip:
+		label := "Archive (" + o.archiveFormat + ") into " + o.out
+		if o.zipEncrypt != "" {
+			kind, _, _ := parseEncrypt(o.zipEncrypt)
+			label = "Archive (" + o.archiveFormat + ", " + kind + ") into " + o.out
+		}
+		p.chain(tail, "archive", nodeSink, label, nil)
+	case o.clear:
+		p.chain(tail, "delete", nodeSink, "Delete", nil)
+	default:
+		p.chain(tail, "retain", nodeSink, "Leave in place", nil)
+	}
+
+	quarantine := p.node("quarantine", nodeSink, "Quarantine "+o.quarantine, nil)
+	p.edge("validate", quarantine, "invalid")
+	for _, from := range failures {
+		if from == "checksum" {
+			p.edge(from, quarantine, "mismatch")
+			continue
+		}
+		p.edge(from, p.deadLetterNode(o), "retries exhausted")
+	}
+
+	return p
+}
+
+func (p *pipeline) deadLetterNode(o options) string {
+	for _, n := range p.Nodes {
+		if n.ID == "deadletter" {
+			return n.ID
+		}
+	}
+
+	return p.node("deadletter", nodeSink, "Dead letter "+o.deadLetter, nil)
+}
+
+// pipelines describes every route and files not covered by routes
+func (o options) pipelines() []pipeline {
+	list := []pipeline{}
+	covered := false
+	for _, r := range o.routes {
+		list = append(list, buildPipeline(o.withRoute(r), path.Join(o.dir, r.Dir)))
+		covered = covered || (r.Dir == "" && len(r.Match) == 0)
+	}
+	if !covered {
+		list = append(list, buildPipeline(o, o.dir))
+	}
+
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Route < list[j].Route })
+
+	return list
+}
+
+// renderDOT renders pipelines as Graphviz graph with cluster per route
+func renderDOT(list []pipeline) string {
+	var b strings.Builder
+	b.WriteString("digraph hooker {\n\trankdir=LR;\n\tnode [fontname=\"Helvetica\"];\n")
+
+	shapes := map[string]string{
+		nodeSource:    "folder",
+		nodeStage:     "box",
+		nodeTransform: "box, style=dashed",
+		nodeSink:      "cylinder",
+	}
+	for i, p := range list {
+		id := func(node string) string {
+			return strconv.Quote(fmt.Sprintf("r%d_%s", i, node))
+		}
+
+		fmt.Fprintf(&b, "\tsubgraph cluster_%d {\n\t\tlabel=%s;\n", i, strconv.Quote(p.Route))
+		for _, n := range p.Nodes {
+			fmt.Fprintf(&b, "\t\t%s [label=%s, shape=%s];\n", id(n.ID), strconv.Quote(n.Label), shapes[n.Kind])
+		}
+		for _, e := range p.Edges {
+			if e.Label == "" {
+				fmt.Fprintf(&b, "\t\t%s -> %s;\n", id(e.From), id(e.To))
+				continue
+			}
+			fmt.Fprintf(&b, "\t\t%s -> %s [label=%s, style=dashed, color=red];\n", id(e.From), id(e.To), strconv.Quote(e.Label))
+		}
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// handlePipeline serves GET /pipeline as JSON
+// graph or Graphviz DOT with ?format=dot
+func (c *controller) handlePipeline(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list := c.opts().pipelines()
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		writeJSON(w, map[string]interface{}{"routes": list})
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.Write([]byte(renderDOT(list)))
+	default:
+		http.Error(w, "Unknown format, use json or dot", http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// copyBufferSize is size of pooled copy buffers, the one io.Copy allocates
+const copyBufferSize = 32 * 1024
+
+// maxPooledBuffer is capacity beyond which byte buffers are not
+// pooled, so one large file doesn't keep its memory for good
+const maxPooledBuffer = 1024 * 1024
+
+// Buffers taken from pools and ones allocated as pools were empty
+var poolGets, poolMisses uint64
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		atomic.AddUint64(&poolMisses, 1)
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+var byteBuffers = sync.Pool{
+	New: func() interface{} {
+		atomic.AddUint64(&poolMisses, 1)
+		return new(bytes.Buffer)
+	},
+}
+
+// Wrappers hide ReaderFrom and WriterTo, which make io.CopyBuffer
+// ignore given buffer and allocate one of its own for files and pipes
+type (
+	readerOnly struct{ io.Reader }
+	writerOnly struct{ io.Writer }
+)
+
+// copyPooled is io.Copy with buffer taken from pool, files
+// are read in every stage of every file through it
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	atomic.AddUint64(&poolGets, 1)
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buf)
+}
+
+// getBuffer takes empty byte buffer from pool
+func getBuffer() *bytes.Buffer {
+	atomic.AddUint64(&poolGets, 1)
+	return byteBuffers.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns byte buffer to pool, buffer must not be used anymore
+func putBuffer(b *bytes.Buffer) {
+	if b == nil || b.Cap() > maxPooledBuffer {
+		return
+	}
+
+	b.Reset()
+	byteBuffers.Put(b)
+}
+
+// allocationGauges reports allocations and garbage collection
+// of process together with buffer pool efficiency
+func allocationGauges() map[string]float64 {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return map[string]float64{
+		gaugeHeapBytes.name:      float64(mem.HeapAlloc),
+		gaugeAllocatedBytes.name: float64(mem.TotalAlloc),
+		gaugeAllocations.name:    float64(mem.Mallocs),
+		gaugeGCRuns.name:         float64(mem.NumGC),
+		gaugeGCPause.name:        float64(mem.PauseTotalNs) / 1e9,
+		gaugePoolGets.name:       float64(atomic.LoadUint64(&poolGets)),
+		gaugePoolMisses.name:     float64(atomic.LoadUint64(&poolMisses)),
+	}
+}
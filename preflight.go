@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+)
+
+// exists asks API whether it already has content with given
+// hash, so upload of re-dropped file may be skipped
+func (p *parser) exists(hash string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, p.options.preflightURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err := p.options.setAPIHeaders(req); err != nil {
+		return false, err
+	}
+	req.Header.Set("X-File-Name", path.Base(p.file.Name()))
+	req.Header.Set("X-Content-SHA256", hash)
+	req.Header.Set("If-None-Match", `"`+hash+`"`)
+
+	tout := time.Second * time.Duration(p.options.timeout)
+	client := http.Client{
+		Transport: p.options.transport(),
+		Timeout:   tout,
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusNotModified:
+		return true, nil
+	case http.StatusNotFound, http.StatusPreconditionFailed:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("Http status: %d", response.StatusCode)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// validatePresign checks -presign-url, it only applies to API uploads
+func validatePresign(presignURL, apiURL string) error {
+	u, err := url.Parse(presignURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("Wrong pre-signed URL endpoint: " + presignURL)
+	}
+	if strings.HasPrefix(apiURL, "s3://") || strings.HasPrefix(apiURL, "sftp://") {
+		return errors.New("Pre-signed uploads require http(s) -url")
+	}
+
+	return nil
+}
+
+// presignRequest describes body hooker is about to upload
+type presignRequest struct {
+	Filename   string            `json:"filename"`
+	Size       int64             `json:"size"`
+	SHA256     string            `json:"sha256"`
+	BodySize   int64             `json:"body_size"`
+	BodySHA256 string            `json:"body_sha256"`
+	Encoding   string            `json:"encoding"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// presignResponse tells where body is uploaded to, upload URL is
+// requested with given method and headers only, without access token
+type presignResponse struct {
+	UploadURL  string            `json:"upload_url"`
+	Method     string            `json:"method"`
+	Headers    map[string]string `json:"headers"`
+	ConfirmURL string            `json:"confirm_url"`
+	UploadID   string            `json:"upload_id"`
+}
+
+// presignConfirm is sent to API once body is stored
+type presignConfirm struct {
+	presignRequest
+	UploadID string `json:"upload_id,omitempty"`
+}
+
+// uploadPresigned asks API for pre-signed URL, uploads request body
+// straight to object storage and confirms upload to API, directives
+// are taken from confirmation response
+func (u *httpUploader) uploadPresigned(ctx context.Context, pl *payload, filename string, headers map[string]string) (*directive, error) {
+	// Pre-signed PUT needs length known upfront
+	tmp, err := u.ws.create("presigned")
+	if err != nil {
+		return nil, err
+	}
+	defer u.ws.discard(tmp.Name())
+	defer tmp.Close()
+
+	body, wait := u.body(pl, filename)
+	_, err = copyPooled(tmp, body)
+	body.Close()
+	requestHash, bodyErr := wait()
+	if err != nil {
+		return nil, err
+	}
+	if bodyErr != nil {
+		return nil, bodyErr
+	}
+
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := presignRequest{
+		Filename:   path.Base(filename),
+		Size:       pl.size,
+		SHA256:     pl.sha256,
+		BodySize:   size,
+		BodySHA256: requestHash,
+		Encoding:   u.options.compress,
+		Headers:    headers,
+	}
+
+	client := u.client()
+	response, err := u.presignCall(ctx, client, u.options.presignURL, meta.Filename, meta, headers)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		data := readResponse(response.Body)
+		response.Body.Close()
+		return nil, &httpStatusError{Code: response.StatusCode, Body: truncate(data)}
+	}
+
+	target := presignResponse{}
+	err = json.NewDecoder(&cappedReader{r: response.Body, limit: u.options.maxResponseSize}).Decode(&target)
+	response.Body.Close()
+	if err != nil {
+		return nil, errors.New("Wrong pre-signed URL response: " + err.Error())
+	}
+	if target.UploadURL == "" {
+		return nil, errors.New("API returned no pre-signed URL")
+	}
+	if target.Method == "" {
+		target.Method = http.MethodPut
+	}
+
+	req, err := http.NewRequestWithContext(ctx, target.Method, target.UploadURL, io.NewSectionReader(tmp, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range target.Headers {
+		req.Header.Set(k, v)
+	}
+
+	// Storage certificate is not the API one, so
+	// pins are not checked for it while proxy is
+	storage := u.options
+	storage.pins = nil
+	response, err = (&http.Client{Transport: storage.transport()}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	stored := readResponse(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return nil, &httpStatusError{Code: response.StatusCode, Body: truncate(stored)}
+	}
+
+	confirmURL := u.options.url
+	if target.ConfirmURL != "" {
+		base, err := url.Parse(u.options.presignURL)
+		if err != nil {
+			return nil, err
+		}
+		ref, err := url.Parse(target.ConfirmURL)
+		if err != nil {
+			return nil, err
+		}
+		confirmURL = base.ResolveReference(ref).String()
+	}
+
+	response, err = u.presignCall(ctx, client, confirmURL, meta.Filename, presignConfirm{meta, target.UploadID}, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{Code: response.StatusCode, Body: truncate(readResponse(response.Body))}
+	}
+
+	d, err := readDirective(response, u.options.maxResponseSize)
+	if err != nil {
+		return nil, err
+	}
+	d.requestHash = requestHash
+
+	return d, nil
+}
+
+// presignCall posts JSON to API with the usual headers,
+// response body must be closed by caller
+func (u *httpUploader) presignCall(ctx context.Context, client *http.Client, target, filename string, in interface{}, headers map[string]string) (*http.Response, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if err := u.options.setAPIHeaders(req); err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-File-Name", filename)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	return client.Do(req)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Stages of file in work reported by status API
+const (
+	progressWaiting     = "waiting"
+	progressStabilizing = "stabilizing"
+	progressValidating  = "validating"
+	progressHeld        = "held"
+	progressSending     = "sending"
+	progressRetrying    = "retrying"
+	progressZipping     = "zipping"
+)
+
+// fileProgress is what file in work is doing now, retry is
+// number of failed upload attempts and bytes sent count request
+// bodies of every attempt to every destination
+type fileProgress struct {
+	Name           string    `json:"name"`
+	Stage          string    `json:"stage"`
+	Retry          int       `json:"retry,omitempty"`
+	StartedAt      time.Time `json:"started_at"`
+	StageStartedAt time.Time `json:"stage_started_at"`
+	BytesSent      int64     `json:"bytes_sent"`
+}
+
+// track starts progress of file, caller holds c.mu
+func (c *controller) track(name string) {
+	now := time.Now()
+	c.progress[name] = &fileProgress{
+		Name:           name,
+		Stage:          progressWaiting,
+		StartedAt:      now,
+		StageStartedAt: now,
+	}
+}
+
+func (c *controller) setStage(name, stage string, retry int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fp, ok := c.progress[name]
+	if !ok || (fp.Stage == stage && fp.Retry == retry) {
+		return
+	}
+
+	fp.Stage, fp.Retry, fp.StageStartedAt = stage, retry, time.Now()
+}
+
+// sentCounter returns counter of bytes sent for file
+func (c *controller) sentCounter(name string) *int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if fp, ok := c.progress[name]; ok {
+		return &fp.BytesSent
+	}
+
+	return nil
+}
+
+// filesInWork lists progress of files in work, oldest first
+func (c *controller) filesInWork() []fileProgress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := []fileProgress{}
+	for _, fp := range c.progress {
+		list = append(list, fileProgress{
+			Name:           fp.Name,
+			Stage:          fp.Stage,
+			Retry:          fp.Retry,
+			StartedAt:      fp.StartedAt,
+			StageStartedAt: fp.StageStartedAt,
+			BytesSent:      atomic.LoadInt64(&fp.BytesSent),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.Before(list[j].StartedAt)
+	})
+
+	return list
+}
+
+func (p *parser) stage(stage string, retry int) {
+	p.controller.setStage(p.file.Name(), stage, retry)
+}
+
+type sentKey struct{}
+
+// withSentCounter makes requests of upload attempt count their body
+func withSentCounter(ctx context.Context, sent *int64) context.Context {
+	if sent == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, sentKey{}, sent)
+}
+
+// sentBody counts bytes of request body read by transport
+type sentBody struct {
+	io.ReadCloser
+	sent *int64
+}
+
+func (b *sentBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.sent, int64(n))
+	return n, err
+}
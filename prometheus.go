@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promCounter is counter with labels, values
+// are keyed by label values joined with labelSeparator
+type promCounter struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+const labelSeparator = "\xff"
+
+// promHistogram is histogram with fixed buckets
+type promHistogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// promGauge is gauge computed when metrics are scraped
+type promGauge struct {
+	name   string
+	help   string
+	labels []string
+}
+
+var (
+	gaugeInWork         = promGauge{name: "hooker_files_in_work", help: "Files being processed."}
+	gaugeHeld           = promGauge{name: "hooker_files_held", help: "Files held until operator releases them."}
+	gaugeQueueDepth     = promGauge{name: "hooker_queue_depth", help: "Files waiting for a worker."}
+	gaugeRetrying       = promGauge{name: "hooker_files_retrying", help: "Files waiting for next upload attempt."}
+	gaugeMetricsDropped = promGauge{name: "hooker_metrics_dropped", help: "Metrics lost while METRICS_URL was unavailable."}
+	gaugeArchiveSize    = promGauge{name: "hooker_archive_size_bytes", help: "Size of dated archives as of last retention run."}
+	gaugeSLOCompliance  = promGauge{name: "hooker_slo_compliance_percent", help: "Share of good files within SLO window.", labels: []string{"route"}}
+	gaugeSLOBudget      = promGauge{name: "hooker_slo_budget_remaining_percent", help: "Error budget left within SLO window.", labels: []string{"route"}}
+	gaugeSLOBurnRate    = promGauge{name: "hooker_slo_burn_rate", help: "Error budget burn rate.", labels: []string{"route", "window"}}
+	gaugeHeapBytes      = promGauge{name: "hooker_heap_bytes", help: "Bytes of allocated heap objects."}
+	gaugeAllocatedBytes = promGauge{name: "hooker_allocated_bytes", help: "Bytes allocated since start, including freed ones."}
+	gaugeAllocations    = promGauge{name: "hooker_allocations", help: "Heap objects allocated since start."}
+	gaugeGCRuns         = promGauge{name: "hooker_gc_runs", help: "Garbage collections since start."}
+	gaugeGCPause        = promGauge{name: "hooker_gc_pause_seconds", help: "Total garbage collection pause since start."}
+	gaugePoolGets       = promGauge{name: "hooker_buffer_pool_gets", help: "Buffers taken from pools since start."}
+	gaugePoolMisses     = promGauge{name: "hooker_buffer_pool_misses", help: "Buffers allocated since start as pools were empty."}
+)
+
+// promGauges lists every gauge, SLO ones are present for routes with SLO only
+var promGauges = []promGauge{gaugeInWork, gaugeHeld, gaugeQueueDepth, gaugeRetrying, gaugeMetricsDropped, gaugeArchiveSize,
+	gaugeSLOCompliance, gaugeSLOBudget, gaugeSLOBurnRate, gaugeHeapBytes, gaugeAllocatedBytes, gaugeAllocations,
+	gaugeGCRuns, gaugeGCPause, gaugePoolGets, gaugePoolMisses}
+
+// promMetrics keeps metrics exposed at /metrics in Prometheus text
+// format, they are counted next to ones sent with go-metrics
+type promMetrics struct {
+	mu sync.Mutex
+
+	discovered        *promCounter
+	sent              *promCounter
+	failures          *promCounter
+	phases            *promCounter
+	retries           *promCounter
+	quarantined       *promCounter
+	deadLettered      *promCounter
+	duplicates        *promCounter
+	oversized         *promCounter
+	shadow            *promCounter
+	shadowComparisons *promCounter
+	shadowDivergences *promCounter
+	canaryFiles       *promCounter
+	canarySeconds     *promCounter
+	archivesPruned    *promCounter
+	archiveReclaimed  *promCounter
+	oauthRequests     *promCounter
+	duration          *promHistogram
+	size              *promHistogram
+}
+
+func newPromMetrics() *promMetrics {
+	return &promMetrics{
+		discovered:        newPromCounter("hooker_files_discovered_total", "Files picked up for processing."),
+		sent:              newPromCounter("hooker_files_sent_total", "Files successfully uploaded.", "destination"),
+		failures:          newPromCounter("hooker_send_failures_total", "Failed upload attempts.", "kind"),
+		phases:            newPromCounter("hooker_send_failure_phases_total", "Failed upload attempts by request phase.", "phase"),
+		retries:           newPromCounter("hooker_send_retries_total", "Upload attempts scheduled after failure.", "destination"),
+		quarantined:       newPromCounter("hooker_files_quarantined_total", "Files moved to quarantine."),
+		deadLettered:      newPromCounter("hooker_files_dead_lettered_total", "Files moved to dead-letter directory."),
+		duplicates:        newPromCounter("hooker_files_duplicate_total", "Files with content delivered under other name.", "action"),
+		oversized:         newPromCounter("hooker_files_oversized_total", "Files set aside as request body exceeds API limit.", "check"),
+		shadow:            newPromCounter("hooker_shadow_uploads_total", "Uploads to shadow URL.", "result"),
+		shadowComparisons: newPromCounter("hooker_shadow_comparisons_total", "Shadow responses compared with main URL ones.", "result"),
+		shadowDivergences: newPromCounter("hooker_shadow_divergences_total", "Fields shadow responses differ from main URL ones in.", "field"),
+		canaryFiles:       newPromCounter("hooker_canary_files_total", "Uploads by route variant.", "route", "variant", "result"),
+		canarySeconds:     newPromCounter("hooker_canary_upload_seconds_total", "Time spent uploading by route variant.", "route", "variant"),
+		archivesPruned:    newPromCounter("hooker_archives_pruned_total", "Archives deleted by retention.", "reason"),
+		archiveReclaimed:  newPromCounter("hooker_archive_reclaimed_bytes_total", "Space freed by deleting archives.", "reason"),
+		oauthRequests:     newPromCounter("hooker_oauth_token_requests_total", "OAuth2 access token requests.", "result"),
+		duration: newPromHistogram("hooker_upload_duration_seconds", "Duration of upload attempts.",
+			[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}),
+		size: newPromHistogram("hooker_payload_size_bytes", "Size of uploaded files.",
+			[]float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30}),
+	}
+}
+
+func newPromCounter(name, help string, labels ...string) *promCounter {
+	return &promCounter{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func newPromHistogram(name, help string, buckets []float64) *promHistogram {
+	return &promHistogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// inc increments counter, label values are ignored for counters without labels
+func (m *promMetrics) inc(c *promCounter, values ...string) {
+	m.add(c, 1, values...)
+}
+
+func (m *promMetrics) add(c *promCounter, v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(values) > len(c.labels) {
+		values = values[:len(c.labels)]
+	}
+	c.values[strings.Join(values, labelSeparator)] += v
+}
+
+func (m *promMetrics) observe(h *promHistogram, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// observeUpload records attempt duration
+func (m *promMetrics) observeUpload(started time.Time) {
+	m.observe(m.duration, time.Since(started).Seconds())
+}
+
+func (m *promMetrics) counters() []*promCounter {
+	return []*promCounter{m.discovered, m.sent, m.failures, m.phases, m.retries, m.quarantined, m.deadLettered, m.duplicates, m.oversized, m.shadow, m.shadowComparisons, m.shadowDivergences, m.canaryFiles, m.canarySeconds, m.archivesPruned, m.archiveReclaimed, m.oauthRequests}
+}
+
+func (m *promMetrics) histograms() []*promHistogram {
+	return []*promHistogram{m.duration, m.size}
+}
+
+func (m *promMetrics) write(w io.Writer, gauges map[string]float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.counters() {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		if len(c.labels) == 0 {
+			fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+			continue
+		}
+
+		values := []string{}
+		for v := range c.values {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+		for _, v := range values {
+			pairs := []string{}
+			for i, value := range strings.Split(v, labelSeparator) {
+				pairs = append(pairs, c.labels[i]+"="+strconv.Quote(value))
+			}
+			fmt.Fprintf(w, "%s{%s} %s\n", c.name, strings.Join(pairs, ","), formatFloat(c.values[v]))
+		}
+	}
+
+	for _, h := range m.histograms() {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(le), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+		fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatFloat(h.sum), h.name, h.count)
+	}
+
+	for _, g := range promGauges {
+		if v, ok := gauges[g.name]; ok {
+			writeGaugeHeader(w, g)
+			fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(v))
+		}
+	}
+}
+
+func writeGaugeHeader(w io.Writer, g promGauge) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+}
+
+// catalogEntry describes metric exposed at /metrics
+type catalogEntry struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Labels      []string `json:"labels"`
+	Description string   `json:"description"`
+}
+
+// catalog lists every metric from the same definitions /metrics is written from
+func (m *promMetrics) catalog() []catalogEntry {
+	list := []catalogEntry{}
+	for _, c := range m.counters() {
+		labels := append([]string{}, c.labels...)
+		list = append(list, catalogEntry{Name: c.name, Type: "counter", Labels: labels, Description: c.help})
+	}
+	for _, h := range m.histograms() {
+		list = append(list, catalogEntry{Name: h.name, Type: "histogram", Labels: []string{"le"}, Description: h.help})
+	}
+	for _, g := range promGauges {
+		labels := append([]string{}, g.labels...)
+		list = append(list, catalogEntry{Name: g.name, Type: "gauge", Labels: labels, Description: g.help})
+	}
+
+	return list
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// handleMetrics serves GET /metrics for Prometheus
+func (c *controller) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	c.mu.Lock()
+	gauges := map[string]float64{
+		gaugeInWork.name:         float64(len(c.files)),
+		gaugeHeld.name:           float64(len(c.held)),
+		gaugeQueueDepth.name:     float64(len(c.queued)),
+		gaugeRetrying.name:       float64(len(c.retries)),
+		gaugeMetricsDropped.name: float64(metricsDropped()),
+		gaugeArchiveSize.name:    float64(c.archiveSize),
+	}
+	c.mu.Unlock()
+	for name, v := range allocationGauges() {
+		gauges[name] = v
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.prom.write(w, gauges)
+	writeSLOMetrics(w, c.sloReports())
+}
+
+// handleMetricsCatalog serves GET /metrics/catalog
+func (c *controller) handleMetricsCatalog(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, c.prom.catalog())
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const proofVersion = 1
+
+// proof is a signed proof of delivery of single file, signature
+// covers JSON encoding of proof with empty signature field
+type proof struct {
+	Version       int       `json:"version"`
+	File          string    `json:"file"`
+	Route         string    `json:"route,omitempty"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	Destination   string    `json:"destination"`
+	RequestSHA256 string    `json:"request_sha256"`
+	Status        int       `json:"status,omitempty"`
+	Receipt       string    `json:"receipt,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	DeliveredAt   time.Time `json:"delivered_at"`
+	Hooker        string    `json:"hooker_version"`
+	Algorithm     string    `json:"algorithm"`
+	PublicKey     string    `json:"public_key"`
+	Signature     string    `json:"signature,omitempty"`
+}
+
+// loadProofKey reads PKCS#8 PEM encoded Ed25519 private key
+func loadProofKey(filePath string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM data found in " + filePath)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("Proof key must be Ed25519 private key")
+	}
+
+	return private, nil
+}
+
+func (p *proof) sign(key signer) ([]byte, error) {
+	p.Algorithm = key.algorithm()
+	p.PublicKey = key.publicKey()
+	p.Signature = ""
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := key.sign(data)
+	if err != nil {
+		return nil, err
+	}
+	p.Signature = base64.StdEncoding.EncodeToString(signature)
+
+	return json.MarshalIndent(p, "", "    ")
+}
+
+// proofPath is where proof of file is stored, next to its archive
+func proofPath(out, name, destination string) string {
+	if destination != "" {
+		name += "." + destination
+	}
+
+	return path.Join(out, name+".proof.json")
+}
+
+// writeProof signs proof of delivery and stores it next to archive
+func (p *parser) writeProof(pr *proof) (string, error) {
+	data, err := pr.sign(p.controller.proofKey)
+	if err != nil {
+		return "", err
+	}
+
+	ws := p.controller.workspace
+	tmp, err := ws.create("proof")
+	if err != nil {
+		return "", err
+	}
+	defer ws.discard(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	target := proofPath(p.options.out, p.file.Name(), p.options.destination)
+	return target, ws.commit(tmp.Name(), target)
+}
+
+// handleProof serves GET /proofs/{name}[?destination=name]
+func (c *controller) handleProof(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/proofs/")
+	if name == "" || path.Clean("/"+name) != "/"+name {
+		http.Error(w, "Wrong file name", http.StatusBadRequest)
+		return
+	}
+
+	destination := r.URL.Query().Get("destination")
+	if strings.ContainsAny(destination, "/\\") {
+		http.Error(w, "Wrong destination name", http.StatusBadRequest)
+		return
+	}
+
+	data, err := ioutil.ReadFile(proofPath(c.opts().out, name, destination))
+	if os.IsNotExist(err) {
+		http.Error(w, "Proof not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
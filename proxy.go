@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// validateProxy checks -proxy URL, only SOCKS5 proxies are
+// supported, with socks5h host names are resolved by proxy
+func validateProxy(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return errors.New("Proxy must be socks5://[user:password@]host:port")
+	}
+	if u.Port() == "" {
+		return errors.New("Proxy port is not set: " + raw)
+	}
+
+	return nil
+}
+
+// proxyURL returns -proxy with password taken from PROXY_PASSWORD
+// when it is not in URL, so it does not show up in process list
+func (o options) proxyURL() *url.URL {
+	if o.proxy == "" {
+		return nil
+	}
+
+	u, _ := url.Parse(o.proxy)
+	if u.User != nil {
+		if _, ok := u.User.Password(); !ok {
+			if password := os.Getenv("PROXY_PASSWORD"); password != "" {
+				u.User = url.UserPassword(u.User.Username(), password)
+			}
+		}
+	}
+
+	return u
+}
+
+// transport returns HTTP transport for API and S3 requests with
+// separate timeouts of every phase, with -proxy set connections
+// go through SOCKS5 proxy
+func (o options) transport() http.RoundTripper {
+	transport := &http.Transport{
+		DialContext:           o.dial,
+		TLSClientConfig:       o.tlsConfig(),
+		TLSHandshakeTimeout:   o.seconds(o.tlsTimeout),
+		ResponseHeaderTimeout: o.seconds(o.responseTimeout),
+	}
+
+	if u := o.proxyURL(); u != nil {
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	return &phaseTransport{base: transport}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	metrics "github.com/cryptopay-dev/go-metrics"
+	"github.com/getsentry/raven-go"
+)
+
+// quarantine moves file with its companions aside
+// so it will not be picked up again
+func (p *parser) quarantine(filePath string, reason error, companions ...string) {
+	log.Printf("[FILE: %s] Quarantining file: %s\n", p.prefix, reason)
+
+	raven.CaptureMessage("File quarantined", errorTags(reason))
+
+	sendMetrics("files", metrics.M{
+		"quarantined": true,
+	}, nil)
+	p.controller.prom.inc(p.controller.prom.quarantined, "")
+
+	// Source must stay untouched, file is
+	// skipped until it is changed instead
+	if p.options.readOnly {
+		log.Printf("[FILE: %s] Read-only source, leaving file in place\n", p.prefix)
+		if fi, err := os.Stat(filePath); err == nil {
+			p.controller.skips.add(relFileInfo{FileInfo: fi, name: p.file.Name()}, p.options.route, skipQuarantined, "")
+		}
+		return
+	}
+
+	for _, src := range append([]string{filePath}, companions...) {
+		dst := p.options.quarantinePath(src)
+		if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+			raven.CaptureErrorAndWait(err, map[string]string{
+				"file": filePath,
+			})
+
+			log.Printf("[FILE: %s] Error creating quarantine directory: %s\n", p.prefix, err)
+			return
+		}
+
+		if err := moveFile(src, dst); err != nil {
+			raven.CaptureErrorAndWait(err, map[string]string{
+				"file": src,
+			})
+
+			log.Printf("[FILE: %s] Error moving %s to quarantine: %s\n", p.prefix, src, err)
+			continue
+		}
+
+		log.Printf("[FILE: %s] Moved %s to %s\n", p.prefix, src, dst)
+	}
+}
+
+// quarantinePath keeps path of file relative to watched directory
+// under quarantine, so files of the same name in different
+// subdirectories don't overwrite each other and go back where they were
+func (o options) quarantinePath(src string) string {
+	return o.setAsidePath(o.quarantine, src)
+}
+
+// setAsidePath places file under root by its path relative to
+// watched directory, files outside of it go by their name
+func (o options) setAsidePath(root, src string) string {
+	rel, err := filepath.Rel(o.dir, src)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(src)
+	}
+
+	return path.Join(root, filepath.ToSlash(rel))
+}
+
+// fail records file which could not be processed in journal
+// and moves it to quarantine or dead-letter directory
+func (p *parser) fail(filePath string, reason error, companions ...string) {
+	raven.CaptureErrorAndWait(reason, errorTags(reason))
+
+	log.Printf("[FILE: %s] Processing failed: %s\n", p.prefix, reason)
+
+	err := p.controller.journal.record(journalEntry{
+		Name:   p.file.Name(),
+		Route:  p.options.route,
+		State:  stateFailed,
+		Size:   p.file.Size(),
+		Mtime:  p.file.ModTime(),
+		SentAt: time.Now(),
+		Error:  reason.Error(),
+	})
+	if err != nil {
+		log.Printf("[FILE: %s] Error writing journal: %s\n", p.prefix, err)
+	}
+
+	p.setAside(filePath, reason, companions...)
+}
+
+// moveFile renames file falling back to copy
+// when destination is on another filesystem
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+
+	return os.Remove(src)
+}
+
+// fileFilter selects files for bulk operations
+type fileFilter struct {
+	pattern string
+	before  time.Time
+}
+
+// parseFilter reads ?pattern=<glob>&before=<date> query, where
+// date is either RFC3339 timestamp or YYYY-MM-DD
+func parseFilter(r *http.Request) (fileFilter, error) {
+	f := fileFilter{
+		pattern: r.URL.Query().Get("pattern"),
+	}
+
+	if f.pattern != "" {
+		if _, err := path.Match(f.pattern, ""); err != nil {
+			return f, fmt.Errorf("Wrong pattern: %s", err)
+		}
+	}
+
+	if before := r.URL.Query().Get("before"); before != "" {
+		t, err := parseTime(before)
+		if err != nil {
+			return f, err
+		}
+
+		f.before = t
+	}
+
+	return f, nil
+}
+
+// match checks file, pattern is matched against
+// its relative path and against its base name
+func (f fileFilter) match(fi os.FileInfo) bool {
+	if f.pattern != "" {
+		ok, _ := path.Match(f.pattern, fi.Name())
+		if !ok {
+			ok, _ = path.Match(f.pattern, path.Base(fi.Name()))
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if !f.before.IsZero() && !fi.ModTime().Before(f.before) {
+		return false
+	}
+
+	return true
+}
+
+// quarantined lists quarantined files matching filter
+func (c *controller) quarantined(f fileFilter) ([]os.FileInfo, error) {
+	return readQuarantine(c.opts().quarantine, f)
+}
+
+// readQuarantine lists quarantine directory, files
+// are named by their path relative to watched directory
+func readQuarantine(dir string, f fileFilter) ([]os.FileInfo, error) {
+	matched := []os.FileInfo{}
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		fi = relFileInfo{FileInfo: fi, name: filepath.ToSlash(rel)}
+		if f.match(fi) {
+			matched = append(matched, fi)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return matched, err
+}
+
+// removeEmptyDirs removes directories of file left
+// empty up to root, which is kept
+func removeEmptyDirs(root, file string) {
+	root = path.Clean(root)
+	for dir := path.Dir(file); dir != root && dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// retryQuarantined moves matching quarantined files back into
+// watched directory, files whose name is taken there are left
+// in quarantine and returned as conflicts
+func (c *controller) retryQuarantined(f fileFilter) ([]string, []string, error) {
+	files, err := c.quarantined(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := c.opts()
+	moved, conflicts := []string{}, []string{}
+	for _, fi := range files {
+		src := path.Join(opts.quarantine, fi.Name())
+		dst := path.Join(opts.dir, fi.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			conflicts = append(conflicts, fi.Name())
+			continue
+		}
+
+		if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+			return moved, conflicts, err
+		}
+		if err := moveFile(src, dst); err != nil {
+			return moved, conflicts, err
+		}
+		removeEmptyDirs(opts.quarantine, src)
+
+		moved = append(moved, fi.Name())
+	}
+
+	return moved, conflicts, nil
+}
+
+func (c *controller) deleteQuarantined(f fileFilter) ([]string, error) {
+	files, err := c.quarantined(f)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := c.opts().quarantine
+	deleted := []string{}
+	for _, fi := range files {
+		if err := os.Remove(path.Join(dir, fi.Name())); err != nil {
+			return deleted, err
+		}
+		removeEmptyDirs(dir, path.Join(dir, fi.Name()))
+
+		deleted = append(deleted, fi.Name())
+	}
+
+	return deleted, nil
+}
+
+// handleQuarantine serves GET /quarantine listing and
+// DELETE /quarantine bulk removal, both accept filters
+func (c *controller) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	min := roleRead
+	if r.Method == http.MethodDelete {
+		min = roleAdmin
+	}
+	if _, ok := c.admin.require(w, r, min); !ok {
+		return
+	}
+
+	f, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		q, err := parseQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		files, err := c.quarantined(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		list := []fileItem{}
+		for _, fi := range files {
+			if q.match(fi.Name(), "", "", 0, fi.ModTime()) {
+				list = append(list, fileItem{
+					Name:  fi.Name(),
+					State: "quarantined",
+					Size:  fi.Size(),
+					Mtime: fi.ModTime(),
+				})
+			}
+		}
+
+		lo, hi := q.page(len(list))
+		writePage(w, q, len(list), list[lo:hi])
+
+	case http.MethodDelete:
+		files, err := c.quarantined(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		items := []string{}
+		for _, fi := range files {
+			items = append(items, fmt.Sprintf("%s\x00%d\x00%d", fi.Name(), fi.Size(), fi.ModTime().UnixNano()))
+		}
+
+		identities, ok := c.admin.authorize(w, r, roleAdmin, "delete-quarantine", r.URL.RawQuery, fingerprint(items))
+		if !ok {
+			return
+		}
+
+		deleted, err := c.deleteQuarantined(f)
+		c.admin.audit.record("delete-quarantine", r.URL.RawQuery, identities, fmt.Sprintf("deleted %d files", len(deleted)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"deleted": deleted,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// query holds filters and pagination shared by listing endpoints:
+// ?name=<substring>&route=&state=&status=&from=&to=&offset=&limit=
+type query struct {
+	name      string
+	exactName bool
+	route     string
+	state     string
+	status    int
+	from      time.Time
+	to        time.Time
+	offset    int
+	limit     int
+}
+
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", s)
+	}
+	if err != nil {
+		return t, errors.New("Wrong date " + s + ", expected RFC3339 or YYYY-MM-DD")
+	}
+
+	return t, nil
+}
+
+func parseQuery(r *http.Request) (query, error) {
+	v := r.URL.Query()
+	q := query{
+		name:   v.Get("name"),
+		route:  v.Get("route"),
+		state:  v.Get("state"),
+		limit:  defaultPageSize,
+		offset: 0,
+	}
+
+	var err error
+	if s := v.Get("file"); s != "" {
+		q.name, q.exactName = s, true
+	}
+	if s := v.Get("status"); s != "" {
+		if q.status, err = strconv.Atoi(s); err != nil {
+			return q, errors.New("Wrong status code: " + s)
+		}
+	}
+	if s := v.Get("from"); s != "" {
+		if q.from, err = parseTime(s); err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.to, err = parseTime(s); err != nil {
+			return q, err
+		}
+	}
+	if s := v.Get("offset"); s != "" {
+		if q.offset, err = strconv.Atoi(s); err != nil || q.offset < 0 {
+			return q, errors.New("Wrong offset: " + s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.limit, err = strconv.Atoi(s); err != nil || q.limit < 1 {
+			return q, errors.New("Wrong limit: " + s)
+		}
+		if q.limit > maxPageSize {
+			q.limit = maxPageSize
+		}
+	}
+
+	return q, nil
+}
+
+// match checks record fields against query, zero
+// values of fields which record has not are ignored
+func (q query) match(name, route, state string, status int, t time.Time) bool {
+	if q.exactName && name != q.name {
+		return false
+	}
+	if !q.exactName && q.name != "" && !strings.Contains(strings.ToLower(name), strings.ToLower(q.name)) {
+		return false
+	}
+	if q.route != "" && route != q.route {
+		return false
+	}
+	if q.state != "" && state != q.state {
+		return false
+	}
+	if q.status != 0 && status != q.status {
+		return false
+	}
+	if !q.from.IsZero() && t.Before(q.from) {
+		return false
+	}
+	if !q.to.IsZero() && !t.Before(q.to) {
+		return false
+	}
+
+	return true
+}
+
+// page returns slice bounds of requested page
+func (q query) page(total int) (int, int) {
+	lo := q.offset
+	if lo > total {
+		lo = total
+	}
+
+	hi := lo + q.limit
+	if hi > total {
+		hi = total
+	}
+
+	return lo, hi
+}
+
+// writePage writes paginated listing response
+func writePage(w http.ResponseWriter, q query, total int, items interface{}) {
+	writeJSON(w, map[string]interface{}{
+		"total":  total,
+		"offset": q.offset,
+		"limit":  q.limit,
+		"items":  items,
+	})
+}
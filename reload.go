@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/getsentry/raven-go"
+)
+
+// reload re-reads configuration file and applies it to files
+// discovered from now on, files in work keep their options
+func (c *controller) reload() error {
+	if c.base.config == "" {
+		return fmt.Errorf("no configuration file given")
+	}
+
+	opts, err := applyConfig(c.base)
+	if err != nil {
+		return err
+	}
+
+	c.setOptions(opts)
+	log.Printf("[CONFIG] Reloaded %s: %d routes, patterns %q, interval %ds\n",
+		opts.config, len(opts.routes), opts.patterns, opts.interval)
+
+	return nil
+}
+
+// reloadOnSignal reloads configuration on every SIGHUP
+func (c *controller) reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	for range sig {
+		if err := c.reload(); err != nil {
+			log.Printf("[CONFIG] Reload failed, keeping previous configuration: %s\n", err)
+			raven.CaptureErrorAndWait(err, nil)
+		}
+	}
+}
+
+// handleReload serves POST /reload
+func (c *controller) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := c.admin.require(w, r, roleAdmin)
+	if !ok {
+		return
+	}
+
+	err := c.reload()
+	if err != nil {
+		c.admin.audit.record("reload", "*", []string{p.name}, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.admin.audit.record("reload", "*", []string{p.name}, "reloaded")
+
+	opts := c.opts()
+	writeJSON(w, map[string]interface{}{
+		"patterns": opts.patterns,
+		"url":      opts.url,
+		"interval": opts.interval,
+		"routes":   opts.routes,
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/getsentry/raven-go"
+)
+
+// retention prunes journal and audit log by age and size,
+// optionally exporting pruned records before dropping them
+type retention struct {
+	maxAge  time.Duration
+	maxSize int64
+	export  string
+	journal *journal
+	audit   *auditLog
+	s3      *s3Client
+}
+
+func newRetention(opts options, j *journal, a *auditLog) *retention {
+	return &retention{
+		maxAge:  time.Hour * 24 * time.Duration(opts.retentionDays),
+		maxSize: int64(opts.retentionSize) * 1024 * 1024,
+		export:  opts.retentionExport,
+		journal: j,
+		audit:   a,
+		s3:      newS3Client(time.Second * time.Duration(opts.timeout)),
+	}
+}
+
+// split divides records into kept and pruned ones: older than maxAge
+// are pruned first, then the oldest until the rest fits in maxSize
+func (r *retention) split(lines [][]byte, times []time.Time) ([][]byte, [][]byte) {
+	cutoff := time.Now().Add(-r.maxAge)
+
+	first := 0
+	if r.maxAge > 0 {
+		for first < len(lines) && times[first].Before(cutoff) {
+			first++
+		}
+	}
+
+	if r.maxSize > 0 {
+		var size int64
+		for _, line := range lines[first:] {
+			size += int64(len(line)) + 1
+		}
+
+		for first < len(lines) && size > r.maxSize {
+			size -= int64(len(lines[first])) + 1
+			first++
+		}
+	}
+
+	return lines[first:], lines[:first]
+}
+
+// exportRecords ships pruned records as gzipped JSON lines
+// into local directory or s3://bucket/prefix location
+func (r *retention) exportRecords(kind string, lines [][]byte) error {
+	if r.export == "" || len(lines) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, line := range lines {
+		gz.Write(line)
+		gz.Write([]byte{'\n'})
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	name := kind + "-" + time.Now().UTC().Format("20060102T150405Z") + ".jsonl.gz"
+
+	if strings.HasPrefix(r.export, "s3://") {
+		loc, err := parseS3URL(r.export)
+		if err != nil {
+			return err
+		}
+
+		return r.s3.put(loc.bucket, loc.key(name), buf.Bytes(), map[string]string{
+			"Content-Type": "application/gzip",
+		})
+	}
+
+	if err := os.MkdirAll(r.export, 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(r.export, name), buf.Bytes(), 0644)
+}
+
+// readRecords reads JSON lines file returning
+// every line with its timestamp field
+func readRecords(filePath, field string) ([][]byte, []time.Time, error) {
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	lines, times := [][]byte{}, []time.Time{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := append([]byte{}, scanner.Bytes()...)
+
+		record := map[string]interface{}{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, nil, err
+		}
+
+		t, _ := time.Parse(time.RFC3339Nano, stringField(record[field]))
+		lines = append(lines, line)
+		times = append(times, t)
+	}
+
+	return lines, times, scanner.Err()
+}
+
+func stringField(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// writeRecords atomically replaces file with given lines
+func writeRecords(filePath string, lines [][]byte) error {
+	tmp := filePath + ".tmp"
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filePath)
+}
+
+// compact prunes single JSON lines file, it is called
+// with lock of the owning store held
+func (r *retention) compact(kind, filePath, field string) (int, error) {
+	lines, times, err := readRecords(filePath, field)
+	if err != nil || len(lines) == 0 {
+		return 0, err
+	}
+
+	kept, pruned := r.split(lines, times)
+	if len(pruned) == 0 {
+		return 0, nil
+	}
+
+	if err := r.exportRecords(kind, pruned); err != nil {
+		return 0, err
+	}
+
+	return len(pruned), writeRecords(filePath, kept)
+}
+
+func (r *retention) run() {
+	if r.journal.path != "" {
+		pruned, err := r.journal.compact(r)
+		r.report("journal", pruned, err)
+	}
+
+	if r.audit.path != "" {
+		r.audit.mu.Lock()
+		pruned, err := r.compact("audit", r.audit.path, "time")
+		r.audit.mu.Unlock()
+		r.report("audit", pruned, err)
+	}
+}
+
+func (r *retention) report(kind string, pruned int, err error) {
+	if err != nil {
+		raven.CaptureError(err, map[string]string{
+			"retention": kind,
+		})
+
+		log.Printf("[RETENTION] Error compacting %s: %s\n", kind, err)
+		return
+	}
+
+	if pruned > 0 {
+		log.Printf("[RETENTION] Pruned %d %s records\n", pruned, kind)
+	}
+}
+
+func (r *retention) watch(interval time.Duration) {
+	for {
+		r.run()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// retryPolicy decides whether and when failed upload is tried again,
+// delay doubles after every attempt starting from base up to max
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+	jitter   float64
+}
+
+func (o options) retryPolicy() retryPolicy {
+	return retryPolicy{
+		attempts: o.retryAttempts,
+		base:     time.Second * time.Duration(o.retryDelay),
+		max:      time.Second * time.Duration(o.retryMaxDelay),
+		jitter:   o.retryJitter,
+	}
+}
+
+// exhausted reports whether no attempts are left after given
+// number of failed ones, zero attempts means retrying forever
+func (r retryPolicy) exhausted(failed int) bool {
+	return r.attempts > 0 && failed >= r.attempts
+}
+
+// delay returns time to wait after given number of failed attempts,
+// jitter takes random part of it off so that files failed together
+// are not retried all at once
+func (r retryPolicy) delay(failed int) time.Duration {
+	d := r.base
+	for i := 1; i < failed && (r.max <= 0 || d < r.max); i++ {
+		d *= 2
+	}
+	if r.max > 0 && d > r.max {
+		d = r.max
+	}
+
+	if r.jitter > 0 {
+		d -= time.Duration(float64(d) * r.jitter * rand.Float64())
+	}
+
+	return d
+}
+
+// retryState describes file waiting for next upload attempt
+type retryState struct {
+	File        string    `json:"file"`
+	Destination string    `json:"destination,omitempty"`
+	Failed      int       `json:"failed_attempts"`
+	LastError   string    `json:"last_error"`
+	NextAt      time.Time `json:"next_attempt_at"`
+}
+
+func retryKey(file, destination string) string {
+	return file + "\x00" + destination
+}
+
+func (c *controller) setRetry(s retryState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.retries[retryKey(s.File, s.Destination)] = s
+}
+
+func (c *controller) clearRetry(file, destination string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.retries, retryKey(file, destination))
+}
+
+// resends returns how many times API asked to resend file to destination
+func (c *controller) resends(file, destination string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.retries[retryKey(file, destination)].Failed
+}
+
+// resendPending tells whether file waits until it may be resent to
+// some destination, it is not picked up until then. Caller holds c.mu
+func (c *controller) resendPending(file string) bool {
+	now := time.Now()
+	for _, s := range c.retries {
+		if s.File == file && now.Before(s.NextAt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filesRetrying lists files waiting for next upload attempt
+func (c *controller) filesRetrying() []retryState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := []retryState{}
+	for _, s := range c.retries {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NextAt.Before(list[j].NextAt)
+	})
+
+	return list
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// prompter asks for values missing in flags when stdin is a terminal
+type prompter struct {
+	in          *bufio.Reader
+	interactive bool
+}
+
+func newPrompter() *prompter {
+	fi, err := os.Stdin.Stat()
+	return &prompter{
+		in:          bufio.NewReader(os.Stdin),
+		interactive: err == nil && fi.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+// ask returns answer or current value when answer is empty
+func (p *prompter) ask(question, value string) string {
+	if !p.interactive {
+		return value
+	}
+
+	if value != "" {
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", question, value)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: ", question)
+	}
+
+	answer, err := p.in.ReadString('\n')
+	if err != nil {
+		// Input is over, remaining values are taken from flags
+		p.interactive = false
+		fmt.Fprintln(os.Stderr)
+	}
+	if answer = strings.TrimSpace(answer); answer != "" {
+		return answer
+	}
+
+	return value
+}
+
+// compactRoute is route as JSON object without empty values
+func compactRoute(r route) map[string]interface{} {
+	block := map[string]interface{}{}
+	v, t := reflect.ValueOf(r), reflect.TypeOf(r)
+	for i := 0; i < t.NumField(); i++ {
+		if f := v.Field(i); !f.IsZero() && !(f.Kind() == reflect.Slice && f.Len() == 0) {
+			block[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = f.Interface()
+		}
+	}
+
+	return block
+}
+
+// checkSample tells whether sample file would be accepted by route,
+// it is only checked and never sent
+func checkSample(cfg *config, r route, sample string) bool {
+	o := options{separator: ",", routes: cfg.Routes, schemas: cfg.Schemas, transforms: cfg.Transforms, sheets: cfg.Sheets, validateCommand: cfg.Validate}.withRoute(r)
+	name := path.Base(sample)
+	ok := true
+	check := func(passed bool, format string, a ...interface{}) {
+		status := "ok  "
+		if !passed {
+			status, ok = "FAIL", false
+		}
+		fmt.Fprintf(os.Stderr, "  %s %s\n", status, fmt.Sprintf(format, a...))
+	}
+
+	matched, reason := o.accepts(path.Join(r.Dir, name))
+	check(matched, "name %s %s", name, reason)
+
+	if owner, found := o.routeFor(path.Join(r.Dir, name)); found && owner.Name != r.Name {
+		check(false, "file in %s is picked by route %s", r.Dir, owner.Name)
+	}
+
+	fi, err := os.Stat(sample)
+	if err != nil {
+		check(false, "sample can't be read: %s", err)
+		return false
+	}
+	check(fi.Size() >= 50, "size %d is at least 50 bytes", fi.Size())
+
+	for _, v := range o.validators(name) {
+		err := v.validate(sample, fi)
+		check(err == nil, "passes %s validation", v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "       %s\n", err)
+			break
+		}
+	}
+
+	return ok
+}
+
+// addRoute appends route block to configuration file keeping other keys as they are
+func addRoute(filePath string, block map[string]interface{}) error {
+	doc := map[string]json.RawMessage{}
+	if buf, err := ioutil.ReadFile(filePath); err == nil {
+		if err := json.Unmarshal(buf, &doc); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	routes := []interface{}{}
+	if raw, ok := doc["routes"]; ok {
+		if err := json.Unmarshal(raw, &routes); err != nil {
+			return err
+		}
+	}
+
+	raw, err := json.Marshal(append(routes, block))
+	if err != nil {
+		return err
+	}
+	doc["routes"] = raw
+
+	data, err := json.MarshalIndent(doc, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filePath, append(data, '\n'), 0644)
+}
+
+func routeCommand(args []string) {
+	if len(args) == 0 || args[0] != "new" {
+		fmt.Println("Usage: hooker route new [-config <file> [-write]] [-name <name>] [-dir <dir>] [-patterns <.xml,...>] [-url <url>] [-token <token> | -token-env <VAR>] [-archive <archive|delete|retain>] [-sample <file>]")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("route new", flag.ExitOnError)
+	configPath := fs.String("config", "", "JSON configuration file route is checked against")
+	write := fs.Bool("write", false, "Add route to -config file instead of printing it")
+	name := fs.String("name", "", "Route name, defaults to directory")
+	dir := fs.String("dir", "", "Subdirectory of watched directory")
+	patterns := fs.String("patterns", ".xml", "File patterns of route (separated by: ,)")
+	url := fs.String("url", "", "API URL of route")
+	token := fs.String("token", "", "API token of route")
+	tokenEnv := fs.String("token-env", "", "Environment variable holding API token of route")
+	archive := fs.String("archive", "", "What to do with delivered files: archive, delete or retain (default is -zip and -clear)")
+	sample := fs.String("sample", "", "Sample file to check against route, it is not sent")
+	fs.Parse(args[1:])
+
+	if *write && *configPath == "" {
+		log.Fatalln("Writing route requires -config to be set")
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	p := newPrompter()
+	if !set["dir"] {
+		*dir = p.ask("Directory (relative to watched one)", *dir)
+	}
+	if !set["name"] {
+		*name = p.ask("Route name", *name)
+	}
+	if !set["patterns"] {
+		*patterns = p.ask("File patterns (separated by: ,)", *patterns)
+	}
+	if !set["url"] {
+		*url = p.ask("API URL (http, https, s3 or sftp)", *url)
+	}
+	if !set["token"] && !set["token-env"] {
+		*tokenEnv = p.ask("Environment variable with API token (empty to enter token)", *tokenEnv)
+		if *tokenEnv == "" {
+			*token = p.ask("API token", *token)
+		}
+	}
+	if !set["archive"] {
+		*archive = p.ask("Delivered files are (archive, delete, retain)", *archive)
+	}
+	if !set["sample"] {
+		*sample = p.ask("Sample file to check (empty to skip)", *sample)
+	}
+
+	r := route{Name: *name, Dir: *dir, URL: *url, Token: *token, TokenEnv: *tokenEnv, Archive: *archive}
+	for _, s := range strings.Split(*patterns, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			r.Patterns = append(r.Patterns, s)
+		}
+	}
+
+	cfg := &config{}
+	if *configPath != "" {
+		var err error
+		if cfg, err = loadConfig(*configPath); err != nil && !(*write && os.IsNotExist(err)) {
+			log.Fatalf("Configuration loading error: %s\n", err)
+		}
+		if cfg == nil {
+			cfg = &config{}
+		}
+	}
+
+	// Route goes through the same parsing as configuration
+	// file, which cleans directory and defaults name
+	block := compactRoute(r)
+	raw, err := json.Marshal(map[string]interface{}{"routes": []interface{}{block}})
+	if err != nil {
+		log.Fatalf("Route marshalling error: %s\n", err)
+	}
+	parsed, err := parseConfig(raw)
+	if err != nil {
+		log.Fatalf("Route error: %s\n", err)
+	}
+	r = parsed.Routes[0]
+	cfg.Routes = append(cfg.Routes, r)
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("Route error: %s\n", err)
+	}
+
+	if *sample != "" {
+		fmt.Fprintf(os.Stderr, "Checking %s against route %s:\n", *sample, r.Name)
+		if !checkSample(cfg, r, *sample) {
+			os.Exit(1)
+		}
+	}
+
+	block = compactRoute(r)
+	if *write {
+		if err := addRoute(*configPath, block); err != nil {
+			log.Fatalf("Configuration writing error: %s\n", err)
+		}
+		log.Printf("Route %s added to %s\n", r.Name, *configPath)
+		return
+	}
+
+	data, err := json.MarshalIndent(block, "", "    ")
+	if err != nil {
+		log.Fatalf("Route marshalling error: %s\n", err)
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Location is a parsed s3://bucket/prefix URL
+type s3Location struct {
+	bucket string
+	prefix string
+}
+
+func parseS3URL(raw string) (s3Location, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return s3Location{}, err
+	}
+
+	if u.Scheme != "s3" || u.Host == "" {
+		return s3Location{}, errors.New("Expected s3://bucket/prefix URL, got " + raw)
+	}
+
+	return s3Location{
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+func (l s3Location) key(name string) string {
+	if l.prefix == "" {
+		return name
+	}
+
+	return l.prefix + "/" + name
+}
+
+// s3Client talks to S3 compatible storage using
+// path-style requests signed with AWS Signature V4
+type s3Client struct {
+	service      string
+	endpoint     string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// newS3Client configures client from standard AWS environment,
+// S3_ENDPOINT points it to MinIO or other compatible storage
+func newS3Client(timeout time.Duration) *s3Client {
+	return newAWSClient("s3", "S3_ENDPOINT", timeout)
+}
+
+// newAWSClient configures Signature V4 client of any AWS service,
+// endpoint is taken from environment variable if it is set
+func newAWSClient(service, endpointEnv string, timeout time.Duration) *s3Client {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := os.Getenv(endpointEnv)
+	if endpoint == "" {
+		endpoint = "https://" + service + "." + region + ".amazonaws.com"
+	}
+
+	return &s3Client{
+		service:      service,
+		endpoint:     strings.TrimRight(endpoint, "/"),
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+func (c *s3Client) objectURL(bucket, key string) string {
+	return c.endpoint + "/" + awsEscapePath(bucket+"/"+key)
+}
+
+// awsEscape is URI encoding of Signature V4: every byte except
+// unreserved characters of RFC 3986 is percent-encoded. url.PathEscape
+// leaves sub-delimiters like + = @ as they are, S3 encodes them
+// and signature of such key would not match
+func awsEscape(s string) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z' || '0' <= ch && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' {
+			b.WriteByte(ch)
+			continue
+		}
+
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[ch>>4])
+		b.WriteByte(hexDigits[ch&15])
+	}
+
+	return b.String()
+}
+
+// awsEscapePath encodes every segment of path keeping slashes
+func awsEscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = awsEscape(part)
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// do signs and executes request returning response body
+func (c *s3Client) do(method, rawURL string, body []byte, headers map[string]string) ([]byte, http.Header, error) {
+	return c.doContext(context.Background(), method, rawURL, body, headers)
+}
+
+// doContext executes signed request which is canceled with context
+func (c *s3Client) doContext(ctx context.Context, method, rawURL string, body []byte, headers map[string]string) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	sum := sha256.Sum256(body)
+	c.sign(req, hex.EncodeToString(sum[:]), time.Now().UTC())
+
+	response, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if response.StatusCode/100 != 2 {
+		return nil, nil, fmt.Errorf("S3 %s %s: %w: %s", method, req.URL.Path, &httpStatusError{Code: response.StatusCode}, strings.TrimSpace(string(data)))
+	}
+
+	return data, response.Header, nil
+}
+
+// put uploads object in a single request
+func (c *s3Client) put(bucket, key string, body []byte, headers map[string]string) error {
+	_, _, err := c.do(http.MethodPut, c.objectURL(bucket, key), body, headers)
+	return err
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds AWS Signature V4 authorization to request
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	names := []string{}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Query must be sorted and strictly encoded
+	query := req.URL.Query()
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+
+	canonicalURI := awsEscapePath(req.URL.Path)
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		strings.Join(params, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/" + c.service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, c.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server-side encryption modes
+const (
+	sseS3  = "AES256"
+	sseKMS = "aws:kms"
+)
+
+// s3PartAttempts is how many times single part is sent
+// before whole multipart upload is given up
+const s3PartAttempts = 3
+
+// s3Uploader stores files as objects under s3://bucket/prefix,
+// files larger than part size are sent with multipart upload
+type s3Uploader struct {
+	client   *s3Client
+	location s3Location
+	options  options
+}
+
+func newS3Uploader(opts options) (*s3Uploader, error) {
+	loc, err := parseS3URL(opts.url)
+	if err != nil {
+		return nil, err
+	}
+
+	client := newS3Client(time.Second * time.Duration(opts.timeout))
+	client.client.Transport = opts.transport()
+
+	return &s3Uploader{
+		client:   client,
+		location: loc,
+		options:  opts,
+	}, nil
+}
+
+// headers builds object headers, custom file headers
+// like X-Batch-Id are stored as object metadata
+func (u *s3Uploader) headers(custom map[string]string) map[string]string {
+	headers := map[string]string{}
+	for k, v := range custom {
+		headers["X-Amz-Meta-"+strings.TrimPrefix(k, "X-")] = v
+	}
+
+	if u.options.s3SSE != "" {
+		headers["X-Amz-Server-Side-Encryption"] = u.options.s3SSE
+	}
+	if u.options.s3SSE == sseKMS && u.options.s3KMSKeyID != "" {
+		headers["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = u.options.s3KMSKeyID
+	}
+
+	return headers
+}
+
+// upload keeps at most one part per concurrent upload in memory,
+// files not larger than part size are sent in a single request
+func (u *s3Uploader) upload(ctx context.Context, pl *payload, filename string, custom map[string]string) (*directive, error) {
+	key := u.location.key(filename)
+	headers := u.headers(custom)
+
+	f, err := pl.open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	partSize := u.options.s3PartSize * 1024 * 1024
+	if partSize > 0 && pl.size > int64(partSize) {
+		etag, err := u.multipart(ctx, key, f, pl.size, partSize, headers)
+		if err != nil {
+			return nil, err
+		}
+
+		return &directive{status: http.StatusOK, response: etag, requestHash: pl.sha256}, nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	_, h, err := u.client.doContext(ctx, http.MethodPut, u.client.objectURL(u.location.bucket, key), data, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &directive{status: http.StatusOK, response: h.Get("ETag"), requestHash: pl.sha256}, nil
+}
+
+// part reads part into buffer and uploads it, retrying
+// network and server errors a few times
+func (u *s3Uploader) part(ctx context.Context, objectURL, uploadID string, n int, r io.Reader, buf []byte) (string, error) {
+	size, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	partURL := fmt.Sprintf("%s?partNumber=%d&uploadId=%s", objectURL, n, uploadID)
+	for attempt := 1; ; attempt++ {
+		_, h, err := u.client.doContext(ctx, http.MethodPut, partURL, buf[:size], nil)
+		if err == nil {
+			return h.Get("ETag"), nil
+		}
+
+		var status *httpStatusError
+		if attempt >= s3PartAttempts || (errors.As(err, &status) && status.Code < 500 && status.Code != http.StatusTooManyRequests) {
+			return "", err
+		}
+
+		t := time.NewTimer(time.Second * time.Duration(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return "", context.Cause(ctx)
+		case <-t.C:
+		}
+	}
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipart uploads object in parts of given size, -s3-concurrency
+// parts at once, each part is retried on its own and upload
+// is aborted on failure so no parts are left behind
+func (u *s3Uploader) multipart(ctx context.Context, key string, r io.ReaderAt, size int64, partSize int, headers map[string]string) (string, error) {
+	objectURL := u.client.objectURL(u.location.bucket, key)
+
+	body, _, err := u.client.doContext(ctx, http.MethodPost, objectURL+"?uploads", nil, headers)
+	if err != nil {
+		return "", err
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &initiated); err != nil {
+		return "", err
+	}
+	if initiated.UploadID == "" {
+		return "", fmt.Errorf("S3 returned no upload id for %s", key)
+	}
+	uploadID := url.QueryEscape(initiated.UploadID)
+
+	count := int((size + int64(partSize) - 1) / int64(partSize))
+	parts := make([]completedPart, count)
+	numbers := make(chan int)
+	errs := make(chan error, count)
+
+	concurrency := u.options.s3Concurrency
+	if concurrency > count {
+		concurrency = count
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, partSize)
+			for n := range numbers {
+				etag, err := u.part(ctx, objectURL, uploadID, n, io.NewSectionReader(r, int64(n-1)*int64(partSize), int64(partSize)), buf)
+				if err != nil {
+					errs <- err
+					continue
+				}
+
+				parts[n-1] = completedPart{PartNumber: n, ETag: etag}
+			}
+		}()
+	}
+
+	var failed error
+	for n := 1; n <= count; n++ {
+		select {
+		case failed = <-errs:
+		default:
+		}
+		if failed != nil {
+			break
+		}
+
+		numbers <- n
+	}
+	close(numbers)
+	wg.Wait()
+
+	if failed == nil && len(errs) > 0 {
+		failed = <-errs
+	}
+	if failed != nil {
+		u.client.doContext(ctx, http.MethodDelete, objectURL+"?uploadId="+uploadID, nil, nil)
+		return "", failed
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return "", err
+	}
+
+	body, _, err = u.client.doContext(ctx, http.MethodPost, objectURL+"?uploadId="+uploadID, complete, nil)
+	if err != nil {
+		u.client.doContext(ctx, http.MethodDelete, objectURL+"?uploadId="+uploadID, nil, nil)
+		return "", err
+	}
+
+	// Complete may fail with 200 status and error in body
+	var completed struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(body, &completed); err != nil {
+		return "", err
+	}
+	if completed.XMLName.Local == "Error" {
+		return "", fmt.Errorf("S3 multipart upload of %s failed: %s", key, completed.Message)
+	}
+
+	return completed.ETag, nil
+}
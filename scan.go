@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cryptopay-dev/go-metrics"
+	"github.com/getsentry/raven-go"
+)
+
+// Directory watch modes
+const (
+	watchPoll   = "poll"
+	watchNotify = "notify"
+	watchUSN    = "usn"
+)
+
+// scan looks through directory once spawning parsers for new
+// files and returns how long to wait before the next scan
+func scan(c *controller, opts options) time.Duration {
+	if opts.verbose {
+		log.Println("Scanning directory for a new files")
+	}
+
+	files, err := c.listChanged(opts)
+	if isTransient(err) {
+		failures := c.source.fail(err)
+		if failures == 1 {
+			raven.CaptureMessage("Source directory degraded", map[string]string{
+				"directory": opts.dir,
+				"message":   err.Error(),
+			})
+		}
+
+		sendMetrics("source", metrics.M{
+			"degraded": true,
+		}, nil)
+
+		// Backoff for 2 4 8 ... seconds but not longer than interval
+		delay := time.Second * time.Duration(math.Pow(2, math.Min(float64(failures), 10)))
+		if max := time.Second * time.Duration(opts.interval); delay > max {
+			delay = max
+		}
+
+		log.Printf("Source directory degraded (failure %d), retrying in %s: %s\n", failures, delay, err)
+		return delay
+	}
+
+	if err != nil {
+		raven.CaptureErrorAndWait(err, map[string]string{
+			"directory": opts.dir,
+		})
+
+		log.Fatalf("Directory traverse error: %s\n", err)
+	}
+
+	if c.source.recover() {
+		log.Println("Source directory recovered")
+	}
+	c.setDirectoryListing(files)
+	unchanged := c.stats.update(files)
+
+	// Files listed in manifests are delivered as batches
+	claimed := map[string]bool{}
+	if opts.manifestSuffix != "" {
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), opts.manifestSuffix) {
+				continue
+			}
+
+			// Unchanged manifest will not become readable
+			if unchanged[file.Name()] && c.stats.unreadable(file.Name()) {
+				continue
+			}
+
+			m, err := readManifest(opts.dir, file.Name())
+			if err != nil {
+				c.stats.setUnreadable(file.Name())
+				if opts.verbose {
+					log.Printf("Manifest %s is not readable yet: %s\n", file.Name(), err)
+				}
+				continue
+			}
+
+			claimed[file.Name()] = true
+			for _, f := range m.Files {
+				claimed[sameDir(file.Name(), f.Name)] = true
+			}
+
+			c.spawnBatch(file, m, opts.forFile(file.Name()))
+		}
+	}
+
+	if len(files) > 0 {
+		for _, file := range files {
+			// Skip if file belongs to batch
+			if claimed[file.Name()] {
+				continue
+			}
+
+			// Skip if this is directory
+			if file.IsDir() {
+				if opts.verbose {
+					log.Printf("Path %s is directory skipping\n", file.Name())
+				}
+
+				continue
+			}
+
+			// Skip if file will not be processed as it is
+			fopts := opts.forFile(file.Name())
+			if c.skips.skipped(file, fopts.selection()) {
+				continue
+			}
+
+			// Skip if file doesn't match patterns or is excluded
+			goodFile, reason := fopts.accepts(file.Name())
+
+			// Waiting for companion checksum file
+			if goodFile && opts.checksums {
+				if _, ok := companionChecksum(path.Join(opts.dir, file.Name())); !ok {
+					if opts.verbose {
+						log.Printf("File %s has no checksum file yet\n", file.Name())
+					}
+					continue
+				}
+			}
+
+			// Too recently modified file may be still written
+			if goodFile && opts.minAge > 0 && time.Since(file.ModTime()) < time.Second*time.Duration(opts.minAge) {
+				if opts.verbose {
+					log.Printf("File %s is modified less than %d seconds ago\n", file.Name(), opts.minAge)
+				}
+				continue
+			}
+
+			// Waiting for done marker
+			if goodFile && !fopts.complete(path.Join(opts.dir, file.Name())) {
+				if opts.verbose {
+					log.Printf("File %s has no done marker yet\n", file.Name())
+				}
+				continue
+			}
+
+			if !goodFile {
+				if opts.verbose {
+					sendMetricsAndWait("files", metrics.M{
+						"skipped": true,
+					}, nil)
+					log.Printf("File %s is not accepted by system: %s\n", file.Name(), reason)
+				}
+				c.skips.add(file, fopts.route, skipPattern, fopts.selection())
+				continue
+			}
+
+			c.spawn(file, fopts)
+		}
+	}
+
+	if err := c.skips.flush(); err != nil {
+		log.Printf("Error saving skip list: %s\n", err)
+	}
+
+	return time.Second * time.Duration(opts.interval)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// jsonSchema builds JSON Schema of configuration type from its fields:
+// json tag gives property name, desc, pattern, enum (separated by |),
+// minimum, maximum (and exclusive ones) and required tags describe
+// the value. Objects don't allow other properties, same as loadConfig
+// rejects unknown keys
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonSchema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+
+			property := jsonSchema(f.Type)
+			if desc := f.Tag.Get("desc"); desc != "" {
+				property["description"] = desc
+			}
+			if pattern := f.Tag.Get("pattern"); pattern != "" {
+				property["pattern"] = pattern
+			}
+			if enum := f.Tag.Get("enum"); enum != "" {
+				property["enum"] = strings.Split(enum, "|")
+			}
+			for _, limit := range []string{"minimum", "maximum", "exclusiveMinimum", "exclusiveMaximum"} {
+				if v, err := strconv.ParseFloat(f.Tag.Get(limit), 64); err == nil {
+					property[limit] = v
+				}
+			}
+			if f.Tag.Get("required") == "true" {
+				required = append(required, name)
+			}
+
+			properties[name] = property
+		}
+
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+
+		return schema
+	}
+
+	panic(fmt.Sprintf("type %s can't be described with JSON Schema", t))
+}
+
+// configSchema is JSON Schema of -config file
+func configSchema() map[string]interface{} {
+	schema := jsonSchema(reflect.TypeOf(config{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "hooker configuration"
+
+	return schema
+}
+
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "schema" {
+		fmt.Println("Usage: hooker config schema")
+		os.Exit(2)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(configSchema()); err != nil {
+		log.Fatalf("Schema marshalling error: %s\n", err)
+	}
+}
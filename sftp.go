@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// sftpError is returned when sftp client fails,
+// exit code 255 means connection was not established
+type sftpError struct {
+	Code   int
+	Output string
+}
+
+func (e *sftpError) Error() string {
+	return fmt.Sprintf("sftp exited with %d: %s", e.Code, e.Output)
+}
+
+// sftpLocation is a parsed sftp://user@host:port/path URL
+type sftpLocation struct {
+	user string
+	host string
+	port int
+	dir  string
+}
+
+func parseSFTPURL(raw string) (sftpLocation, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return sftpLocation{}, err
+	}
+
+	if u.Scheme != "sftp" || u.Hostname() == "" || u.User == nil {
+		return sftpLocation{}, errors.New("Expected sftp://user@host/path URL, got " + raw)
+	}
+
+	port := 22
+	if p := u.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return sftpLocation{}, errors.New("Wrong port in " + raw)
+		}
+	}
+
+	return sftpLocation{
+		user: u.User.Username(),
+		host: u.Hostname(),
+		port: port,
+		dir:  strings.TrimRight(u.Path, "/"),
+	}, nil
+}
+
+// sftpUploader delivers files with system OpenSSH sftp client
+// in batch mode using key-based authentication only
+type sftpUploader struct {
+	location sftpLocation
+	options  options
+}
+
+// errSFTPProxy is returned for sftp:// URLs with -proxy set,
+// OpenSSH client would silently connect directly instead
+var errSFTPProxy = errors.New("-proxy is not supported for sftp:// URLs")
+
+func newSFTPUploader(opts options) (*sftpUploader, error) {
+	if opts.proxy != "" {
+		return nil, errSFTPProxy
+	}
+
+	loc, err := parseSFTPURL(opts.url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sftpUploader{
+		location: loc,
+		options:  opts,
+	}, nil
+}
+
+// quoteSFTP quotes batch file argument, so spaces don't split it
+// and sftp escapes glob characters instead of expanding them
+func quoteSFTP(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// checkSFTPPath rejects paths quoting can't carry, newline would end
+// batch command and backslash is unescaped differently by commands
+func checkSFTPPath(p string) error {
+	if strings.ContainsAny(p, "\\\r\n") {
+		return fmt.Errorf("Path %q can not be sent over sftp", p)
+	}
+
+	return nil
+}
+
+// upload puts file under temporary name and renames it
+// afterwards, so partner never sees partially written file
+func (u *sftpUploader) upload(ctx context.Context, pl *payload, filename string, headers map[string]string) (*directive, error) {
+	target := path.Join(u.location.dir, filename)
+	if u.location.dir == "" {
+		target = filename
+	}
+	partial := target + ".part"
+	for _, p := range []string{pl.path, target} {
+		if err := checkSFTPPath(p); err != nil {
+			return nil, err
+		}
+	}
+
+	// Commands prefixed with - may fail, e.g. directory exists
+	var script bytes.Buffer
+	dirs := []string{}
+	for dir := path.Dir(target); dir != "." && dir != "/" && dir != u.location.dir; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		fmt.Fprintf(&script, "-mkdir %s\n", quoteSFTP(dir))
+	}
+	fmt.Fprintf(&script, "put %s %s\n", quoteSFTP(pl.path), quoteSFTP(partial))
+	fmt.Fprintf(&script, "-rm %s\n", quoteSFTP(target))
+	fmt.Fprintf(&script, "rename %s %s\n", quoteSFTP(partial), quoteSFTP(target))
+
+	args := []string{
+		"-b", "-",
+		"-P", strconv.Itoa(u.location.port),
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", fmt.Sprintf("ConnectTimeout=%d", int(u.options.seconds(u.options.connectTimeout).Seconds())),
+	}
+	if u.options.sftpKey != "" {
+		args = append(args, "-i", u.options.sftpKey)
+	}
+	if u.options.sftpKnownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+u.options.sftpKnownHosts)
+	}
+	args = append(args, u.location.user+"@"+u.location.host)
+
+	cmd := exec.CommandContext(ctx, "sftp", args...)
+	cmd.Stdin = &script
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, &sftpError{Code: exitErr.ExitCode(), Output: strings.TrimSpace(string(output))}
+		}
+		return nil, err
+	}
+
+	return &directive{
+		response:    "sftp://" + u.location.host + "/" + strings.TrimPrefix(target, "/"),
+		requestHash: pl.sha256,
+	}, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/cryptopay-dev/go-metrics"
+)
+
+// shadowRecent is how many shadow results are kept in memory
+const shadowRecent = 100
+
+// shadowResult is outcome of single upload to -shadow-url
+type shadowResult struct {
+	Name     string    `json:"name"`
+	Route    string    `json:"route,omitempty"`
+	SHA256   string    `json:"sha256"`
+	SentAt   time.Time `json:"sent_at"`
+	Duration float64   `json:"duration"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Response string    `json:"response,omitempty"`
+
+	// Compared is set when main URL was sent to as well,
+	// divergences list fields its response differs in
+	Compared      bool     `json:"compared"`
+	PrimaryStatus int      `json:"primary_status,omitempty"`
+	Divergences   []string `json:"divergences,omitempty"`
+}
+
+// shadowLog keeps recent shadow results and appends
+// every one of them to JSON lines file when it is set
+type shadowLog struct {
+	mu      sync.Mutex
+	path    string
+	recent  []shadowResult
+	summary *shadowSummary
+}
+
+func newShadowLog(path string) *shadowLog {
+	return &shadowLog{path: path, summary: newShadowSummary()}
+}
+
+func (s *shadowLog) record(r shadowResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recent = append(s.recent, r)
+	s.summary.add(r)
+	if len(s.recent) > shadowRecent {
+		s.recent = s.recent[len(s.recent)-shadowRecent:]
+	}
+
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// list returns recent results newest first
+func (s *shadowLog) list() []shadowResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]shadowResult, 0, len(s.recent))
+	for i := len(s.recent) - 1; i >= 0; i-- {
+		list = append(list, s.recent[i])
+	}
+
+	return list
+}
+
+// shadowTarget is options of sending to -shadow-url
+func (o options) shadowTarget() options {
+	o.url = o.shadowURL
+	if o.shadowToken != "" {
+		o.token = o.shadowToken
+	}
+	o.destination = "shadow"
+	o.pins = nil
+	o.presignURL = ""
+
+	return o
+}
+
+// responseOf returns status and body API answered upload with,
+// status is 0 when there was no response at all
+func responseOf(d *directive, err error) (int, string) {
+	var status *httpStatusError
+	switch {
+	case err == nil && d != nil:
+		return d.status, d.response
+	case errors.As(err, &status):
+		return status.Code, status.Body
+	}
+
+	return 0, ""
+}
+
+// sendShadow makes single upload attempt to -shadow-url
+func (p *parser) sendShadow(pl *payload) shadowResult {
+	sp := p.to(p.options.shadowTarget())
+
+	started := time.Now()
+	d, err := sp.post(pl, p.file.Name())
+	result := shadowResult{
+		Name:     p.file.Name(),
+		Route:    p.options.route,
+		SHA256:   pl.sha256,
+		SentAt:   started,
+		Duration: time.Since(started).Seconds(),
+	}
+	result.Status, result.Response = responseOf(d, err)
+	if err != nil {
+		result.Error = err.Error()
+		log.Printf("[FILE: %s] Shadow upload failed: %s\n", sp.prefix, err)
+	} else if p.options.verbose {
+		log.Printf("[FILE: %s] Shadow upload delivered\n", sp.prefix)
+	}
+
+	return result
+}
+
+// recordShadow compares shadow result with response of main URL when
+// it was sent to, records and counts it. It never changes what happens
+// to the file
+func (p *parser) recordShadow(result shadowResult, sent bool, d *directive, err error) {
+	if sent {
+		status, response := responseOf(d, err)
+		result.Compared, result.PrimaryStatus = true, status
+		result.Divergences = compareResponses(status, response, result.Status, result.Response, p.options.shadowIgnore)
+		if len(result.Divergences) > 0 {
+			log.Printf("[FILE: %s] Shadow response diverges in: %s\n", p.prefix, strings.Join(result.Divergences, ", "))
+		}
+	}
+
+	if err := p.controller.shadow.record(result); err != nil {
+		log.Printf("[FILE: %s] Error writing shadow log: %s\n", p.prefix, err)
+	}
+
+	sendMetrics("shadow", metrics.M{
+		"delivered": result.Error == "",
+		"diverged":  len(result.Divergences) > 0,
+		"duration":  result.Duration,
+	}, metrics.T{
+		"route": p.options.route,
+	})
+
+	prom := p.controller.prom
+	outcome := "delivered"
+	if result.Error != "" {
+		outcome = "failed"
+	}
+	prom.inc(prom.shadow, outcome)
+	if !result.Compared {
+		return
+	}
+
+	comparison := "match"
+	if len(result.Divergences) > 0 {
+		comparison = "diverged"
+	}
+	prom.inc(prom.shadowComparisons, comparison)
+	for _, field := range result.Divergences {
+		prom.inc(prom.shadowDivergences, field)
+	}
+}
+
+// handleShadow serves GET /shadow with recent shadow upload results
+func (c *controller) handleShadow(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	c.shadow.mu.Lock()
+	summary := c.shadow.summary.copy()
+	c.shadow.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"url":     redactURL(c.opts().shadowURL),
+		"summary": summary,
+		"results": c.shadow.list(),
+	})
+}
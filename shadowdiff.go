@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// shadowExamples is how many diverged results summary keeps
+const shadowExamples = 10
+
+// shadowSummary counts how shadow responses compare with main URL ones
+type shadowSummary struct {
+	Uploads  int            `json:"uploads"`
+	Failed   int            `json:"failed"`
+	Compared int            `json:"compared"`
+	Matching int            `json:"matching"`
+	Diverged int            `json:"diverged"`
+	Fields   map[string]int `json:"fields"`
+	Examples []shadowResult `json:"examples"`
+}
+
+func newShadowSummary() *shadowSummary {
+	return &shadowSummary{Fields: map[string]int{}, Examples: []shadowResult{}}
+}
+
+func (s *shadowSummary) add(r shadowResult) {
+	s.Uploads++
+	if r.Error != "" {
+		s.Failed++
+	}
+	if !r.Compared {
+		return
+	}
+
+	s.Compared++
+	if len(r.Divergences) == 0 {
+		s.Matching++
+		return
+	}
+
+	s.Diverged++
+	for _, field := range r.Divergences {
+		s.Fields[field]++
+	}
+	if len(s.Examples) < shadowExamples {
+		s.Examples = append(s.Examples, r)
+	}
+}
+
+func (s *shadowSummary) copy() shadowSummary {
+	c := *s
+	c.Fields = make(map[string]int, len(s.Fields))
+	for k, v := range s.Fields {
+		c.Fields[k] = v
+	}
+	c.Examples = append([]shadowResult{}, s.Examples...)
+
+	return c
+}
+
+// flattenResponse turns JSON response into dotted path to value map,
+// body which is not JSON object is compared as a whole
+func flattenResponse(body string) map[string]interface{} {
+	out := map[string]interface{}{}
+
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		if body != "" {
+			out["body"] = body
+		}
+		return out
+	}
+
+	var walk func(prefix string, v interface{})
+	walk = func(prefix string, v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				if prefix != "" {
+					k = prefix + "." + k
+				}
+				walk(k, item)
+			}
+		case []interface{}:
+			for i, item := range v {
+				walk(prefix+"["+strconv.Itoa(i)+"]", item)
+			}
+		default:
+			out[prefix] = v
+		}
+	}
+	walk("", v)
+
+	return out
+}
+
+// compareResponses lists fields shadow response differs from main one
+// in, status first and then response fields sorted, ignored ones skipped
+func compareResponses(status int, body string, shadowStatus int, shadowBody string, ignore []string) []string {
+	skip := map[string]bool{}
+	for _, f := range ignore {
+		skip[f] = true
+	}
+
+	diff := []string{}
+	if status != shadowStatus && !skip["status"] {
+		diff = append(diff, "status")
+	}
+
+	primary, shadow := flattenResponse(body), flattenResponse(shadowBody)
+	fields := []string{}
+	for k, v := range primary {
+		if sv, ok := shadow[k]; !ok || !reflect.DeepEqual(v, sv) {
+			fields = append(fields, k)
+		}
+	}
+	for k := range shadow {
+		if _, ok := primary[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+
+	for _, f := range fields {
+		if !skip[f] {
+			diff = append(diff, f)
+		}
+	}
+
+	return diff
+}
+
+func shadowCommand(args []string) {
+	if len(args) == 0 || args[0] != "report" {
+		fmt.Println("Usage: hooker shadow report -log <shadow.jsonl>")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("shadow report", flag.ExitOnError)
+	logPath := fs.String("log", "", "Shadow log file written with -shadow-log")
+	fs.Parse(args[1:])
+
+	if *logPath == "" {
+		fmt.Println("Usage: hooker shadow report -log <shadow.jsonl>")
+		os.Exit(2)
+	}
+
+	f, err := os.Open(*logPath)
+	if err != nil {
+		log.Fatalf("Shadow log reading error: %s\n", err)
+	}
+	defer f.Close()
+
+	summary := newShadowSummary()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r shadowResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Fatalf("Shadow log parsing error: %s\n", err)
+		}
+		summary.add(r)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Shadow log reading error: %s\n", err)
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		log.Fatalf("Report marshalling error: %s\n", err)
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	metrics "github.com/cryptopay-dev/go-metrics"
+	"github.com/getsentry/raven-go"
+)
+
+// shutdown stops admitting new files, interrupts files waiting to be
+// uploaded or retried and waits up to grace for uploads in progress,
+// returning how many files were left unfinished. Interrupted, held
+// and queued files are left for the next run.
+func (c *controller) shutdown(grace time.Duration) int {
+	c.mu.Lock()
+	c.stopping = true
+	c.mu.Unlock()
+	c.interruptAll(errShutdown)
+
+	deadline := time.Now().Add(grace)
+	for {
+		c.mu.Lock()
+		left := len(c.files) - len(c.held) - len(c.queued)
+		c.mu.Unlock()
+
+		if left <= 0 || time.Now().After(deadline) {
+			return left
+		}
+
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// stopOnSignal shuts down gracefully on SIGTERM or SIGINT,
+// files still unfinished after grace are processed on next start
+func (c *controller) stopOnSignal(grace time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+
+	s := <-sig
+	log.Printf("Received %s, waiting up to %s for files in work\n", s, grace)
+
+	left := c.shutdown(grace)
+	if left > 0 {
+		log.Printf("Grace period is over, %d files left unfinished\n", left)
+	}
+
+	sendMetricsAndWait("files", metrics.M{
+		"shutdown":   true,
+		"unfinished": left,
+	}, nil)
+	disableMetrics()
+	raven.Wait()
+
+	log.Println("Stopped")
+	if left > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
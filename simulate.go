@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sinkRequest is request mock sink received
+type sinkRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// mockSink stands in for API while simulating, it accepts
+// every upload and answers with configured response
+type mockSink struct {
+	mu       sync.Mutex
+	requests []sinkRequest
+	status   int
+	response string
+}
+
+func (s *mockSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, sinkRequest{header: r.Header.Clone(), body: body})
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(s.status)
+	w.Write([]byte(s.response))
+}
+
+// decodeBody undoes Content-Encoding of request body
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case compressGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case compressZstd:
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = bytes.NewReader(body)
+		return cmd.Output()
+	}
+
+	return nil, fmt.Errorf("unknown Content-Encoding %s", encoding)
+}
+
+// simulation prints outcome of every stage of file pipeline
+type simulation struct {
+	ok bool
+}
+
+func (s *simulation) stage(passed bool, stage, format string, a ...interface{}) {
+	status := "ok  "
+	if !passed {
+		status, s.ok = "FAIL", false
+	}
+	fmt.Printf("  %s %-10s %s\n", status, stage, fmt.Sprintf(format, a...))
+}
+
+func (s *simulation) info(format string, a ...interface{}) {
+	fmt.Printf("       %s\n", fmt.Sprintf(format, a...))
+}
+
+// request prints what mock sink received and checks that body
+// decodes back to transformed file, -body gets decoded body
+func (s *simulation) request(req sinkRequest, o options, transformed []byte, bodyFile string) {
+	keys := []string{}
+	for k := range req.header {
+		if strings.HasPrefix(k, "X-") || k == "Content-Encoding" || k == "Authorization" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := req.header.Get(k)
+		if (k == "X-Access-Token" || k == "Authorization") && v != "" {
+			v = redactedToken(v)
+		}
+		s.info("%s: %s", k, v)
+	}
+
+	decoded, err := decodeBody(req.header.Get("Content-Encoding"), req.body)
+	same := err == nil && bytes.Equal(decoded, transformed)
+	s.stage(same, "body", "%d bytes (%s), %d decoded", len(req.body), o.compress, len(decoded))
+	if err != nil {
+		s.info("%s", err)
+	}
+
+	switch bodyFile {
+	case "":
+	case "-":
+		os.Stdout.Write(decoded)
+		fmt.Println()
+	default:
+		if err := ioutil.WriteFile(bodyFile, decoded, 0644); err != nil {
+			s.stage(false, "body", "%s", err)
+		}
+	}
+}
+
+// simulateCommand implements "hooker simulate", it runs file through
+// configuration the way daemon would, except that upload goes
+// to local mock sink and nothing is archived or deleted
+func simulateCommand(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	configPath := fs.String("config", "", "JSON configuration file to simulate")
+	file := fs.String("file", "", "Sample file")
+	name := fs.String("name", "", "Path of file relative to watched directory, picking its route (default is sample name)")
+	patterns := fs.String("patterns", ".xml, .xlsx", "Patterns of files configuration doesn't set (separated by: ,)")
+	transforms := fs.String("transform", ".xml=minify", "Transforms configuration doesn't set as <suffix>=<transform> (separated by: ,)")
+	compress := fs.String("compress", compressGzip, "Compression of request body configuration doesn't set")
+	status := fs.Int("status", http.StatusOK, "Status code mock sink answers with")
+	response := fs.String("response", "{}", "Response body mock sink answers with, e.g. directive")
+	bodyFile := fs.String("body", "", "Write request body as API would get it, decompressed, into file (- for stdout)")
+	fs.Parse(args)
+
+	if *configPath == "" || *file == "" || fs.NArg() != 0 {
+		fmt.Println("Usage: hooker simulate -config <file> -file <sample> [-name <dir/file>] [-response <json>] [-body <file>]")
+		os.Exit(2)
+	}
+	if *name == "" {
+		*name = path.Base(*file)
+	}
+
+	s := &simulation{ok: true}
+	defer func() {
+		if !s.ok {
+			os.Exit(1)
+		}
+	}()
+
+	fmt.Printf("Simulating %s as %s with %s\n", *file, *name, *configPath)
+
+	// Configuration
+	base := options{
+		separator:       ",",
+		patterns:        *patterns,
+		compress:        *compress,
+		timeout:         30,
+		maxResponseSize: 1024 * 1024,
+		out:             "<out>",
+		zip:             true,
+		clear:           true,
+	}
+	base.archiveFormat = archiveZip
+	var err error
+	if base.transforms, err = parseTransforms(*transforms, base.separator); err == nil {
+		err = validateCompress(base.compress, 0)
+	}
+	if err != nil {
+		s.stage(false, "flags", "%s", err)
+		return
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err == nil {
+		base, err = base.withConfig(cfg)
+	}
+	s.stage(err == nil, "config", "%s is valid", *configPath)
+	if err != nil {
+		s.info("%s", err)
+		return
+	}
+
+	// Route
+	o := base.forFile(*name)
+	route := o.route
+	if route == "" {
+		route = "default"
+	}
+	s.stage(true, "route", "%s, url %s", route, redactURL(o.url))
+	if o.variant != "" {
+		s.info("canary variant %s", o.variant)
+	}
+
+	matched, reason := o.accepts(*name)
+	s.stage(matched, "pattern", "%s %s", path.Base(*name), reason)
+
+	fi, err := os.Stat(*file)
+	if err != nil {
+		s.stage(false, "read", "%s", err)
+		return
+	}
+	fi = relFileInfo{FileInfo: fi, name: *name}
+	s.stage(fi.Size() >= 50, "size", "%d bytes, at least 50 are required", fi.Size())
+
+	// Validation
+	for _, v := range o.validators(*name) {
+		err := v.validate(*file, fi)
+		s.stage(err == nil, "validate", "%s", v)
+		if err != nil {
+			s.info("%s", err)
+			return
+		}
+	}
+
+	pl, err := newPayload(*file)
+	if err != nil {
+		s.stage(false, "read", "%s", err)
+		return
+	}
+
+	// Transform and compression
+	var transformed bytes.Buffer
+	err = o.transform(&transformed, mustOpen(pl), *name)
+	s.stage(err == nil, "transform", "%s: %d -> %d bytes", o.transformFor(*name), pl.size, transformed.Len())
+	if err != nil {
+		s.info("%s", err)
+		return
+	}
+
+	// Upload goes to mock sink, chunked and pre-signed uploads
+	// talk protocols of their own and are simulated as plain ones
+	sink := &mockSink{status: *status, response: *response}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	p := newParser(fi, make(chan struct{}, 1), o, newController(o, nil, nil, nil, nil))
+	p.setFileHeaders(pl)
+
+	// Every destination gets its own request, directive of the primary one counts
+	var d *directive
+	for _, t := range o.targets() {
+		target := "primary"
+		if t.destination != "" {
+			target = "destination " + t.destination
+		}
+		if strings.HasPrefix(t.url, "s3://") || strings.HasPrefix(t.url, "sftp://") {
+			s.info("%s upload to %s is simulated as HTTP request", strings.SplitN(t.url, ":", 2)[0], target)
+		}
+		t.url, t.pins, t.proxy = server.URL, nil, ""
+		t.chunkSize, t.presignURL = 0, ""
+
+		sink.requests = nil
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		got, err := (&httpUploader{options: t}).upload(ctx, pl, *name, p.headers)
+		cancel()
+		if t.destination == "" {
+			d = got
+		}
+
+		s.stage(err == nil, "upload", "%s, mock sink answered %d", target, *status)
+		if err != nil {
+			s.info("%s", err)
+		}
+		if len(sink.requests) == 1 {
+			s.request(sink.requests[0], t, transformed.Bytes(), *bodyFile)
+		}
+	}
+
+	if d != nil && d.Action != "" {
+		s.info("API requests %s action", d.Action)
+	}
+
+	// Archiving is only described
+	switch {
+	case d != nil && d.Action == actionRetain, !o.zip && !o.clear:
+		s.stage(true, "archive", "file would be left in place")
+	case d != nil && d.Action == actionDelete, !o.zip:
+		s.stage(true, "archive", "file would be deleted")
+	default:
+		s.stage(true, "archive", "file would be archived to %s", path.Join(o.out, o.archiveName(path.Base(*name))))
+	}
+}
+
+// mustOpen opens payload for simulation, it was just read
+func mustOpen(pl *payload) io.Reader {
+	f, err := pl.open()
+	if err != nil {
+		return bytes.NewReader(nil)
+	}
+
+	return f
+}
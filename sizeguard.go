@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bodyLimitTTL is how long limit discovered for URL is trusted
+const bodyLimitTTL = time.Hour
+
+// bodyTooLargeError is returned for request body API doesn't accept,
+// retrying such file only burns attempts on 413 answers. Size is 0
+// when API rejected body on its own and Limit is 0 when it is unknown
+type bodyTooLargeError struct {
+	Size  int64
+	Limit int64
+	Err   error
+}
+
+func (e *bodyTooLargeError) Error() string {
+	if e.Err != nil && e.Limit > 0 {
+		return fmt.Sprintf("request body exceeds API limit of %d bytes: %s", e.Limit, e.Err)
+	}
+	if e.Err != nil {
+		return "request body is too large for API: " + e.Err.Error()
+	}
+
+	return fmt.Sprintf("request body of %d bytes exceeds API limit of %d bytes", e.Size, e.Limit)
+}
+
+func (e *bodyTooLargeError) Unwrap() error {
+	return e.Err
+}
+
+// maxBodyHeader reads limit API announces in X-Max-Body-Size, 0 when there is none
+func maxBodyHeader(h http.Header) (int64, error) {
+	v := strings.TrimSpace(h.Get("X-Max-Body-Size"))
+	if v == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit < 0 {
+		return 0, errors.New("Wrong X-Max-Body-Size: " + v)
+	}
+
+	return limit, nil
+}
+
+type bodyLimit struct {
+	limit int64
+	at    time.Time
+}
+
+// bodyLimits caches limits discovered per API URL
+type bodyLimits struct {
+	mu   sync.Mutex
+	urls map[string]bodyLimit
+}
+
+func newBodyLimits() *bodyLimits {
+	return &bodyLimits{
+		urls: make(map[string]bodyLimit),
+	}
+}
+
+func (l *bodyLimits) get(url string) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.urls[url]
+	if !ok || time.Since(b.at) > bodyLimitTTL {
+		return 0, false
+	}
+
+	return b.limit, true
+}
+
+func (l *bodyLimits) set(url string, limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.urls[url] = bodyLimit{limit: limit, at: time.Now()}
+}
+
+// discoverBodyLimit asks API for its limit with OPTIONS request,
+// configured -max-body-size is kept when API doesn't announce one
+func (p *parser) discoverBodyLimit() (int64, error) {
+	req, err := http.NewRequest(http.MethodOptions, p.options.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.options.setAPIHeaders(req); err != nil {
+		return 0, err
+	}
+
+	client := http.Client{
+		Transport: p.options.transport(),
+		Timeout:   time.Second * time.Duration(p.options.timeout),
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	limit, err := maxBodyHeader(response.Header)
+	if err != nil {
+		return 0, err
+	}
+	if limit == 0 {
+		return p.options.maxBodySize, nil
+	}
+
+	return limit, nil
+}
+
+// bodyLimit returns largest request body API accepts, 0 when unlimited
+func (p *parser) bodyLimit() int64 {
+	o := p.options
+	if !o.discoverBodySize {
+		return o.maxBodySize
+	}
+	if limit, ok := p.controller.limits.get(o.url); ok {
+		return limit
+	}
+
+	limit, err := p.discoverBodyLimit()
+	if err != nil {
+		log.Printf("[FILE: %s] Error discovering API body size limit, using %d bytes: %s\n", p.prefix, o.maxBodySize, err)
+		limit = o.maxBodySize
+	}
+	p.controller.limits.set(o.url, limit)
+
+	return limit
+}
+
+// bodySize streams request body to nowhere to learn its size
+func (u *httpUploader) bodySize(pl *payload, filename string) (int64, error) {
+	body, wait := u.body(pl, filename)
+	n, err := io.Copy(ioutil.Discard, body)
+	if _, bodyErr := wait(); bodyErr != nil {
+		return 0, bodyErr
+	}
+
+	return n, err
+}
+
+// checkBodySize tells whether request body of file fits API limit
+// before it is sent. Tus chunks are what limit applies to with
+// chunked upload and pre-signed uploads go to storage, not API
+func (p *parser) checkBodySize(pl *payload) error {
+	o := p.options
+	if strings.HasPrefix(o.url, "s3://") || strings.HasPrefix(o.url, "sftp://") {
+		return nil
+	}
+	if o.presignURL != "" && pl.size >= o.presignMinSize {
+		return nil
+	}
+
+	limit := p.bodyLimit()
+	if limit <= 0 || pl.size <= limit {
+		return nil
+	}
+
+	chunk := int64(o.chunkSize) * 1024 * 1024
+	if chunk > 0 && pl.size > chunk {
+		if chunk <= limit {
+			return nil
+		}
+		return &bodyTooLargeError{Size: chunk, Limit: limit}
+	}
+
+	size, err := (&httpUploader{options: o}).bodySize(pl, p.file.Name())
+	if err != nil {
+		// Upload itself reports what is wrong with file
+		log.Printf("[FILE: %s] Error measuring request body: %s\n", p.prefix, err)
+		return nil
+	}
+	if size > limit {
+		return &bodyTooLargeError{Size: size, Limit: limit}
+	}
+
+	return nil
+}
+
+// tooLarge tells whether upload failed as API doesn't accept body size,
+// limit API answered with is remembered when limits are discovered
+func (p *parser) tooLarge(err error) bool {
+	var tooLarge *bodyTooLargeError
+	if errors.As(err, &tooLarge) {
+		if tooLarge.Limit > 0 && p.options.discoverBodySize {
+			p.controller.limits.set(p.options.url, tooLarge.Limit)
+		}
+		return true
+	}
+
+	var status *httpStatusError
+	return errors.As(err, &status) && status.Code == http.StatusRequestEntityTooLarge
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reasons of skipping files
+const (
+	skipPattern      = "pattern"
+	skipQuarantined  = "quarantined"
+	skipDeadLettered = "dead_lettered"
+)
+
+type skipEntry struct {
+	Name   string `json:"name"`
+	Route  string `json:"route,omitempty"`
+	Reason string `json:"reason"`
+
+	// Patterns file did not match, entry is
+	// ignored once they are changed
+	Patterns string `json:"patterns,omitempty"`
+
+	Size  int64     `json:"size"`
+	Mtime time.Time `json:"mtime"`
+	Since time.Time `json:"since"`
+}
+
+// skipList keeps files which will never be processed as they are,
+// entry stops matching as soon as file size or mtime changes
+type skipList struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]skipEntry
+	dirty   bool
+}
+
+// openSkipList loads skip list from JSON lines file,
+// empty path keeps it in memory only
+func openSkipList(path string) (*skipList, error) {
+	s := &skipList{
+		path:    path,
+		entries: make(map[string]skipEntry),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e skipEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+
+		s.entries[e.Name] = e
+	}
+
+	return s, scanner.Err()
+}
+
+// skipped tells whether unchanged file is in skip list
+func (s *skipList) skipped(fi os.FileInfo, patterns string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[fi.Name()]
+	if !ok || e.Size != fi.Size() || !e.Mtime.Equal(fi.ModTime()) {
+		return false
+	}
+
+	return e.Reason != skipPattern || e.Patterns == patterns
+}
+
+func (s *skipList) add(fi os.FileInfo, route, reason, patterns string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[fi.Name()] = skipEntry{
+		Name:     fi.Name(),
+		Route:    route,
+		Reason:   reason,
+		Patterns: patterns,
+		Size:     fi.Size(),
+		Mtime:    fi.ModTime(),
+		Since:    time.Now(),
+	}
+	s.dirty = true
+}
+
+// clear removes entries accepted by filter returning their names
+func (s *skipList) clear(filter func(e skipEntry) bool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := []string{}
+	for name, e := range s.entries {
+		if filter(e) {
+			delete(s.entries, name)
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		s.dirty = true
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (s *skipList) list() []skipEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []skipEntry{}
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	return entries
+}
+
+// flush saves skip list if it was changed, it is called
+// once per scan instead of on every added entry
+func (s *skipList) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.dirty || s.path == "" {
+		return nil
+	}
+
+	lines := [][]byte{}
+	for _, e := range s.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+	}
+
+	if err := writeRecords(s.path, lines); err != nil {
+		return err
+	}
+	s.dirty = false
+
+	return nil
+}
+
+// handleSkipped serves GET /skipped listing skip list
+// and DELETE /skipped clearing matching entries
+func (c *controller) handleSkipped(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	filter := func(e skipEntry) bool {
+		return (reason == "" || e.Reason == reason) && q.match(e.Name, e.Route, "", 0, e.Since)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := c.admin.require(w, r, roleRead); !ok {
+			return
+		}
+
+		matched := []skipEntry{}
+		for _, e := range c.skips.list() {
+			if filter(e) {
+				matched = append(matched, e)
+			}
+		}
+
+		lo, hi := q.page(len(matched))
+		writePage(w, q, len(matched), matched[lo:hi])
+
+	case http.MethodDelete:
+		p, ok := c.admin.require(w, r, roleOperator)
+		if !ok {
+			return
+		}
+
+		cleared := c.skips.clear(filter)
+		if err := c.skips.flush(); err != nil {
+			log.Printf("Error saving skip list: %s\n", err)
+		}
+
+		c.admin.audit.record("clear-skipped", r.URL.RawQuery, []string{p.name}, fmt.Sprintf("cleared %d entries", len(cleared)))
+		writeJSON(w, map[string]interface{}{
+			"cleared": cleared,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
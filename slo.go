@@ -0,0 +1,372 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cryptopay-dev/go-metrics"
+	"github.com/getsentry/raven-go"
+)
+
+// sloDefaultWindow is compliance window when route does not set one
+const sloDefaultWindow = 24 * 60 * 60
+
+// slo is objective of a route, e.g. 99% of
+// files delivered within 900 seconds
+type slo struct {
+	// Objective is percent of files which have to be good
+	Objective float64 `json:"objective" desc:"Percent of files which have to be good" exclusiveMinimum:"0" exclusiveMaximum:"100" required:"true"`
+	// Latency is seconds from file modification
+	// time to its delivery to every destination
+	Latency int `json:"latency" desc:"Seconds from file modification to delivery" minimum:"1" required:"true"`
+	// Window is seconds compliance is computed over
+	Window int `json:"window" desc:"Seconds compliance is computed over, a day by default" minimum:"0"`
+}
+
+func (s *slo) validate(name string) error {
+	if s.Objective <= 0 || s.Objective >= 100 {
+		return fmt.Errorf("SLO objective of route %s must be between 0 and 100", name)
+	}
+	if s.Latency <= 0 {
+		return errors.New("SLO latency must be set for route " + name)
+	}
+	if s.Window < 0 {
+		return errors.New("SLO window can't be negative for route " + name)
+	}
+
+	return nil
+}
+
+func (s *slo) window() time.Duration {
+	if s.Window == 0 {
+		return sloDefaultWindow * time.Second
+	}
+
+	return time.Duration(s.Window) * time.Second
+}
+
+// budget is share of files allowed to be bad
+func (s *slo) budget() float64 {
+	return (100 - s.Objective) / 100
+}
+
+// burnAlert is multi-window burn rate alert, it fires when error budget
+// burns faster than threshold over both long and short windows, short
+// one makes alert stop soon after burning stops
+type burnAlert struct {
+	name      string
+	long      time.Duration
+	short     time.Duration
+	threshold float64
+}
+
+// burnAlerts are usual fast and slow burn alerts, burning
+// 2% and 5% of 30 days budget within an hour and 6 hours
+var burnAlerts = []burnAlert{
+	{name: "fast", long: time.Hour, short: 5 * time.Minute, threshold: 14.4},
+	{name: "slow", long: 6 * time.Hour, short: 30 * time.Minute, threshold: 6},
+}
+
+// burnWindows are windows burn rate is reported for
+var burnWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+// sloBucket counts files finished within one minute
+type sloBucket struct {
+	minute int64
+	good   int
+	total  int
+}
+
+// sloTracker keeps per-minute counts of good and bad
+// files of every route having SLO, in memory only
+type sloTracker struct {
+	mu     sync.Mutex
+	routes map[string][]sloBucket
+	alerts map[string]string
+}
+
+func newSLOTracker() *sloTracker {
+	return &sloTracker{
+		routes: make(map[string][]sloBucket),
+		alerts: make(map[string]string),
+	}
+}
+
+// observe counts file of route finished at given time
+func (t *sloTracker) observe(route string, good bool, size time.Duration, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	buckets := t.grow(route, size)
+	minute := at.Unix() / 60
+	b := &buckets[minute%int64(len(buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	if good {
+		b.good++
+	}
+}
+
+// grow makes sure route keeps enough buckets to cover
+// given duration, window may be changed by reload
+func (t *sloTracker) grow(route string, size time.Duration) []sloBucket {
+	n := int(size / time.Minute)
+	buckets := t.routes[route]
+	if len(buckets) >= n {
+		return buckets
+	}
+
+	grown := make([]sloBucket, n)
+	for _, b := range buckets {
+		if b.total > 0 {
+			grown[b.minute%int64(n)] = b
+		}
+	}
+	t.routes[route] = grown
+
+	return grown
+}
+
+// counts returns good and total files of route within window
+func (t *sloTracker) counts(route string, window time.Duration, now time.Time) (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	from := now.Add(-window).Unix() / 60
+	good, total := 0, 0
+	for _, b := range t.routes[route] {
+		if b.minute > from {
+			good += b.good
+			total += b.total
+		}
+	}
+
+	return good, total
+}
+
+// burnRate is how many times faster than allowed error budget is burnt
+func (t *sloTracker) burnRate(route string, s *slo, window time.Duration, now time.Time) float64 {
+	good, total := t.counts(route, window, now)
+	if total == 0 {
+		return 0
+	}
+
+	return float64(total-good) / float64(total) / s.budget()
+}
+
+// swapAlert stores firing alert of route and returns previous one
+func (t *sloTracker) swapAlert(route, alert string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev := t.alerts[route]
+	t.alerts[route] = alert
+
+	return prev
+}
+
+// sloReport is compliance of a single route
+type sloReport struct {
+	Route      string             `json:"route"`
+	Objective  float64            `json:"objective"`
+	Latency    int                `json:"latency"`
+	Window     int                `json:"window"`
+	Good       int                `json:"good"`
+	Total      int                `json:"total"`
+	Compliance float64            `json:"compliance"`
+	Budget     float64            `json:"budget_remaining"`
+	BurnRates  map[string]float64 `json:"burn_rates"`
+	Alert      string             `json:"alert"`
+}
+
+// sloFor returns SLO of route with given name
+func (o options) sloFor(name string) *slo {
+	for _, r := range o.routes {
+		if r.Name == name {
+			return r.SLO
+		}
+	}
+
+	return nil
+}
+
+// deadline is time file has to be delivered by to meet SLO of its route
+func (p *parser) deadline() (time.Time, bool) {
+	s := p.options.sloFor(p.options.route)
+	if s == nil {
+		return time.Time{}, false
+	}
+
+	return p.file.ModTime().Add(time.Duration(s.Latency) * time.Second), true
+}
+
+// recordDeadline notes in journal entry of delivery whether it met deadline
+func (p *parser) recordDeadline(e *journalEntry) {
+	deadline, ok := p.deadline()
+	if !ok {
+		return
+	}
+
+	met := !e.SentAt.After(deadline)
+	e.Deadline, e.DeadlineMet = &deadline, &met
+}
+
+// observeSLO counts file finished by parser, it is good when it was
+// delivered everywhere within route latency and bad when it was late
+// or given up on, files rejected as invalid are not counted
+func (p *parser) observeSLO(delivered bool) {
+	s := p.options.sloFor(p.options.route)
+	if s == nil {
+		return
+	}
+
+	now := time.Now()
+	good := delivered && now.Sub(p.file.ModTime()) <= time.Duration(s.Latency)*time.Second
+
+	size := s.window()
+	if size < 6*time.Hour {
+		size = 6 * time.Hour
+	}
+	p.controller.slo.observe(p.options.route, good, size, now)
+}
+
+// sloReports computes compliance of every route having SLO
+func (c *controller) sloReports() []sloReport {
+	now := time.Now()
+	reports := []sloReport{}
+	for _, r := range c.opts().routes {
+		s := r.SLO
+		if s == nil {
+			continue
+		}
+
+		report := sloReport{
+			Route:      r.Name,
+			Objective:  s.Objective,
+			Latency:    s.Latency,
+			Window:     int(s.window() / time.Second),
+			Compliance: 100,
+			Budget:     100,
+			BurnRates:  map[string]float64{},
+		}
+		report.Good, report.Total = c.slo.counts(r.Name, s.window(), now)
+		if report.Total > 0 {
+			bad := float64(report.Total-report.Good) / float64(report.Total)
+			report.Compliance = 100 * (1 - bad)
+			report.Budget = 100 * (1 - bad/s.budget())
+		}
+
+		for _, w := range burnWindows {
+			report.BurnRates[shortDuration(w)] = c.slo.burnRate(r.Name, s, w, now)
+		}
+
+		for _, a := range burnAlerts {
+			if c.slo.burnRate(r.Name, s, a.long, now) >= a.threshold &&
+				c.slo.burnRate(r.Name, s, a.short, now) >= a.threshold {
+				report.Alert = a.name
+				break
+			}
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports
+}
+
+// shortDuration formats window like 5m or 6h
+func shortDuration(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return strconv.Itoa(int(d/time.Hour)) + "h"
+	}
+
+	return strconv.Itoa(int(d/time.Minute)) + "m"
+}
+
+// watchSLO reports compliance and alerts when
+// error budget of some route burns too fast
+func (c *controller) watchSLO(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		for _, report := range c.sloReports() {
+			m := metrics.M{
+				"compliance":       report.Compliance,
+				"budget_remaining": report.Budget,
+			}
+			for w, rate := range report.BurnRates {
+				m["burn_rate_"+w] = rate
+			}
+			sendMetrics("slo", m, metrics.T{"route": report.Route})
+
+			prev := c.slo.swapAlert(report.Route, report.Alert)
+			if report.Alert == prev {
+				continue
+			}
+
+			if report.Alert == "" {
+				log.Printf("[SLO] Route %s error budget is no longer burning too fast\n", report.Route)
+				continue
+			}
+
+			log.Printf("[SLO] WARNING: Route %s error budget burns too fast (%s burn, 1h rate %.1f, compliance %.2f%% of %.2f%%)\n",
+				report.Route, report.Alert, report.BurnRates["1h"], report.Compliance, report.Objective)
+
+			raven.CaptureMessage("SLO error budget burns too fast", map[string]string{
+				"route":      report.Route,
+				"alert":      report.Alert,
+				"compliance": strconv.FormatFloat(report.Compliance, 'f', 2, 64),
+			})
+		}
+	}
+}
+
+// writeSLOMetrics adds route compliance to Prometheus metrics
+func writeSLOMetrics(w io.Writer, reports []sloReport) {
+	if len(reports) == 0 {
+		return
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Route < reports[j].Route })
+
+	writeGaugeHeader(w, gaugeSLOCompliance)
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s{route=%s} %s\n", gaugeSLOCompliance.name, strconv.Quote(r.Route), formatFloat(r.Compliance))
+	}
+
+	writeGaugeHeader(w, gaugeSLOBudget)
+	for _, r := range reports {
+		fmt.Fprintf(w, "%s{route=%s} %s\n", gaugeSLOBudget.name, strconv.Quote(r.Route), formatFloat(r.Budget))
+	}
+
+	writeGaugeHeader(w, gaugeSLOBurnRate)
+	for _, r := range reports {
+		for _, window := range burnWindows {
+			name := shortDuration(window)
+			fmt.Fprintf(w, "%s{route=%s,window=%s} %s\n", gaugeSLOBurnRate.name, strconv.Quote(r.Route), strconv.Quote(name), formatFloat(r.BurnRates[name]))
+		}
+	}
+}
+
+// handleSLO serves GET /slo
+func (c *controller) handleSLO(w http.ResponseWriter, r *http.Request) {
+	if _, ok := c.admin.require(w, r, roleRead); !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, c.sloReports())
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// Snapshot modes
+const (
+	snapshotLink = "link"
+	snapshotCopy = "copy"
+)
+
+// errChanged is returned when source file was
+// modified while snapshot was being taken
+var errChanged = errors.New("File changed while taking snapshot")
+
+// snapshot hardlinks or copies stable file into workspace, everything
+// after that is read from snapshot and only original is removed. Hardlink
+// shares inode with original, so it only protects from file being replaced
+// or removed, writer rewriting it in place changes snapshot too. File which
+// may still be held by writer is therefore copied even in link mode
+func (p *parser) snapshot(filePath string) (string, error) {
+	ws := p.controller.workspace
+
+	before, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ws.create("snapshot")
+	if err != nil {
+		return "", err
+	}
+	snap := tmp.Name()
+	tmp.Close()
+
+	linked := false
+	if p.options.snapshot == snapshotLink && writerDone(filePath) {
+		os.Remove(snap)
+		linked = os.Link(filePath, snap) == nil
+	}
+
+	if !linked {
+		if err := copyFile(filePath, snap); err != nil {
+			ws.discard(snap)
+			return "", err
+		}
+	}
+
+	after, err := os.Stat(filePath)
+	if err != nil {
+		ws.discard(snap)
+		return "", err
+	}
+
+	if before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		ws.discard(snap)
+		return "", errChanged
+	}
+
+	if p.options.verbose {
+		log.Printf("[FILE: %s] Snapshot taken to %s (linked: %t)\n", p.prefix, snap, linked)
+	}
+
+	return snap, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+)
+
+// spillBuffer keeps intermediate output in memory until it grows beyond
+// threshold and moves it into workspace file then, so one huge file
+// can't take memory every other file in work needs. Without
+// workspace everything is kept in memory
+type spillBuffer struct {
+	ws        *workspace
+	threshold int64
+	name      string
+	mem       *bytes.Buffer
+	file      *os.File
+}
+
+// newSpillBuffer returns buffer for intermediate output of file
+func (o options) newSpillBuffer(name string) *spillBuffer {
+	b := &spillBuffer{
+		threshold: int64(o.spillThreshold) * 1024 * 1024,
+		name:      name,
+		mem:       getBuffer(),
+	}
+	if o.workspace != "" {
+		b.ws = &workspace{dir: o.workspace}
+	}
+
+	return b
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.ws != nil && int64(b.mem.Len()+len(p)) > b.threshold {
+		f, err := b.ws.create("spill")
+		if err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(b.mem.Bytes()); err != nil {
+			f.Close()
+			b.ws.discard(f.Name())
+			return 0, err
+		}
+
+		log.Printf("[WORKSPACE] Intermediate output of %s exceeds %d MB, spilling it to %s\n", b.name, b.threshold/1024/1024, f.Name())
+		putBuffer(b.mem)
+		b.file, b.mem = f, nil
+	}
+
+	if b.file != nil {
+		return b.file.Write(p)
+	}
+
+	return b.mem.Write(p)
+}
+
+// reader returns everything written so far from the start
+func (b *spillBuffer) reader() (io.Reader, error) {
+	if b.file == nil {
+		return b.mem, nil
+	}
+
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return b.file, nil
+}
+
+// close releases buffer removing spilled file
+func (b *spillBuffer) close() {
+	putBuffer(b.mem)
+	b.mem = nil
+	if b.file == nil {
+		return
+	}
+
+	b.file.Close()
+	b.ws.discard(b.file.Name())
+	b.file = nil
+}
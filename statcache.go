@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// fileStat is what scans saw of file so far
+type fileStat struct {
+	size  int64
+	mtime time.Time
+
+	// since is when file was first seen with this size and mtime
+	since time.Time
+
+	// unreadable marks manifest which could not be read
+	unreadable bool
+}
+
+// statCache remembers size and modification time of every listed
+// file, so files unchanged between scans are not examined again
+type statCache struct {
+	mu    sync.Mutex
+	files map[string]*fileStat
+}
+
+func newStatCache() *statCache {
+	return &statCache{
+		files: make(map[string]*fileStat),
+	}
+}
+
+// update replaces cache with new listing returning
+// names of files unchanged since previous scan
+func (s *statCache) update(files []os.FileInfo) map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	next := make(map[string]*fileStat, len(files))
+	unchanged := make(map[string]bool)
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+
+		st, ok := s.files[fi.Name()]
+		if ok && st.size == fi.Size() && st.mtime.Equal(fi.ModTime()) {
+			next[fi.Name()] = st
+			unchanged[fi.Name()] = true
+			continue
+		}
+
+		next[fi.Name()] = &fileStat{
+			size:  fi.Size(),
+			mtime: fi.ModTime(),
+			since: now,
+		}
+	}
+	s.files = next
+
+	return unchanged
+}
+
+// stableFor tells how long file is known to have given size and mtime
+func (s *statCache) stableFor(name string, size int64, mtime time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.files[name]
+	if !ok || st.size != size || !st.mtime.Equal(mtime) {
+		return 0
+	}
+
+	return time.Since(st.since)
+}
+
+func (s *statCache) setUnreadable(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if st, ok := s.files[name]; ok {
+		st.unreadable = true
+	}
+}
+
+func (s *statCache) unreadable(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.files[name]
+	return ok && st.unreadable
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const snapshotVersion = 1
+
+// snapshot is a portable copy of hooker state: journal of delivered
+// files (which is also dedup index) and queue of files in work
+type snapshot struct {
+	Version int            `json:"version"`
+	Created time.Time      `json:"created_at"`
+	Journal []journalEntry `json:"journal"`
+	Queue   []fileItem     `json:"queue"`
+}
+
+func (j *journal) all() []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return append([]journalEntry{}, j.entries...)
+}
+
+// merge records entries which journal does not have yet
+func (j *journal) merge(entries []journalEntry) (int, error) {
+	added := 0
+	for _, e := range entries {
+		known := false
+		e = withID(e)
+		for _, existing := range j.find(e.Name) {
+			if existing.ID == e.ID && existing.Destination == e.Destination &&
+				existing.State == e.State && existing.SentAt.Equal(e.SentAt) {
+				known = true
+				break
+			}
+		}
+
+		if known {
+			continue
+		}
+
+		if err := j.record(e); err != nil {
+			return added, err
+		}
+		added++
+	}
+
+	return added, nil
+}
+
+func readSnapshot(data []byte) (*snapshot, error) {
+	s := &snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("Unsupported snapshot version: %d", s.Version)
+	}
+
+	return s, nil
+}
+
+// handleState serves GET /state exporting snapshot
+// and POST /state importing one into running journal
+func (c *controller) handleState(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := c.admin.require(w, r, roleAdmin); !ok {
+			return
+		}
+
+		queue := []fileItem{}
+		for _, item := range c.fileItems() {
+			if item.State != fileWaiting {
+				queue = append(queue, item)
+			}
+		}
+
+		writeJSON(w, snapshot{
+			Version: snapshotVersion,
+			Created: time.Now(),
+			Journal: c.journal.all(),
+			Queue:   queue,
+		})
+
+	case http.MethodPost:
+		p, ok := c.admin.require(w, r, roleAdmin)
+		if !ok {
+			return
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 512*1024*1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s, err := readSnapshot(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		added, err := c.journal.merge(s.Journal)
+		c.admin.audit.record("state-import", "*", []string{p.name}, fmt.Sprintf("imported %d journal entries", added))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, map[string]interface{}{
+			"imported": added,
+			"queue":    s.Queue,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// stateCommand implements "hooker state export|import" working
+// directly with journal file while daemon is stopped
+func stateCommand(args []string) {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fmt.Println("Usage: hooker state export|import -journal <file> -file <snapshot>")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("state "+args[0], flag.ExitOnError)
+	journalPath := fs.String("journal", "", "Journal file of delivered files")
+	file := fs.String("file", "-", "Snapshot file (- for stdout/stdin)")
+	fs.Parse(args[1:])
+
+	if *journalPath == "" {
+		log.Fatalln("Journal file is not set")
+	}
+
+	j, err := openJournal(*journalPath)
+	if err != nil {
+		log.Fatalf("Journal loading error: %s\n", err)
+	}
+
+	if args[0] == "export" {
+		data, err := json.MarshalIndent(snapshot{
+			Version: snapshotVersion,
+			Created: time.Now(),
+			Journal: j.all(),
+			Queue:   []fileItem{},
+		}, "", "  ")
+		if err != nil {
+			log.Fatalf("Snapshot marshalling error: %s\n", err)
+		}
+
+		if *file == "-" {
+			os.Stdout.Write(append(data, '\n'))
+			return
+		}
+
+		if err := ioutil.WriteFile(*file, data, 0644); err != nil {
+			log.Fatalf("Snapshot writing error: %s\n", err)
+		}
+
+		log.Printf("Exported %d journal entries to %s\n", len(j.all()), *file)
+		return
+	}
+
+	var data []byte
+	if *file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		log.Fatalf("Snapshot reading error: %s\n", err)
+	}
+
+	s, err := readSnapshot(data)
+	if err != nil {
+		log.Fatalf("Snapshot parsing error: %s\n", err)
+	}
+
+	added, err := j.merge(s.Journal)
+	if err != nil {
+		log.Fatalf("Journal writing error: %s\n", err)
+	}
+
+	log.Printf("Imported %d journal entries from %s\n", added, *file)
+	for _, item := range s.Queue {
+		log.Printf("File %s was %s at snapshot time, drop it into watched directory again to process\n", item.Name, item.State)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of status command, the ones of Nagios plugins
+const (
+	statusOK       = 0
+	statusWarning  = 1
+	statusCritical = 2
+	statusUnknown  = 3
+)
+
+// statusMetrics are values conditions of status command may check
+var statusMetrics = []string{
+	"backlog", "in_work", "queued", "held", "retrying",
+	"dead_lettered", "quarantined", "oldest_age", "paused", "degraded",
+}
+
+var conditionPattern = regexp.MustCompile(`^([a-z_]+)\s*(>=|<=|==|!=|>|<)\s*(-?[0-9]+(?:\.[0-9]+)?)$`)
+
+// condition is check like backlog>100
+type condition struct {
+	metric string
+	op     string
+	value  float64
+	text   string
+}
+
+func parseCondition(s string) (condition, error) {
+	m := conditionPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return condition{}, errors.New("Wrong condition, expected <metric><op><number>, e.g. backlog>100: " + s)
+	}
+
+	known := false
+	for _, name := range statusMetrics {
+		known = known || name == m[1]
+	}
+	if !known {
+		return condition{}, fmt.Errorf("Unknown metric %s, expected one of: %s", m[1], strings.Join(statusMetrics, ", "))
+	}
+
+	value, _ := strconv.ParseFloat(m[3], 64)
+	return condition{metric: m[1], op: m[2], value: value, text: strings.Join(strings.Fields(s), "")}, nil
+}
+
+func (c condition) holds(values map[string]float64) bool {
+	v := values[c.metric]
+	switch c.op {
+	case ">":
+		return v > c.value
+	case ">=":
+		return v >= c.value
+	case "<":
+		return v < c.value
+	case "<=":
+		return v <= c.value
+	case "==":
+		return v == c.value
+	}
+
+	return v != c.value
+}
+
+// conditions is repeatable flag of conditions
+type conditions []condition
+
+func (c *conditions) String() string {
+	list := []string{}
+	for _, cond := range *c {
+		list = append(list, cond.text)
+	}
+
+	return strings.Join(list, ",")
+}
+
+func (c *conditions) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		cond, err := parseCondition(part)
+		if err != nil {
+			return err
+		}
+		*c = append(*c, cond)
+	}
+
+	return nil
+}
+
+// statusValues collects metrics of running instance from admin API
+func statusValues(client *adminClient) (map[string]float64, error) {
+	var status struct {
+		DirFiles      []string       `json:"dir_files"`
+		WorkingFiles  []fileProgress `json:"working_files"`
+		HeldFiles     []string       `json:"held_files"`
+		QueueDepth    int            `json:"queue_depth"`
+		RetryingFiles []retryState   `json:"retrying_files"`
+		Source        struct {
+			State string `json:"state"`
+		} `json:"source"`
+		Control struct {
+			Paused bool `json:"paused"`
+		} `json:"control"`
+	}
+	if err := client.getJSON("/", &status); err != nil {
+		return nil, err
+	}
+
+	values := map[string]float64{
+		"backlog":  float64(len(status.DirFiles)),
+		"in_work":  float64(len(status.WorkingFiles)),
+		"queued":   float64(status.QueueDepth),
+		"held":     float64(len(status.HeldFiles)),
+		"retrying": float64(len(status.RetryingFiles)),
+		"paused":   0,
+		"degraded": 0,
+	}
+	if status.Control.Paused {
+		values["paused"] = 1
+	}
+	if status.Source.State == healthDegraded {
+		values["degraded"] = 1
+	}
+
+	for metric, path := range map[string]string{"dead_lettered": "/deadletter?limit=1", "quarantined": "/quarantine?limit=1"} {
+		var page struct {
+			Total int `json:"total"`
+		}
+		if err := client.getJSON(path, &page); err != nil {
+			return nil, err
+		}
+		values[metric] = float64(page.Total)
+	}
+
+	// Age of the oldest file in directory, pages of listing are walked through
+	oldest := 0.0
+	for offset := 0; ; offset += maxPageSize {
+		var page struct {
+			Total int        `json:"total"`
+			Items []fileItem `json:"items"`
+		}
+		if err := client.getJSON(fmt.Sprintf("/files?limit=%d&offset=%d", maxPageSize, offset), &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			if age := time.Since(item.Mtime).Seconds(); age > oldest {
+				oldest = age
+			}
+		}
+		if offset+maxPageSize >= page.Total {
+			break
+		}
+	}
+	values["oldest_age"] = float64(int64(oldest))
+
+	return values, nil
+}
+
+// statusCommand implements "hooker status", it prints metrics of
+// running instance and exits with Nagios plugin codes: 2 when
+// any -fail-if condition holds, 1 for -warn-if and 3 when
+// instance can't be queried
+func statusCommand(args []string) {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	adminURL := fs.String("admin", "http://localhost:8080", "Admin API URL of running hooker")
+	apiKey := fs.String("api-key", "", "Admin API key (default $HOOKER_API_KEY)")
+	format := fs.String("format", "table", "Output format: table or json")
+	var failIf, warnIf conditions
+	fs.Var(&failIf, "fail-if", "Condition like backlog>100 making status critical (exit code 2), may be repeated")
+	fs.Var(&warnIf, "warn-if", "Condition like oldest_age>=3600 making status warning (exit code 1), may be repeated")
+	if err := fs.Parse(args); err != nil {
+		os.Exit(statusUnknown)
+	}
+
+	if (*format != "table" && *format != "json") || fs.NArg() != 0 {
+		fmt.Println("Usage: hooker status [-admin <url>] [-api-key <key>] [-format json|table] [-fail-if <condition>]... [-warn-if <condition>]...")
+		fmt.Printf("Metrics: %s\n", strings.Join(statusMetrics, ", "))
+		os.Exit(statusUnknown)
+	}
+
+	values, err := statusValues(newAdminClient(*adminURL, *apiKey))
+	if err != nil {
+		fmt.Printf("UNKNOWN: %s\n", err)
+		os.Exit(statusUnknown)
+	}
+
+	code, state := statusOK, "OK"
+	failed, warned := []string{}, []string{}
+	for _, c := range failIf {
+		if c.holds(values) {
+			failed = append(failed, c.text)
+		}
+	}
+	for _, c := range warnIf {
+		if c.holds(values) {
+			warned = append(warned, c.text)
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		code, state = statusCritical, "CRITICAL"
+	case len(warned) > 0:
+		code, state = statusWarning, "WARNING"
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]interface{}{
+			"status":  state,
+			"metrics": values,
+			"failed":  failed,
+			"warned":  warned,
+		})
+		os.Exit(code)
+	}
+
+	names := append([]string{}, statusMetrics...)
+	sort.Strings(names)
+	fmt.Printf("%-14s %s\n", "STATUS", state)
+	for _, name := range names {
+		fmt.Printf("%-14s %g\n", name, values[name])
+	}
+	if len(failed) > 0 {
+		fmt.Printf("%-14s %s\n", "FAILED", strings.Join(failed, ", "))
+	}
+	if len(warned) > 0 {
+		fmt.Printf("%-14s %s\n", "WARNED", strings.Join(warned, ", "))
+	}
+
+	os.Exit(code)
+}
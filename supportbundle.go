@@ -0,0 +1,396 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bundleLogLines is how many last log lines are kept for support bundle
+	bundleLogLines = 1000
+	// bundleFailures is default number of failed files bundle describes
+	bundleFailures = 50
+)
+
+// logRing keeps last lines written to log
+type logRing struct {
+	mu      sync.Mutex
+	lines   []string
+	next    int
+	partial string
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, 0, size)}
+}
+
+func (l *logRing) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data := l.partial + string(b)
+	for {
+		i := strings.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		l.add(data[:i])
+		data = data[i+1:]
+	}
+	l.partial = data
+
+	return len(b), nil
+}
+
+func (l *logRing) add(line string) {
+	if len(l.lines) < cap(l.lines) {
+		l.lines = append(l.lines, line)
+		return
+	}
+
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % len(l.lines)
+}
+
+// tail returns kept lines, oldest first
+func (l *logRing) tail() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append(append([]string{}, l.lines[l.next:]...), l.lines[:l.next]...)
+}
+
+// recentLogs is what daemon logged lately
+var recentLogs = newLogRing(bundleLogLines)
+
+// bundleFile is single file of support bundle
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+// supportFailures describes files which failed,
+// their metadata only and never their content
+type supportFailures struct {
+	Journal    []journalEntry   `json:"journal"`
+	DeadLetter []deadLetterItem `json:"dead_letter"`
+	Quarantine []fileItem       `json:"quarantine"`
+}
+
+// collectFailures returns last n failures of each kind, newest first
+func collectFailures(j *journal, quarantineDir, deadLetterDir string, n int) supportFailures {
+	failures := supportFailures{
+		Journal:    []journalEntry{},
+		DeadLetter: []deadLetterItem{},
+		Quarantine: []fileItem{},
+	}
+
+	entries := j.all()
+	for i := len(entries) - 1; i >= 0 && len(failures.Journal) < n; i-- {
+		if entries[i].State == stateFailed {
+			failures.Journal = append(failures.Journal, entries[i])
+		}
+	}
+
+	files, sidecars, _ := readDeadLetter(deadLetterDir, fileFilter{})
+	sort.Slice(files, func(a, b int) bool { return files[a].ModTime().After(files[b].ModTime()) })
+	for _, fi := range files {
+		if len(failures.DeadLetter) == n {
+			break
+		}
+
+		item := deadLetterItem{fileItem: fileItem{Name: fi.Name(), State: "dead_lettered", Size: fi.Size(), Mtime: fi.ModTime()}}
+		if d, ok := sidecars[fi.Name()]; ok {
+			item.Route = d.Route
+			item.Failure = &d
+		}
+		failures.DeadLetter = append(failures.DeadLetter, item)
+	}
+
+	quarantined, _ := readQuarantine(quarantineDir, fileFilter{})
+	sort.Slice(quarantined, func(a, b int) bool { return quarantined[a].ModTime().After(quarantined[b].ModTime()) })
+	for _, fi := range quarantined {
+		if len(failures.Quarantine) == n {
+			break
+		}
+		if !fi.IsDir() {
+			failures.Quarantine = append(failures.Quarantine, fileItem{Name: fi.Name(), State: "quarantined", Size: fi.Size(), Mtime: fi.ModTime()})
+		}
+	}
+
+	return failures
+}
+
+// redactValue hides tokens, header values and credentials of URLs in decoded JSON
+func redactValue(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			// Extra headers carry credentials like Authorization
+			// or X-Api-Key, none of their values is kept
+			if key == "headers" {
+				v[k] = redactValue("token", item)
+				continue
+			}
+			v[k] = redactValue(k, item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(key, item)
+		}
+	case string:
+		if v == "" {
+			return v
+		}
+		if key == "token" || strings.Contains(key, "secret") || strings.Contains(key, "password") {
+			return redactedToken(v)
+		}
+		if strings.Contains(v, "://") {
+			return redactURL(v)
+		}
+	}
+
+	return v
+}
+
+// redactedFlags lists flags set on command line with secrets redacted
+func redactedFlags(fs *flag.FlagSet) map[string]interface{} {
+	flags := map[string]interface{}{}
+	fs.Visit(func(f *flag.Flag) {
+		key := f.Name
+		if strings.Contains(key, "token") || strings.HasSuffix(key, "-keys") {
+			key = "token"
+		}
+		flags[f.Name] = redactValue(key, f.Value.String())
+	})
+
+	return flags
+}
+
+// buildBundle puts support bundle files together, cfg
+// is configuration in effect and flags may be nil
+func buildBundle(o options, cfg config, flags map[string]interface{}, j *journal, queue []fileItem, logs []string, failures int) ([]bundleFile, error) {
+	var raw interface{}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	docs := []struct {
+		name string
+		v    interface{}
+	}{
+		{"version.json", map[string]interface{}{
+			"version":    version,
+			"go":         runtime.Version(),
+			"os":         runtime.GOOS,
+			"arch":       runtime.GOARCH,
+			"fips":       o.fipsStatus(),
+			"created_at": time.Now(),
+		}},
+		{"config.json", redactValue("", raw)},
+		{"state.json", snapshot{
+			Version: snapshotVersion,
+			Created: time.Now(),
+			Journal: j.all(),
+			Queue:   queue,
+		}},
+		{"failures.json", collectFailures(j, o.quarantine, o.deadLetter, failures)},
+	}
+	if flags != nil {
+		docs = append(docs, struct {
+			name string
+			v    interface{}
+		}{"flags.json", flags})
+	}
+
+	files := []bundleFile{}
+	for _, d := range docs {
+		data, err := json.MarshalIndent(d.v, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.name, err)
+		}
+		files = append(files, bundleFile{name: d.name, data: append(data, '\n')})
+	}
+	if logs != nil {
+		files = append(files, bundleFile{name: "logs.txt", data: []byte(strings.Join(logs, "\n") + "\n")})
+	}
+
+	return files, nil
+}
+
+// writeBundle writes files as tar.gz under common directory
+func writeBundle(w io.Writer, files []bundleFile) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	now := time.Now()
+	dir := "hooker-support-" + now.UTC().Format("20060102-150405")
+	for _, f := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    dir + "/" + f.name,
+			Mode:    0644,
+			Size:    int64(len(f.data)),
+			ModTime: now,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// handleSupportBundle serves GET /support-bundle
+func (c *controller) handleSupportBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, ok := c.admin.require(w, r, roleAdmin); !ok {
+		return
+	}
+
+	failures := bundleFailures
+	if s := r.URL.Query().Get("failures"); s != "" {
+		if _, err := fmt.Sscanf(s, "%d", &failures); err != nil || failures < 0 {
+			http.Error(w, "Wrong failures: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+
+	o := c.opts()
+	queue := []fileItem{}
+	for _, item := range c.fileItems() {
+		if item.State != fileWaiting {
+			queue = append(queue, item)
+		}
+	}
+
+	files, err := buildBundle(o, o.effectiveConfig(), redactedFlags(flag.CommandLine), c.journal, queue, recentLogs.tail(), failures)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="hooker-support.tar.gz"`)
+	writeBundle(w, files)
+}
+
+// supportBundleCommand implements "hooker support-bundle", it downloads
+// bundle from running daemon or, while it is stopped, builds one
+// from its files
+func supportBundleCommand(args []string) {
+	fs := flag.NewFlagSet("support-bundle", flag.ExitOnError)
+	adminURL := fs.String("admin", "", "Admin API URL of running hooker, e.g. http://localhost:8080")
+	apiKey := fs.String("api-key", "", "Admin API key (default $HOOKER_API_KEY)")
+	configPath := fs.String("config", "", "JSON configuration file of stopped hooker")
+	journalPath := fs.String("journal", "", "Journal file of stopped hooker")
+	quarantine := fs.String("quarantine", "", "Quarantine directory of stopped hooker")
+	deadLetter := fs.String("dead-letter", "", "Dead-letter directory of stopped hooker")
+	logPath := fs.String("log", "", "Log file of stopped hooker, last lines of which are included")
+	failures := fs.Int("failures", bundleFailures, "Number of last failed files of each kind described")
+	file := fs.String("file", "hooker-support.tar.gz", "Bundle file (- for stdout)")
+	fs.Parse(args)
+
+	if *adminURL == "" && *journalPath == "" && *configPath == "" {
+		fmt.Println("Usage: hooker support-bundle -admin <url> [-api-key <key>] | -config <file> -journal <file> [-quarantine <dir>] [-dead-letter <dir>] [-log <file>] [-file <bundle.tar.gz>]")
+		os.Exit(2)
+	}
+
+	// Bundle file is created only once there is something to write
+	create := func() io.WriteCloser {
+		if *file == "-" {
+			return nopWriteCloser{os.Stdout}
+		}
+
+		f, err := os.Create(*file)
+		if err != nil {
+			log.Fatalf("Bundle writing error: %s\n", err)
+		}
+		return f
+	}
+
+	if *adminURL != "" {
+		response, err := newAdminClient(*adminURL, *apiKey).get(fmt.Sprintf("/support-bundle?failures=%d", *failures))
+		if err != nil {
+			log.Fatalf("Bundle download error: %s\n", err)
+		}
+		defer response.Body.Close()
+
+		out := create()
+		defer out.Close()
+		if _, err := io.Copy(out, response.Body); err != nil {
+			log.Fatalf("Bundle download error: %s\n", err)
+		}
+		log.Printf("Support bundle written to %s\n", *file)
+		return
+	}
+
+	o := options{quarantine: *quarantine, deadLetter: *deadLetter}
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("Configuration loading error: %s\n", err)
+		}
+		o.config = *configPath
+		if o, err = o.withConfig(cfg); err != nil {
+			log.Fatalf("Configuration error: %s\n", err)
+		}
+	}
+
+	j, err := openJournal(*journalPath)
+	if err != nil {
+		log.Fatalf("Journal loading error: %s\n", err)
+	}
+
+	var logs []string
+	if *logPath != "" {
+		data, err := ioutil.ReadFile(*logPath)
+		if err != nil {
+			log.Fatalf("Log reading error: %s\n", err)
+		}
+		logs = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+		if len(logs) > bundleLogLines {
+			logs = logs[len(logs)-bundleLogLines:]
+		}
+	}
+
+	files, err := buildBundle(o, o.effectiveConfig(), nil, j, []fileItem{}, logs, *failures)
+	if err != nil {
+		log.Fatalf("Bundle building error: %s\n", err)
+	}
+
+	out := create()
+	defer out.Close()
+	if err := writeBundle(out, files); err != nil {
+		log.Fatalf("Bundle writing error: %s\n", err)
+	}
+
+	log.Printf("Support bundle written to %s\n", *file)
+}
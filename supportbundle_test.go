@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBundleRedactsHeaders(t *testing.T) {
+	cfg := config{
+		Routes: []route{{
+			Name:    "gps",
+			Headers: map[string]string{"Authorization": "Bearer route-secret"},
+		}},
+		Destinations: []destination{{
+			Name:    "backup",
+			URL:     "https://backup.example.com/",
+			Headers: map[string]string{"X-Api-Key": "destination-secret"},
+		}},
+	}
+
+	j, err := openJournal("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := buildBundle(options{}, cfg, nil, j, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		if f.name != "config.json" {
+			continue
+		}
+
+		data := string(f.data)
+		for _, secret := range []string{"route-secret", "destination-secret"} {
+			if strings.Contains(data, secret) {
+				t.Errorf("config.json contains header value %q:\n%s", secret, data)
+			}
+		}
+		if !strings.Contains(data, `"Authorization": "\u003credacted`) {
+			t.Errorf("config.json has no redacted Authorization header:\n%s", data)
+		}
+		return
+	}
+
+	t.Fatal("Bundle has no config.json")
+}
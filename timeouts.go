@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Phases of request failure is attributed to
+const (
+	phaseDNS      = "dns"
+	phaseConnect  = "connect"
+	phaseTLS      = "tls"
+	phaseRequest  = "request"
+	phaseResponse = "response"
+	phaseAttempt  = "attempt"
+)
+
+// phaseError tells at which phase of request error happened
+type phaseError struct {
+	Phase string
+	Err   error
+}
+
+func (e *phaseError) Error() string {
+	return e.Phase + ": " + e.Err.Error()
+}
+
+func (e *phaseError) Unwrap() error {
+	return e.Err
+}
+
+// errorPhase returns phase of failure or empty string when it is unknown
+func errorPhase(err error) string {
+	var pe *phaseError
+	if errors.As(err, &pe) {
+		return pe.Phase
+	}
+
+	return ""
+}
+
+// seconds returns timeout of given seconds falling back to -timeout
+func (o options) seconds(v int) time.Duration {
+	if v <= 0 {
+		v = o.timeout
+	}
+
+	return time.Second * time.Duration(v)
+}
+
+// dial resolves host within -dns-timeout and connects to its addresses
+// in turn within -connect-timeout, errors are attributed to phase here
+// as transport dials in background where request trace is not seen
+func (o options) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	lookup, cancel := context.WithTimeout(ctx, o.seconds(o.dnsTimeout))
+	ips, err := net.DefaultResolver.LookupIPAddr(lookup, host)
+	cancel()
+	if err != nil {
+		return nil, &phaseError{Phase: phaseDNS, Err: err}
+	}
+
+	dialer := net.Dialer{Timeout: o.seconds(o.connectTimeout)}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, &phaseError{Phase: phaseConnect, Err: err}
+}
+
+// phaseTransport follows request with httptrace and
+// wraps its error into phaseError of the last phase
+type phaseTransport struct {
+	base http.RoundTripper
+}
+
+func (t *phaseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var mu sync.Mutex
+	phase := phaseConnect
+	set := func(p string) {
+		mu.Lock()
+		phase = p
+		mu.Unlock()
+	}
+
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { set(phaseDNS) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { set(phaseConnect) },
+		ConnectStart:      func(string, string) { set(phaseConnect) },
+		TLSHandshakeStart: func() { set(phaseTLS) },
+		GotConn:           func(httptrace.GotConnInfo) { set(phaseRequest) },
+		WroteRequest:      func(httptrace.WroteRequestInfo) { set(phaseResponse) },
+	}
+
+	if sent, ok := req.Context().Value(sentKey{}).(*int64); ok && req.Body != nil {
+		req = req.Clone(req.Context())
+		req.Body = &sentBody{ReadCloser: req.Body, sent: sent}
+	}
+
+	response, err := t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		if errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+			return nil, &phaseError{Phase: phaseAttempt, Err: err}
+		}
+		if errorPhase(err) != "" {
+			return nil, err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		return nil, &phaseError{Phase: phase, Err: err}
+	}
+
+	return response, nil
+}
+
+// attempt returns context of single upload attempt
+// which ends after -attempt-timeout when it is set
+func (o options) attempt() (context.Context, context.CancelFunc) {
+	if o.attemptTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+
+	return context.WithTimeout(context.Background(), time.Second*time.Duration(o.attemptTimeout))
+}
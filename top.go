@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// topStages is how far along its pipeline file in each stage is
+var topStages = map[string]float64{
+	progressWaiting:     0,
+	progressStabilizing: 0.2,
+	progressValidating:  0.4,
+	progressHeld:        0.5,
+	progressSending:     0.6,
+	progressRetrying:    0.6,
+	progressZipping:     0.9,
+}
+
+// topErrors is how many recent errors are shown
+const topErrors = 8
+
+// topStatus is part of GET / hooker top shows
+type topStatus struct {
+	DirFiles      []string       `json:"dir_files"`
+	WorkingFiles  []fileProgress `json:"working_files"`
+	HeldFiles     []string       `json:"held_files"`
+	QueueDepth    int            `json:"queue_depth"`
+	RetryingFiles []retryState   `json:"retrying_files"`
+	Control       struct {
+		Paused bool `json:"paused"`
+	} `json:"control"`
+}
+
+// topSample is what throughput is measured between
+type topSample struct {
+	at    time.Time
+	files float64
+	bytes float64
+}
+
+// topError is recent failure, either file being retried or dead-lettered one
+type topError struct {
+	at    time.Time
+	name  string
+	state string
+	err   string
+}
+
+// sumMetric adds up values of every series of metric in Prometheus text format
+func sumMetric(text, name string) float64 {
+	sum := 0.0
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, name+" ") && !strings.HasPrefix(line, name+"{") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if v, err := strconv.ParseFloat(fields[len(fields)-1], 64); err == nil {
+			sum += v
+		}
+	}
+
+	return sum
+}
+
+// formatBytes prints size with binary unit
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// progressBar draws fraction as bar of given width
+func progressBar(fraction float64, width int) string {
+	if fraction > 1 {
+		fraction = 1
+	}
+	done := int(fraction * float64(width))
+
+	return "[" + strings.Repeat("#", done) + strings.Repeat(".", width-done) + "]"
+}
+
+// cut shortens s to width, marking that it was cut
+func cut(s string, width int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= width {
+		return s
+	}
+	if width < 4 {
+		return s[:width]
+	}
+
+	return s[:width-3] + "..."
+}
+
+// topView polls admin API and renders its screens
+type topView struct {
+	client *adminClient
+	url    string
+	width  int
+	last   *topSample
+}
+
+// render returns screen with current state of hooker
+func (t *topView) render() (string, error) {
+	var status topStatus
+	if err := t.client.getJSON("/", &status); err != nil {
+		return "", err
+	}
+
+	sample := &topSample{at: time.Now()}
+	if response, err := t.client.get("/metrics"); err == nil {
+		text, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		sample.files = sumMetric(string(text), "hooker_files_sent_total")
+		sample.bytes = sumMetric(string(text), "hooker_payload_size_bytes_sum")
+	}
+
+	var deadLetter struct {
+		Items []deadLetterItem `json:"items"`
+	}
+	t.client.getJSON(fmt.Sprintf("/deadletter?limit=%d", maxPageSize), &deadLetter)
+
+	var b strings.Builder
+	state := "running"
+	if status.Control.Paused {
+		state = "paused"
+	}
+	fmt.Fprintf(&b, "hooker top - %s - %s - %s\n\n", t.url, state, sample.at.Format("15:04:05"))
+
+	fmt.Fprintf(&b, "Backlog:    %d in directory, %d queued, %d held, %d retrying, %d in work\n",
+		len(status.DirFiles), status.QueueDepth, len(status.HeldFiles), len(status.RetryingFiles), len(status.WorkingFiles))
+
+	if t.last != nil {
+		seconds := sample.at.Sub(t.last.at).Seconds()
+		fmt.Fprintf(&b, "Throughput: %.2f files/s, %s/s\n",
+			(sample.files-t.last.files)/seconds, formatBytes((sample.bytes-t.last.bytes)/seconds))
+	} else {
+		fmt.Fprintf(&b, "Throughput: measuring...\n")
+	}
+	fmt.Fprintf(&b, "Delivered:  %.0f files, %s since start\n\n", sample.files, formatBytes(sample.bytes))
+	t.last = sample
+
+	nameWidth := t.width - 62
+	if nameWidth < 16 {
+		nameWidth = 16
+	}
+	fmt.Fprintf(&b, "%-*s %-12s %-22s %10s %8s %5s\n", nameWidth, "IN FLIGHT", "STAGE", "PROGRESS", "SENT", "ELAPSED", "RETRY")
+	for _, fp := range status.WorkingFiles {
+		fmt.Fprintf(&b, "%-*s %-12s %-22s %10s %8s %5d\n",
+			nameWidth, cut(fp.Name, nameWidth), fp.Stage, progressBar(topStages[fp.Stage], 20),
+			formatBytes(float64(fp.BytesSent)), time.Since(fp.StartedAt).Truncate(time.Second), fp.Retry)
+	}
+	if len(status.WorkingFiles) == 0 {
+		fmt.Fprintf(&b, "(none)\n")
+	}
+
+	recent := []topError{}
+	for _, r := range status.RetryingFiles {
+		recent = append(recent, topError{
+			at:    r.NextAt,
+			name:  r.File,
+			state: fmt.Sprintf("retry #%d", r.Failed+1),
+			err:   r.LastError,
+		})
+	}
+	for _, item := range deadLetter.Items {
+		e := topError{at: item.Mtime, name: item.Name, state: "dead-letter"}
+		if item.Failure != nil {
+			e.at, e.err = item.Failure.DeadLetteredAt, item.Failure.Error
+		}
+		recent = append(recent, e)
+	}
+	sort.Slice(recent, func(i, j int) bool {
+		return recent[i].at.After(recent[j].at)
+	})
+	if len(recent) > topErrors {
+		recent = recent[:topErrors]
+	}
+
+	fmt.Fprintf(&b, "\nRECENT ERRORS\n")
+	for _, e := range recent {
+		line := fmt.Sprintf("%s %-11s %s: %s", e.at.Local().Format("15:04:05"), e.state, e.name, e.err)
+		fmt.Fprintf(&b, "%s\n", cut(line, t.width))
+	}
+	if len(recent) == 0 {
+		fmt.Fprintf(&b, "(none)\n")
+	}
+
+	return b.String(), nil
+}
+
+// topCommand implements "hooker top", terminal view of running
+// hooker for servers without browser, it redraws screen until
+// interrupted or prints it just once with -once
+func topCommand(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	adminURL := fs.String("admin", "http://localhost:8080", "Admin API URL of running hooker")
+	apiKey := fs.String("api-key", "", "Admin API key (default $HOOKER_API_KEY)")
+	interval := fs.Int("interval", 2, "Time in seconds between refreshes")
+	once := fs.Bool("once", false, "Print screen once and exit, e.g. when output is not terminal")
+	width := fs.Int("width", 0, "Screen width (default $COLUMNS or 100)")
+	fs.Parse(args)
+
+	if *interval < 1 || fs.NArg() != 0 {
+		fmt.Println("Usage: hooker top [-admin <url>] [-api-key <key>] [-interval <seconds>] [-width <columns>] [-once]")
+		os.Exit(2)
+	}
+
+	if *width <= 0 {
+		*width, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+	}
+	if *width <= 0 {
+		*width = 100
+	}
+
+	t := &topView{client: newAdminClient(*adminURL, *apiKey), url: *adminURL, width: *width}
+	if *once {
+		screen, err := t.render()
+		if err != nil {
+			log.Fatalf("Admin API error: %s\n", err)
+		}
+		fmt.Print(screen)
+		return
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	// Alternate screen keeps terminal contents intact on exit
+	fmt.Print("\033[?1049h\033[?25l")
+	restore := func() { fmt.Print("\033[?25h\033[?1049l") }
+
+	ticker := time.NewTicker(time.Second * time.Duration(*interval))
+	defer ticker.Stop()
+
+	for {
+		screen, err := t.render()
+		if err != nil {
+			screen = fmt.Sprintf("hooker top - %s - %s\n\nAdmin API error: %s\n", t.url, time.Now().Format("15:04:05"), err)
+		}
+		fmt.Print("\033[H\033[2J" + screen)
+
+		select {
+		case <-interrupt:
+			restore()
+			return
+		case <-ticker.C:
+		}
+	}
+}
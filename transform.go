@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	x "encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/tdewolff/minify"
+	"github.com/tdewolff/minify/xml"
+)
+
+// Transforms applied to file content before it is compressed
+const (
+	transformMinify   = "minify"
+	transformNone     = "none"
+	transformXSLT     = "xslt"
+	transformTemplate = "template"
+)
+
+// transformTimeout limits single XSLT run
+const transformTimeout = 5 * time.Minute
+
+// minifier is shared by every file, configured minify.M is safe
+// for concurrent use, so it isn't built again on every attempt
+var minifier = func() *minify.M {
+	m := minify.New()
+	m.AddFunc("xml", xml.Minify)
+
+	return m
+}()
+
+// transformError is returned when transform can't be applied to file
+type transformError struct {
+	Step   string
+	Output string
+}
+
+func (e *transformError) Error() string {
+	return fmt.Sprintf("transform %s failed: %s", e.Step, e.Output)
+}
+
+// transformStep is single step of transform chain, e.g. xslt:fix.xsl
+type transformStep struct {
+	kind string
+	file string
+}
+
+func (s transformStep) String() string {
+	if s.file == "" {
+		return s.kind
+	}
+
+	return s.kind + ":" + s.file
+}
+
+// parseTransform parses chain of steps joined by +, e.g. xslt:fix.xsl+minify
+func parseTransform(spec string) ([]transformStep, error) {
+	steps := []transformStep{}
+	for _, s := range strings.Split(spec, "+") {
+		parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+		step := transformStep{kind: parts[0]}
+		if len(parts) == 2 {
+			step.file = parts[1]
+		}
+
+		switch step.kind {
+		case transformMinify, transformNone:
+			if step.file != "" {
+				return nil, errors.New("Transform " + step.kind + " takes no file: " + s)
+			}
+		case transformXSLT, transformTemplate:
+			if step.file == "" {
+				return nil, errors.New("Transform " + step.kind + " needs file: " + s)
+			}
+		default:
+			return nil, errors.New("Unknown transform: " + s)
+		}
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// parseTransforms parses -transform list of suffix=transform pairs
+func parseTransforms(list, separator string) (map[string]string, error) {
+	transforms, err := parseSuffixes(list, separator)
+	if err != nil {
+		return nil, errors.New("Wrong transform, expected <suffix>=<transform>: " + err.Error())
+	}
+
+	return transforms, validateTransforms(transforms)
+}
+
+// validateTransforms checks transform chains, their
+// stylesheets and templates and that xsltproc is installed
+func validateTransforms(transforms map[string]string) error {
+	for suffix, spec := range transforms {
+		steps, err := parseTransform(spec)
+		if err != nil {
+			return fmt.Errorf("Transform of %s: %w", suffix, err)
+		}
+
+		for _, step := range steps {
+			switch step.kind {
+			case transformXSLT:
+				if _, err := exec.LookPath("xsltproc"); err != nil {
+					return errors.New("XSLT transform requires xsltproc (libxslt)")
+				}
+				if _, err := os.Stat(step.file); err != nil {
+					return fmt.Errorf("XSLT stylesheet %s: %w", step.file, err)
+				}
+			case transformTemplate:
+				if _, err := newTransformTemplate(step.file); err != nil {
+					return fmt.Errorf("Transform template %s: %w", step.file, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// transformFor returns transform of file with the longest matching
+// suffix, files matching none are sent as they are
+func (o options) transformFor(name string) string {
+	if t := bySuffix(o.transforms, name); t != "" {
+		return t
+	}
+
+	return transformNone
+}
+
+// rewrites tells whether transform of file changes its content
+// beyond minifying, such transforms are tried out on validation
+func (o options) rewrites(name string) bool {
+	steps, _ := parseTransform(o.transformFor(name))
+	for _, step := range steps {
+		if step.kind == transformXSLT || step.kind == transformTemplate {
+			return true
+		}
+	}
+
+	return false
+}
+
+// transform copies file content into w applying transform of file, output
+// of every step but the last one is kept in memory up to -spill-threshold
+// and in workspace file beyond it
+func (o options) transform(w io.Writer, r io.Reader, name string) error {
+	steps, err := parseTransform(o.transformFor(name))
+	if err != nil {
+		return err
+	}
+
+	for _, step := range steps[:len(steps)-1] {
+		buf := o.newSpillBuffer(name)
+		defer buf.close()
+
+		if err := o.applyStep(step, buf, r, name); err != nil {
+			return err
+		}
+		if r, err = buf.reader(); err != nil {
+			return err
+		}
+	}
+
+	return o.applyStep(steps[len(steps)-1], w, r, name)
+}
+
+func (o options) applyStep(step transformStep, w io.Writer, r io.Reader, name string) error {
+	switch step.kind {
+	case transformMinify:
+		return minifier.Minify("xml", w, r)
+	case transformXSLT:
+		return applyXSLT(step, w, r)
+	case transformTemplate:
+		return o.applyTemplate(step, w, r, name)
+	}
+
+	_, err := copyPooled(w, r)
+	return err
+}
+
+// applyXSLT runs xsltproc with document on stdin, *transformError
+// means that it did run and stylesheet can't be applied
+func applyXSLT(step transformStep, w io.Writer, r io.Reader) error {
+	ctx, cancel := context.WithTimeout(context.Background(), transformTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "xsltproc", "--nonet", step.file, "-")
+	cmd.Stdin = r
+	cmd.Stdout = w
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || ctx.Err() != nil {
+		return err
+	}
+
+	return &transformError{
+		Step:   step.String(),
+		Output: truncate(bytes.TrimSpace(output.Bytes())),
+	}
+}
+
+// xmlNode is element of document given to templates
+type xmlNode struct {
+	XMLName x.Name
+	Attrs   []x.Attr  `xml:",any,attr"`
+	Text    string    `xml:",chardata"`
+	Nodes   []xmlNode `xml:",any"`
+}
+
+// Attr returns value of attribute with given local name
+func (n xmlNode) Attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+// Find returns elements under given slash separated path of local names
+func (n xmlNode) Find(path string) []xmlNode {
+	found := []xmlNode{n}
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		next := []xmlNode{}
+		for _, f := range found {
+			for _, c := range f.Nodes {
+				if c.XMLName.Local == name {
+					next = append(next, c)
+				}
+			}
+		}
+		found = next
+	}
+
+	return found
+}
+
+// Value returns trimmed text of the first element under path
+func (n xmlNode) Value(path string) string {
+	if found := n.Find(path); len(found) > 0 {
+		return strings.TrimSpace(found[0].Text)
+	}
+
+	return ""
+}
+
+// templateData is what transform templates are executed with
+type templateData struct {
+	Name    string
+	Route   string
+	Content string
+	Doc     xmlNode
+}
+
+var templateFuncs = template.FuncMap{
+	"escape": func(s string) string {
+		var buf bytes.Buffer
+		x.EscapeText(&buf, []byte(s))
+		return buf.String()
+	},
+	"replace": strings.ReplaceAll,
+	"trim":    strings.TrimSpace,
+}
+
+func newTransformTemplate(file string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return template.New(file).Funcs(templateFuncs).Parse(string(data))
+}
+
+// applyTemplate executes Go template with parsed document,
+// template output is what is sent instead of file
+func (o options) applyTemplate(step transformStep, w io.Writer, r io.Reader, name string) error {
+	t, err := newTransformTemplate(step.file)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	data := templateData{Name: name, Route: o.route, Content: string(content)}
+	if err := x.Unmarshal(content, &data.Doc); err != nil {
+		return &transformError{Step: step.String(), Output: err.Error()}
+	}
+	if err := t.Execute(w, data); err != nil {
+		return &transformError{Step: step.String(), Output: err.Error()}
+	}
+
+	return nil
+}
+
+// transformValidator tries transform out, so file it can't be
+// applied to is quarantined instead of failing every upload
+type transformValidator struct {
+	options options
+	name    string
+}
+
+func (v transformValidator) validate(filePath string, fi os.FileInfo) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return v.options.transform(ioutil.Discard, f, v.name)
+}
+
+func (v transformValidator) String() string {
+	return "transform " + v.options.transformFor(v.name)
+}
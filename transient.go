@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var transientErrnos = []syscall.Errno{
+	syscall.ESTALE,
+	syscall.EAGAIN,
+	syscall.EINTR,
+	syscall.EBUSY,
+	syscall.EIO,
+	syscall.ETIMEDOUT,
+	syscall.ECONNRESET,
+	syscall.EHOSTDOWN,
+}
+
+// Messages which network filesystems produce for temporary failures,
+// including SMB errors surfaced by Windows
+var transientMessages = []string{
+	"resource temporarily unavailable",
+	"stale file handle",
+	"stale nfs file handle",
+	"the specified network name is no longer available",
+	"an unexpected network error occurred",
+	"the process cannot access the file because it is being used by another process",
+}
+
+// isTransient reports whether I/O error is likely
+// to go away if we simply try again later
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, m := range transientMessages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryTransient calls fn until it succeeds, returns permanent
+// error or transient error persists after all attempts. Waits
+// between attempts are interrupted like other waits before upload
+func (p *parser) retryTransient(attempts int, fn func() error) error {
+	delay := time.Second
+
+	for i := 1; ; i++ {
+		err := fn()
+		if err == nil || !isTransient(err) || i >= attempts {
+			return err
+		}
+
+		log.Printf("[FILE: %s] Transient I/O error (attempt %d/%d), retrying in %s: %s\n", p.prefix, i, attempts, delay, err)
+		if err := p.sleep(delay, true); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+)
+
+const tusVersion = "1.0.0"
+
+// uploadSessions remembers chunked uploads created on API, so that
+// retry continues after the last stored chunk instead of starting over
+type uploadSessions struct {
+	mu        sync.Mutex
+	locations map[string]string
+}
+
+func newUploadSessions() *uploadSessions {
+	return &uploadSessions{
+		locations: make(map[string]string),
+	}
+}
+
+func (s *uploadSessions) get(key string) string {
+	if s == nil {
+		return ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.locations[key]
+}
+
+// set stores upload location, empty location forgets upload
+func (s *uploadSessions) set(key, location string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if location == "" {
+		delete(s.locations, key)
+		return
+	}
+	s.locations[key] = location
+}
+
+// uploadChunked sends request body with tus resumable upload protocol:
+// body is prepared in workspace, upload is created with POST and
+// filled with PATCH requests of chunkSize bytes each
+func (u *httpUploader) uploadChunked(ctx context.Context, pl *payload, filename string, headers map[string]string, chunkSize int64) (*directive, error) {
+	tmp, err := u.ws.create("chunked")
+	if err != nil {
+		return nil, err
+	}
+	defer u.ws.discard(tmp.Name())
+	defer tmp.Close()
+
+	body, wait := u.body(pl, filename)
+	_, err = copyPooled(tmp, body)
+	body.Close()
+	requestHash, bodyErr := wait()
+	if err != nil {
+		return nil, err
+	}
+	if bodyErr != nil {
+		return nil, bodyErr
+	}
+
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Body is the same for the same content, so
+	// upload started by previous attempt is continued
+	client := u.client()
+	key := u.options.url + " " + pl.sha256
+	location, offset := u.sessions.get(key), int64(0)
+	if location != "" {
+		if offset, err = u.tusOffset(ctx, client, location); err != nil {
+			location = ""
+		}
+	}
+	if location == "" {
+		if location, err = u.tusCreate(ctx, client, size, filename, headers); err != nil {
+			return nil, err
+		}
+		offset = 0
+		u.sessions.set(key, location)
+	}
+
+	d := &directive{status: http.StatusOK}
+	for offset < size {
+		n := chunkSize
+		if size-offset < n {
+			n = size - offset
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPatch, location, io.NewSectionReader(tmp, offset, n))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = n
+		req.Header.Set("Tus-Resumable", tusVersion)
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		if err := u.options.setAPIHeaders(req); err != nil {
+			return nil, err
+		}
+
+		response, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.StatusCode/100 != 2 {
+			data := readResponse(response.Body)
+			response.Body.Close()
+			return nil, &httpStatusError{Code: response.StatusCode, Body: truncate(data)}
+		}
+
+		d, err = readDirective(response, u.options.maxResponseSize)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		next, err := strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong Upload-Offset in response: %s", err)
+		}
+
+		// Offset that doesn't advance would keep upload looping
+		// forever, fail attempt and start upload anew on next one
+		if next <= offset || next > size {
+			u.sessions.set(key, "")
+			return nil, fmt.Errorf("Upload-Offset %d in response doesn't advance from %d", next, offset)
+		}
+		offset = next
+	}
+	u.sessions.set(key, "")
+
+	d.requestHash = requestHash
+
+	return d, nil
+}
+
+// tusCreate creates upload of given length and returns its URL
+func (u *httpUploader) tusCreate(ctx context.Context, client *http.Client, size int64, filename string, headers map[string]string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.options.url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(path.Base(filename)))+
+		",encoding "+base64.StdEncoding.EncodeToString([]byte(u.options.compress)))
+	if err := u.options.setAPIHeaders(req); err != nil {
+		return "", err
+	}
+	req.Header.Set("X-File-Name", path.Base(filename))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	data := readResponse(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		return "", &httpStatusError{Code: response.StatusCode, Body: truncate(data)}
+	}
+
+	base, err := url.Parse(u.options.url)
+	if err != nil {
+		return "", err
+	}
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || location.String() == "" {
+		return "", fmt.Errorf("API returned no upload location: %v", err)
+	}
+
+	return base.ResolveReference(location).String(), nil
+}
+
+// tusOffset asks how much of upload API has already stored
+func (u *httpUploader) tusOffset(ctx context.Context, client *http.Client, location string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, location, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	if err := u.options.setAPIHeaders(req); err != nil {
+		return 0, err
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return 0, &httpStatusError{Code: response.StatusCode}
+	}
+
+	return strconv.ParseInt(response.Header.Get("Upload-Offset"), 10, 64)
+}
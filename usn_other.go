@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "errors"
+
+func watchJournal(opts options, events chan struct{}, changes *changeSet, done *completions) error {
+	return errors.New("USN change journal is only available on Windows")
+}
@@ -0,0 +1,260 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Change journal control codes and errors
+const (
+	fsctlQueryUSNJournal                   = 0x000900f4
+	fsctlReadUSNJournal                    = 0x000900bb
+	errorJournalEntryDeleted syscall.Errno = 1181
+)
+
+// Reasons of change journal records hooker is interested in
+const (
+	usnReasonDataOverwrite  = 0x00000001
+	usnReasonDataExtend     = 0x00000002
+	usnReasonDataTruncation = 0x00000004
+	usnReasonFileCreate     = 0x00000100
+	usnReasonFileDelete     = 0x00000200
+	usnReasonRenameNewName  = 0x00002000
+	usnReasonClose          = 0x80000000
+
+	usnReasonData = usnReasonDataOverwrite | usnReasonDataExtend | usnReasonDataTruncation
+)
+
+// usnJournalData is USN_JOURNAL_DATA_V0
+type usnJournalData struct {
+	UsnJournalID    uint64
+	FirstUsn        int64
+	NextUsn         int64
+	LowestValidUsn  int64
+	MaxUsn          int64
+	MaximumSize     uint64
+	AllocationDelta uint64
+}
+
+// readUSNJournalData is READ_USN_JOURNAL_DATA_V0
+type readUSNJournalData struct {
+	StartUsn          int64
+	ReasonMask        uint32
+	ReturnOnlyOnClose uint32
+	Timeout           uint64
+	BytesToWaitFor    uint64
+	UsnJournalID      uint64
+}
+
+// usnRecord is USN_RECORD_V2 up to its file name
+type usnRecord struct {
+	RecordLength              uint32
+	MajorVersion              uint16
+	MinorVersion              uint16
+	FileReferenceNumber       uint64
+	ParentFileReferenceNumber uint64
+	Usn                       int64
+	TimeStamp                 int64
+	Reason                    uint32
+	SourceInfo                uint32
+	SecurityID                uint32
+	FileAttributes            uint32
+	FileNameLength            uint16
+	FileNameOffset            uint16
+}
+
+// fileID returns NTFS file reference number of path, the one
+// journal records identify files and their directories by
+func fileID(p string) (uint64, error) {
+	name, err := syscall.UTF16PtrFromString(p)
+	if err != nil {
+		return 0, err
+	}
+
+	handle, err := syscall.CreateFile(
+		name,
+		0,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil,
+		syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS,
+		0,
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.CloseHandle(handle)
+
+	var info syscall.ByHandleFileInformation
+	if err := syscall.GetFileInformationByHandle(handle, &info); err != nil {
+		return 0, err
+	}
+
+	return uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), nil
+}
+
+func queryJournal(volume syscall.Handle) (usnJournalData, error) {
+	var data usnJournalData
+	var n uint32
+	err := syscall.DeviceIoControl(volume, fsctlQueryUSNJournal, nil, 0,
+		(*byte)(unsafe.Pointer(&data)), uint32(unsafe.Sizeof(data)), &n, nil)
+
+	return data, err
+}
+
+// watchJournal follows NTFS change journal of volume with watched
+// directory and records files created or changed in it (and its
+// subdirectories when recursive is set) in changes, files closed
+// after writing or renamed into directory are marked in completions.
+// Journal is read from volume itself, so it requires administrator
+// rights and local NTFS volume, network shares are not supported
+func watchJournal(opts options, events chan struct{}, changes *changeSet, done *completions) error {
+	dir, err := filepath.Abs(opts.dir)
+	if err != nil {
+		return err
+	}
+
+	volume := filepath.VolumeName(dir)
+	if volume == "" || strings.HasPrefix(volume, `\\`) {
+		return errors.New("change journal is available for local volumes only, not " + dir)
+	}
+
+	name, err := syscall.UTF16PtrFromString(`\\.\` + volume)
+	if err != nil {
+		return err
+	}
+
+	handle, err := syscall.CreateFile(
+		name,
+		syscall.GENERIC_READ,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE,
+		nil,
+		syscall.OPEN_EXISTING,
+		0,
+		0,
+	)
+	if err != nil {
+		return err
+	}
+
+	journal, err := queryJournal(handle)
+	if err != nil {
+		syscall.CloseHandle(handle)
+		return err
+	}
+
+	// Directories are known by reference number, journal
+	// records point to their parent directory with it
+	root, err := fileID(dir)
+	if err != nil {
+		syscall.CloseHandle(handle)
+		return err
+	}
+	dirs := map[uint64]string{root: ""}
+	skip := excludedDirs(opts)
+	if opts.recursive {
+		filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() || p == dir {
+				return nil
+			}
+			if skip[p] {
+				return filepath.SkipDir
+			}
+
+			if id, err := fileID(p); err == nil {
+				rel, _ := filepath.Rel(dir, p)
+				dirs[id] = filepath.ToSlash(rel)
+			}
+			return nil
+		})
+	}
+
+	read := readUSNJournalData{
+		StartUsn:       journal.NextUsn,
+		ReasonMask:     usnReasonData | usnReasonFileCreate | usnReasonFileDelete | usnReasonRenameNewName | usnReasonClose,
+		BytesToWaitFor: 1,
+		UsnJournalID:   journal.UsnJournalID,
+	}
+
+	go func() {
+		defer syscall.CloseHandle(handle)
+
+		buf := make([]byte, 64*1024)
+		for {
+			var n uint32
+			err := syscall.DeviceIoControl(handle, fsctlReadUSNJournal,
+				(*byte)(unsafe.Pointer(&read)), uint32(unsafe.Sizeof(read)), &buf[0], uint32(len(buf)), &n, nil)
+			if err == errorJournalEntryDeleted {
+				// Journal wrapped around and changes are
+				// lost, only full rescan finds everything
+				log.Println("Change journal records were overwritten, rescanning")
+				if journal, err = queryJournal(handle); err == nil {
+					read.StartUsn = journal.FirstUsn
+					changes.rescan()
+					notify(events)
+					continue
+				}
+			}
+			if err != nil {
+				log.Printf("Change journal error, relying on polling: %s\n", err)
+				changes.stop()
+				notify(events)
+				return
+			}
+			if n < 8 {
+				continue
+			}
+
+			changed := false
+			for offset := uint32(8); offset+uint32(unsafe.Sizeof(usnRecord{})) <= n; {
+				record := (*usnRecord)(unsafe.Pointer(&buf[offset]))
+				if record.RecordLength == 0 {
+					break
+				}
+
+				parent, ok := dirs[record.ParentFileReferenceNumber]
+				if ok {
+					file := syscall.UTF16ToString(unsafe.Slice(
+						(*uint16)(unsafe.Pointer(&buf[offset+uint32(record.FileNameOffset)])), record.FileNameLength/2))
+					rel := path.Join(parent, file)
+
+					switch {
+					case record.FileAttributes&syscall.FILE_ATTRIBUTE_DIRECTORY != 0:
+						if record.Reason&usnReasonFileDelete != 0 {
+							delete(dirs, record.FileReferenceNumber)
+						} else if opts.recursive && !skip[filepath.Join(dir, filepath.FromSlash(rel))] {
+							dirs[record.FileReferenceNumber] = rel
+						}
+					case record.Reason&usnReasonFileDelete != 0:
+						// Gone file is dropped by next scan
+					default:
+						changes.add(rel)
+						if record.Reason&usnReasonRenameNewName != 0 ||
+							(record.Reason&usnReasonClose != 0 && record.Reason&usnReasonData != 0) {
+							done.mark(rel)
+						}
+						changed = true
+					}
+				}
+
+				offset += record.RecordLength
+			}
+
+			read.StartUsn = *(*int64)(unsafe.Pointer(&buf[0]))
+			if changed {
+				notify(events)
+			}
+		}
+	}()
+
+	return nil
+}
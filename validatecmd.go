@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandTimeout limits single run of validation command
+const commandTimeout = 5 * time.Minute
+
+// exitTempFail is EX_TEMPFAIL of sysexits.h, command exits
+// with it when file is not complete and has to be checked later
+const exitTempFail = 75
+
+// commandError is verdict of validation command rejecting file
+type commandError struct {
+	Command string
+	Code    int
+	Output  string
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("rejected by %s (exit code %d): %s", e.Command, e.Code, e.Output)
+}
+
+// commandValidator runs user command with file path as its last
+// argument and on stdin, exit code 0 accepts file and any other
+// except exitTempFail rejects it. Command is not run by shell
+type commandValidator struct {
+	command string
+	route   string
+}
+
+func (v commandValidator) validate(filePath string, fi os.FileInfo) error {
+	args := strings.Fields(v.command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], filePath)...)
+	cmd.Stdin = strings.NewReader(filePath + "\n")
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(), "HOOKER_FILE="+filePath, "HOOKER_ROUTE="+v.route)
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || ctx.Err() != nil {
+		return err
+	}
+
+	if exit.ExitCode() == exitTempFail {
+		return &incompleteError{Err: fmt.Errorf("%s asked to check later", args[0])}
+	}
+
+	return &commandError{
+		Command: args[0],
+		Code:    exit.ExitCode(),
+		Output:  truncate(bytes.TrimSpace(output.Bytes())),
+	}
+}
+
+func (v commandValidator) String() string {
+	return "command " + v.command
+}
+
+// validateCommand checks that validation command can be found
+func validateCommand(command string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return fmt.Errorf("Validation command %s: %w", args[0], err)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// relFileInfo is a file found in subdirectory,
+// its name is a slash separated relative path
+type relFileInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (f relFileInfo) Name() string {
+	return f.name
+}
+
+// archiveLayout matches dated directories archives are placed into
+const archiveLayout = `re:^\d{4}/\d{2}/\d{2}/`
+
+// excludedDirs are absolute paths of directories hooker moves files
+// into, they are never looked into even when they are in watched one
+func excludedDirs(opts options) map[string]bool {
+	root, _ := filepath.Abs(opts.dir)
+	skip := map[string]bool{}
+	for _, dir := range []string{opts.out, opts.quarantine, opts.deadLetter, opts.workspace} {
+		if abs, err := filepath.Abs(dir); err == nil && dir != "" && abs != root {
+			skip[abs] = true
+		}
+	}
+
+	return skip
+}
+
+// producedPatterns match paths relative to watched directory of files
+// hooker writes itself, for output, quarantine, dead letter and workspace
+// directories inside of it. Output which is watched directory itself
+// holds archives in dated subdirectories
+func producedPatterns(opts options) []string {
+	root, err := filepath.Abs(opts.dir)
+	if err != nil {
+		return nil
+	}
+
+	patterns := []string{}
+	for _, dir := range []string{opts.out, opts.quarantine, opts.deadLetter, opts.workspace} {
+		abs, err := filepath.Abs(dir)
+		if err != nil || dir == "" {
+			continue
+		}
+
+		rel, err := filepath.Rel(root, abs)
+		switch {
+		case err != nil, rel == "..", strings.HasPrefix(rel, ".."+string(filepath.Separator)):
+		case rel == ".":
+			if dir == opts.out {
+				patterns = append(patterns, archiveLayout)
+			}
+		default:
+			patterns = append(patterns, regexpPrefix+"^"+regexp.QuoteMeta(filepath.ToSlash(rel))+"/")
+		}
+	}
+
+	return patterns
+}
+
+// listFiles reads watched directory, descending into
+// subdirectories when recursive is set
+func listFiles(opts options) ([]os.FileInfo, error) {
+	if !opts.recursive {
+		return ioutil.ReadDir(opts.dir)
+	}
+
+	skip := excludedDirs(opts)
+	files := []os.FileInfo{}
+	err := filepath.Walk(opts.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(opts.dir, p)
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			if abs, err := filepath.Abs(p); err == nil && skip[abs] {
+				return filepath.SkipDir
+			}
+			if produced, _ := opts.produced(filepath.ToSlash(rel) + "/"); produced {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		files = append(files, relFileInfo{
+			FileInfo: fi,
+			name:     filepath.ToSlash(rel),
+		})
+		return nil
+	})
+
+	return files, err
+}
+
+// sameDir joins name with directory of
+// file given by relative path
+func sameDir(rel, name string) string {
+	return path.Join(path.Dir(rel), name)
+}
@@ -0,0 +1,120 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchDir subscribes to inotify events of directory (and its
+// subdirectories when recursive is set) and signals events
+// channel whenever something may be new there, files closed
+// after writing or moved in are marked in completions
+func watchDir(dir string, recursive bool, events chan struct{}, done *completions) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+
+	mask := uint32(syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO)
+
+	var mu sync.Mutex
+	dirs := map[int32]string{}
+	add := func(dir string) error {
+		wd, err := syscall.InotifyAddWatch(fd, dir, mask)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		dirs[int32(wd)] = dir
+		mu.Unlock()
+
+		return nil
+	}
+
+	if err := add(dir); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	if recursive {
+		filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.IsDir() && p != dir {
+				if err := add(p); err != nil {
+					log.Printf("Unable to watch %s: %s\n", p, err)
+				}
+			}
+			return nil
+		})
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				log.Printf("Inotify read error, relying on polling: %s\n", err)
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				nameEnd := nameStart + int(event.Len)
+				offset = nameEnd
+
+				if event.Len == 0 || nameEnd > n {
+					continue
+				}
+
+				name := string(buf[nameStart:nameEnd])
+				for i := 0; i < len(name); i++ {
+					if name[i] == 0 {
+						name = name[:i]
+						break
+					}
+				}
+
+				mu.Lock()
+				parent := dirs[event.Wd]
+				mu.Unlock()
+				p := filepath.Join(parent, name)
+
+				// Watching newly created subdirectories
+				if event.Mask&syscall.IN_ISDIR != 0 {
+					if recursive {
+						if err := add(p); err != nil {
+							log.Printf("Unable to watch %s: %s\n", p, err)
+						}
+					}
+					continue
+				}
+
+				if event.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0 {
+					if rel, err := filepath.Rel(dir, p); err == nil {
+						done.mark(filepath.ToSlash(rel))
+					}
+				}
+			}
+
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import "errors"
+
+func watchDir(dir string, recursive bool, events chan struct{}, done *completions) error {
+	return errors.New("Notify watch mode is not supported on this platform")
+}
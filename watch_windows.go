@@ -0,0 +1,89 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// errorNotifyEnumDir is returned when too many changes happened
+// to fit into buffer and directory has to be rescanned
+const errorNotifyEnumDir syscall.Errno = 1022
+
+// watchDir subscribes to ReadDirectoryChangesW notifications of
+// directory (with its subtree when recursive is set) and signals
+// events channel whenever something may be new there, files
+// renamed into directory are marked in completions
+func watchDir(dir string, recursive bool, events chan struct{}, done *completions) error {
+	name, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return err
+	}
+
+	handle, err := syscall.CreateFile(
+		name,
+		syscall.FILE_LIST_DIRECTORY,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil,
+		syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_BACKUP_SEMANTICS,
+		0,
+	)
+	if err != nil {
+		return err
+	}
+
+	mask := uint32(syscall.FILE_NOTIFY_CHANGE_FILE_NAME | syscall.FILE_NOTIFY_CHANGE_DIR_NAME |
+		syscall.FILE_NOTIFY_CHANGE_SIZE | syscall.FILE_NOTIFY_CHANGE_LAST_WRITE)
+
+	go func() {
+		defer syscall.CloseHandle(handle)
+
+		// Network shares don't accept buffers over 64 KB
+		buf := make([]byte, 64*1024)
+		for {
+			var n uint32
+			err := syscall.ReadDirectoryChanges(handle, &buf[0], uint32(len(buf)), recursive, mask, &n, nil, 0)
+			if err == errorNotifyEnumDir || (err == nil && n == 0) {
+				// Buffer overflow, changes are lost and
+				// only full rescan finds everything
+				log.Println("Directory changes buffer overflow, rescanning")
+				notify(events)
+				continue
+			}
+			if err != nil {
+				log.Printf("ReadDirectoryChanges error, relying on polling: %s\n", err)
+				return
+			}
+
+			for offset := uint32(0); offset < n; {
+				info := (*syscall.FileNotifyInformation)(unsafe.Pointer(&buf[offset]))
+				file := syscall.UTF16ToString(unsafe.Slice(&info.FileName, info.FileNameLength/2))
+
+				if info.Action == syscall.FILE_ACTION_RENAMED_NEW_NAME {
+					done.mark(filepath.ToSlash(file))
+				}
+
+				if info.NextEntryOffset == 0 {
+					break
+				}
+				offset += info.NextEntryOffset
+			}
+
+			notify(events)
+		}
+	}()
+
+	return nil
+}
+
+func notify(events chan struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
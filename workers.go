@@ -0,0 +1,158 @@
+package main
+
+import "context"
+
+// waiter is file queued for a worker
+type waiter struct {
+	name     string
+	priority int
+	ready    chan struct{}
+}
+
+// acquire waits for a free worker, without workers limit every file
+// gets one at once. File interrupted or paused while it is queued
+// leaves the queue and gets no worker
+func (c *controller) acquire(ctx context.Context, name string, priority int) error {
+	if c.workers == 0 {
+		return nil
+	}
+
+	paused := c.pausing()
+	c.mu.Lock()
+	if c.busy < c.workers && len(c.waiters) == 0 {
+		c.busy++
+		c.mu.Unlock()
+		return nil
+	}
+
+	w := &waiter{name: name, priority: priority, ready: make(chan struct{})}
+	c.waiters = append(c.waiters, w)
+	c.queued[name] = true
+	c.mu.Unlock()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	case <-paused:
+		err = errPaused
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, queued := range c.waiters {
+		if queued == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			delete(c.queued, name)
+			return err
+		}
+	}
+
+	// Worker was handed over in the meantime
+	return nil
+}
+
+// releaseWorker hands worker over to queued file of the highest
+// priority, files of the same priority are served in order they came
+func (c *controller) releaseWorker() {
+	if c.workers == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.waiters) == 0 {
+		c.busy--
+		return
+	}
+
+	next := 0
+	for i, w := range c.waiters {
+		if w.priority > c.waiters[next].priority {
+			next = i
+		}
+	}
+	w := c.waiters[next]
+	c.waiters = append(c.waiters[:next], c.waiters[next+1:]...)
+	delete(c.queued, w.name)
+	close(w.ready)
+}
+
+// work runs fn for file once worker is free, files still queued
+// on shutdown or pause are left for the next run
+func (c *controller) work(ctx context.Context, name string, priority int, ch chan struct{}, fn func()) {
+	if err := c.acquire(ctx, name, priority); err != nil {
+		ch <- struct{}{}
+		return
+	}
+	defer c.releaseWorker()
+
+	c.mu.Lock()
+	stopping, paused := c.stopping, !c.pausedAt.IsZero()
+	c.mu.Unlock()
+
+	if stopping || paused {
+		ch <- struct{}{}
+		return
+	}
+
+	fn()
+}
+
+// waitHold holds file until operator decides on it, its worker
+// serves other files in the meantime. Like other waits before
+// upload it is interrupted by shutdown, delete and pause
+func (c *controller) waitHold(ctx context.Context, name, sha256 string, priority int) (bool, error) {
+	ch := c.hold(name, sha256)
+	paused := c.pausing()
+
+	c.releaseWorker()
+
+	var err error
+	select {
+	case send := <-ch:
+		if err = c.acquire(ctx, name, priority); err == nil {
+			return send, nil
+		}
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	case <-paused:
+		err = errPaused
+	}
+
+	// Interrupted file only leaves, it takes worker back
+	// without queueing as work releases it once file is done
+	c.unhold(name)
+	c.takeWorker()
+
+	return false, err
+}
+
+// takeWorker takes worker for file which has to finish at
+// once, even though it may briefly exceed workers limit
+func (c *controller) takeWorker() {
+	if c.workers == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.busy++
+}
+
+func (c *controller) filesQueued() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	files := []string{}
+	for file := range c.queued {
+		files = append(files, file)
+	}
+
+	return files
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+)
+
+// workspaceOrphan matches names of files created by workspace.create,
+// only these are removed on startup, anything else there is kept
+var workspaceOrphan = regexp.MustCompile(`^(archive|chunked|presigned|proof|snapshot|spill)-\d+$`)
+
+// workspace is a directory holding intermediate artifacts
+// (temp archives, transformed bodies, ...) of every stage,
+// nothing in it outlives the process
+type workspace struct {
+	dir string
+}
+
+// openWorkspace creates workspace directory,
+// removing artifacts left by previous run
+func openWorkspace(dir string) (*workspace, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || !workspaceOrphan.MatchString(fi.Name()) {
+			continue
+		}
+
+		orphan := path.Join(dir, fi.Name())
+		if err := os.Remove(orphan); err != nil {
+			return nil, err
+		}
+
+		log.Printf("[WORKSPACE] Removed orphan %s\n", orphan)
+	}
+
+	return &workspace{dir: dir}, nil
+}
+
+// create opens new temporary file for given stage,
+// stage has to be listed in workspaceOrphan
+func (w *workspace) create(stage string) (*os.File, error) {
+	return ioutil.TempFile(w.dir, stage+"-")
+}
+
+// commit moves finished artifact to its destination
+func (w *workspace) commit(tmp, dst string) error {
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	return moveFile(tmp, dst)
+}
+
+// discard removes artifact which is not needed anymore
+func (w *workspace) discard(tmp string) {
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		log.Printf("[WORKSPACE] Error removing %s: %s\n", tmp, err)
+	}
+}
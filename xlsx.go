@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/zip"
+	x "encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// spreadsheetSuffixes are files validated as ZIP containers of workbook parts
+var spreadsheetSuffixes = []string{".xlsx", ".xlsm"}
+
+// xlsxParts are parts every workbook has
+var xlsxParts = []string{"[Content_Types].xml", "xl/workbook.xml"}
+
+func isSpreadsheet(name string) bool {
+	name = strings.ToLower(name)
+	for _, suffix := range spreadsheetSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// xlsxError is returned for complete container which is not a valid
+// workbook, unlike zip.ErrFormat of file which is still being written
+type xlsxError struct {
+	Reason string
+}
+
+func (e *xlsxError) Error() string {
+	return "broken spreadsheet: " + e.Reason
+}
+
+// xlsxValidator checks that spreadsheet is complete and readable
+type xlsxValidator struct {
+	sheets []string
+}
+
+func (v xlsxValidator) validate(filePath string, fi os.FileInfo) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = checkXLSX(f, fi.Size(), v.sheets)
+	if errors.Is(err, zip.ErrFormat) {
+		return &incompleteError{Err: err}
+	}
+
+	return err
+}
+
+func (v xlsxValidator) String() string {
+	return "XLSX"
+}
+
+// checkXLSX reads every part of spreadsheet to verify checksums
+// and checks that workbook has all required sheets
+func checkXLSX(r io.ReaderAt, size int64, sheets []string) error {
+	// Central directory is written last, so it is missing until file is complete
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	parts := map[string]*zip.File{}
+	for _, f := range zr.File {
+		parts[f.Name] = f
+
+		rc, err := f.Open()
+		if err != nil {
+			return &xlsxError{Reason: fmt.Sprintf("part %s: %s", f.Name, err)}
+		}
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return &xlsxError{Reason: fmt.Sprintf("part %s: %s", f.Name, err)}
+		}
+	}
+
+	for _, name := range xlsxParts {
+		if parts[name] == nil {
+			return &xlsxError{Reason: "no " + name + " part"}
+		}
+	}
+
+	if len(sheets) == 0 {
+		return nil
+	}
+
+	rc, err := parts["xl/workbook.xml"].Open()
+	if err != nil {
+		return &xlsxError{Reason: err.Error()}
+	}
+	defer rc.Close()
+
+	workbook := struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"sheets>sheet"`
+	}{}
+	if err := x.NewDecoder(rc).Decode(&workbook); err != nil {
+		return &xlsxError{Reason: "workbook: " + err.Error()}
+	}
+
+	present := map[string]bool{}
+	for _, s := range workbook.Sheets {
+		present[s.Name] = true
+	}
+	missing := []string{}
+	for _, s := range sheets {
+		if !present[s] {
+			missing = append(missing, s)
+		}
+	}
+	if len(missing) > 0 {
+		return &xlsxError{Reason: "no sheets " + strings.Join(missing, ", ")}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// xsdTimeout limits single schema validation run
+const xsdTimeout = 5 * time.Minute
+
+// xsdError is returned when file does not conform to its schema,
+// output holds errors reported by xmllint with line numbers
+type xsdError struct {
+	Schema string
+	Output string
+}
+
+func (e *xsdError) Error() string {
+	return fmt.Sprintf("file does not conform to %s: %s", e.Schema, e.Output)
+}
+
+// parseSuffixes parses list of suffix=value pairs
+func parseSuffixes(list, separator string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, item := range strings.Split(list, separator) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New(item)
+		}
+		values[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	return values, nil
+}
+
+// bySuffix returns value of the longest suffix name ends with
+func bySuffix(values map[string]string, name string) string {
+	best, value := -1, ""
+	for suffix, v := range values {
+		if strings.HasSuffix(name, suffix) && len(suffix) > best {
+			best, value = len(suffix), v
+		}
+	}
+
+	return value
+}
+
+// parseSchemas parses -xsd list of suffix=schema pairs
+func parseSchemas(list, separator string) (map[string]string, error) {
+	schemas, err := parseSuffixes(list, separator)
+	if err != nil {
+		return nil, errors.New("Wrong XSD schema, expected <suffix>=<file.xsd>: " + err.Error())
+	}
+
+	return schemas, nil
+}
+
+// validateSchemas checks that schema files exist and xmllint is installed
+func validateSchemas(schemas map[string]string) error {
+	if len(schemas) == 0 {
+		return nil
+	}
+
+	if _, err := exec.LookPath("xmllint"); err != nil {
+		return errors.New("XSD validation requires xmllint (libxml2-utils)")
+	}
+	for _, schema := range schemas {
+		if _, err := os.Stat(schema); err != nil {
+			return fmt.Errorf("XSD schema %s: %w", schema, err)
+		}
+	}
+
+	return nil
+}
+
+// schemaFor returns schema of file with the longest matching suffix
+func (o options) schemaFor(name string) string {
+	return bySuffix(o.schemas, name)
+}
+
+// xsdValidator checks file against XSD schema picked by its suffix
+type xsdValidator struct {
+	schema string
+}
+
+func (v xsdValidator) validate(filePath string, fi os.FileInfo) error {
+	return lintSchema(v.schema, filePath)
+}
+
+func (v xsdValidator) String() string {
+	return "XSD " + v.schema
+}
+
+// lintSchema runs xmllint, *xsdError means that it did run and file is invalid
+func lintSchema(schema, filePath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), xsdTimeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "xmllint", "--noout", "--nonet", "--schema", schema, filePath)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || ctx.Err() != nil {
+		return err
+	}
+
+	return &xsdError{
+		Schema: schema,
+		Output: truncate(bytes.TrimSpace(output.Bytes())),
+	}
+}